@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// backgroundHandle tracks background commands started by cmd action with handle name,
+// all lines and pipe sections of the action are waited together.
+type backgroundHandle struct {
+	name string
+	wg   sync.WaitGroup
+
+	mu        sync.Mutex
+	processes []*os.Process
+	running   int
+	err       error
+}
+
+// watch waits commands in background, the first error is kept as exit status of handle.
+func (h *backgroundHandle) watch(cmds []*exec.Cmd) {
+	h.mu.Lock()
+	for _, cmd := range cmds {
+		if cmd.Process != nil {
+			h.processes = append(h.processes, cmd.Process)
+		}
+	}
+	h.running++
+	h.mu.Unlock()
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		var firstErr error
+		for _, cmd := range cmds {
+			err := cmd.Wait()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.running--
+		if h.err == nil {
+			h.err = firstErr
+		}
+	}()
+}
+
+// wait waits all commands of handle exit, returns false if timeout reached, 0 means no timeout.
+func (h *backgroundHandle) wait(timeout time.Duration) (exited bool, err error) {
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-done:
+		case <-timer.C:
+			return false, nil
+		}
+	} else {
+		<-done
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return true, h.err
+}
+
+// kill kills all processes of handle, exited processes are ignored.
+func (h *backgroundHandle) kill() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, p := range h.processes {
+		p.Kill()
+	}
+}
+
+// exitCode converts wait error to exit code, -1 is returned if process is killed by signal or failed to wait.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// backgroundRegistry holds named background commands of all tasks.
+type backgroundRegistry struct {
+	mu      sync.Mutex
+	handles map[string]*backgroundHandle
+}
+
+func newBackgroundRegistry() *backgroundRegistry {
+	return &backgroundRegistry{handles: map[string]*backgroundHandle{}}
+}
+
+// register creates handle of name, name of exited handle could be reused.
+func (b *backgroundRegistry) register(name string) (*backgroundHandle, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if h, has := b.handles[name]; has {
+		h.mu.Lock()
+		running := h.running
+		h.mu.Unlock()
+		if running > 0 {
+			return nil, fmt.Errorf("background handle is still running: %s", name)
+		}
+	}
+	h := &backgroundHandle{name: name}
+	b.handles[name] = h
+	return h, nil
+}
+
+func (b *backgroundRegistry) lookup(name string) (*backgroundHandle, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h, has := b.handles[name]
+	return h, has
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
 
 	"github.com/ghodss/yaml"
 	"github.com/uiez/tash/syntax"
@@ -13,16 +18,47 @@ import (
 type Configuration struct {
 	// defines global environment variables.
 	Env syntax.EnvList
+	// defines environment profiles, profiles with same name in different files are merged.
+	Profiles map[string]syntax.EnvList
 	// defines templates(action list) can be referenced from tasks.
 	// the key is template name
 	Templates map[string]syntax.ActionList
 
+	// max nesting depth of template references
+	TemplateMaxDepth int
+	// task completion notification
+	Notify syntax.Notification
+	// redactions of logs
+	Redact syntax.Redaction
+
 	// defines tasks
 	// the key is task name
 	Tasks map[string]syntax.Task
+	// directory of config file that task defined in, it's the base of relative paths if task workdir is empty.
+	// the key is task name
+	TaskDirs map[string]string
+
+	// absolute paths of config files being built, used to detect import cycles
+	importChain []string
+	// system and builtin environments expanding import paths
+	importEnvs *ExpandEnvs
+	// merge config files discovered in discoverDir beside the root config file
+	discover bool
+	// config is read from stdin, so it couldn't be read again by tasks
+	fromStdin bool
+	// config files that tasks and templates defined in, used to report conflicts
+	// the key is 'task NAME' or 'template NAME'
+	definedIn map[string]string
 }
 
-func parseConfiguration(log indentLogger, conf string, saveConf bool) *Configuration {
+// discoverDir is the directory beside root config file, config files ending with discoverSuffix in it are
+// merged by convention without listing in imports.
+const (
+	discoverDir    = ".tash"
+	discoverSuffix = ".tash.yaml"
+)
+
+func parseConfiguration(log indentLogger, conf string, saveConf, discover bool) *Configuration {
 	currDir, _ := os.Getwd()
 
 	if conf == "" {
@@ -37,6 +73,9 @@ func parseConfiguration(log indentLogger, conf string, saveConf bool) *Configura
 			log.infoln(fmt.Sprintf("use config file path '%s'", conf))
 		}
 	} else {
+		if saveConf && conf == stdinConfigPath {
+			log.fatalln("couldn't save config file path of stdin")
+		}
 		if saveConf {
 			log.infoln("saving config file path to .tashfile")
 			err := ioutil.WriteFile(recordFile, []byte(conf), 0644)
@@ -45,16 +84,35 @@ func parseConfiguration(log indentLogger, conf string, saveConf bool) *Configura
 			}
 		}
 	}
-	c := &Configuration{
+	c := newConfiguration(discover)
+	c.buildFrom(log, currDir, conf)
+	if c.TemplateMaxDepth <= 0 {
+		c.TemplateMaxDepth = defaultTemplateMaxDepth
+	}
+	if err := c.checkTemplates(); err != nil {
+		log.fatalln(err)
+	}
+	return c
+}
+
+func newConfiguration(discover bool) *Configuration {
+	return &Configuration{
+		Profiles:  make(map[string]syntax.EnvList),
 		Templates: make(map[string]syntax.ActionList),
 		Tasks:     make(map[string]syntax.Task),
+		TaskDirs:  make(map[string]string),
+		discover:  discover,
+		definedIn: make(map[string]string),
 	}
-	c.buildFrom(log, currDir, conf)
-	return c
 }
 
 const recordFile = ".tashfile"
 
+// stdinConfigPath reads config from stdin, relative paths are based on current directory.
+const stdinConfigPath = "-"
+
+const defaultTemplateMaxDepth = 32
+
 func lookupConfigurationPath(currDir string) (path string, isRecorded bool) {
 	content, err := ioutil.ReadFile(recordFile)
 	if err == nil {
@@ -86,7 +144,24 @@ func lookupConfigurationPath(currDir string) (path string, isRecorded bool) {
 	}
 }
 
-func (c *Configuration) importPath(log indentLogger, baseDir, path string) {
+// splitImportChecksum splits checksum suffix '#alg:hex' from import entry, '#' not followed by valid
+// checksum is kept as part of path.
+func splitImportChecksum(entry string) (path, checksum string) {
+	i := strings.LastIndex(entry, "#")
+	if i < 0 {
+		return entry, ""
+	}
+	secs := strings.SplitN(entry[i+1:], ":", 2)
+	if len(secs) != 2 || secs[1] == "" || hashCreator(strings.ToUpper(secs[0])) == nil {
+		return entry, ""
+	}
+	if _, err := hex.DecodeString(secs[1]); err != nil {
+		return entry, ""
+	}
+	return entry[:i], entry[i+1:]
+}
+
+func (c *Configuration) importPath(log indentLogger, baseDir, path, checksum string) {
 	var relpath string
 	{
 		var err error
@@ -98,9 +173,9 @@ func (c *Configuration) importPath(log indentLogger, baseDir, path string) {
 
 		p, err := filepath.Rel(baseDir, path)
 		if err == nil {
-			relpath = p
+			relpath = stringToSlash(p)
 		} else {
-			relpath = path
+			relpath = stringToSlash(path)
 		}
 	}
 
@@ -118,34 +193,127 @@ func (c *Configuration) importPath(log indentLogger, baseDir, path string) {
 		return
 	}
 
-	switch filepath.Ext(path) {
-	case ".env":
-		log.debugln("import environment file:", relpath)
-		content, err := ioutil.ReadFile(path)
+	ext := filepath.Ext(path)
+	switch ext {
+	case ".env", ".yaml", ".yml":
+	default:
+		log.debugln("ignore file:", relpath)
+		return
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.fatalln("read imported file failed:", relpath, err)
+		return
+	}
+	if checksum != "" {
+		err = verifyChecksum(content, checksum)
 		if err != nil {
-			log.fatalln("read env file content failed:", err)
+			log.fatalln("verify imported file failed:", relpath, err)
 			return
 		}
+	}
+	switch ext {
+	case ".env":
+		log.debugln("import environment file:", relpath)
 		if len(content) > 0 {
 			c.Env.AppendItem(string(content))
 		}
-	default:
-		log.debugln("ignore file:", relpath)
 	case ".yaml", ".yml":
 		log.debugln("import tash config file:", relpath)
-		c.buildFrom(log.addIndent(), baseDir, path)
+		c.build(log.addIndent(), baseDir, path, content)
+	}
+}
+
+// enterImport records config file in import chain, fails if it's already being built.
+func (c *Configuration) enterImport(log indentLogger, baseDir, path string) bool {
+	if path != stdinConfigPath {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+	}
+	c.importChain = append(c.importChain, path)
+	for _, p := range c.importChain[:len(c.importChain)-1] {
+		if p != path {
+			continue
+		}
+		var names []string
+		for _, p := range c.importChain {
+			if rel, err := filepath.Rel(baseDir, p); err == nil && p != stdinConfigPath {
+				p = rel
+			}
+			names = append(names, stringToSlash(p))
+		}
+		c.importChain = c.importChain[:len(c.importChain)-1]
+		log.fatalln("import cycle:", strings.Join(names, " -> "))
+		return false
+	}
+	return true
+}
+
+// expandImportPath expands import path by system environments and builtin HOST_OS, HOST_ARCH, PATHLISTSEP,
+// environments defined in config files aren't available. expanded path should be inside of config directory dir,
+// so environments couldn't make config import arbitrary files.
+func (c *Configuration) expandImportPath(log indentLogger, dir, path string) (string, error) {
+	if c.importEnvs == nil {
+		envs := newExpandEnvs()
+		silent := log.silent(true, false)
+		envs.parsePairs(silent, os.Environ(), false)
+		envs.addAndExpand(silent, syntax.BUILTIN_ENV_HOST_OS, runtime.GOOS, false)
+		envs.addAndExpand(silent, syntax.BUILTIN_ENV_HOST_ARCH, runtime.GOARCH, false)
+		envs.addAndExpand(silent, syntax.BUILTIN_ENV_PATHLISTSEP, string(os.PathListSeparator), false)
+		c.importEnvs = envs
+	}
+	expanded, err := c.importEnvs.expandString(path)
+	if err != nil {
+		return "", fmt.Errorf("expand import path failed: %s, %w", path, err)
 	}
+	if strings.TrimSpace(expanded) == "" {
+		return "", fmt.Errorf("import path is expanded to empty: %s", path)
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	resolved := filepath.FromSlash(expanded)
+	if !filepath.IsAbs(resolved) {
+		resolved = filepath.Join(dir, resolved)
+	}
+	if !isSubPath(dir, filepath.Clean(resolved)) {
+		return "", fmt.Errorf("expanded import path is outside of config directory: %s, %s", path, expanded)
+	}
+	log.debugln("import path expanded:", path, expanded)
+	return expanded, nil
 }
 
 func (c *Configuration) buildFrom(log indentLogger, baseDir, path string) {
-	content, err := ioutil.ReadFile(path)
+	var (
+		content []byte
+		err     error
+	)
+	if path == stdinConfigPath {
+		// directory of path is '.', so imports and task directories are based on current directory.
+		content, err = ioutil.ReadAll(os.Stdin)
+		c.fromStdin = true
+	} else {
+		content, err = ioutil.ReadFile(path)
+	}
 	if err != nil {
 		log.fatalln("read config file failed:", path, err)
 		return
 	}
+	c.build(log, baseDir, path, content)
+}
+
+func (c *Configuration) build(log indentLogger, baseDir, path string, content []byte) {
+	if !c.enterImport(log, baseDir, path) {
+		return
+	}
+	defer func() {
+		c.importChain = c.importChain[:len(c.importChain)-1]
+	}()
 
 	var configs syntax.Configuration
-	err = yaml.Unmarshal(content, &configs)
+	err := yaml.Unmarshal(content, &configs)
 	if err != nil {
 		log.fatalln("parsing config file failed:", path, err)
 		return
@@ -154,12 +322,22 @@ func (c *Configuration) buildFrom(log indentLogger, baseDir, path string) {
 	if configs.Imports != "" {
 		dir := filepath.Dir(path)
 		err = runInDir(dir, func() error {
-			matched, err := splitBlocksAndGlobPath(configs.Imports, true)
-			if err != nil {
-				return fmt.Errorf("glob path failed: %w", err)
-			}
-			for _, m := range matched {
-				c.importPath(log, baseDir, m)
+			for _, block := range splitBlocks(configs.Imports) {
+				block, checksum := splitImportChecksum(block)
+				if strings.Contains(block, "$") {
+					expanded, err := c.expandImportPath(log, dir, block)
+					if err != nil {
+						return err
+					}
+					block = expanded
+				}
+				matched, err := globPaths([]string{block}, true)
+				if err != nil {
+					return fmt.Errorf("glob path failed: %w", err)
+				}
+				for _, m := range matched {
+					c.importPath(log, baseDir, m, checksum)
+				}
 			}
 			return nil
 		})
@@ -168,19 +346,170 @@ func (c *Configuration) buildFrom(log indentLogger, baseDir, path string) {
 			return
 		}
 	}
+	if c.discover && len(c.importChain) == 1 {
+		c.importDiscovered(log, baseDir, path)
+	}
+	configDir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		log.fatalln("get config file directory failed:", err)
+		return
+	}
+	if configs.TemplateMaxDepth > 0 {
+		// imported files are built before current file, so values in importing files take priority.
+		c.TemplateMaxDepth = configs.TemplateMaxDepth
+	}
+	if configs.Notify.Url != "" || configs.Notify.File != "" {
+		c.Notify = configs.Notify
+	}
+	c.Redact.Values = append(c.Redact.Values, configs.Redact.Values...)
+	c.Redact.Patterns = append(c.Redact.Patterns, configs.Redact.Patterns...)
+	c.Redact.SecretEnvs = c.Redact.SecretEnvs || configs.Redact.SecretEnvs
 	c.Env.Append(&configs.Env)
+	for name, envs := range configs.Profiles {
+		profile := c.Profiles[name]
+		profile.Append(&envs)
+		c.Profiles[name] = profile
+	}
 	for name, actions := range configs.Templates {
-		_, has := c.Templates[name]
-		if has {
-			log.fatalln("duplicated template definition:", name)
+		if !c.define(log, baseDir, path, "template", name) {
+			continue
 		}
 		c.Templates[name] = actions
 	}
 	for name, task := range configs.Tasks {
-		_, has := c.Tasks[name]
-		if has {
-			log.fatalln("duplicated task definition:", name)
+		if !c.define(log, baseDir, path, "task", name) {
+			continue
+		}
+		if task.WorkDir == "" {
+			task.WorkDir = configs.WorkDir
+		}
+		if task.WorkDir != "" && !filepath.IsAbs(task.WorkDir) {
+			task.WorkDir = filepath.Join(configDir, task.WorkDir)
 		}
 		c.Tasks[name] = task
+		c.TaskDirs[name] = configDir
+	}
+}
+
+// importDiscovered merges config files in discoverDir beside root config file in sorted order, they are built
+// after explicit imports and before root config file, so for values such as templateMaxDepth and notify,
+// root config file takes priority over discovered files, and later files take priority over earlier files.
+// envs are appended in the same order.
+func (c *Configuration) importDiscovered(log indentLogger, baseDir, path string) {
+	dir := filepath.Join(filepath.Dir(path), discoverDir)
+	matched, err := filepath.Glob(filepath.Join(dir, "*"+discoverSuffix))
+	if err != nil {
+		log.fatalln("discover config files failed:", err)
+		return
+	}
+	root, _ := filepath.Abs(path)
+	for _, m := range matched {
+		if abs, err := filepath.Abs(m); err == nil && abs == root {
+			continue
+		}
+		if info, err := os.Stat(m); err != nil || info.IsDir() {
+			continue
+		}
+		log.debugln("discovered config file:", m)
+		c.importPath(log, baseDir, m, "")
+	}
+}
+
+// define records config file that task or template defined in, it reports conflict if the name has been
+// defined by another file.
+func (c *Configuration) define(log indentLogger, baseDir, path, kind, name string) bool {
+	if path != stdinConfigPath {
+		if rel, err := filepath.Rel(baseDir, path); err == nil {
+			path = rel
+		}
+		path = stringToSlash(path)
+	}
+	key := kind + " " + name
+	if prev, has := c.definedIn[key]; has {
+		log.fatalln(fmt.Sprintf("duplicated %s definition: %s, defined in both %s and %s", kind, name, prev, path))
+		return false
+	}
+	c.definedIn[key] = path
+	return true
+}
+
+// checkTemplates detects template reference cycles and nesting deeper than TemplateMaxDepth before running,
+// chains are checked like running templates, and reported such as 'template cycle: A -> B -> A'.
+// templates referenced by names containing environments are only checked when running.
+func (c *Configuration) checkTemplates() error {
+	var names []string
+	for name := range c.Templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// deepest reference chain begins at template, templates in it have been checked
+	deepest := make(map[string][]string)
+	var visit func(chain []string) error
+	visit = func(chain []string) error {
+		name := chain[len(chain)-1]
+		if d, has := deepest[name]; has {
+			return checkTemplateChain(append(chain[:len(chain)-1:len(chain)-1], d...), c.TemplateMaxDepth)
+		}
+		err := checkTemplateChain(chain, c.TemplateMaxDepth)
+		if err != nil {
+			return err
+		}
+		longest := []string{name}
+		for _, ref := range templateRefs(reflect.ValueOf(c.Templates[name])) {
+			if _, has := c.Templates[ref]; !has {
+				continue
+			}
+			err = visit(append(chain[:len(chain):len(chain)], ref))
+			if err != nil {
+				return err
+			}
+			if d := deepest[ref]; len(d)+1 > len(longest) {
+				longest = append([]string{name}, d...)
+			}
+		}
+		deepest[name] = longest
+		return nil
+	}
+	for _, name := range names {
+		err := visit([]string{name})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templateRefs returns names of templates referenced by actions in value, including nested actions.
+func templateRefs(v reflect.Value) []string {
+	var refs []string
+	switch x := v.Interface().(type) {
+	case syntax.ActionList:
+		for _, a := range x.Actions() {
+			refs = append(refs, templateRefs(reflect.ValueOf(a))...)
+		}
+		return refs
+	case syntax.ActionTemplate:
+		for _, name := range splitBlocks(x.Name) {
+			if !strings.Contains(name, "$") {
+				refs = append(refs, name)
+			}
+		}
+		return refs
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		for _, f := range structFields(v) {
+			refs = append(refs, templateRefs(f.value)...)
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			refs = append(refs, templateRefs(v.MapIndex(k))...)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			refs = append(refs, templateRefs(v.Index(i))...)
+		}
 	}
+	return refs
 }
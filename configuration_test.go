@@ -0,0 +1,439 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/uiez/tash/syntax"
+)
+
+// testDir creates temporary directory with files, it's removed after test.
+func testDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// testLogger fails test at fatal errors instead of exiting.
+func testLogger(t *testing.T) indentLogger {
+	log := newLogger(false)
+	log.exit = func(string) {
+		t.Fatal("fatal error logged")
+	}
+	return log
+}
+
+// testConfiguration builds config file tash.yaml in dir without checking templates.
+func testConfiguration(t *testing.T, dir string) *Configuration {
+	t.Helper()
+	c := newConfiguration(false)
+	c.buildFrom(testLogger(t), dir, filepath.Join(dir, "tash.yaml"))
+	if c.TemplateMaxDepth <= 0 {
+		c.TemplateMaxDepth = defaultTemplateMaxDepth
+	}
+	return c
+}
+
+func TestCheckTemplates(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name: "direct cycle",
+			config: `
+templates:
+  a: [{template: a}]
+`,
+			err: "template cycle: a -> a",
+		},
+		{
+			name: "indirect cycle",
+			config: `
+templates:
+  a: [{cmd: {exec: echo a}}, {template: b}]
+  b: [{if: {check: "true", actions: {template: c}}}]
+  c: [{template: a}]
+`,
+			err: "template cycle: a -> b -> c -> a",
+		},
+		{
+			name: "depth limit",
+			config: `
+templateMaxDepth: 2
+templates:
+  a: [{template: b}]
+  b: [{template: c}]
+  c: [{cmd: {exec: echo c}}]
+`,
+			err: "template depth exceeds limit 2: a -> b -> c",
+		},
+		{
+			name: "deep nesting within limit",
+			config: `
+templateMaxDepth: 3
+templates:
+  a: [{template: b}, {template: c}]
+  b: [{template: c}]
+  c: [{cmd: {exec: echo c}}]
+`,
+		},
+		{
+			name: "dynamic names are skipped",
+			config: `
+templates:
+  a: [{template: $NAME}]
+`,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dir := testDir(t, map[string]string{"tash.yaml": c.config})
+			err := testConfiguration(t, dir).checkTemplates()
+			switch {
+			case c.err == "" && err != nil:
+				t.Fatal(err)
+			case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+				t.Fatalf("got error %v, want %s", err, c.err)
+			}
+		})
+	}
+}
+
+func TestImportPathFromEnv(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"tash.yaml":           "imports: conf/${TASH_TEST_IMPORT_DIR}/*.yaml\n",
+		"conf/linux/a.yaml":   "tasks:\n  a:\n    actions: []\n",
+		"outside/b.yaml":      "tasks:\n  b:\n    actions: []\n",
+		"conf/linux/skip.txt": "",
+	})
+	defer os.Unsetenv("TASH_TEST_IMPORT_DIR")
+
+	os.Setenv("TASH_TEST_IMPORT_DIR", "linux")
+	c := testConfiguration(t, dir)
+	if _, ok := c.Tasks["a"]; !ok {
+		t.Errorf("task isn't imported by expanded path: %v", c.Tasks)
+	}
+
+	os.Setenv("TASH_TEST_IMPORT_DIR", "../../outside")
+	var failure string
+	log := newLogger(false)
+	log.exit = func(msg string) {
+		if failure == "" {
+			failure = msg
+		}
+	}
+	newConfiguration(false).buildFrom(log, dir, filepath.Join(dir, "tash.yaml"))
+	if !strings.Contains(failure, "outside of config directory") {
+		t.Errorf("expanded path escaping config directory should be refused: %q", failure)
+	}
+}
+
+func TestSplitImportChecksum(t *testing.T) {
+	for _, c := range []struct {
+		entry, path, checksum string
+	}{
+		{"common.yaml", "common.yaml", ""},
+		{"common.yaml#sha256:ab01", "common.yaml", "sha256:ab01"},
+		{"conf#1/common.yaml#MD5:AB01", "conf#1/common.yaml", "MD5:AB01"},
+		{"conf#1/common.yaml", "conf#1/common.yaml", ""},
+		{"common#v2.yaml", "common#v2.yaml", ""},
+		{"common.yaml#sha256:", "common.yaml#sha256:", ""},
+		{"common.yaml#crc:ab01", "common.yaml#crc:ab01", ""},
+		{"common.yaml#sha1:xyz", "common.yaml#sha1:xyz", ""},
+	} {
+		path, checksum := splitImportChecksum(c.entry)
+		if path != c.path || checksum != c.checksum {
+			t.Errorf("%s: got (%q, %q), want (%q, %q)", c.entry, path, checksum, c.path, c.checksum)
+		}
+	}
+}
+
+func TestImportWithChecksum(t *testing.T) {
+	const common = "tasks:\n  a:\n    actions: []\n"
+	sum := sha256.Sum256([]byte(common))
+	dir := testDir(t, map[string]string{
+		"tash.yaml":          "imports: 'conf#1/common.yaml#sha256:" + hex.EncodeToString(sum[:]) + "'\n",
+		"conf#1/common.yaml": common,
+	})
+	c := testConfiguration(t, dir)
+	if _, ok := c.Tasks["a"]; !ok {
+		t.Errorf("task isn't imported from path containing '#': %v", c.Tasks)
+	}
+
+	err := ioutil.WriteFile(filepath.Join(dir, "conf#1", "common.yaml"), []byte(common+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failure string
+	log := newLogger(false)
+	log.exit = func(msg string) {
+		if failure == "" {
+			failure = msg
+		}
+	}
+	newConfiguration(false).buildFrom(log, dir, filepath.Join(dir, "tash.yaml"))
+	if !strings.Contains(failure, "checksum") {
+		t.Errorf("modified import should be refused: %q", failure)
+	}
+}
+
+func TestConfigurationFromStdin(t *testing.T) {
+	dir := testDir(t, map[string]string{"common.yaml": `
+templates:
+  write:
+    - echo: {content: "${CONTENT}", file: out.txt}
+`})
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	stdin := os.Stdin
+	defer func() { os.Stdin = stdin }()
+	os.Stdin = rd
+	go func() {
+		wr.Write([]byte(`
+imports: common.yaml
+tasks:
+  main:
+    actions:
+      - env: ["CONTENT=from stdin"]
+      - template: {name: write}
+`))
+		wr.Close()
+	}()
+
+	configs := parseConfiguration(testLogger(t), stdinConfigPath, false, false)
+	if !configs.fromStdin {
+		t.Error("config isn't marked as read from stdin")
+	}
+	r := newRunner(nil, newLogger(false), configs)
+	r.noExitOnFail = true
+	r.backgrounds = newBackgroundRegistry()
+	r.runTaskByName("main", nil, dir)
+	if r.failed {
+		t.Fatal(r.failure)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "out.txt"))
+	if err != nil || string(content) != "from stdin" {
+		t.Errorf("task of config read from stdin: %q, %v", content, err)
+	}
+}
+
+func TestImportCycle(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"tash.yaml": "imports: a.yaml\n",
+		"a.yaml":    "imports: b.yaml\n",
+		"b.yaml":    "imports: a.yaml\n",
+	})
+	var failure string
+	log := newLogger(false)
+	log.exit = func(msg string) {
+		if failure == "" {
+			failure = msg
+		}
+	}
+	newConfiguration(false).buildFrom(log, dir, filepath.Join(dir, "tash.yaml"))
+	if !strings.Contains(failure, "import cycle:") || !strings.Contains(failure, "a.yaml -> b.yaml -> a.yaml") {
+		t.Errorf("import cycle should be reported with the chain: %q", failure)
+	}
+}
+
+func TestPlatformEnv(t *testing.T) {
+	env := syntax.PlatformEnv{
+		Name:  "BINEXT",
+		Value: ".bin",
+		Platforms: map[string]string{
+			"windows":     ".exe",
+			"linux/arm64": ".arm",
+			"wasm":        "",
+		},
+	}
+	for _, c := range []struct {
+		goos, goarch, want string
+	}{
+		{"windows", "amd64", "BINEXT=.exe"},
+		{"linux", "arm64", "BINEXT=.arm"},
+		{"linux", "amd64", "BINEXT=.bin"},
+		{"js", "wasm", `BINEXT=""`},
+	} {
+		if got := env.Resolve(c.goos, c.goarch); got != c.want {
+			t.Errorf("%s/%s: %s, want %s", c.goos, c.goarch, got, c.want)
+		}
+	}
+
+	dir := testDir(t, map[string]string{"tash.yaml": `
+env:
+  - NAME=tash
+  - {name: BINEXT, platforms: {` + runtime.GOOS + `: .host}}
+  - {name: EMPTY, value: fallback, platforms: {` + runtime.GOOS + "/" + runtime.GOARCH + `: ""}}
+tasks:
+  main:
+    actions:
+      - echo: {content: "${NAME}${BINEXT} [${EMPTY}]", file: out.txt}
+`})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "out.txt"); content != "tash.host []" {
+		t.Errorf("resolved platform envs: %q", content)
+	}
+}
+
+func TestEnvBlockSeparator(t *testing.T) {
+	for _, c := range []struct {
+		block syntax.EnvBlock
+		want  string
+	}{
+		{syntax.EnvBlock{Block: "A=1; B = 2"}, "A=1\nB=2"},
+		{syntax.EnvBlock{Block: "name: tash\nurl: http://host:8080\n\nquoted: \" a: b \"", Separator: ":"}, "name=tash\nurl=http://host:8080\nquoted=\" a: b \""},
+		{syntax.EnvBlock{Block: "a => x => y; b=>z", Separator: "=>"}, "a=x => y\nb=z"},
+	} {
+		got, err := c.block.Resolve()
+		if err != nil {
+			t.Errorf("%q: %s", c.block.Block, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%q: got %q, want %q", c.block.Block, got, c.want)
+		}
+	}
+	for _, block := range []string{"name tash", ": tash"} {
+		if _, err := (syntax.EnvBlock{Block: block, Separator: ":"}).Resolve(); err == nil {
+			t.Errorf("%q should be refused", block)
+		}
+	}
+
+	dir := testDir(t, map[string]string{"tash.yaml": `
+env:
+  - {block: "name: tash\nurl: http://host:8080\ngreeting: ' hi: there '", separator: ":"}
+tasks:
+  main:
+    actions:
+      - echo: {content: "${name}|${url}|${greeting}", file: out.txt}
+`})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "out.txt"); content != "tash|http://host:8080| hi: there " {
+		t.Errorf("envs of block: %q", content)
+	}
+}
+
+func TestDiscoverConfigFiles(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"tash.yaml": `
+notify: {file: root.jsonl}
+tasks:
+  main:
+    actions: []
+`,
+		".tash/build.tash.yaml": `
+env: [STAGE=build]
+notify: {file: build.jsonl}
+tasks:
+  build:
+    actions:
+      - echo: {content: "${STAGE}", file: ../build.txt}
+`,
+		".tash/deploy.tash.yaml": `
+env: [STAGE=deploy]
+tasks:
+  deploy:
+    actions:
+      - echo: {content: "${STAGE}", file: ../deploy.txt}
+`,
+		".tash/ignored.yaml": `
+tasks:
+  ignored:
+    actions: []
+`,
+	})
+	build := func(discover bool) *Configuration {
+		c := newConfiguration(discover)
+		c.buildFrom(testLogger(t), dir, filepath.Join(dir, "tash.yaml"))
+		c.TemplateMaxDepth = defaultTemplateMaxDepth
+		return c
+	}
+	if _, has := build(false).Tasks["build"]; has {
+		t.Fatal("config files shouldn't be discovered if disabled")
+	}
+
+	configs := build(true)
+	if _, has := configs.Tasks["ignored"]; has {
+		t.Error("files without suffix shouldn't be discovered")
+	}
+	if configs.Notify.File != "root.jsonl" {
+		t.Errorf("root config file should take priority: %s", configs.Notify.File)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	for _, name := range []string{"build", "deploy"} {
+		r := newRunner(nil, newLogger(false), configs)
+		r.noExitOnFail = true
+		r.backgrounds = newBackgroundRegistry()
+		r.runTaskByName(name, nil, dir)
+		if r.failed {
+			t.Fatalf("%s: %s", name, r.failure)
+		}
+	}
+	// later files take priority
+	for file, want := range map[string]string{"build.txt": "deploy", "deploy.txt": "deploy"} {
+		if got := readTestFile(t, dir, file); got != want {
+			t.Errorf("%s: got %q, want %q", file, got, want)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, ".tash", "dup.tash.yaml"), []byte("tasks:\n  build:\n    actions: []\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var failure string
+	log := newLogger(false)
+	log.exit = func(msg string) {
+		if failure == "" {
+			failure = msg
+		}
+	}
+	newConfiguration(true).buildFrom(log, dir, filepath.Join(dir, "tash.yaml"))
+	if !strings.Contains(failure, "duplicated task definition: build") || !strings.Contains(failure, ".tash/dup.tash.yaml") {
+		t.Errorf("conflict isn't reported: %q", failure)
+	}
+}
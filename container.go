@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+
+	"github.com/uiez/tash/syntax"
+)
+
+type containerOptions struct {
+	syntax.TaskContainer
+	// host directory mounted into container at the same path
+	Mount string
+}
+
+func newContainerOptions(c syntax.TaskContainer, workDir string) (*containerOptions, error) {
+	switch c.Runtime {
+	case "":
+		c.Runtime = syntax.ContainerRuntimeDocker
+	case syntax.ContainerRuntimeDocker, syntax.ContainerRuntimePodman:
+	default:
+		return nil, fmt.Errorf("unsupported container runtime: %s", c.Runtime)
+	}
+	if _, err := exec.LookPath(c.Runtime); err != nil {
+		return nil, fmt.Errorf("container runtime not found: %s", c.Runtime)
+	}
+	mount, err := filepath.Abs(stringFromSlash(workDir))
+	if err != nil {
+		return nil, fmt.Errorf("get absolute path of workdir failed: %w", err)
+	}
+	return &containerOptions{TaskContainer: c, Mount: mount}, nil
+}
+
+// wrap converts each command section to container run command.
+// environments are passed by name only, values are read by runtime from its own environments.
+func (c *containerOptions) wrap(envs *ExpandEnvs, sections [][]string, cmdDir string) ([][]string, error) {
+	if cmdDir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("get current directory failed: %w", err)
+		}
+		cmdDir = wd
+	}
+	cmdDir, err := filepath.Abs(stringFromSlash(cmdDir))
+	if err != nil {
+		return nil, fmt.Errorf("get absolute path of command directory failed: %w", err)
+	}
+
+	var names []string
+	for k, v := range envs.envs {
+		if k == "PATH" {
+			continue
+		}
+		if hv, has := os.LookupEnv(k); has && hv == v {
+			continue
+		}
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	prefix := []string{c.Runtime, "run", "--rm", "-i",
+		"-v", c.Mount + ":" + c.Mount,
+		"-w", cmdDir,
+	}
+	for _, name := range names {
+		prefix = append(prefix, "-e", name)
+	}
+	prefix = append(prefix, c.Options...)
+	prefix = append(prefix, c.Image)
+
+	wrapped := make([][]string, len(sections))
+	for i, args := range sections {
+		section := make([]string, 0, len(prefix)+len(args))
+		section = append(section, prefix...)
+		section = append(section, args...)
+		wrapped[i] = section
+	}
+	return wrapped, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/uiez/tash/syntax"
+)
+
+func TestContainerWrap(t *testing.T) {
+	path := os.Getenv("PATH")
+	envs := testEnvs(t, "PATH=/custom/bin:"+path, "APP=demo")
+	mount, _ := filepath.Abs("work")
+	c := &containerOptions{
+		TaskContainer: syntax.TaskContainer{Image: "alpine", Runtime: "podman", Options: []string{"--network=host"}},
+		Mount:         mount,
+	}
+	sections, err := c.wrap(envs, [][]string{{"uname", "-a"}, {"echo", "hi"}}, mount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := "podman run --rm -i -v " + mount + ":" + mount + " -w " + mount + " -e APP --network=host alpine "
+	for i, want := range []string{prefix + "uname -a", prefix + "echo hi"} {
+		if got := strings.Join(sections[i], " "); got != want {
+			t.Errorf("section %d: %q, want %q", i, got, want)
+		}
+	}
+
+	if _, err := newContainerOptions(syntax.TaskContainer{Image: "alpine", Runtime: "lxc"}, "."); err == nil {
+		t.Error("unsupported runtime should be refused")
+	}
+}
+
+func TestContainerRunsCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("linux containers are not available on windows")
+	}
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker is not available")
+	}
+	if err := exec.Command("docker", "image", "inspect", "alpine").Run(); err != nil {
+		t.Skip("alpine image is not available")
+	}
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  main:
+    container: {image: alpine}
+    actions:
+      - cmd: {exec: uname -s, stdout: uname.txt}
+`})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "uname.txt"); strings.TrimSpace(content) != "Linux" {
+		t.Errorf("uname in container: %q", content)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	diffEqual = iota
+	diffDelete
+	diffInsert
+)
+
+type diffOp struct {
+	kind int
+	line string
+}
+
+// maxDiffCells limits memory of lcs table, files exceeding it are reported without hunks.
+const maxDiffCells = 1 << 24
+
+// diffLines computes line edit script by longest common subsequence.
+func diffLines(a, b []string) ([]diffOp, bool) {
+	// common prefix and suffix are trimmed to reduce table size
+	var prefix, suffix int
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if (len(ma)+1)*(len(mb)+1) > maxDiffCells {
+		return nil, false
+	}
+
+	var ops []diffOp
+	for _, l := range a[:prefix] {
+		ops = append(ops, diffOp{diffEqual, l})
+	}
+	n, m := len(ma), len(mb)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if ma[i] == mb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && ma[i] == mb[j]:
+			ops = append(ops, diffOp{diffEqual, ma[i]})
+			i++
+			j++
+		case j < m && (i == n || lcs[i][j+1] > lcs[i+1][j]):
+			ops = append(ops, diffOp{diffInsert, mb[j]})
+			j++
+		default:
+			ops = append(ops, diffOp{diffDelete, ma[i]})
+			i++
+		}
+	}
+	for _, l := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{diffEqual, l})
+	}
+	return ops, true
+}
+
+// unifiedDiff formats the difference of a and b in unified diff format, empty if they are equal.
+func unifiedDiff(nameA, nameB, a, b string, context int) string {
+	if a == b {
+		return ""
+	}
+	linesA, linesB := splitDiffLines(a), splitDiffLines(b)
+	ops, ok := diffLines(linesA, linesB)
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", nameA, nameB)
+	if !ok {
+		fmt.Fprintf(&buf, "files are too large to diff: %d lines, %d lines\n", len(linesA), len(linesB))
+		return buf.String()
+	}
+
+	for start := 0; start < len(ops); {
+		// find next change
+		for start < len(ops) && ops[start].kind == diffEqual {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+		// extend hunk until there are more than 2*context equal lines
+		end := start
+		for end < len(ops) {
+			if ops[end].kind != diffEqual {
+				end++
+				continue
+			}
+			eq := end
+			for eq < len(ops) && ops[eq].kind == diffEqual {
+				eq++
+			}
+			if eq == len(ops) || eq-end > 2*context {
+				break
+			}
+			end = eq
+		}
+		hunkStart := start - context
+		if hunkStart < 0 {
+			hunkStart = 0
+		}
+		hunkEnd := end + context
+		if hunkEnd > len(ops) {
+			hunkEnd = len(ops)
+		}
+
+		lineA, lineB := 1, 1
+		for _, op := range ops[:hunkStart] {
+			if op.kind != diffInsert {
+				lineA++
+			}
+			if op.kind != diffDelete {
+				lineB++
+			}
+		}
+		var countA, countB int
+		for _, op := range ops[hunkStart:hunkEnd] {
+			if op.kind != diffInsert {
+				countA++
+			}
+			if op.kind != diffDelete {
+				countB++
+			}
+		}
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n", hunkRange(lineA, countA), hunkRange(lineB, countB))
+		for _, op := range ops[hunkStart:hunkEnd] {
+			switch op.kind {
+			case diffEqual:
+				buf.WriteString(" ")
+			case diffDelete:
+				buf.WriteString("-")
+			case diffInsert:
+				buf.WriteString("+")
+			}
+			buf.WriteString(op.line)
+			buf.WriteString("\n")
+		}
+		start = hunkEnd
+	}
+	if a != "" && b != "" && strings.HasSuffix(a, "\n") != strings.HasSuffix(b, "\n") {
+		buf.WriteString("\\ No newline at end of file\n")
+	}
+	return buf.String()
+}
+
+func splitDiffLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		start--
+	}
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
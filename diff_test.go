@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiffNoNewlineMarker(t *testing.T) {
+	const marker = "\\ No newline at end of file"
+	for _, c := range []struct {
+		a, b   string
+		marker bool
+	}{
+		{"a\n", "b\n", false},
+		{"a\n", "b", true},
+		{"a", "b\n", true},
+		{"", "b", false},
+		{"a", "", false},
+	} {
+		diff := unifiedDiff("a", "b", c.a, c.b, 3)
+		if got := strings.Contains(diff, marker); got != c.marker {
+			t.Errorf("diff %q -> %q: marker %v, want %v:\n%s", c.a, c.b, got, c.marker, diff)
+		}
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	if diff := unifiedDiff("a", "b", "x\ny\n", "x\ny\n", 3); diff != "" {
+		t.Errorf("identical content should have no diff: %q", diff)
+	}
+	want := "--- expected.txt\n+++ actual.txt\n@@ -1,3 +1,3 @@\n one\n-two\n+TWO\n three\n"
+	if diff := unifiedDiff("expected.txt", "actual.txt", "one\ntwo\nthree\n", "one\nTWO\nthree\n", 3); diff != want {
+		t.Errorf("diff:\n%s\nwant:\n%s", diff, want)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	driftCreate = "+"
+	driftUpdate = "~"
+	driftRemove = "-"
+)
+
+// driftItem is a change required to reach desired state.
+type driftItem struct {
+	kind string
+	name string
+	// changes such as 'mode 0600 -> 0644'
+	changes []string
+	// unified diff of content
+	diff string
+}
+
+func (d driftItem) String() string {
+	s := d.kind + " " + d.name
+	if len(d.changes) > 0 {
+		s += ": " + strings.Join(d.changes, ", ")
+	}
+	if d.diff != "" {
+		s += "\n" + strings.TrimSuffix(d.diff, "\n")
+	}
+	return s
+}
+
+// desiredFile is desired state of file, mode isn't compared if it's zero.
+type desiredFile struct {
+	path    string
+	content []byte
+	mode    os.FileMode
+	absent  bool
+}
+
+// fileDrift compares file with desired state, it returns nil if file is unchanged.
+func fileDrift(want desiredFile, context int) (*driftItem, error) {
+	stat, err := os.Stat(want.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	name := stringToSlash(want.path)
+	exist := err == nil
+	switch {
+	case want.absent && !exist:
+		return nil, nil
+	case want.absent:
+		return &driftItem{kind: driftRemove, name: name}, nil
+	case !exist:
+		item := &driftItem{kind: driftCreate, name: name}
+		if want.mode != 0 {
+			item.changes = append(item.changes, fmt.Sprintf("mode %04o", want.mode))
+		}
+		item.diff = unifiedDiff(devNull, name, "", string(want.content), context)
+		return item, nil
+	case stat.IsDir():
+		return nil, fmt.Errorf("path is a directory: %s", name)
+	}
+	item := &driftItem{kind: driftUpdate, name: name}
+	if want.mode != 0 && stat.Mode().Perm() != want.mode {
+		item.changes = append(item.changes, fmt.Sprintf("mode %04o -> %04o", stat.Mode().Perm(), want.mode))
+	}
+	content, err := ioutil.ReadFile(want.path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(content, want.content) {
+		item.changes = append(item.changes, "content")
+		item.diff = unifiedDiff(name, "desired", string(content), string(want.content), context)
+	}
+	if len(item.changes) == 0 {
+		return nil, nil
+	}
+	return item, nil
+}
+
+// envDrift compares env value with desired value, it returns nil if value is unchanged.
+func envDrift(envs *ExpandEnvs, name, want string) *driftItem {
+	val, has := envs.get(name)
+	switch {
+	case !has:
+		return &driftItem{kind: driftCreate, name: "env " + name, changes: []string{fmt.Sprintf("%q", want)}}
+	case val != want:
+		return &driftItem{kind: driftUpdate, name: "env " + name, changes: []string{fmt.Sprintf("%q -> %q", val, want)}}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestFileDrift(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"same.conf":    "port=80\n",
+		"changed.conf": "port=80\nhost=a\n",
+	})
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+
+	item, err := fileDrift(desiredFile{path: path("same.conf"), content: []byte("port=80\n")}, 3)
+	if err != nil || item != nil {
+		t.Errorf("unchanged file drift: %v, %v", item, err)
+	}
+
+	item, err = fileDrift(desiredFile{path: path("changed.conf"), content: []byte("port=8080\nhost=a\n")}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item == nil || item.kind != driftUpdate || len(item.changes) != 1 || item.changes[0] != "content" {
+		t.Fatalf("changed file drift: %v", item)
+	}
+	if !strings.Contains(item.diff, "-port=80\n+port=8080\n") {
+		t.Errorf("diff of changed file: %q", item.diff)
+	}
+
+	item, err = fileDrift(desiredFile{path: path("new.conf"), content: []byte("x\n"), mode: 0600}, 3)
+	if err != nil || item == nil || item.kind != driftCreate || !strings.Contains(item.String(), "mode 0600") {
+		t.Errorf("missing file drift: %v, %v", item, err)
+	}
+	item, err = fileDrift(desiredFile{path: path("same.conf"), absent: true}, 3)
+	if err != nil || item == nil || item.kind != driftRemove {
+		t.Errorf("unwanted file drift: %v, %v", item, err)
+	}
+	item, err = fileDrift(desiredFile{path: path("new.conf"), absent: true}, 3)
+	if err != nil || item != nil {
+		t.Errorf("absent file drift: %v, %v", item, err)
+	}
+
+	if runtime.GOOS != "windows" {
+		if err = os.Chmod(path("same.conf"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		item, err = fileDrift(desiredFile{path: path("same.conf"), content: []byte("port=80\n"), mode: 0644}, 3)
+		if err != nil || item == nil || item.String() != "~ "+stringToSlash(path("same.conf"))+": mode 0600 -> 0644" {
+			t.Errorf("mode drift: %v, %v", item, err)
+		}
+	}
+}
+
+func TestDriftAction(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"same.conf":    "port=80\n",
+		"changed.conf": "port=80\n",
+		"tash.yaml": `
+tasks:
+  plan:
+    actions:
+      - env: [STAGE=dev, REGION=us]
+      - drift:
+          files:
+            - {path: same.conf, content: "port=80\n"}
+            - {path: changed.conf, content: "port=8080\n"}
+          envs: {STAGE: prod, REGION: us}
+          countEnv: DRIFTED
+      - echo: {content: "${DRIFTED}", file: count.txt}
+  check:
+    actions:
+      - drift:
+          files:
+            - {path: changed.conf, content: "port=8080\n"}
+          fail: true
+`,
+	})
+	var failure string
+	output := captureStdout(t, func() {
+		failure = runTestTask(t, dir, "plan")
+	})
+	if failure != "" {
+		t.Fatal(failure)
+	}
+	if count := readTestFile(t, dir, "count.txt"); count != "2" {
+		t.Errorf("count of drifted items: %q", count)
+	}
+	for _, want := range []string{"drift detected: 2 items", "~ changed.conf: content", "+port=8080", `~ env STAGE: "dev" -> "prod"`} {
+		if !strings.Contains(output, want) {
+			t.Errorf("drift report doesn't contain %q: %s", want, output)
+		}
+	}
+	if strings.Contains(output, "same.conf") || strings.Contains(output, "REGION") {
+		t.Errorf("unchanged items shouldn't be reported: %s", output)
+	}
+	if content := readTestFile(t, dir, "changed.conf"); content != "port=80\n" {
+		t.Errorf("drift shouldn't change files: %q", content)
+	}
+
+	if failure := runTestTask(t, dir, "check"); !strings.Contains(failure, "drift detected") {
+		t.Errorf("drift should fail task: %q", failure)
+	}
+}
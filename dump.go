@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/uiez/tash/syntax"
+)
+
+const (
+	dumpFormatYaml = "yaml"
+	dumpFormatJson = "json"
+)
+
+// secretEnvPattern matches env names whose values are masked in dumped config.
+var secretEnvPattern = regexp.MustCompile(`(?i)(secret|token|passw(or)?d|credential|api_?key|private_?key)`)
+
+// dumpConfig prints effective config after imports are resolved, selected profile is merged into env.
+// zero fields are omitted and field names are in lower camel case like config files.
+func dumpConfig(configs *Configuration, log indentLogger, profile, format string) {
+	envs := configs.Env
+	if profile != "" {
+		p, has := configs.Profiles[profile]
+		if !has {
+			log.fatalln("profile not found:", profile)
+			return
+		}
+		envs = syntax.EnvList{}
+		envs.Append(&configs.Env)
+		envs.Append(&p)
+	}
+	secrets := map[string]bool{}
+	for _, task := range configs.Tasks {
+		for _, s := range task.Secrets {
+			secrets[s.Env] = true
+		}
+	}
+	d := dumper{secrets: secrets}
+	tasks := map[string]interface{}{}
+	for name, task := range configs.Tasks {
+		if dir := configs.TaskDirs[name]; task.WorkDir == "" && dir != "" {
+			task.WorkDir = stringToSlash(dir)
+		}
+		tasks[name] = d.value(reflect.ValueOf(task))
+	}
+	data := map[string]interface{}{
+		"templateMaxDepth": configs.TemplateMaxDepth,
+	}
+	for key, v := range map[string]interface{}{
+		"env":       d.value(reflect.ValueOf(envs)),
+		"profiles":  d.value(reflect.ValueOf(configs.Profiles)),
+		"templates": d.value(reflect.ValueOf(configs.Templates)),
+		"notify":    d.value(reflect.ValueOf(configs.Notify)),
+		"redact":    d.value(reflect.ValueOf(configs.Redact)),
+		"tasks":     tasks,
+	} {
+		if !d.isEmpty(v) {
+			data[key] = v
+		}
+	}
+
+	content, err := json.MarshalIndent(data, "", "  ")
+	if err == nil {
+		switch format {
+		case "", dumpFormatYaml:
+			content, err = yaml.JSONToYAML(content)
+		case dumpFormatJson:
+			content = append(content, '\n')
+		default:
+			err = fmt.Errorf("unsupported format: %s", format)
+		}
+	}
+	if err != nil {
+		log.fatalln("dump config failed:", err)
+		return
+	}
+	fmt.Print(string(content))
+}
+
+type dumper struct {
+	secrets map[string]bool
+}
+
+func (d dumper) isEmpty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Map, reflect.Slice:
+		return rv.Len() == 0
+	}
+	return false
+}
+
+func (d dumper) maskEnvs(envs []string) []string {
+	var masked []string
+	for _, env := range envs {
+		var items []string
+		for _, item := range splitBlocks(env) {
+			k, v := stringSplitAndTrimToPair(item, "=")
+			if v != "" && (d.secrets[k] || secretEnvPattern.MatchString(k)) {
+				item = k + "=***"
+			}
+			items = append(items, item)
+		}
+		masked = append(masked, strings.Join(items, "; "))
+	}
+	return masked
+}
+
+func (d dumper) value(v reflect.Value) interface{} {
+	switch val := v.Interface().(type) {
+	case syntax.EnvList:
+		if val.Length() == 0 {
+			return nil
+		}
+		return d.maskEnvs(val.Envs())
+	case syntax.ActionList:
+		var actions []interface{}
+		for _, a := range val.Actions() {
+			actions = append(actions, d.value(reflect.ValueOf(a)))
+		}
+		return actions
+	case json.RawMessage:
+		var raw interface{}
+		if json.Unmarshal(val, &raw) != nil {
+			return string(val)
+		}
+		return raw
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		fields := map[string]interface{}{}
+		for _, f := range structFields(v) {
+			if f.value.IsZero() {
+				continue
+			}
+			fv := d.value(f.value)
+			if !d.isEmpty(fv) {
+				fields[lowerFirst(f.name)] = fv
+			}
+		}
+		if len(fields) == 0 {
+			return nil
+		}
+		return fields
+	case reflect.Map:
+		m := map[string]interface{}{}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		for _, k := range keys {
+			m[fmt.Sprint(k.Interface())] = d.value(v.MapIndex(k))
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		var items []interface{}
+		for i := 0; i < v.Len(); i++ {
+			items = append(items, d.value(v.Index(i)))
+		}
+		return items
+	default:
+		return v.Interface()
+	}
+}
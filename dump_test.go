@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDumpConfig(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"tash.yaml": `
+imports: common.yaml
+env:
+  - NAME=root
+  - API_TOKEN=abcdef
+profiles:
+  prod:
+    - NAME=prod
+tasks:
+  main:
+    actions:
+      - template: {name: greet}
+`,
+		"common.yaml": `
+templates:
+  greet:
+    - echo: {content: "hello from imported"}
+tasks:
+  imported:
+    actions:
+      - cmd: {exec: echo imported}
+`,
+	})
+	configs := testConfiguration(t, dir)
+	output := captureStdout(t, func() {
+		dumpConfig(configs, testLogger(t), "", dumpFormatYaml)
+	})
+	for _, want := range []string{"hello from imported", "imported:", "exec: echo imported", "NAME=root", "API_TOKEN=***"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("dumped yaml doesn't contain %q:\n%s", want, output)
+		}
+	}
+	if strings.Contains(output, "abcdef") {
+		t.Errorf("secret env isn't masked:\n%s", output)
+	}
+
+	output = captureStdout(t, func() {
+		dumpConfig(configs, testLogger(t), "prod", dumpFormatJson)
+	})
+	var data struct {
+		Env   []string
+		Tasks map[string]interface{}
+	}
+	if err := json.Unmarshal([]byte(output), &data); err != nil {
+		t.Fatal(err, output)
+	}
+	if strings.Join(data.Env, ",") != "NAME=root,API_TOKEN=***,NAME=prod" {
+		t.Errorf("envs merged with profile: %q", data.Env)
+	}
+	if _, has := data.Tasks["imported"]; !has {
+		t.Errorf("imported task isn't dumped: %v", data.Tasks)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/cosiner/argv"
@@ -11,6 +13,20 @@ import (
 
 type ExpandEnvs struct {
 	envs map[string]string
+	// command substitution is not executed in dry run mode
+	dryRun bool
+	// names declared but not bound yet, such as task arguments defined later, referencing them is an error.
+	pending map[string]bool
+	// names of task secrets, they couldn't be expanded
+	secrets map[string]bool
+	// elements of array envs, envs stores elements joined by space
+	arrays map[string][]string
+	// transforms applied when env is assigned, declared by 'NAME|transform...=value'
+	transforms map[string][]string
+	// values of envs whose names look like secrets are masked in logs when assigned
+	redactSecretEnvs bool
+	// process environments are not changed, such as in iterations of parallel loop
+	noProcessEnvs bool
 }
 
 func newExpandEnvs() *ExpandEnvs {
@@ -22,16 +38,34 @@ func newExpandEnvs() *ExpandEnvs {
 }
 func (e *ExpandEnvs) copy() *ExpandEnvs {
 	ne := ExpandEnvs{
-		envs: make(map[string]string),
+		envs:    make(map[string]string),
+		dryRun:  e.dryRun,
+		secrets: e.secrets,
+
+		redactSecretEnvs: e.redactSecretEnvs,
+		noProcessEnvs:    e.noProcessEnvs,
 	}
 	for k, v := range e.envs {
 		ne.envs[k] = v
 	}
+	if len(e.arrays) > 0 {
+		ne.arrays = make(map[string][]string)
+		for k, v := range e.arrays {
+			ne.arrays[k] = v
+		}
+	}
+	if len(e.transforms) > 0 {
+		ne.transforms = make(map[string][]string)
+		for k, v := range e.transforms {
+			ne.transforms[k] = v
+		}
+	}
 	return &ne
 }
 
 func (e *ExpandEnvs) remove(k string) {
 	delete(e.envs, k)
+	delete(e.arrays, k)
 }
 
 func (e *ExpandEnvs) get(k string) (string, bool) {
@@ -41,10 +75,30 @@ func (e *ExpandEnvs) get(k string) (string, bool) {
 
 func (e *ExpandEnvs) set(k, v string) {
 	e.envs[k] = v
-	if k == "PATH" {
+	delete(e.arrays, k)
+	if k == "PATH" && !e.noProcessEnvs {
 		os.Setenv(k, v)
 	}
 }
+
+func (e *ExpandEnvs) setArray(k string, elems []string) {
+	e.set(k, strings.Join(elems, syntax.DefaultArraySeparator))
+	if e.arrays == nil {
+		e.arrays = make(map[string][]string)
+	}
+	e.arrays[k] = elems
+}
+
+// getArray returns elements of array env, non-array env is treated as array of one element.
+func (e *ExpandEnvs) getArray(k string) []string {
+	if elems, has := e.arrays[k]; has {
+		return elems
+	}
+	if v, has := e.envs[k]; has {
+		return []string{v}
+	}
+	return nil
+}
 func (e *ExpandEnvs) addAndExpand(log logger, k, v string, expand bool) {
 	if expand {
 		err := e.expandStringPtrs(&v)
@@ -52,11 +106,40 @@ func (e *ExpandEnvs) addAndExpand(log logger, k, v string, expand bool) {
 			log.fatalln(err)
 		}
 	}
-
+	v = e.transformAndRedact(log, k, v)
+	if k == "PATH" && e.noProcessEnvs && v != os.Getenv(k) {
+		log.fatalln("PATH couldn't be changed in parallel loop")
+		return
+	}
 	log.debugln("env add:", k, v)
 	e.set(k, v)
 }
 
+// addArray adds array env, each element is transformed and redacted like addAndExpand.
+func (e *ExpandEnvs) addArray(log logger, k string, elems []string) {
+	for i := range elems {
+		elems[i] = e.transformAndRedact(log, k, elems[i])
+	}
+	log.debugln("env add:", k, elems)
+	e.setArray(k, elems)
+}
+
+// transformAndRedact applies declared transforms of env to value, and masks value in logs if env name
+// looks like secret.
+func (e *ExpandEnvs) transformAndRedact(log logger, k, v string) string {
+	if ts := e.transforms[k]; len(ts) > 0 {
+		var err error
+		v, err = e.transform(v, ts)
+		if err != nil {
+			log.fatalln("transform env failed:", k, err)
+		}
+	}
+	if e.redactSecretEnvs && len(v) >= minSecretEnvLength && secretEnvPattern.MatchString(k) {
+		addMaskedSecret(v)
+	}
+	return v
+}
+
 func (e *ExpandEnvs) parseEnv(log indentLogger, envs syntax.EnvList) {
 	for _, env := range envs.Envs() {
 		blocks := splitBlocks(env)
@@ -64,6 +147,105 @@ func (e *ExpandEnvs) parseEnv(log indentLogger, envs syntax.EnvList) {
 	}
 }
 
+// overlay adds environments and returns a function to restore previous values of keys changed.
+func (e *ExpandEnvs) overlay(log indentLogger, envs syntax.EnvList) (restore func()) {
+	before := e.copy()
+	e.parseEnv(log, envs)
+
+	type prevValue struct {
+		val   string
+		arr   []string
+		exist bool
+	}
+	changed := make(map[string]prevValue)
+	for k, v := range e.envs {
+		old, has := before.envs[k]
+		if !has || old != v || len(e.arrays[k]) != len(before.arrays[k]) {
+			changed[k] = prevValue{val: old, arr: before.arrays[k], exist: has}
+		}
+	}
+	return func() {
+		for k, p := range changed {
+			switch {
+			case p.arr != nil:
+				e.setArray(k, p.arr)
+			case p.exist:
+				e.set(k, p.val)
+			default:
+				e.remove(k)
+			}
+		}
+		e.transforms = before.transforms
+	}
+}
+
+// setScoped sets environment and returns a function to restore previous value.
+func (e *ExpandEnvs) setScoped(k, v string) (restore func()) {
+	old, has := e.envs[k]
+	arr := e.arrays[k]
+	e.set(k, v)
+	return func() {
+		switch {
+		case arr != nil:
+			e.setArray(k, arr)
+		case has:
+			e.set(k, old)
+		default:
+			e.remove(k)
+		}
+	}
+}
+
+// transformEnvName matches env name of key declaring transforms, array envs aren't transformed.
+var transformEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// declareTransforms splits transforms from key 'NAME|transform...' and records them. '|' is always
+// the transform separator in keys, so the name must be valid env name and transforms couldn't be empty.
+func (e *ExpandEnvs) declareTransforms(key string) (string, error) {
+	parts := strings.Split(key, "|")
+	if len(parts) == 1 {
+		return key, nil
+	}
+	name := strings.TrimSpace(parts[0])
+	if !transformEnvName.MatchString(name) {
+		return "", fmt.Errorf("invalid env name to declare transforms: %s", key)
+	}
+	var transforms []string
+	for _, t := range parts[1:] {
+		t = strings.TrimSpace(t)
+		sections, err := argv.Argv(t, nil, func(s string) (string, error) {
+			return s, nil
+		})
+		if err != nil || len(sections) != 1 || len(sections[0]) == 0 {
+			return "", fmt.Errorf("invalid transform of env %s: '%s'", name, t)
+		}
+		transforms = append(transforms, t)
+	}
+	if e.transforms == nil {
+		e.transforms = make(map[string][]string)
+	}
+	e.transforms[name] = transforms
+	return name, nil
+}
+
+// transform applies transforms to value in order, transforms are functions of string.transform filter.
+func (e *ExpandEnvs) transform(v string, transforms []string) (string, error) {
+	fn := expandFilters[syntax.Ef_string_transform]
+	for _, t := range transforms {
+		sections, err := argv.Argv(t, nil, func(s string) (string, error) {
+			return s, nil
+		})
+		if err != nil || len(sections) != 1 || len(sections[0]) == 0 {
+			return "", fmt.Errorf("invalid transform: %s", t)
+		}
+		v, err = fn(v, sections[0], e)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", t, err)
+		}
+	}
+	return v, nil
+}
+
 func (e *ExpandEnvs) parsePairs(log logger, items []string, expand bool) {
 	for _, item := range items {
 		if item == "" {
@@ -73,12 +255,148 @@ func (e *ExpandEnvs) parsePairs(log logger, items []string, expand bool) {
 		if k == "" || v == "" {
 			continue
 		}
+		k, err := e.declareTransforms(k)
+		if err != nil {
+			log.fatalln(err)
+			continue
+		}
+		if name, ok := arrayEnvName(k); ok && expand {
+			if !isArrayLiteral(v) {
+				log.fatalln("array value should be surrounded by parentheses:", name, v)
+				continue
+			}
+			k = name
+			elems, err := e.parseArray(v)
+			if err != nil {
+				log.fatalln("parse array failed:", k, err)
+				continue
+			}
+			e.addArray(log, k, elems)
+			continue
+		}
+		if expand && isBackquoted(v) {
+			cmd := v[1 : len(v)-1]
+			if e.dryRun {
+				e.addAndExpand(log, k, v, false)
+				continue
+			}
+			output, err := getCmdStringOutput(e, cmd, "")
+			if err != nil {
+				log.fatalln("command substitution failed:", k, err)
+				continue
+			}
+			e.addAndExpand(log, k, output, false)
+			continue
+		}
 		v = stringUnquote(v)
 
 		e.addAndExpand(log, k, v, expand)
 	}
 }
 
+// isBackquoted reports whether the whole value is surrounded by '`'
+func isBackquoted(v string) bool {
+	l := len(v)
+	return l >= 2 && v[0] == '`' && v[l-1] == '`' && !strings.Contains(v[1:l-1], "`")
+}
+
+// arrayEnvName returns name of array env declared as 'NAME[]'.
+func arrayEnvName(k string) (string, bool) {
+	if !strings.HasSuffix(k, "[]") || len(k) == 2 {
+		return k, false
+	}
+	return k[:len(k)-2], true
+}
+
+// isArrayLiteral reports whether the value is array assignment like '(a b c)'
+func isArrayLiteral(v string) bool {
+	l := len(v)
+	return l >= 2 && v[0] == '(' && v[l-1] == ')'
+}
+
+// parseArray splits array literal into elements by quotes and spaces, elements are expanded separately.
+func (e *ExpandEnvs) parseArray(v string) ([]string, error) {
+	content := strings.TrimSpace(v[1 : len(v)-1])
+	elems := []string{}
+	if content == "" {
+		return elems, nil
+	}
+	sections, err := argv.Argv(content, nil, func(s string) (string, error) {
+		return s, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(sections) != 1 {
+		return nil, fmt.Errorf("invalid array syntax: %s", v)
+	}
+	for _, elem := range sections[0] {
+		elem, err = e.expandString(elem)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, elem)
+	}
+	return elems, nil
+}
+
+// lookupArray resolves array expression: 'NAME[index]', 'NAME[@]', 'NAME[@SEP]' or '#NAME[@]',
+// ok is false if name is not an array expression.
+func (e *ExpandEnvs) lookupArray(name string) (val string, ok bool, err error) {
+	l := len(name)
+	if l < 3 || name[l-1] != ']' {
+		return "", false, nil
+	}
+	open := strings.IndexByte(name, '[')
+	if open <= 0 {
+		return "", false, nil
+	}
+	arrName, subscript := name[:open], name[open+1:l-1]
+	count := strings.HasPrefix(arrName, "#")
+	if count {
+		arrName = arrName[1:]
+	}
+	for _, c := range arrName {
+		if !isAlphaNum(c) {
+			return "", false, nil
+		}
+	}
+	if arrName == "" {
+		return "", false, nil
+	}
+	if e.pending[arrName] {
+		return "", true, fmt.Errorf("%s is referenced before defined", arrName)
+	}
+	if e.secrets[arrName] {
+		return "", true, fmt.Errorf("secret %s couldn't be expanded", arrName)
+	}
+	elems := e.getArray(arrName)
+	switch {
+	case count:
+		if subscript != "@" {
+			return "", true, fmt.Errorf("invalid array length syntax: %s", name)
+		}
+		return strconv.Itoa(len(elems)), true, nil
+	case strings.HasPrefix(subscript, "@"):
+		sep := syntax.DefaultArraySeparator
+		if len(subscript) > 1 {
+			sep = subscript[1:]
+		}
+		return strings.Join(elems, sep), true, nil
+	}
+	index, err := strconv.Atoi(strings.TrimSpace(subscript))
+	if err != nil {
+		return "", true, fmt.Errorf("invalid array index: %s", name)
+	}
+	if index < 0 {
+		index += len(elems)
+	}
+	if index < 0 || index >= len(elems) {
+		return "", true, fmt.Errorf("array index out of range: %s, length: %d", name, len(elems))
+	}
+	return elems[index], true, nil
+}
+
 func (e *ExpandEnvs) formatEnvs() []string {
 	var items []string
 	for k, v := range e.envs {
@@ -138,7 +456,20 @@ func (e *ExpandEnvs) lookupAndFilter(name string, filters []string) (string, err
 			val = us
 		}
 	} else {
-		val = e.envs[name]
+		arrVal, isArray, err := e.lookupArray(name)
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case isArray:
+			val = arrVal
+		case e.pending[name]:
+			return "", fmt.Errorf("%s is referenced before defined", name)
+		case e.secrets[name]:
+			return "", fmt.Errorf("secret %s couldn't be expanded, escape it as \\$%s to be read by command", name, name)
+		default:
+			val = e.envs[name]
+		}
 	}
 
 	for _, filter := range filters {
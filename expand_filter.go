@@ -88,16 +88,21 @@ func init() {
 				return "", fmt.Errorf("%s args not needed", fn)
 			}
 			return strings.TrimSpace(val), nil
+		case "collapseSpace":
+			if len(args) != 0 {
+				return "", fmt.Errorf("%s args not needed", fn)
+			}
+			return strings.Join(strings.Fields(val), " "), nil
 		case "trimPrefix":
 			if len(args) != 1 {
 				return "", fmt.Errorf("%s args invalid", fn)
 			}
-			return strings.TrimPrefix(val, args[1]), nil
+			return strings.TrimPrefix(val, args[0]), nil
 		case "trimSuffix":
 			if len(args) != 1 {
 				return "", fmt.Errorf("%s args invalid", fn)
 			}
-			return strings.TrimSuffix(val, args[1]), nil
+			return strings.TrimSuffix(val, args[0]), nil
 		case "quote":
 			if len(args) != 0 {
 				return "", fmt.Errorf("%s args not needed", fn)
@@ -518,6 +523,27 @@ func init() {
 		matched = sliceToSlash(matched)
 		return strings.Join(matched, sep), nil
 	}
+	expandFilters[syntax.Ef_git_changed] = func(val string, args []string, envs *ExpandEnvs) (string, error) {
+		var pattern, sep string
+		switch len(args) {
+		case 0:
+		case 1:
+			pattern = args[0]
+		case 2:
+			pattern = args[0]
+			sep = args[1]
+		default:
+			return "", fmt.Errorf("args invalid")
+		}
+		if sep == "" {
+			sep = syntax.DefaultArraySeparator
+		}
+		files, err := gitChangedFiles(val, pattern)
+		if err != nil {
+			return "", err
+		}
+		return strings.Join(files, sep), nil
+	}
 	expandFilters[syntax.Ef_file_abspath] = func(val string, args []string, envs *ExpandEnvs) (string, error) {
 		if len(args) != 0 {
 			return "", fmt.Errorf("args is not needed")
@@ -609,6 +635,9 @@ func init() {
 		default:
 			return "", fmt.Errorf("args invalid")
 		}
+		if envs.dryRun {
+			return "`" + val + "`", nil
+		}
 		return getCmdStringOutput(envs, val, workingDir)
 	}
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uiez/tash/syntax"
+)
+
+func TestStringTransformTrimPrefixSuffix(t *testing.T) {
+	transform := expandFilters[syntax.Ef_string_transform]
+	for _, c := range []struct {
+		val  string
+		args []string
+		want string
+	}{
+		{"v1.2.3", []string{"trimPrefix", "v"}, "1.2.3"},
+		{"main.go", []string{"trimSuffix", ".go"}, "main"},
+		{"main.go", []string{"trimPrefix", "x"}, "main.go"},
+	} {
+		got, err := transform(c.val, c.args, newExpandEnvs())
+		if err != nil {
+			t.Fatalf("%s %v: %s", c.val, c.args, err)
+		}
+		if got != c.want {
+			t.Errorf("%s %v: got %q, want %q", c.val, c.args, got, c.want)
+		}
+	}
+}
+
+func TestPathFiltersSlashSeparated(t *testing.T) {
+	dir := testDir(t, map[string]string{"sub/a.txt": "a", "sub/b.txt": "b"})
+	native := filepath.Join(dir, "sub", "a.txt")
+	for _, c := range []struct {
+		filter string
+		val    string
+		args   []string
+		want   string
+	}{
+		{syntax.Ef_file_abspath, native, nil, filepath.ToSlash(native)},
+		{syntax.Ef_file_dirname, native, nil, filepath.ToSlash(filepath.Dir(native))},
+		{syntax.Ef_file_glob, filepath.Join(dir, "sub", "a*.txt"), nil, filepath.ToSlash(native)},
+	} {
+		got, err := expandFilters[c.filter](c.val, c.args, newExpandEnvs())
+		if err != nil {
+			t.Fatalf("%s %s: %s", c.filter, c.val, err)
+		}
+		if got != c.want || strings.Contains(got, `\`) {
+			t.Errorf("%s %s: got %q, want %q", c.filter, c.val, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testEnvs parses env pairs like env list of config.
+func testEnvs(t *testing.T, pairs ...string) *ExpandEnvs {
+	t.Helper()
+	envs := newExpandEnvs()
+	envs.parsePairs(testLogger(t), pairs, true)
+	return envs
+}
+
+func TestArrayEnvs(t *testing.T) {
+	envs := testEnvs(t, "X=x", `ARR[]=(a "b c" $X)`, "EMPTY[]=()")
+	for expr, want := range map[string]string{
+		"${ARR[0]}":    "a",
+		"${ARR[1]}":    "b c",
+		"${ARR[-1]}":   "x",
+		"${ARR[@]}":    "a b c x",
+		"${ARR[@,]}":   "a,b c,x",
+		"${#ARR[@]}":   "3",
+		"$ARR":         "a b c x",
+		"${#EMPTY[@]}": "0",
+		"${#X[@]}":     "1",
+		"${#NONE[@]}":  "0",
+	} {
+		got, err := envs.expandString(expr)
+		if err != nil {
+			t.Errorf("%s: %s", expr, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got %q, want %q", expr, got, want)
+		}
+	}
+	for _, expr := range []string{"${ARR[3]}", "${ARR[-4]}", "${EMPTY[0]}"} {
+		if _, err := envs.expandString(expr); err == nil || !strings.Contains(err.Error(), "out of range") {
+			t.Errorf("%s: out of range error expected, got %v", expr, err)
+		}
+	}
+}
+
+func TestParenthesisedScalarEnvs(t *testing.T) {
+	envs := testEnvs(t, "PATTERN=(foo|bar)", "X=(a b)", "EMPTY=()")
+	for name, want := range map[string]string{
+		"PATTERN": "(foo|bar)",
+		"X":       "(a b)",
+		"EMPTY":   "()",
+	} {
+		if got, _ := envs.get(name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+		if envs.arrays[name] != nil {
+			t.Errorf("%s shouldn't be array", name)
+		}
+	}
+}
+
+func TestEnvTransforms(t *testing.T) {
+	envs := testEnvs(t, `VERSION | trimSpace | collapseSpace | lower = "  V1.0   Beta "`, "NAME|trimPrefix 'x-'|upper=x-tash")
+	for name, want := range map[string]string{
+		"VERSION": "v1.0 beta",
+		"NAME":    "TASH",
+	} {
+		if got, _ := envs.get(name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	// transforms are applied to later assignments too
+	envs.parsePairs(testLogger(t), []string{"VERSION= V2 "}, true)
+	if got, _ := envs.get("VERSION"); got != "v2" {
+		t.Errorf("reassigned VERSION: %q", got)
+	}
+
+	for _, key := range []string{"A B|lower", "A[]|lower", "|lower", "A|", "A|lower||upper", "A-B|lower"} {
+		var fatal string
+		log := newLogger(false)
+		log.exit = func(msg string) {
+			fatal = msg
+		}
+		newExpandEnvs().parsePairs(log, []string{key + "=x"}, true)
+		if !strings.Contains(fatal, "transform") {
+			t.Errorf("key %q declaring transforms ambiguously should be refused", key)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/uiez/tash/syntax"
+)
+
+// explainer prints the action plan of tasks without running them.
+//
+// strings are expanded with task environments where possible, command substitution
+// is kept unexpanded to avoid side effects, and environment actions are applied
+// in order so later actions could see them.
+type explainer struct {
+	r     *runner
+	envs  *ExpandEnvs
+	chain []string
+}
+
+func explainTasks(configs *Configuration, log indentLogger, names []string, args []string, profile string) {
+	if len(names) == 0 {
+		log.fatalln("no tasks to explain")
+		return
+	}
+	currDir, err := os.Getwd()
+	if err != nil {
+		log.fatalln("get current directory failed:", err)
+		return
+	}
+	r := newRunner(nil, log, configs)
+	r.globalArgs = args
+	r.profile = profile
+	r.dryRun = true
+	calls, err := parseTaskCalls(configs, names)
+	if err != nil {
+		log.fatalln(err)
+		return
+	}
+	for i, call := range calls {
+		name := call.name
+		if i > 0 {
+			r.infoln()
+		}
+		task, ok := r.searchTask(name)
+		if !ok {
+			r.fatalln("task not found:", name)
+			return
+		}
+		r.infoln("Task:", name)
+		workDir := currDir
+		if task.WorkDir != "" {
+			workDir = task.WorkDir
+		}
+		tr := r.addIndent()
+		tr.infoln("workdir:", stringToSlash(workDir))
+		if task.Host.Address != "" {
+			tr.infoln("host:", task.Host.Address)
+		}
+		if task.Lock.File != "" {
+			tr.infoln("lock:", task.Lock.File)
+		}
+		if task.Container.Image != "" {
+			tr.infoln("container:", task.Container.Image)
+		}
+		if task.Disabled != "" {
+			tr.infoln("disabled:", task.Disabled)
+		}
+		e := explainer{
+			r:     tr,
+			envs:  tr.createTaskEnvs(name, task, stringToSlash(workDir), call.args),
+			chain: []string{"task:" + name},
+		}
+		e.explainActions(tr.log(), task.Before)
+		e.explainActions(tr.log(), task.Actions)
+		if task.After.Length() > 0 {
+			tr.infoln("after:")
+			e.explainActions(tr.log().addIndent(), task.After)
+		}
+	}
+}
+
+func (e *explainer) expand(s string) string {
+	v, err := e.envs.expandString(s)
+	if err != nil {
+		return s
+	}
+	return v
+}
+
+func (e *explainer) enter(kind, name string, log indentLogger, fn func()) {
+	key := kind + ":" + name
+	for _, c := range e.chain {
+		if c == key {
+			log.warnln("recursive reference:", key)
+			return
+		}
+	}
+	e.chain = append(e.chain, key)
+	fn()
+	e.chain = e.chain[:len(e.chain)-1]
+}
+
+func (e *explainer) explainActions(log indentLogger, list syntax.ActionList) {
+	for _, a := range list.Actions() {
+		e.explainAction(log, a)
+	}
+}
+
+func (e *explainer) explainAction(log indentLogger, a syntax.Action) {
+	if a.Disabled != "" {
+		log.infoln("- disabled:", e.expand(string(a.Disabled)))
+		log = log.addIndent()
+	}
+	if a.On != "" {
+		log.infoln("- on:", e.expand(a.On))
+		log = log.addIndent()
+	}
+	if a.LocalEnv.Length() > 0 {
+		log.infoln("- localEnv:", strings.Join(a.LocalEnv.Envs(), "; "))
+		restore := e.envs.overlay(log.silent(true, false), a.LocalEnv)
+		defer restore()
+	}
+	if a.Env.Length() > 0 {
+		e.envs.parseEnv(log.silent(true, false), a.Env)
+	}
+	val := reflect.ValueOf(a)
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		group := typ.Field(i)
+		if !group.Anonymous {
+			continue
+		}
+		groupVal := val.Field(i)
+		for j := 0; j < group.Type.NumField(); j++ {
+			field := groupVal.Field(j)
+			if field.IsZero() {
+				continue
+			}
+			e.explainField(log, "- ", group.Type.Field(j).Name, field)
+		}
+	}
+}
+
+func (e *explainer) explainField(log indentLogger, prefix, name string, v reflect.Value) {
+	name = prefix + lowerFirst(name)
+	switch v := v.Interface().(type) {
+	case syntax.ActionList:
+		log.infoln(name + ":")
+		e.explainActions(log.addIndent(), v)
+		return
+	case syntax.EnvList:
+		log.infoln(name+":", strings.Join(v.Envs(), "; "))
+		return
+	case syntax.ActionTask:
+		for _, taskName := range splitBlocks(e.expand(v.Name)) {
+			log.infoln(name+":", taskName)
+			e.enter("task", taskName, log, func() {
+				task, ok := e.r.searchTask(taskName)
+				if !ok {
+					log.warnln("task not found:", taskName)
+					return
+				}
+				e.explainActions(log.addIndent(), task.Actions)
+			})
+		}
+		return
+	}
+	if tmpl, ok := v.Interface().(syntax.ActionTemplate); ok {
+		for _, tmplName := range splitBlocks(tmpl.Name) {
+			params := []string{tmplName}
+			if tmpl.Mode != "" {
+				params = append(params, "mode="+tmpl.Mode)
+			}
+			if len(tmpl.Overrides) > 0 {
+				params = append(params, fmt.Sprintf("overrides=%d", len(tmpl.Overrides)))
+			}
+			log.infoln(name+":", strings.Join(params, " "))
+			e.enter("template", tmplName, log, func() {
+				actions, ok := e.r.searchTemplate(tmplName)
+				if !ok {
+					log.warnln("template not found:", tmplName)
+					return
+				}
+				if len(tmpl.Overrides) > 0 {
+					var err error
+					actions, err = overrideActions(actions, tmpl.Overrides)
+					if err != nil {
+						log.warnln("override template actions failed:", err)
+						return
+					}
+				}
+				e.explainActions(log.addIndent(), actions)
+			})
+		}
+		return
+	}
+
+	if loop, ok := v.Interface().(syntax.ActionLoop); ok && loop.Var != "" {
+		// loop variable is kept unexpanded
+		old, has := e.envs.get(loop.Var)
+		e.envs.set(loop.Var, "$"+loop.Var)
+		defer func() {
+			if has {
+				e.envs.set(loop.Var, old)
+			} else {
+				e.envs.remove(loop.Var)
+			}
+		}()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		var (
+			params []string
+			blocks []func(log indentLogger)
+		)
+		for _, f := range structFields(v) {
+			field := f.value
+			if field.IsZero() {
+				continue
+			}
+			fieldName := f.name
+			switch field.Kind() {
+			case reflect.Struct, reflect.Map:
+				if _, ok := field.Interface().(syntax.EnvList); !ok {
+					blocks = append(blocks, func(log indentLogger) {
+						e.explainField(log, "", fieldName, field)
+					})
+					continue
+				}
+			}
+			params = append(params, lowerFirst(fieldName)+"="+e.formatValue(field))
+		}
+		log.infoln(name+":", strings.Join(params, ", "))
+		for _, b := range blocks {
+			b(log.addIndent())
+		}
+	case reflect.Map:
+		log.infoln(name + ":")
+		var keys []string
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			e.explainField(log.addIndent(), "", e.expand(k), v.MapIndex(reflect.ValueOf(k)))
+		}
+	default:
+		log.infoln(name+":", e.formatValue(v))
+	}
+}
+
+func (e *explainer) formatValue(v reflect.Value) string {
+	switch v := v.Interface().(type) {
+	case string:
+		return fmt.Sprintf("%q", e.expand(v))
+	case []string:
+		vals := make([]string, len(v))
+		for i := range v {
+			vals[i] = fmt.Sprintf("%q", e.expand(v[i]))
+		}
+		return "[" + strings.Join(vals, ", ") + "]"
+	case syntax.EnvList:
+		return fmt.Sprintf("%q", strings.Join(v.Envs(), "; "))
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+type structField struct {
+	name  string
+	value reflect.Value
+}
+
+// structFields returns exported fields of struct, fields of embedded structs are flattened.
+func structFields(v reflect.Value) []structField {
+	var fields []structField
+	typ := v.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			fields = append(fields, structFields(v.Field(i))...)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		fields = append(fields, structField{name: f.Name, value: v.Field(i)})
+	}
+	return fields
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
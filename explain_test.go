@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fatih/color"
+)
+
+// captureStdout returns content written to stdout by fn.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, noColor := os.Stdout, color.NoColor
+	os.Stdout, color.NoColor = wr, true
+	defer func() {
+		os.Stdout, color.NoColor = stdout, noColor
+	}()
+	done := make(chan []byte)
+	go func() {
+		content, _ := ioutil.ReadAll(rd)
+		done <- content
+	}()
+	fn()
+	wr.Close()
+	return string(<-done)
+}
+
+func TestExplainTasks(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - env: [NAME=tash, "NOW=` + "`date`" + `"]
+      - loop:
+          array: [a, b]
+          var: ITEM
+          actions:
+            - echo: {content: "${NAME}-${ITEM}", file: "${ITEM}.txt"}
+      - if:
+          check: "${NAME|? == tash}"
+          actions:
+            - echo: {content: "${NOW}", file: now.txt}
+          else:
+            - fatal: unexpected
+`})
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	out := captureStdout(t, func() {
+		explainTasks(testConfiguration(t, dir), testLogger(t), []string{"main"}, nil, "")
+	})
+	if _, err = os.Stat("a.txt"); !os.IsNotExist(err) {
+		t.Error("actions shouldn't run when explaining")
+	}
+	for _, line := range []string{
+		"Task: main",
+		"- env: NAME=tash; NOW=`date`",
+		`- loop: var="ITEM", array=["a", "b"]`,
+		`- echo: content="tash-$ITEM", file="$ITEM.txt"`,
+		`- if: check="true"`,
+		"- echo: content=\"`date`\", file=\"now.txt\"",
+		"else:",
+		`- fatal: "unexpected"`,
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("line not found in plan: %s", line)
+		}
+	}
+}
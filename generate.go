@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// binarySniffLen is the length of content prefix checked for NUL bytes, like git.
+const binarySniffLen = 8000
+
+// isBinaryContent reports whether content looks like binary file.
+func isBinaryContent(content []byte) bool {
+	if len(content) > binarySniffLen {
+		content = content[:binarySniffLen]
+	}
+	return bytes.IndexByte(content, 0) >= 0
+}
+
+// renderTemplate executes text template with envs as data, missing envs are errors.
+func renderTemplate(name, text string, data map[string]string) (string, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	err = t.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// renderTemplatePath renders components of slash separated relative path containing template actions.
+func renderTemplatePath(rel string, data map[string]string) (string, error) {
+	parts := strings.Split(rel, "/")
+	for i, part := range parts {
+		if !strings.Contains(part, "{{") {
+			continue
+		}
+		name, err := renderTemplate(rel, part, data)
+		if err != nil {
+			return "", fmt.Errorf("render path failed: %s, %w", rel, err)
+		}
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return "", fmt.Errorf("invalid rendered path: %s, %s", rel, name)
+		}
+		parts[i] = name
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// writeGeneratedFile writes file with mode, mode of existing file is also changed and isn't affected by umask.
+func writeGeneratedFile(name string, content []byte, mode os.FileMode, durable bool) error {
+	fd, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(content)
+	if err == nil {
+		err = fd.Chmod(mode)
+	}
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	return closeFile(fd, durable)
+}
+
+// generateTree renders text files of src tree to dst as templates, binary files are copied verbatim.
+// file and directory names are also rendered, modes are preserved. existing files are replaced only if overwrite,
+// it returns count of files generated.
+func generateTree(dst, src string, data map[string]string, overwrite, durable bool) (int, error) {
+	stat, err := os.Stat(src)
+	if err != nil {
+		return 0, fmt.Errorf("read source path status failed: %w", err)
+	}
+	if !stat.IsDir() {
+		return 0, fmt.Errorf("source is not a directory: %s", src)
+	}
+	var (
+		generated int
+		dirChmods = map[string]os.FileMode{}
+	)
+	err = filepath.Walk(src, func(srcPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, srcPath)
+		if err != nil {
+			return err
+		}
+		relPath, err = renderTemplatePath(filepath.ToSlash(relPath), data)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dst, filepath.FromSlash(relPath))
+		if info.IsDir() {
+			err = os.MkdirAll(dstPath, 0755)
+			if err != nil {
+				return fmt.Errorf("create directory failed: %s, %w", dstPath, err)
+			}
+			if info.Mode().Perm() != 0755 {
+				dirChmods[dstPath] = info.Mode().Perm()
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if existed, err := os.Lstat(dstPath); err == nil {
+			if !overwrite || existed.IsDir() {
+				return fmt.Errorf("dest path already exists: %s", dstPath)
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		content, err := ioutil.ReadFile(srcPath)
+		if err != nil {
+			return err
+		}
+		if !isBinaryContent(content) {
+			rendered, err := renderTemplate(filepath.ToSlash(relPath), string(content), data)
+			if err != nil {
+				return fmt.Errorf("render template failed: %w", err)
+			}
+			content = []byte(rendered)
+		}
+		err = writeGeneratedFile(dstPath, content, info.Mode().Perm(), durable)
+		if err != nil {
+			return fmt.Errorf("write file failed: %s, %w", dstPath, err)
+		}
+		generated++
+		return nil
+	})
+	if err != nil {
+		return generated, err
+	}
+	for dir, mode := range dirChmods {
+		err = os.Chmod(dir, mode)
+		if err != nil {
+			return generated, fmt.Errorf("fix dir mod failed: %w", err)
+		}
+	}
+	return generated, nil
+}
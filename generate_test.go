@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestGenerateTree(t *testing.T) {
+	binary := "\x89PNG\x00{{.NAME}}\x00\xff"
+	src := testDir(t, map[string]string{
+		"{{.NAME}}/{{.NAME}}.go": "package {{.NAME}}\n\nconst Version = \"{{.VERSION}}\"\n",
+		"scripts/build.sh":       "#!/bin/sh\necho {{.NAME}}\n",
+		"assets/logo.png":        binary,
+	})
+	if err := os.Chmod(filepath.Join(src, "scripts", "build.sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(testDir(t, nil), "out")
+	data := map[string]string{"NAME": "demo", "VERSION": "1.0"}
+
+	generated, err := generateTree(dst, src, data, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generated != 3 {
+		t.Errorf("count of generated files: %d", generated)
+	}
+	for file, want := range map[string]string{
+		"demo/demo.go":     "package demo\n\nconst Version = \"1.0\"\n",
+		"scripts/build.sh": "#!/bin/sh\necho demo\n",
+		"assets/logo.png":  binary,
+	} {
+		if got := readTestFile(t, dst, file); got != want {
+			t.Errorf("%s: got %q, want %q", file, got, want)
+		}
+	}
+	if runtime.GOOS != "windows" {
+		stat, err := os.Stat(filepath.Join(dst, "scripts", "build.sh"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Mode().Perm() != 0755 {
+			t.Errorf("mode of generated script: %s", stat.Mode())
+		}
+	}
+
+	_, err = generateTree(dst, src, data, false, false)
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("existing files should be kept without overwrite: %v", err)
+	}
+	data["VERSION"] = "2.0"
+	if _, err = generateTree(dst, src, data, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, dst, "demo/demo.go"); !strings.Contains(got, `"2.0"`) {
+		t.Errorf("overwritten file: %q", got)
+	}
+
+	if _, err = generateTree(filepath.Join(dst, "missing"), src, map[string]string{"NAME": "demo"}, false, false); err == nil {
+		t.Error("missing env of template should fail")
+	}
+}
+
+func TestRenderTemplatePath(t *testing.T) {
+	data := map[string]string{"NAME": "demo", "SLASH": "a/b", "EMPTY": ""}
+	path, err := renderTemplatePath("cmd/{{.NAME}}/{{.NAME}}_test.go", data)
+	if err != nil || path != "cmd/demo/demo_test.go" {
+		t.Errorf("rendered path: %s, %v", path, err)
+	}
+	for _, rel := range []string{"{{.SLASH}}.go", "dir/{{.EMPTY}}", "{{.MISSING}}.go"} {
+		if path, err := renderTemplatePath(rel, data); err == nil {
+			t.Errorf("%s should be refused, rendered %s", rel, path)
+		}
+	}
+}
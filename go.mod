@@ -9,9 +9,12 @@ require (
 	github.com/fsnotify/fsnotify v1.4.9
 	github.com/ghodss/yaml v1.0.0
 	github.com/mattn/go-colorable v0.1.6 // indirect
+	github.com/mattn/go-isatty v0.0.12
 	github.com/mattn/go-zglob v0.0.1
 	github.com/mitchellh/go-ps v1.0.0
-	github.com/tidwall/gjson v1.6.7 // indirect
-	golang.org/x/sys v0.0.0-20200420163511-1957bb5e6d1f // indirect
+	github.com/pkg/sftp v1.11.0
+	github.com/tidwall/gjson v1.6.7
+	golang.org/x/crypto v0.0.0-20200420201142-3c4aac89819a
+	golang.org/x/sys v0.0.0-20200420163511-1957bb5e6d1f
 	gopkg.in/yaml.v2 v2.2.8 // indirect
 )
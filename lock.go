@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uiez/tash/syntax"
+)
+
+// lockPollInterval is the interval of retrying to acquire lock while waiting
+const lockPollInterval = 100 * time.Millisecond
+
+// fileLock is an exclusive lock held by flock on unix or LockFileEx on windows,
+// it's released by OS if process exited.
+type fileLock struct {
+	fd *os.File
+}
+
+// acquireFileLock locks file, it fails immediately if lock is held by another process unless wait,
+// timeout limits waiting time, 0 means forever.
+func acquireFileLock(path string, wait bool, timeout time.Duration) (*fileLock, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("create parent directories failed: %w", err)
+	}
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, defaultFileMode)
+	if err != nil {
+		return nil, fmt.Errorf("open lock file failed: %w", err)
+	}
+	begin := time.Now()
+	for {
+		locked, err := tryLockFile(fd)
+		if err != nil {
+			fd.Close()
+			return nil, fmt.Errorf("lock file failed: %w", err)
+		}
+		if locked {
+			break
+		}
+		if !wait || (timeout > 0 && time.Since(begin) >= timeout) {
+			fd.Close()
+			msg := "lock is held by another process"
+			if wait {
+				msg = "wait lock timeout, it's held by another process"
+			}
+			if pid := lockHolder(path); pid != "" {
+				msg += " " + pid
+			}
+			return nil, fmt.Errorf("%s: %s", msg, path)
+		}
+		time.Sleep(lockPollInterval)
+	}
+	// record pid for diagnosing, errors are ignored
+	if fd.Truncate(0) == nil {
+		fd.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	return &fileLock{fd: fd}, nil
+}
+
+// lockHolder returns pid recorded in lock file, it's empty if unknown.
+func lockHolder(path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+func (l *fileLock) release() {
+	unlockFile(l.fd)
+	l.fd.Close()
+}
+
+type taskLock struct {
+	lock *fileLock
+	done string
+}
+
+// lockTask acquires lock of task, returned taskLock should be released after task completed.
+func (r *runner) lockTask(envs *ExpandEnvs, opts syntax.TaskLock) (*taskLock, bool) {
+	err := envs.expandStringPtrs(&opts.File, &opts.Done)
+	if err != nil {
+		r.fatalln(err)
+		return nil, false
+	}
+	r.resolvePathPtrs(&opts.File, &opts.Done)
+	var l taskLock
+	l.done = stringFromSlash(opts.Done)
+	if opts.File != "" {
+		r.debugln("acquire lock:", opts.File)
+		l.lock, err = acquireFileLock(stringFromSlash(opts.File), opts.Wait, time.Duration(opts.Timeout)*time.Millisecond)
+		if err != nil {
+			r.fatalln(err)
+			return nil, false
+		}
+	}
+	return &l, true
+}
+
+// completed checks whether done marker exists.
+func (l *taskLock) completed() bool {
+	if l.done == "" {
+		return false
+	}
+	_, err := os.Stat(l.done)
+	return err == nil
+}
+
+func (l *taskLock) markCompleted() error {
+	if l.done == "" {
+		return nil
+	}
+	fd, err := openFile(l.done, false, defaultFileMode)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	_, err = fd.WriteString(time.Now().Format(time.RFC3339) + "\n")
+	return err
+}
+
+func (l *taskLock) release() {
+	if l.lock != nil {
+		l.lock.release()
+	}
+}
+
+// heldLocks are locks acquired by lock actions, they are released when task ends.
+type heldLocks struct {
+	mu    sync.Mutex
+	locks []*fileLock
+}
+
+func (h *heldLocks) add(l *fileLock) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.locks = append(h.locks, l)
+}
+
+// release releases locks in reverse order of acquiring.
+func (h *heldLocks) release() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.locks) - 1; i >= 0; i-- {
+		h.locks[i].release()
+	}
+	h.locks = nil
+}
+
+// taskLocks returns locks held until nearest task ends.
+func (r *runner) taskLocks() *heldLocks {
+	for rt := r; rt != nil; rt = rt.parent {
+		if rt.locks != nil {
+			return rt.locks
+		}
+	}
+	// not in task, lock is released by OS when tash exits
+	return &heldLocks{}
+}
+
+func (r *runner) runActionLock(a syntax.ActionLock, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&a.File)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	a.File = r.resolvePath(a.File)
+	r.infoln("Lock:", stringToSlash(a.File))
+	lock, err := acquireFileLock(stringFromSlash(a.File), a.Wait, time.Duration(a.Timeout)*time.Millisecond)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	if a.Actions.Length() == 0 {
+		r.taskLocks().add(lock)
+		return
+	}
+	defer lock.release()
+	r.addIndent().runActions(envs, a.Actions)
+}
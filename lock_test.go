@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTaskLock(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"tash.yaml": `
+tasks:
+  deploy:
+    lock: {file: deploy.lock}
+    actions:
+      - echo: {content: deployed, file: deploy.txt}
+  wait:
+    lock: {file: deploy.lock, wait: true, timeout: 2000}
+    actions:
+      - echo: {content: waited, file: wait.txt}
+  timeout:
+    lock: {file: deploy.lock, wait: true, timeout: 200}
+    actions: []
+  once:
+    lock: {done: once.done}
+    actions:
+      - echo: {content: ran, file: once.txt}
+`,
+	})
+	// lock held by first run
+	held, err := acquireFileLock(filepath.Join(dir, "deploy.lock"), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failure := runTestTask(t, dir, "deploy"); !strings.Contains(failure, "held by another process") {
+		t.Errorf("second run should fail while lock is held: %q", failure)
+	}
+	if readTestFile(t, dir, "deploy.txt") != "" {
+		t.Error("actions shouldn't run without lock")
+	}
+
+	begin := time.Now()
+	if failure := runTestTask(t, dir, "timeout"); !strings.Contains(failure, "wait lock timeout") {
+		t.Errorf("waiting lock should timeout: %q", failure)
+	}
+	if elapsed := time.Since(begin); elapsed < 200*time.Millisecond {
+		t.Errorf("waiting time %s is less than timeout", elapsed)
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		held.release()
+	}()
+	begin = time.Now()
+	if failure := runTestTask(t, dir, "wait"); failure != "" {
+		t.Fatal(failure)
+	}
+	if elapsed := time.Since(begin); elapsed < 200*time.Millisecond || readTestFile(t, dir, "wait.txt") != "waited" {
+		t.Errorf("run should block until lock is released, waited %s", elapsed)
+	}
+	if failure := runTestTask(t, dir, "deploy"); failure != "" {
+		t.Errorf("lock should be released after task ended: %s", failure)
+	}
+
+	if failure := runTestTask(t, dir, "once"); failure != "" || readTestFile(t, dir, "once.txt") != "ran" {
+		t.Fatalf("first run: %q", failure)
+	}
+	if err = os.Remove(filepath.Join(dir, "once.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if failure := runTestTask(t, dir, "once"); failure != "" {
+		t.Fatal(failure)
+	}
+	if readTestFile(t, dir, "once.txt") != "" {
+		t.Error("completed task should be skipped")
+	}
+	if err = os.Remove(filepath.Join(dir, "once.done")); err != nil {
+		t.Fatal(err)
+	}
+	if failure := runTestTask(t, dir, "once"); failure != "" || readTestFile(t, dir, "once.txt") != "ran" {
+		t.Errorf("task should run again after marker removed: %q", failure)
+	}
+}
+
+func TestLockAction(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"tash.yaml": `
+tasks:
+  scoped:
+    actions:
+      - lock:
+          file: locks/db.lock
+          actions:
+            - echo: {content: locked, file: scoped.txt}
+      # released after actions completed
+      - lock: {file: locks/db.lock}
+      - echo: {content: relocked, file: relocked.txt}
+  nested:
+    actions:
+      - lock:
+          file: locks/db.lock
+          actions:
+            - lock: {file: locks/db.lock}
+  rest:
+    actions:
+      - lock: {file: locks/db.lock, wait: true, timeout: 2000}
+      - echo: {content: rest, file: rest.txt}
+  timeout:
+    actions:
+      - lock: {file: locks/db.lock, wait: true, timeout: 200}
+      - echo: {content: timeout, file: timeout.txt}
+`,
+	})
+	lockPath := filepath.Join(dir, "locks", "db.lock")
+	if failure := runTestTask(t, dir, "scoped"); failure != "" {
+		t.Fatal(failure)
+	}
+	if readTestFile(t, dir, "scoped.txt") != "locked" || readTestFile(t, dir, "relocked.txt") != "relocked" {
+		t.Error("scoped lock should be released after its actions")
+	}
+	if failure := runTestTask(t, dir, "nested"); !strings.Contains(failure, "held by another process") {
+		t.Errorf("lock should be held while running actions: %q", failure)
+	}
+
+	// lock of rest of task is released when task ends
+	if failure := runTestTask(t, dir, "rest"); failure != "" {
+		t.Fatal(failure)
+	}
+	held, err := acquireFileLock(lockPath, false, 0)
+	if err != nil {
+		t.Fatalf("lock should be released after task ended: %s", err)
+	}
+
+	begin := time.Now()
+	if failure := runTestTask(t, dir, "timeout"); !strings.Contains(failure, "wait lock timeout") {
+		t.Errorf("waiting contended lock should timeout: %q", failure)
+	}
+	if elapsed := time.Since(begin); elapsed < 200*time.Millisecond {
+		t.Errorf("waiting time %s is less than timeout", elapsed)
+	}
+	if readTestFile(t, dir, "timeout.txt") != "" {
+		t.Error("actions after failed lock shouldn't run")
+	}
+
+	if err = os.Remove(filepath.Join(dir, "rest.txt")); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		held.release()
+	}()
+	if failure := runTestTask(t, dir, "rest"); failure != "" || readTestFile(t, dir, "rest.txt") != "rest" {
+		t.Errorf("contended lock should be acquired after released: %q", failure)
+	}
+}
@@ -0,0 +1,21 @@
+// +build linux darwin freebsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLockFile locks file exclusively without blocking, it returns false if lock is held by another process.
+func tryLockFile(fd *os.File) (bool, error) {
+	err := syscall.Flock(int(fd.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(fd *os.File) {
+	syscall.Flock(int(fd.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,22 @@
+// +build windows
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// tryLockFile locks file exclusively without blocking, it returns false if lock is held by another process.
+func tryLockFile(fd *os.File) (bool, error) {
+	err := windows.LockFileEx(windows.Handle(fd.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &windows.Overlapped{})
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(fd *os.File) {
+	windows.UnlockFileEx(windows.Handle(fd.Fd()), 0, 1, 0, &windows.Overlapped{})
+}
@@ -5,7 +5,7 @@ import (
 )
 
 type Flags struct {
-	Conf     string `names:"-c, --conf" usage:"config file, default tash.yaml in current/ancestor directory"`
+	Conf     string `names:"-c, --conf" usage:"config file, '-' to read from stdin, default tash.yaml in current/ancestor directory"`
 	SaveConf bool   `names:"-s, --save" usage:"save current config file path to .tashfile" desc:"--conf option should also be present, but it could be omitted in later commands"`
 	List     struct {
 		Enable bool
@@ -13,18 +13,38 @@ type Flags struct {
 		ShowArgs bool     `names:"-w, -with-args" usage:"show task args"`
 		Tasks    []string `args:"true" argsAnywhere:"true"`
 	} `arglist:"TASK... [OPTION]..."`
+	Config struct {
+		Enable bool
+
+		Format string `names:"-f, --format" usage:"output format, yaml or json, yaml by default"`
+	} `names:"config" usage:"print effective config after imports resolved and selected profile merged"`
+	SelfUpdate struct {
+		Enable bool
+
+		Url     string `names:"-u, --url" env:"TASH_UPDATE_URL" usage:"binary url, HOST_OS and HOST_ARCH env could be used"`
+		HashAlg string `names:"--hash-alg" usage:"checksum algorithm, SHA256 by default"`
+		Hash    string `names:"--hash" usage:"expected checksum of binary"`
+		HashUrl string `names:"--hash-url" env:"TASH_UPDATE_HASH_URL" usage:"checksum file url, used if --hash is not present"`
+	} `names:"self-update" usage:"download, verify and replace current tash binary"`
 
 	// global command
-	Debug    bool     `names:"-d, --debug" usage:"show debug messages"`
-	TaskArgs []string `names:"-a, --args" usage:"add task args" desc:"each arg could be multiple semicolon separated key=value pair"`
-	Tasks    []string `args:"true" argsAnywhere:"true"`
+	Debug         bool     `names:"-d, --debug" usage:"show debug messages"`
+	NoDiscover    bool     `names:"--no-discover" usage:"don't merge *.tash.yaml files in .tash directory beside config file"`
+	TaskArgs      []string `names:"-a, --args" usage:"add task args" desc:"each arg could be multiple semicolon separated key=value pair"`
+	Profile       string   `names:"-p, --profile" env:"TASH_PROFILE" usage:"select environment profile"`
+	Explain       bool     `names:"-e, --explain" usage:"print action plan of tasks without running"`
+	Outputs       string   `names:"-o, --outputs" env:"TASH_OUTPUTS" usage:"write task outputs to file after tasks completed, the file is flushed to disk"`
+	OutputsFormat string   `names:"--outputs-format" usage:"outputs file format, json or env, json by default"`
+	Timing        bool     `names:"--timing" usage:"print slowest tasks and actions after tasks completed"`
+	TimingFile    string   `names:"--timing-file" usage:"write durations of tasks and actions to json file"`
+	Tasks         []string `args:"true" argsAnywhere:"true"`
 }
 
 func (f *Flags) Metadata() map[string]flag.Flag {
 	return map[string]flag.Flag{
 		"": {
 			Desc:    "task runner",
-			Arglist: "TASK... [OPTION]... | list [TASK]... [OPTION]...",
+			Arglist: "(TASK [ARG]...)... [OPTION]... | list [TASK]... [OPTION]... | config [OPTION]... | self-update [OPTION]...",
 		},
 	}
 }
@@ -34,13 +54,28 @@ func main() {
 	_ = flag.ParseStruct(&flags)
 
 	log := newLogger(flags.Debug)
-	configs := parseConfiguration(log, flags.Conf, flags.SaveConf)
+	if flags.SelfUpdate.Enable {
+		u := flags.SelfUpdate
+		selfUpdate(log, u.Url, u.HashAlg, u.Hash, u.HashUrl)
+		return
+	}
+	configs := parseConfiguration(log, flags.Conf, flags.SaveConf, !flags.NoDiscover)
 	switch {
 	default:
 		fallthrough
 	case flags.List.Enable:
 		listTasks(configs, log, flags.List.Tasks, flags.List.ShowArgs)
+	case flags.Config.Enable:
+		dumpConfig(configs, log, flags.Profile, flags.Config.Format)
+	case len(flags.Tasks) > 0 && flags.Explain:
+		explainTasks(configs, log, flags.Tasks, flags.TaskArgs, flags.Profile)
 	case len(flags.Tasks) > 0:
-		runTasks(configs, log, flags.Tasks, flags.TaskArgs)
+		runTasks(configs, log, flags.Tasks, flags.TaskArgs, flags.Profile, taskOutputs{
+			File:   flags.Outputs,
+			Format: flags.OutputsFormat,
+		}, &taskTimings{
+			Summary: flags.Timing,
+			File:    flags.TimingFile,
+		})
 	}
 }
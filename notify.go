@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/uiez/tash/syntax"
+)
+
+const (
+	taskStatusSucceeded = "succeeded"
+	taskStatusFailed    = "failed"
+
+	defaultNotifyTimeout = 10000
+)
+
+type taskEvent struct {
+	Task         string    `json:"task"`
+	Status       string    `json:"status"`
+	Start        time.Time `json:"start"`
+	DurationMs   float64   `json:"durationMs"`
+	FailedAction string    `json:"failedAction,omitempty"`
+}
+
+// taskNotifier sends completion event of task to webhook and json lines file, it's set for each task runner.
+type taskNotifier struct {
+	syntax.Notification
+	task  string
+	start time.Time
+	sent  bool
+
+	mu sync.Mutex
+	// innermost action running when task failed first
+	failedAction string
+}
+
+// recordFailure records the failed action, only the first failure is kept because
+// parallel loop iterations may fail concurrently.
+func (n *taskNotifier) recordFailure(action string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.failedAction == "" {
+		n.failedAction = action
+	}
+}
+
+func (n *taskNotifier) enabled() bool {
+	return n.Url != "" || n.File != ""
+}
+
+// postEvent posts event to webhook url by shared http client.
+func postEvent(url string, content []byte, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("create notify request failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client, err := httpClient(downloadOptions{})
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded: %s", resp.Status)
+	}
+	return nil
+}
+
+// appendEvent appends event as a line to file.
+func appendEvent(file string, content []byte) error {
+	fd, err := openFile(file, true, defaultFileMode)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(append(content, '\n'))
+	if err1 := fd.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// setupNotifier expands notification options by task envs.
+func (r *runner) setupNotifier(envs *ExpandEnvs, start time.Time) bool {
+	r.notifier = &taskNotifier{task: r.task, start: start}
+	n := r.configs.Notify
+	if n.Url == "" && n.File == "" {
+		return true
+	}
+	err := envs.expandStringPtrs(&n.Url, &n.File)
+	if err != nil {
+		r.fatalln("expand notification failed:", err)
+		return false
+	}
+	if n.File != "" {
+		n.File = r.resolvePath(n.File)
+	}
+	if n.Timeout == 0 {
+		n.Timeout = defaultNotifyTimeout
+	}
+	r.notifier.Notification = n
+	return true
+}
+
+// taskNotifier returns notifier of nearest task.
+func (r *runner) taskNotifier() *taskNotifier {
+	for rt := r; rt != nil; rt = rt.parent {
+		if rt.notifier != nil {
+			return rt.notifier
+		}
+	}
+	return nil
+}
+
+// runningAction returns name of innermost running action.
+func (r *runner) runningAction() string {
+	for rt := r; rt != nil; rt = rt.parent {
+		if rt.action != nil {
+			return rt.actionName(*rt.action)
+		}
+	}
+	return ""
+}
+
+// notifyTask sends completion event of task once, failures are printed as warnings.
+func (r *runner) notifyTask(failed bool) {
+	n := r.taskNotifier()
+	if n == nil || n.sent || !n.enabled() {
+		return
+	}
+	n.sent = true
+	d := time.Since(n.start)
+	event := taskEvent{
+		Task:       n.task,
+		Status:     taskStatusSucceeded,
+		Start:      n.start,
+		DurationMs: float64(d) / float64(time.Millisecond),
+	}
+	if failed {
+		event.Status = taskStatusFailed
+		n.mu.Lock()
+		event.FailedAction = n.failedAction
+		n.mu.Unlock()
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(event)
+	if err != nil {
+		r.warnln("encode task event failed:", err)
+		return
+	}
+	content := bytes.TrimSpace(buf.Bytes())
+	if n.File != "" {
+		err = appendEvent(n.File, content)
+		if err != nil {
+			r.warnln("write task event failed:", stringToSlash(n.File), err)
+		}
+	}
+	if n.Url != "" {
+		err = r.withRetry(n.Retry, func() error {
+			return postEvent(n.Url, content, time.Duration(n.Timeout)*time.Millisecond)
+		})
+		if err != nil {
+			r.warnln("notify task event failed:", err)
+		}
+	}
+}
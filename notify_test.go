@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNotifyTask(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		events   []taskEvent
+		requests int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var event taskEvent
+		content, _ := ioutil.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" || json.Unmarshal(content, &event) != nil {
+			t.Errorf("invalid notify request: %s %s %q", r.Method, r.Header.Get("Content-Type"), content)
+		}
+		events = append(events, event)
+	}))
+	defer server.Close()
+
+	config := `
+tasks:
+  build:
+    actions:
+      - env: ["X=1"]
+  broken:
+    actions:
+      - fatal: boom
+`
+	dir := testDir(t, map[string]string{"tash.yaml": "notify: {url: '" + server.URL + "/${HOOK_PATH}', file: events.jsonl}\nenv: [HOOK_PATH=events]\n" + config})
+	if failure := runTestTask(t, dir, "build"); failure != "" {
+		t.Fatal(failure)
+	}
+	if failure := runTestTask(t, dir, "broken"); failure == "" {
+		t.Fatal("task should fail")
+	}
+	if len(events) != 2 {
+		t.Fatalf("posted events: %+v", events)
+	}
+	if e := events[0]; e.Task != "build" || e.Status != taskStatusSucceeded || e.FailedAction != "" || e.Start.IsZero() {
+		t.Errorf("succeeded event: %+v", e)
+	}
+	if e := events[1]; e.Task != "broken" || e.Status != taskStatusFailed || e.FailedAction != "broken > fatal" {
+		t.Errorf("failed event: %+v", e)
+	}
+	if lines := strings.Split(strings.TrimSpace(readTestFile(t, dir, "events.jsonl")), "\n"); len(lines) != 2 {
+		t.Errorf("events appended to file: %q", lines)
+	}
+
+	// failures of webhook are retried and don't fail task
+	dir = testDir(t, map[string]string{"tash.yaml": "notify: {url: '" + server.URL + "/broken', retry: {times: 2, delay: 1}}\n" + config})
+	requests = 0
+	if failure := runTestTask(t, dir, "build"); failure != "" {
+		t.Errorf("notify failure shouldn't fail task: %s", failure)
+	}
+	if requests != 3 {
+		t.Errorf("notify requests: %d, want 3", requests)
+	}
+}
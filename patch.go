@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// devNull is the file name of created or deleted file in unified diff
+const devNull = "/dev/null"
+
+type patchHunk struct {
+	header   string
+	oldStart int
+	newStart int
+	oldLines []string
+	newLines []string
+	// '\ No newline at end of file' of old and new lines
+	oldNoEOL bool
+	newNoEOL bool
+}
+
+type filePatch struct {
+	oldName string
+	newName string
+	hunks   []patchHunk
+}
+
+// parsePatch parses unified diff of one or more files, lines outside of file patches such as
+// 'diff --git' and commit messages are ignored.
+func parsePatch(content string) ([]filePatch, error) {
+	lines := splitDiffLines(strings.Replace(content, "\r\n", "\n", -1))
+	var patches []filePatch
+	for i := 0; i < len(lines); i++ {
+		if !strings.HasPrefix(lines[i], "--- ") || i+1 >= len(lines) || !strings.HasPrefix(lines[i+1], "+++ ") {
+			continue
+		}
+		fp := filePatch{
+			oldName: patchFileName(lines[i][4:]),
+			newName: patchFileName(lines[i+1][4:]),
+		}
+		i += 2
+		for i < len(lines) && strings.HasPrefix(lines[i], "@@ ") {
+			hunk, next, err := parseHunk(lines, i)
+			if err != nil {
+				return nil, err
+			}
+			fp.hunks = append(fp.hunks, hunk)
+			i = next
+		}
+		if len(fp.hunks) == 0 {
+			return nil, fmt.Errorf("no hunks for file: %s", fp.newName)
+		}
+		// 'diff -N' uses file names with epoch time instead of /dev/null
+		if h := fp.hunks[0]; len(fp.hunks) == 1 {
+			if h.oldStart == 0 && len(h.oldLines) == 0 {
+				fp.oldName = devNull
+			}
+			if h.newStart == 0 && len(h.newLines) == 0 {
+				fp.newName = devNull
+			}
+		}
+		patches = append(patches, fp)
+		i--
+	}
+	if len(patches) == 0 {
+		return nil, fmt.Errorf("no file patches found")
+	}
+	return patches, nil
+}
+
+// patchFileName removes timestamp after tab from file name of '---'/'+++' line.
+func patchFileName(s string) string {
+	if i := strings.IndexByte(s, '\t'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(stringUnquote(strings.TrimSpace(s)))
+}
+
+// parseHunk parses hunk begins at lines[i], returns index of line after hunk.
+func parseHunk(lines []string, i int) (patchHunk, int, error) {
+	hunk := patchHunk{header: lines[i]}
+	fields := strings.Fields(lines[i])
+	if len(fields) < 4 || fields[3] != "@@" {
+		return hunk, 0, fmt.Errorf("invalid hunk header: %s", lines[i])
+	}
+	oldStart, oldCount, err1 := parseHunkRange(fields[1], "-")
+	newStart, newCount, err2 := parseHunkRange(fields[2], "+")
+	if err1 != nil || err2 != nil {
+		return hunk, 0, fmt.Errorf("invalid hunk header: %s", lines[i])
+	}
+	hunk.oldStart = oldStart
+	hunk.newStart = newStart
+	var last byte
+	for i++; i < len(lines) && (len(hunk.oldLines) < oldCount || len(hunk.newLines) < newCount || strings.HasPrefix(lines[i], "\\")); i++ {
+		line := lines[i]
+		if line == "" {
+			// some editors trim trailing space of empty context lines
+			line = " "
+		}
+		switch line[0] {
+		case ' ':
+			hunk.oldLines = append(hunk.oldLines, line[1:])
+			hunk.newLines = append(hunk.newLines, line[1:])
+		case '-':
+			hunk.oldLines = append(hunk.oldLines, line[1:])
+		case '+':
+			hunk.newLines = append(hunk.newLines, line[1:])
+		case '\\':
+			switch last {
+			case ' ':
+				hunk.oldNoEOL = true
+				hunk.newNoEOL = true
+			case '-':
+				hunk.oldNoEOL = true
+			case '+':
+				hunk.newNoEOL = true
+			}
+			continue
+		default:
+			return hunk, 0, fmt.Errorf("invalid hunk line: %s", line)
+		}
+		last = line[0]
+	}
+	if len(hunk.oldLines) != oldCount || len(hunk.newLines) != newCount {
+		return hunk, 0, fmt.Errorf("hunk is truncated: %s", hunk.header)
+	}
+	return hunk, i, nil
+}
+
+func parseHunkRange(s, prefix string) (start, count int, err error) {
+	if !strings.HasPrefix(s, prefix) {
+		return 0, 0, fmt.Errorf("invalid range: %s", s)
+	}
+	s = s[len(prefix):]
+	count = 1
+	if i := strings.IndexByte(s, ','); i >= 0 {
+		count, err = strconv.Atoi(s[i+1:])
+		if err != nil {
+			return 0, 0, err
+		}
+		s = s[:i]
+	}
+	start, err = strconv.Atoi(s)
+	return start, count, err
+}
+
+// stripPatchPath removes leading path components like 'patch -p', name is unchanged if strip is 0.
+func stripPatchPath(name string, strip int) string {
+	if strip <= 0 {
+		return name
+	}
+	parts := strings.SplitN(name, "/", strip+1)
+	return parts[len(parts)-1]
+}
+
+// findLines returns index of sub in lines beginning from start, the position nearest to hint is preferred.
+func findLines(lines, sub []string, start, hint int) int {
+	matches := func(at int) bool {
+		if at < start || at+len(sub) > len(lines) {
+			return false
+		}
+		for i := range sub {
+			if lines[at+i] != sub[i] {
+				return false
+			}
+		}
+		return true
+	}
+	if hint < start {
+		hint = start
+	}
+	for offset := 0; hint-offset >= start || hint+offset <= len(lines); offset++ {
+		if matches(hint + offset) {
+			return hint + offset
+		}
+		if offset > 0 && matches(hint-offset) {
+			return hint - offset
+		}
+	}
+	return -1
+}
+
+// applyHunks applies hunks to file content in order.
+func applyHunks(content string, hunks []patchHunk) (string, error) {
+	lines := splitDiffLines(content)
+	eol := content == "" || strings.HasSuffix(content, "\n")
+	var (
+		result []string
+		pos    int
+		delta  int
+	)
+	for i, h := range hunks {
+		hint := h.oldStart - 1 + delta
+		if len(h.oldLines) == 0 {
+			hint = h.oldStart + delta
+		}
+		at := findLines(lines, h.oldLines, pos, hint)
+		if at < 0 {
+			return "", fmt.Errorf("hunk #%d rejected, context mismatched: %s", i+1, h.header)
+		}
+		result = append(result, lines[pos:at]...)
+		result = append(result, h.newLines...)
+		pos = at + len(h.oldLines)
+		delta += len(h.newLines) - len(h.oldLines)
+		if pos == len(lines) {
+			switch {
+			case h.newNoEOL:
+				eol = false
+			case h.oldNoEOL:
+				eol = true
+			}
+		}
+	}
+	result = append(result, lines[pos:]...)
+	if len(result) == 0 {
+		return "", nil
+	}
+	s := strings.Join(result, "\n")
+	if eol {
+		s += "\n"
+	}
+	return s, nil
+}
+
+// reverseHunks returns hunks undoing the patch, used to detect patch already applied.
+func reverseHunks(hunks []patchHunk) []patchHunk {
+	reversed := make([]patchHunk, len(hunks))
+	var delta int
+	for i, h := range hunks {
+		reversed[i] = patchHunk{
+			header:   h.header,
+			oldStart: h.oldStart + delta,
+			oldLines: h.newLines,
+			newLines: h.oldLines,
+			oldNoEOL: h.newNoEOL,
+			newNoEOL: h.oldNoEOL,
+		}
+		delta += len(h.newLines) - len(h.oldLines)
+	}
+	return reversed
+}
+
+type patchResult struct {
+	path    string
+	content string
+	remove  bool
+	// patch has been applied before, file is unchanged
+	applied bool
+}
+
+// patchFilePath joins dir and file name of patch, names escaping dir are refused.
+func patchFilePath(dir, name string) (string, error) {
+	if name == "" || path.IsAbs(name) || filepath.IsAbs(filepath.FromSlash(name)) {
+		return "", fmt.Errorf("invalid file name in patch: %s", name)
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(absDir, filepath.FromSlash(name))
+	if p == absDir || !isSubPath(absDir, p) {
+		return "", fmt.Errorf("file is outside of patch directory: %s", name)
+	}
+	return p, nil
+}
+
+// applyFilePatch computes patched content of file, it doesn't write file.
+func applyFilePatch(dir string, fp filePatch, strip int) (patchResult, error) {
+	name := fp.newName
+	if name == devNull {
+		name = fp.oldName
+	}
+	name = stripPatchPath(name, strip)
+	file, err := patchFilePath(dir, name)
+	if err != nil {
+		return patchResult{}, err
+	}
+	result := patchResult{path: file}
+
+	content, err := ioutil.ReadFile(result.path)
+	exist := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return result, err
+	}
+	switch {
+	case fp.oldName == devNull:
+		if !exist {
+			result.content, err = applyHunks("", fp.hunks)
+			return result, err
+		}
+	case fp.newName == devNull:
+		if !exist {
+			result.applied = true
+			return result, nil
+		}
+		_, err = applyHunks(string(content), fp.hunks)
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", name, err)
+		}
+		result.remove = true
+		return result, nil
+	default:
+		if !exist {
+			return result, fmt.Errorf("file not found: %s", name)
+		}
+		result.content, err = applyHunks(string(content), fp.hunks)
+		if err == nil {
+			return result, nil
+		}
+	}
+	// check whether patch has been applied by reversing it, created file should be reversed to empty
+	if origin, rerr := applyHunks(string(content), reverseHunks(fp.hunks)); rerr == nil && (fp.oldName != devNull || origin == "") {
+		result.applied = true
+		return result, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("file already exists")
+	}
+	return result, fmt.Errorf("%s: %w", name, err)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testPatch = `diff --git a/greet.txt b/greet.txt
+--- a/greet.txt
++++ b/greet.txt
+@@ -1,3 +1,3 @@
+ hello
+-world
++tash
+ bye
+`
+
+func TestPatchAction(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"fix.patch":     testPatch,
+		"src/greet.txt": "hello\nworld\nbye\n",
+		"bad/greet.txt": "hello\nthere\nbye\n",
+		"tash.yaml": `
+tasks:
+  apply:
+    actions:
+      - patch: {file: fix.patch, dir: src, strip: 1}
+  reject:
+    actions:
+      - patch: {file: fix.patch, dir: bad, strip: 1}
+  p0:
+    actions:
+      - patch: {file: fix.patch, dir: src}
+`,
+	})
+	if failure := runTestTask(t, dir, "apply"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "src/greet.txt"); content != "hello\ntash\nbye\n" {
+		t.Fatalf("patched content: %q", content)
+	}
+	if failure := runTestTask(t, dir, "apply"); failure != "" {
+		t.Errorf("applying patch again should be no-op: %s", failure)
+	}
+	if content := readTestFile(t, dir, "src/greet.txt"); content != "hello\ntash\nbye\n" {
+		t.Errorf("content changed after patched again: %q", content)
+	}
+	if failure := runTestTask(t, dir, "reject"); !strings.Contains(failure, "rejected") {
+		t.Errorf("mismatched hunk should be rejected: %q", failure)
+	}
+	if content := readTestFile(t, dir, "bad/greet.txt"); content != "hello\nthere\nbye\n" {
+		t.Errorf("rejected file is changed: %q", content)
+	}
+	if failure := runTestTask(t, dir, "p0"); !strings.Contains(failure, "b/greet.txt") {
+		t.Errorf("prefix shouldn't be stripped without strip: %q", failure)
+	}
+}
+
+func TestPatchFileOutsideDir(t *testing.T) {
+	dir := testDir(t, map[string]string{"src/a.txt": "a\n"})
+	for _, name := range []string{"../a.txt", "src/../../a.txt", "/etc/passwd", ".", ""} {
+		fp := filePatch{oldName: name, newName: name, hunks: []patchHunk{{oldStart: 1, newStart: 1, oldLines: []string{"a"}, newLines: []string{"b"}}}}
+		if _, err := applyFilePatch(dir+"/src", fp, 0); err == nil {
+			t.Errorf("file name escaping dir should be refused: %q", name)
+		}
+	}
+	fp := filePatch{oldName: "x/../a.txt", newName: "x/../a.txt", hunks: []patchHunk{{oldStart: 1, newStart: 1, oldLines: []string{"a"}, newLines: []string{"b"}}}}
+	result, err := applyFilePatch(dir+"/src", fp, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.content != "b\n" {
+		t.Errorf("patched content: %q", result.content)
+	}
+}
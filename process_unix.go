@@ -0,0 +1,40 @@
+// +build linux darwin freebsd
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"syscall"
+)
+
+// processRunning checks whether process exists by sending signal 0, exited but unwaited background
+// commands are zombies, they are detected by process state on linux.
+func processRunning(pid int) (bool, error) {
+	err := syscall.Kill(pid, 0)
+	switch err {
+	case nil, syscall.EPERM:
+		return !processZombie(pid), nil
+	case syscall.ESRCH:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// processZombie reads state from /proc/PID/stat, it returns false if procfs isn't available.
+func processZombie(pid int) bool {
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// format: 'pid (comm) state ...', comm may contain spaces and parentheses
+	stat := string(content)
+	i := strings.LastIndexByte(stat, ')')
+	if i < 0 {
+		return false
+	}
+	fields := strings.Fields(stat[i+1:])
+	return len(fields) > 0 && fields[0] == "Z"
+}
@@ -0,0 +1,28 @@
+// +build windows
+
+package main
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// stillActive is the exit code of running process
+const stillActive = 259
+
+// processRunning checks whether process exists and hasn't exited.
+func processRunning(pid int) (bool, error) {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		if err == windows.ERROR_INVALID_PARAMETER {
+			return false, nil
+		}
+		return false, err
+	}
+	defer windows.CloseHandle(h)
+	var code uint32
+	err = windows.GetExitCodeProcess(h, &code)
+	if err != nil {
+		return false, err
+	}
+	return code == stillActive, nil
+}
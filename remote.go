@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uiez/tash/syntax"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const defaultRemoteTimeout = 10000
+
+// defaultIdentityFiles are tried if identity file is not specified
+var defaultIdentityFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// remoteHost runs commands over ssh, the connection is established at first command and shared by
+// commands of the task.
+type remoteHost struct {
+	syntax.TaskHost
+	password func() (string, error)
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+func newRemoteHost(h syntax.TaskHost, password func() (string, error)) (*remoteHost, error) {
+	if i := strings.LastIndex(h.Address, "@"); i >= 0 {
+		if h.User == "" {
+			h.User = h.Address[:i]
+		}
+		h.Address = h.Address[i+1:]
+	}
+	if h.Address == "" {
+		return nil, fmt.Errorf("remote host address is empty")
+	}
+	if _, _, err := net.SplitHostPort(h.Address); err != nil {
+		h.Address = net.JoinHostPort(h.Address, "22")
+	}
+	if h.User == "" {
+		u, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("get current user failed: %w", err)
+		}
+		h.User = u.Username
+	}
+	if h.Timeout == 0 {
+		h.Timeout = defaultRemoteTimeout
+	}
+	return &remoteHost{TaskHost: h, password: password}, nil
+}
+
+func (h *remoteHost) authMethods() ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	identities := []string{h.IdentityFile}
+	if h.IdentityFile == "" {
+		identities = nil
+		if home, err := os.UserHomeDir(); err == nil {
+			for _, name := range defaultIdentityFiles {
+				identities = append(identities, filepath.Join(home, ".ssh", name))
+			}
+		}
+	}
+	for _, file := range identities {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			if h.IdentityFile == "" && os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("read identity file failed: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(content)
+		if err != nil {
+			return nil, fmt.Errorf("parse identity file failed: %s, %w", file, err)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	if h.PasswordSecret != "" {
+		methods = append(methods, ssh.PasswordCallback(h.password))
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no ssh auth methods available, specify identity file or password secret")
+	}
+	return methods, nil
+}
+
+func (h *remoteHost) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if h.InsecureIgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	file := h.KnownHostsFile
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("get home directory failed: %w", err)
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(file)
+	if err != nil {
+		return nil, fmt.Errorf("read known hosts failed: %w", err)
+	}
+	return callback, nil
+}
+
+func (h *remoteHost) connect() (*ssh.Client, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.client != nil {
+		return h.client, nil
+	}
+	auth, err := h.authMethods()
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := h.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+	client, err := ssh.Dial("tcp", h.Address, &ssh.ClientConfig{
+		User:            h.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         time.Duration(h.Timeout) * time.Millisecond,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("connect %s failed: %w", h.Address, err)
+	}
+	h.client = client
+	return client, nil
+}
+
+func (h *remoteHost) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.client != nil {
+		h.client.Close()
+		h.client = nil
+	}
+}
+
+// localOnlyEnvs describe local machine, they are meaningless on remote host and not exported.
+var localOnlyEnvs = map[string]bool{
+	"PATH":                              true,
+	syntax.BUILTIN_ENV_WORKDIR:          true,
+	syntax.BUILTIN_ENV_HOST_OS:          true,
+	syntax.BUILTIN_ENV_HOST_ARCH:        true,
+	syntax.BUILTIN_ENV_PATHLISTSEP:      true,
+	syntax.BUILTIN_ENV_LAST_COMMAND_PID: true,
+}
+
+// checkRemoteEnvs refuses passing secrets to remote command, exported environments are visible in
+// command line of remote shell.
+func checkRemoteEnvs(envs *ExpandEnvs) error {
+	for name := range envs.secrets {
+		if _, has := envs.envs[name]; has {
+			return fmt.Errorf("secret couldn't be passed to command on remote host: %s", name)
+		}
+	}
+	return nil
+}
+
+// script builds shell command line run by remote shell, arguments are quoted, sections are piped.
+// environments declared or passed to command are exported, they are detected by differing from local
+// environments, local only environments and secrets are excluded.
+func (h *remoteHost) script(envs *ExpandEnvs, sections [][]string, cmdDir string) string {
+	var names []string
+	for k, v := range envs.envs {
+		if localOnlyEnvs[k] || envs.secrets[k] {
+			continue
+		}
+		if hv, has := os.LookupEnv(k); has && hv == v {
+			continue
+		}
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var buf strings.Builder
+	if len(names) > 0 {
+		buf.WriteString("export")
+		for _, name := range names {
+			buf.WriteString(" " + name + "=" + shellQuote(envs.envs[name]))
+		}
+		buf.WriteString(" && ")
+	}
+	dir := stringToSlash(cmdDir)
+	if dir != "" && !path.IsAbs(dir) && h.Dir != "" {
+		dir = path.Join(h.Dir, dir)
+	} else if dir == "" {
+		dir = h.Dir
+	}
+	if dir != "" {
+		buf.WriteString("cd " + shellQuote(dir) + " && ")
+	}
+	for i, args := range sections {
+		if i > 0 {
+			buf.WriteString(" | ")
+		}
+		for j, arg := range args {
+			if j > 0 {
+				buf.WriteString(" ")
+			}
+			buf.WriteString(shellQuote(arg))
+		}
+	}
+	return buf.String()
+}
+
+// run executes command on remote host, exit status of remote command is returned as error.
+// session is closed if command doesn't exit before timeout, 0 for no limit.
+func (h *remoteHost) run(envs *ExpandEnvs, sections [][]string, cmdDir string, fds commandFds, timeout time.Duration) error {
+	client, err := h.connect()
+	if err != nil {
+		return err
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("create ssh session failed: %w", err)
+	}
+	defer session.Close()
+
+	session.Stdin = fds.Stdin
+	session.Stdout = fds.Stdout
+	session.Stderr = fds.Stderr
+	if session.Stdout == nil {
+		session.Stdout = os.Stdout
+	}
+	if session.Stderr == nil {
+		session.Stderr = os.Stderr
+	}
+	var timedOut int32
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			session.Signal(ssh.SIGKILL)
+			session.Close()
+		})
+		defer timer.Stop()
+	}
+	err = session.Run(h.script(envs, sections, cmdDir))
+	if err != nil && atomic.LoadInt32(&timedOut) != 0 {
+		return fmt.Errorf("remote command timeout after %s", timeout)
+	}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("remote command failed: exit status %d", exitErr.ExitStatus())
+	}
+	return err
+}
+
+// shellQuote quotes string for posix shell if it contains special characters.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(c rune) bool {
+		return !(isAlphaNum(c) || strings.ContainsRune("-_./:=@%+,", c))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// remoteOutput runs command on remote host and returns trimmed stdout.
+func (h *remoteHost) output(envs *ExpandEnvs, sections [][]string, cmdDir string, timeout time.Duration) (string, error) {
+	var buf bytes.Buffer
+	err := h.run(envs, sections, cmdDir, commandFds{Stdout: &buf}, timeout)
+	return strings.TrimSpace(buf.String()), err
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestRemoteScriptEnvs(t *testing.T) {
+	home := os.Getenv("HOME")
+	envs := testEnvs(t, "HOME="+home, "APP=demo", "WORKDIR=/local/dir", "HOST_OS=linux")
+	envs.secrets = map[string]bool{"TOKEN": true}
+
+	h := &remoteHost{}
+	script := h.script(envs, [][]string{{"echo", "hi"}}, "/srv")
+	if want := "export APP=" + shellQuote("demo") + " && cd /srv && echo hi"; script != want {
+		t.Errorf("script: %q, want %q", script, want)
+	}
+	if err := checkRemoteEnvs(envs); err != nil {
+		t.Errorf("unpassed secret shouldn't be refused: %s", err)
+	}
+
+	envs.set("TOKEN", "secret")
+	if script := h.script(envs, [][]string{{"echo", "hi"}}, ""); strings.Contains(script, "secret") {
+		t.Errorf("secret is exported: %q", script)
+	}
+	if err := checkRemoteEnvs(envs); err == nil {
+		t.Error("secret passed to remote command should be refused")
+	}
+}
+
+// testSshServer accepts public key of clientKey and runs exec requests by local sh, it returns address.
+func testSshServer(t *testing.T, hostKey ssh.Signer, clientKey ssh.PublicKey) (string, func()) {
+	t.Helper()
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown public key")
+		},
+	}
+	config.AddHostKey(hostKey)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSsh(conn, config)
+		}
+	}()
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+func serveTestSsh(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unsupported channel")
+			continue
+		}
+		ch, reqs, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			for req := range reqs {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				var payload struct{ Command string }
+				ssh.Unmarshal(req.Payload, &payload)
+				req.Reply(true, nil)
+
+				cmd := exec.Command("sh", "-c", payload.Command)
+				cmd.Stdin, cmd.Stdout, cmd.Stderr = ch, ch, ch.Stderr()
+				var status struct{ Status uint32 }
+				if err := cmd.Run(); err != nil {
+					status.Status = 255
+					if exitErr, ok := err.(*exec.ExitError); ok {
+						status.Status = uint32(exitErr.ExitCode())
+					}
+				}
+				ch.SendRequest("exit-status", false, ssh.Marshal(&status))
+				return
+			}
+		}()
+	}
+}
+
+func TestRemoteHostRunsCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	newKey := func() (ssh.Signer, []byte) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signer, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	}
+	hostKey, _ := newKey()
+	clientKey, clientPem := newKey()
+	addr, stop := testSshServer(t, hostKey, clientKey.PublicKey())
+	defer stop()
+
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Unsetenv("SSH_AUTH_SOCK")
+	remoteDir := testDir(t, nil)
+	dir := testDir(t, map[string]string{
+		"id_test":     string(clientPem),
+		"known_hosts": knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostKey.PublicKey()) + "\n",
+		"tash.yaml": `
+tasks:
+  main:
+    host:
+      address: tester@` + addr + `
+      identityFile: id_test
+      knownHostsFile: known_hosts
+      dir: ` + remoteDir + `
+    actions:
+      - env: ["GREETING=hello remote"]
+      - cmd: {exec: "printenv GREETING", stdout: out.txt}
+      - cmd: {exec: "pwd", stdout: pwd.txt}
+  failed:
+    host: {address: ` + addr + `, identityFile: id_test, knownHostsFile: known_hosts}
+    actions:
+      - cmd: {exec: sh -c "exit 3"}
+`,
+	})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "out.txt"); content != "hello remote\n" {
+		t.Errorf("output of remote command: %q", content)
+	}
+	if content := strings.TrimSpace(readTestFile(t, dir, "pwd.txt")); content != remoteDir {
+		t.Errorf("remote command directory: %q, want %q", content, remoteDir)
+	}
+	if failure := runTestTask(t, dir, "failed"); !strings.Contains(failure, "exit status 3") {
+		t.Errorf("exit code of remote command isn't propagated: %q", failure)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/uiez/tash/syntax"
+)
+
+const (
+	defaultRetryDelay      = 1000
+	defaultRetryMultiplier = 2
+)
+
+// lockedRand is a random source safe for concurrent use, such as retries in parallel loops.
+type lockedRand struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{rand: rand.New(rand.NewSource(seed))}
+}
+
+// int63n returns random number in [0, n], n should not be negative.
+func (r *lockedRand) int63n(n int64) int64 {
+	if n <= 0 {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rand.Int63n(n + 1)
+}
+
+var retryRand = newLockedRand(time.Now().UnixNano())
+
+type retryPolicy struct {
+	syntax.Retry
+	rand *lockedRand
+}
+
+func newRetryPolicy(retry syntax.Retry, rand *lockedRand) (retryPolicy, error) {
+	switch retry.Jitter {
+	case "", syntax.RetryJitterNone, syntax.RetryJitterFull, syntax.RetryJitterEqual:
+	default:
+		return retryPolicy{}, fmt.Errorf("invalid retry jitter: %s", retry.Jitter)
+	}
+	if retry.Times < 0 {
+		return retryPolicy{}, fmt.Errorf("invalid retry times: %d", retry.Times)
+	}
+	if retry.Multiplier != 0 && retry.Multiplier < 1 {
+		return retryPolicy{}, fmt.Errorf("invalid retry multiplier: %v", retry.Multiplier)
+	}
+	if retry.Delay == 0 {
+		retry.Delay = defaultRetryDelay
+	}
+	if retry.Multiplier == 0 {
+		retry.Multiplier = defaultRetryMultiplier
+	}
+	return retryPolicy{Retry: retry, rand: rand}, nil
+}
+
+// backoff returns delay before n-th retry without jitter, n begins at 1.
+func (p retryPolicy) backoff(n int) time.Duration {
+	ms := float64(p.Delay) * math.Pow(p.Multiplier, float64(n-1))
+	if p.MaxDelay > 0 && ms > float64(p.MaxDelay) {
+		ms = float64(p.MaxDelay)
+	}
+	if ms > float64(math.MaxInt64/int64(time.Millisecond)) {
+		ms = float64(math.MaxInt64 / int64(time.Millisecond))
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// delay returns jittered delay before n-th retry:
+// none: backoff; full: random in [0, backoff]; equal: backoff/2 plus random in [0, backoff/2].
+func (p retryPolicy) delay(n int) time.Duration {
+	d := p.backoff(n)
+	switch p.Jitter {
+	case syntax.RetryJitterFull:
+		return time.Duration(p.rand.int63n(int64(d)))
+	case syntax.RetryJitterEqual:
+		half := d / 2
+		return d - half + time.Duration(p.rand.int63n(int64(half)))
+	default:
+		return d
+	}
+}
+
+// permanentError stops retrying, the wrapped error is returned.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// retryLoop runs fn until it succeeded or wait reports no more attempts, wait returns delay before next
+// attempt after n-th attempt failed. attempts count and the last error are returned.
+func retryLoop(fn func(n int) error, wait func(n int, err error) (time.Duration, bool)) (int, error) {
+	for n := 1; ; n++ {
+		err := fn(n)
+		if err == nil {
+			return n, nil
+		}
+		var perm permanentError
+		if errors.As(err, &perm) {
+			return n, perm.err
+		}
+		d, ok := wait(n, err)
+		if !ok {
+			return n, err
+		}
+		time.Sleep(d)
+	}
+}
+
+// withRetry runs fn until it succeeded or retry times exhausted, the last error is returned.
+func (r *runner) withRetry(retry syntax.Retry, fn func() error) error {
+	policy, err := newRetryPolicy(retry, retryRand)
+	if err != nil {
+		return err
+	}
+	_, err = retryLoop(func(int) error {
+		return fn()
+	}, func(n int, err error) (time.Duration, bool) {
+		if n > policy.Times {
+			return 0, false
+		}
+		d := policy.delay(n)
+		r.warnln(fmt.Sprintf("attempt %d failed: %s, retry after %s", n, err, d.Round(time.Millisecond)))
+		return d, true
+	})
+	return err
+}
+
+// poll runs fn at interval until it succeeded or timeout, fn is given time remaining before timeout to
+// bound the attempt, no more attempt is made if remaining time is not more than interval.
+// attempts count and the last error are returned.
+func poll(interval, timeout time.Duration, fn func(n int, remain time.Duration) error) (int, error) {
+	deadline := time.Now().Add(timeout)
+	return retryLoop(func(n int) error {
+		return fn(n, time.Until(deadline))
+	}, func(n int, err error) (time.Duration, bool) {
+		if time.Until(deadline) <= interval {
+			return 0, false
+		}
+		return interval, true
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/uiez/tash/syntax"
+)
+
+func TestWithRetry(t *testing.T) {
+	r := newRunner(nil, testLogger(t), newConfiguration(false))
+	var calls int
+	err := r.withRetry(syntax.Retry{Times: 2, Delay: 1}, func() error {
+		calls++
+		return errors.New("failed")
+	})
+	if err == nil || calls != 3 {
+		t.Errorf("retry times: calls %d, err %v", calls, err)
+	}
+
+	calls = 0
+	err = r.withRetry(syntax.Retry{Times: 2, Delay: 1}, func() error {
+		calls++
+		return permanentError{errors.New("permanent")}
+	})
+	if err == nil || err.Error() != "permanent" || calls != 1 {
+		t.Errorf("permanent error: calls %d, err %v", calls, err)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	attempts, err := poll(time.Millisecond, time.Second, func(n int, remain time.Duration) error {
+		if remain <= 0 || remain > time.Second {
+			t.Errorf("remaining time of attempt %d: %s", n, remain)
+		}
+		if n < 3 {
+			return errors.New("not ready")
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("succeeded after %d attempts: %v", attempts, err)
+	}
+
+	start := time.Now()
+	attempts, err = poll(10*time.Millisecond, 50*time.Millisecond, func(n int, remain time.Duration) error {
+		return errors.New("not ready")
+	})
+	if err == nil || attempts < 2 {
+		t.Errorf("timeout after %d attempts: %v", attempts, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("poll doesn't stop at timeout: %s", elapsed)
+	}
+}
+
+func TestRetryDelayJitter(t *testing.T) {
+	retry := syntax.Retry{Times: 5, Delay: 100, Multiplier: 2, MaxDelay: 500}
+	none, err := newRetryPolicy(retry, newLockedRand(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, want := range []time.Duration{100, 200, 400, 500, 500} {
+		if d := none.delay(n + 1); d != want*time.Millisecond {
+			t.Errorf("delay of retry %d: %s, want %s", n+1, d, want*time.Millisecond)
+		}
+	}
+
+	for _, jitter := range []string{syntax.RetryJitterFull, syntax.RetryJitterEqual} {
+		retry.Jitter = jitter
+		p, err := newRetryPolicy(retry, newLockedRand(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var delays []time.Duration
+		for i := 0; i < 100; i++ {
+			n := i%5 + 1
+			d, backoff := p.delay(n), p.backoff(n)
+			min := time.Duration(0)
+			if jitter == syntax.RetryJitterEqual {
+				min = backoff - backoff/2
+			}
+			if d < min || d > backoff {
+				t.Errorf("%s jitter delay of retry %d: %s, want in [%s, %s]", jitter, n, d, min, backoff)
+			}
+			delays = append(delays, d)
+		}
+		// same seed produces same delays
+		p.rand = newLockedRand(1)
+		for i, want := range delays {
+			if d := p.delay(i%5 + 1); d != want {
+				t.Errorf("%s jitter isn't deterministic with seed: %s, want %s", jitter, d, want)
+				break
+			}
+		}
+	}
+
+	retry.Jitter = "random"
+	if _, err := newRetryPolicy(retry, newLockedRand(1)); err == nil {
+		t.Error("invalid jitter should be refused")
+	}
+}
+
+func TestRetryCapturesLastAttempt(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	dir := testDir(t, map[string]string{
+		"flaky.sh": "if [ -f failed ]; then echo succeeded; echo warn >&2; else touch failed; echo failed; echo broken >&2; exit 1; fi\n",
+		"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - cmd:
+          exec: sh flaky.sh
+          stdoutEnv: OUT
+          stderrEnv: ERR
+          retry: {times: 2, delay: 1}
+      - echo: {content: "${OUT}|${ERR}", file: out.txt}
+`,
+	})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "out.txt"); content != "succeeded|warn" {
+		t.Errorf("outputs of failed attempts should be dropped: %q", content)
+	}
+}
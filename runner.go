@@ -1,19 +1,30 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/fatih/color"
+	"github.com/mattn/go-isatty"
 	"github.com/mitchellh/go-ps"
 	"github.com/uiez/tash/syntax"
 )
@@ -24,7 +35,7 @@ type indentLogger struct {
 	hideLog    bool
 	allowError bool
 
-	exit func()
+	exit func(msg string)
 }
 
 func newLogger(debug bool) indentLogger {
@@ -53,11 +64,16 @@ func (w indentLogger) silent(hideLog, allowError bool) indentLogger {
 	return nw
 }
 
+// logMu keeps lines of concurrent runners from interleaving
+var logMu sync.Mutex
+
 func (w indentLogger) print(fg color.Attribute, out io.Writer, v ...interface{}) {
 	if !w.hideLog || w.debug {
-		fmt := color.New(fg)
-		_, _ = fmt.Fprint(out, w.indent)
-		_, _ = fmt.Fprintln(out, v...)
+		logMu.Lock()
+		defer logMu.Unlock()
+		c := color.New(fg)
+		_, _ = c.Fprint(out, w.indent)
+		_, _ = c.Fprint(out, maskSecrets(fmt.Sprintln(v...)))
 	}
 }
 
@@ -65,7 +81,7 @@ func (w indentLogger) fatalln(v ...interface{}) {
 	w.print(color.FgHiRed, os.Stderr, v...)
 	if !w.allowError {
 		if w.exit != nil {
-			w.exit()
+			w.exit(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
 		} else {
 			os.Exit(1)
 		}
@@ -120,13 +136,102 @@ func listTasks(configs *Configuration, log indentLogger, taskNames []string, sho
 					if arg.Default != "" {
 						alog.infoln(fmt.Sprintf("  default: '%s'", arg.Default))
 					}
+					if len(arg.Allowed) > 0 {
+						alog.infoln(fmt.Sprintf("  allowed: [%s]", strings.Join(arg.Allowed, ", ")))
+					}
+					if arg.Regexp != "" {
+						alog.infoln(fmt.Sprintf("  pattern: '%s'", arg.Regexp))
+					}
 				}
 			}
 		}
 	}
 }
 
-func runTasks(configs *Configuration, log indentLogger, names []string, args []string) {
+// taskCall is a task to run with positional arguments from command line.
+type taskCall struct {
+	name string
+	args []string
+}
+
+// parseTaskCalls splits command line words into tasks and their positional arguments, word naming
+// a task always starts a new task, other words are positional arguments of the preceding task.
+// values equal to task names should be passed by '--args'.
+func parseTaskCalls(configs *Configuration, words []string) ([]taskCall, error) {
+	var calls []taskCall
+	for _, w := range words {
+		if _, has := configs.Tasks[w]; has {
+			calls = append(calls, taskCall{name: w})
+			continue
+		}
+		if len(calls) == 0 {
+			return nil, fmt.Errorf("task not found: %s", w)
+		}
+		last := &calls[len(calls)-1]
+		if len(last.args) >= len(configs.Tasks[last.name].Args) {
+			return nil, fmt.Errorf("task not found or too many positional arguments of task %s: %s", last.name, w)
+		}
+		last.args = append(last.args, w)
+	}
+	return calls, nil
+}
+
+const (
+	outputsFormatJson = "json"
+	outputsFormatEnv  = "env"
+)
+
+// taskOutputs writes environments designated by Task.Outputs of all tasks to file,
+// latter tasks overwrite former ones with same env name.
+type taskOutputs struct {
+	File   string
+	Format string
+
+	values map[string]string
+}
+
+func (o *taskOutputs) write() error {
+	var buf bytes.Buffer
+	switch o.Format {
+	case "", outputsFormatJson:
+		if o.values == nil {
+			o.values = make(map[string]string)
+		}
+		content, err := json.MarshalIndent(o.values, "", "  ")
+		if err != nil {
+			return err
+		}
+		buf.Write(content)
+		buf.WriteByte('\n')
+	case outputsFormatEnv:
+		var keys []string
+		for k := range o.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := o.values[k]
+			if strings.ContainsAny(v, "\r\n") {
+				return fmt.Errorf("multi-line value isn't supported in env format: %s", k)
+			}
+			buf.WriteString(k + "=" + v + "\n")
+		}
+	default:
+		return fmt.Errorf("invalid outputs format: %s", o.Format)
+	}
+	fd, err := openFile(o.File, false, defaultFileMode)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(buf.Bytes())
+	// outputs are consumed by later ci steps, it's written once and always flushed to disk.
+	if err1 := closeFile(fd, true); err == nil {
+		err = err1
+	}
+	return err
+}
+
+func runTasks(configs *Configuration, log indentLogger, names []string, args []string, profile string, outputs taskOutputs, timings *taskTimings) {
 	if len(names) == 0 {
 		log.fatalln("no tasks to run")
 		return
@@ -136,33 +241,112 @@ func runTasks(configs *Configuration, log indentLogger, names []string, args []s
 		log.fatalln("get current directory failed:", err)
 		return
 	}
-	for _, name := range names {
-		_, has := configs.Tasks[name]
-		if !has {
-			log.fatalln("task not found:", name)
+	calls, err := parseTaskCalls(configs, names)
+	if err != nil {
+		log.fatalln(err)
+		return
+	}
+
+	if _, has := configs.Profiles[profile]; profile != "" && !has {
+		var available []string
+		for name := range configs.Profiles {
+			available = append(available, name)
+		}
+		sort.Strings(available)
+		log.fatalln(fmt.Sprintf("profile not found: %s, available: [%s]", profile, strings.Join(available, ", ")))
+		return
+	}
+
+	switch outputs.Format {
+	case "", outputsFormatJson, outputsFormatEnv:
+	default:
+		log.fatalln("invalid outputs format:", outputs.Format)
+		return
+	}
+	if outputs.File != "" {
+		outputs.File, err = filepath.Abs(outputs.File)
+		if err != nil {
+			log.fatalln("get outputs file path failed:", err)
 			return
 		}
 	}
 
 	r := newRunner(nil, log, configs)
 	r.globalArgs = args
-	for i, name := range names {
+	r.profile = profile
+	r.outputs = &outputs
+	r.backgrounds = newBackgroundRegistry()
+	r.stdin = os.Stdin
+	if timings.enabled() {
+		r.timings = timings
+	}
+	for i, call := range calls {
 		if i > 0 {
 			r.infoln() // create new line
 		}
-		r.runTaskByName(name, currDir)
+		r.runTaskByName(call.name, call.args, currDir)
+	}
+	if r.timings != nil {
+		r.timings.report(log)
+	}
+	if outputs.File != "" {
+		err = outputs.write()
+		if err != nil {
+			log.fatalln("write outputs failed:", err)
+		}
 	}
 }
 
 type runner struct {
 	globalArgs []string
+	profile    string
+	dryRun     bool
+	outputs    *taskOutputs
+	timings    *taskTimings
+	// named background commands, set for root runner
+	backgrounds *backgroundRegistry
+	// lines read from stdin by loops, set for root runner
+	stdin      io.Reader
+	stdinOnce  sync.Once
+	stdinLines []string
+	stdinErr   error
 	parent     *runner
 
 	indentLogger
 	configs      *Configuration
 	noExitOnFail bool
+	// base of relative fs paths, inherited from parent if empty
+	pathBase string
+	// template name if runner is created to run template actions
+	template string
+	// task name if runner is created to run task actions
+	task string
+	// container of task, set for each task runner
+	container *containerOptions
+	// remote host of task, set for each task runner
+	remote *remoteHost
+	// secrets of task, set for each task runner
+	secrets *secretStore
+	// completion notifier of task, set for each task runner
+	notifier *taskNotifier
+	// action being run by runner, used to report failed action
+	action *syntax.Action
+	// index of action in its list and name of the list such as 'before' and 'else', empty for main actions.
+	// they identify position of action in retry block together with loop iteration.
+	actionIndex int
+	list        string
+	// 1-based iteration of loop if runner is created for loop iteration
+	iteration int
+	// commands marked once in retry block, set for retry block runner
+	retryBlock *retryBlockState
+	// locks acquired by lock actions, set for each task runner
+	locks *heldLocks
+	// parallel loop of iteration, set for each iteration runner
+	loop *parallelLoop
 
 	failed bool
+	// message of the first failure recorded in scope
+	failure string
 }
 
 func newRunner(parent *runner, log indentLogger, configs *Configuration) *runner {
@@ -183,14 +367,108 @@ func (r *runner) root() *runner {
 	return rt
 }
 
-func (r *runner) doExit() {
-	rt := r.root()
-	rt.failed = true
-	if !rt.noExitOnFail {
+// scope returns the nearest runner that failures are recorded in.
+func (r *runner) scope() *runner {
+	s := r
+	for !s.noExitOnFail && s.parent != nil {
+		s = s.parent
+	}
+	return s
+}
+
+// isolated creates a child runner that records failures itself instead of exiting.
+func (r *runner) isolated() *runner {
+	nr := newRunner(r, r.log(), r.configs)
+	nr.noExitOnFail = true
+	return nr
+}
+
+func (r *runner) doExit(msg string) {
+	s := r.scope()
+	s.failed = true
+	if s.failure == "" {
+		s.failure = msg
+	}
+	// action is recorded before unwinding, notification is sent after task ended in isolated scope.
+	if n := r.taskNotifier(); n != nil {
+		n.recordFailure(r.runningAction())
+	}
+	if !s.noExitOnFail {
+		r.notifyTask(true)
+		if t := r.root().timings; t != nil {
+			t.report(r.root().log())
+		}
 		os.Exit(1)
 	}
 }
 
+// cwdPathPrefix marks a relative path to be resolved against the current working directory
+const cwdPathPrefix = "cwd:"
+
+// taskContainer returns container options of nearest task, nil if not enabled.
+func (r *runner) taskContainer() *containerOptions {
+	for rt := r; rt != nil; rt = rt.parent {
+		if rt.container != nil {
+			if rt.container.Image == "" {
+				return nil
+			}
+			return rt.container
+		}
+	}
+	return nil
+}
+
+// taskRemote returns remote host of nearest task, nil if not enabled.
+func (r *runner) taskRemote() *remoteHost {
+	for rt := r; rt != nil; rt = rt.parent {
+		if rt.remote != nil {
+			if rt.remote.Address == "" {
+				return nil
+			}
+			return rt.remote
+		}
+	}
+	return nil
+}
+
+func (r *runner) basePath() string {
+	for rt := r; rt != nil; rt = rt.parent {
+		if rt.pathBase != "" {
+			return rt.pathBase
+		}
+	}
+	return ""
+}
+
+// resolvePath resolves relative path of fs actions against the chdir directory or task workdir,
+// falling back to the directory of config file the task defined in.
+// paths prefixed by 'cwd:' are resolved against current working directory instead.
+func (r *runner) resolvePath(path string) string {
+	if strings.HasPrefix(path, cwdPathPrefix) {
+		return strings.TrimPrefix(path, cwdPathPrefix)
+	}
+	base := r.basePath()
+	if path == "" || base == "" || filepath.IsAbs(stringFromSlash(path)) {
+		return path
+	}
+	if wd, err := os.Getwd(); err == nil && wd == base {
+		return path
+	}
+	return stringToSlash(filepath.Join(base, stringFromSlash(path)))
+}
+
+func (r *runner) resolvePathPtrs(ptrs ...*string) {
+	for _, p := range ptrs {
+		*p = r.resolvePath(*p)
+	}
+}
+
+func (r *runner) resolvePaths(paths []string) {
+	for i := range paths {
+		paths[i] = r.resolvePath(paths[i])
+	}
+}
+
 func (r *runner) log() indentLogger {
 	return r.indentLogger
 }
@@ -217,8 +495,13 @@ func (r *runner) searchTemplate(name string) (syntax.ActionList, bool) {
 	return tmpl, ok
 }
 
-func (r *runner) createTaskEnvs(name string, task syntax.Task, workDir string) *ExpandEnvs {
+// createTaskEnvs creates environments of task, task arguments are bound by precedence:
+// '--args' pairs, positional arguments, process environments and default values.
+// positional arguments are bound to declared arguments in order, skipping ones passed by '--args'.
+func (r *runner) createTaskEnvs(name string, task syntax.Task, workDir string, positionals []string) *ExpandEnvs {
 	envs := newExpandEnvs()
+	envs.dryRun = r.root().dryRun
+	envs.noProcessEnvs = r.parallelLoop() != nil
 	r.debugln(">>>>> adds system environments")
 	envs.parsePairs(r.log(), os.Environ(), false)
 	r.debugln(">>>>> adds builtin environments")
@@ -229,15 +512,39 @@ func (r *runner) createTaskEnvs(name string, task syntax.Task, workDir string) *
 	envs.addAndExpand(r.log(), syntax.BUILTIN_ENV_PATHLISTSEP, string(os.PathListSeparator), false)
 
 	userArgsEnv := envs.copy()
+	namedArgs := map[string]bool{}
 	if len(r.root().globalArgs) > 0 {
 		r.debugln(">>>>> adds user provided arguments")
 		for _, a := range r.root().globalArgs {
 			blocks := splitBlocks(a)
 			userArgsEnv.parsePairs(r.log(), blocks, false)
+			for _, b := range blocks {
+				if k, v := stringSplitAndTrimToPair(b, "="); k != "" && v != "" {
+					namedArgs[k] = true
+				}
+			}
+		}
+	}
+	var positionalArgs int
+	for _, arg := range task.Args {
+		if !namedArgs[arg.Env] {
+			positionalArgs++
 		}
 	}
+	if len(positionals) > positionalArgs {
+		r.fatalln(fmt.Sprintf("too many positional arguments of task %s, expect at most %d: [%s]", name, positionalArgs, strings.Join(positionals, ", ")))
+		return envs
+	}
 	if len(task.Args) > 0 {
 		r.debugln(">>>>> checking task default arguments")
+		// defaults could only reference arguments defined before
+		envs.pending = make(map[string]bool)
+		for _, arg := range task.Args {
+			envs.pending[arg.Env] = true
+		}
+		defer func() {
+			envs.pending = nil
+		}()
 		for _, arg := range task.Args {
 			if arg.Env == "" {
 				r.fatalln("empty task argument name")
@@ -249,6 +556,11 @@ func (r *runner) createTaskEnvs(name string, task syntax.Task, workDir string) *
 				r.fatalln("lookup task argument value failed:", arg.Env, err)
 				return envs
 			}
+			if !namedArgs[arg.Env] && len(positionals) > 0 {
+				val = positionals[0]
+				positionals = positionals[1:]
+				r.debugln("uses positional argument:", arg.Env)
+			}
 			if val == "" {
 				val = arg.Default
 				err = envs.expandStringPtrs(&val)
@@ -258,6 +570,10 @@ func (r *runner) createTaskEnvs(name string, task syntax.Task, workDir string) *
 				}
 				r.debugln("uses task argument default value:", arg.Env)
 			}
+			if !r.validateTaskArg(envs, arg, val) {
+				return envs
+			}
+			delete(envs.pending, arg.Env)
 			envs.addAndExpand(r.log(), arg.Env, val, false)
 		}
 	}
@@ -266,24 +582,303 @@ func (r *runner) createTaskEnvs(name string, task syntax.Task, workDir string) *
 		r.debugln(">>>>> add configuration environments")
 		envs.parseEnv(r.log(), r.configs.Env)
 	}
+	if profile := r.root().profile; profile != "" {
+		r.debugln(">>>>> add profile environments:", profile)
+		envs.parseEnv(r.log(), r.configs.Profiles[profile])
+	}
 
 	return envs
 }
 
-func (r *runner) runTask(name string, task syntax.Task, baseDir string) {
-	workDir := stringToSlash(filepath.Join(baseDir, task.WorkDir))
-	err := os.Chdir(workDir)
+func (r *runner) runTask(name string, task syntax.Task, args []string, baseDir string) {
+	r.resetTaskStates(name)
+	defer r.locks.release()
+	start := time.Now()
+	if t := r.root().timings; t != nil {
+		defer t.record(timingKindTask, name, time.Now())
+	}
+	workDir := baseDir
+	r.pathBase = r.configs.TaskDirs[name]
+	if task.WorkDir != "" {
+		workDir = task.WorkDir
+		r.pathBase = task.WorkDir
+	}
+	workDir = stringToSlash(workDir)
+	r.infoln("workdir:", workDir)
+	err := runInDir(workDir, func() error {
+		envs := r.createTaskEnvs(name, task, workDir, args)
+		if disabled, ok := r.checkBoolString(envs, "disabled", task.Disabled); !ok || disabled {
+			if disabled {
+				r.warnln("task is disabled, skipped:", name)
+			}
+			return nil
+		}
+		if !r.setupNotifier(envs, start) {
+			return nil
+		}
+		defer func() {
+			r.notifyTask(r.scope().failed)
+		}()
+		r.runTaskBody(task, envs, workDir)
+		return nil
+	})
 	if err != nil {
 		r.fatalln("change working directory failed:", err)
 		return
 	}
+}
 
-	r.infoln("workdir:", workDir)
-	envs := r.createTaskEnvs(name, task, workDir)
-	r.runActions(envs, task.Actions)
+// resetTaskStates sets task scoped states of runner, so states of calling task aren't inherited.
+func (r *runner) resetTaskStates(name string) {
+	r.task = name
+	r.container = &containerOptions{}
+	r.remote = &remoteHost{}
+	r.secrets = &secretStore{}
+	r.locks = &heldLocks{}
+}
+
+// runTaskBody sets up execution context of task such as container, secrets, remote host and lock,
+// then runs task actions.
+func (r *runner) runTaskBody(task syntax.Task, envs *ExpandEnvs, workDir string) {
+	if !r.checkRequiredEnvs(envs, task.RequireEnvs) {
+		return
+	}
+	if task.Container.Image != "" && !r.setupContainer(envs, task.Container, workDir) {
+		return
+	}
+	if len(task.Secrets) > 0 && !r.setupSecrets(envs, task.Secrets) {
+		return
+	}
+	if !r.setupRedaction(envs) {
+		return
+	}
+	if task.Host.Address != "" {
+		if !r.setupRemote(envs, task.Host) {
+			return
+		}
+		defer r.remote.close()
+	}
+	lock, ok := r.lockTask(envs, task.Lock)
+	if !ok {
+		return
+	}
+	defer lock.release()
+	if lock.completed() {
+		r.infoln("task has been completed, skipped:", stringToSlash(lock.done))
+		return
+	}
+	r.runTaskActions(envs, task)
+	if !r.scope().failed {
+		err := lock.markCompleted()
+		if err != nil {
+			r.fatalln("create task done marker failed:", err)
+		}
+	}
+}
+
+// checkBoolString evaluates boolean field, empty value is false.
+func (r *runner) checkBoolString(envs *ExpandEnvs, field string, b syntax.BoolString) (bool, bool) {
+	if b == "" {
+		return false, true
+	}
+	val, err := envs.expandString(string(b))
+	if err != nil {
+		r.fatalln(err)
+		return false, false
+	}
+	ok, err := checkCondition(envs, val, "", nil)
+	if err != nil {
+		r.fatalln(fmt.Sprintf("couldn't eval value of '%s' field:", field), b, err)
+		return false, false
+	}
+	return ok, true
+}
+
+// runTaskActions runs before actions, actions and after actions, after actions always run
+// and the task fails after them if previous actions failed.
+func (r *runner) runTaskActions(envs *ExpandEnvs, task syntax.Task) {
+	if task.After.Length() == 0 {
+		r.runListActions(envs, "before", task.Before)
+		r.runActions(envs, task.Actions)
+		r.recordOutputs(envs, task.Outputs)
+		return
+	}
+	nr := r.isolated()
+	nr.runListActions(envs, "before", task.Before)
+	if !nr.failed {
+		nr.runActions(envs, task.Actions)
+	}
+	if !nr.failed {
+		nr.recordOutputs(envs, task.Outputs)
+	}
+	r.infoln("After")
+	r.addIndent().runListActions(envs, "after", task.After)
+	if nr.failed {
+		r.fatalln(nr.failure)
+		return
+	}
+}
+
+func (r *runner) setupContainer(envs *ExpandEnvs, c syntax.TaskContainer, workDir string) bool {
+	c.Options = append([]string(nil), c.Options...)
+	err := envs.expandStringPtrs(&c.Image, &c.Runtime)
+	if err == nil {
+		err = envs.expandStringSlice(c.Options)
+	}
+	if err != nil {
+		r.fatalln(err)
+		return false
+	}
+	r.container, err = newContainerOptions(c, workDir)
+	if err != nil {
+		r.fatalln(err)
+		return false
+	}
+	r.infoln("container:", c.Image)
+	return true
+}
+
+func (r *runner) setupRemote(envs *ExpandEnvs, h syntax.TaskHost) bool {
+	remote, ok := r.newRemote(envs, h)
+	if !ok {
+		return false
+	}
+	r.remote = remote
+	r.infoln("host:", remote.User+"@"+remote.Address)
+	return true
+}
+
+func (r *runner) newRemote(envs *ExpandEnvs, h syntax.TaskHost) (*remoteHost, bool) {
+	err := envs.expandStringPtrs(&h.Address, &h.User, &h.IdentityFile, &h.KnownHostsFile, &h.Dir)
+	if err != nil {
+		r.fatalln(err)
+		return nil, false
+	}
+	r.resolvePathPtrs(&h.IdentityFile, &h.KnownHostsFile)
+	h.IdentityFile = stringFromSlash(h.IdentityFile)
+	h.KnownHostsFile = stringFromSlash(h.KnownHostsFile)
+	store := r.taskSecrets()
+	remote, err := newRemoteHost(h, func() (string, error) {
+		return store.get(h.PasswordSecret)
+	})
+	if err != nil {
+		r.fatalln(err)
+		return nil, false
+	}
+	return remote, true
+}
+
+func (r *runner) setupSecrets(envs *ExpandEnvs, secrets []syntax.TaskSecret) bool {
+	envs.secrets = map[string]bool{}
+	sources := map[string]syntax.TaskSecret{}
+	for _, s := range secrets {
+		err := envs.expandStringPtrs(&s.File, &s.Keyring.Service, &s.Keyring.Account)
+		if err != nil {
+			r.fatalln(err)
+			return false
+		}
+		if s.Env == "" || (s.File == "") == (s.Keyring.Service == "") {
+			r.fatalln("secret should have env name and either file or keyring:", s.Env)
+			return false
+		}
+		if _, has := sources[s.Env]; has {
+			r.fatalln("duplicated secret:", s.Env)
+			return false
+		}
+		s.File = r.resolvePath(s.File)
+		sources[s.Env] = s
+		envs.secrets[s.Env] = true
+		envs.remove(s.Env)
+	}
+	r.secrets = newSecretStore(sources)
+	return true
+}
+
+// taskSecrets returns secret store of nearest task.
+func (r *runner) taskSecrets() *secretStore {
+	for rt := r; rt != nil; rt = rt.parent {
+		if rt.secrets != nil {
+			return rt.secrets
+		}
+	}
+	return &secretStore{}
+}
+
+// commandSecretEnvs returns environments with secrets added for command.
+func (r *runner) commandSecretEnvs(envs *ExpandEnvs, names []string) (*ExpandEnvs, bool) {
+	if len(names) == 0 {
+		return envs, true
+	}
+	envs = envs.copy()
+	store := r.taskSecrets()
+	for _, name := range names {
+		val, err := store.get(name)
+		if err != nil {
+			r.fatalln("load secret failed:", name, err)
+			return nil, false
+		}
+		envs.set(name, val)
+	}
+	return envs, true
+}
+
+func (r *runner) validateTaskArg(envs *ExpandEnvs, arg syntax.TaskArgument, val string) bool {
+	if arg.Regexp != "" {
+		ok, err := checkCondition(envs, val, syntax.Op_string_regexp, &arg.Regexp)
+		if err != nil {
+			r.fatalln("check task argument failed:", arg.Env, err)
+			return false
+		}
+		if !ok {
+			r.fatalln(fmt.Sprintf("invalid task argument value: %s=%q, doesn't match pattern: %s", arg.Env, val, arg.Regexp))
+			return false
+		}
+	}
+	if len(arg.Allowed) > 0 {
+		for _, a := range arg.Allowed {
+			if a == val {
+				return true
+			}
+		}
+		r.fatalln(fmt.Sprintf("invalid task argument value: %s=%q, allowed: [%s]", arg.Env, val, strings.Join(arg.Allowed, ", ")))
+		return false
+	}
+	return true
+}
+
+func (r *runner) recordOutputs(envs *ExpandEnvs, names []string) {
+	outputs := r.root().outputs
+	if outputs == nil || len(names) == 0 || r.scope().failed {
+		return
+	}
+	if outputs.values == nil {
+		outputs.values = make(map[string]string)
+	}
+	for _, name := range names {
+		val, has := envs.get(name)
+		if !has {
+			r.warnln("output environment not defined:", name)
+			continue
+		}
+		outputs.values[name] = val
+	}
+}
+
+func (r *runner) checkRequiredEnvs(envs *ExpandEnvs, names []string) bool {
+	var missing []string
+	for _, name := range names {
+		if !envs.Exist(name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		r.fatalln("required environments missing:", strings.Join(missing, ", "))
+		return false
+	}
+	return true
 }
 
-func (r *runner) runTaskByName(name, baseDir string) {
+func (r *runner) runTaskByName(name string, args []string, baseDir string) {
 	r.infoln("Task:", name)
 	task, ok := r.searchTask(name)
 	if !ok {
@@ -291,7 +886,7 @@ func (r *runner) runTaskByName(name, baseDir string) {
 		return
 	}
 
-	r.addIndent().runTask(name, task, baseDir)
+	r.addIndent().runTask(name, task, args, baseDir)
 }
 
 func (r *runner) resourceNeedsSync(cpy syntax.ActionCopy, isLocalFile bool) bool {
@@ -339,7 +934,14 @@ func (r *runner) runActionCopy(cpy syntax.ActionCopy, envs *ExpandEnvs) {
 		sourcePath  string
 		needsRemove bool
 		force       bool
+		// hash has been checked while downloading
+		verified bool
+		digest   string
 	)
+	if cpy.Hash.Env != "" && cpy.Hash.Alg == "" {
+		r.fatalln("hash algorithm is required to bind digest env:", cpy.Hash.Env)
+		return
+	}
 	if cpy.Force != "" {
 		val, err := envs.expandString(cpy.Force)
 		if err != nil {
@@ -375,17 +977,49 @@ func (r *runner) runActionCopy(cpy syntax.ActionCopy, envs *ExpandEnvs) {
 				sourcePath = strings.TrimPrefix(sourcePath, "/")
 			}
 		case "http", "https":
+			switch cpy.ContentEncoding {
+			case "", syntax.ContentEncodingDecode, syntax.ContentEncodingRaw:
+			default:
+				r.fatalln("invalid content encoding mode:", cpy.ContentEncoding)
+				return
+			}
 			if !force && !r.resourceNeedsSync(cpy, false) {
 				r.debugln("resource reuse.")
 				return
 			}
-			path, err := downloadFile(cpy.SourceUrl)
+			err := envs.expandStringPtrs(&cpy.Proxy.Url, &cpy.Proxy.NoProxy, &cpy.Tls.CaFile, &cpy.Tls.CertFile, &cpy.Tls.KeyFile)
+			if err != nil {
+				r.fatalln(err)
+				return
+			}
+			r.resolvePathPtrs(&cpy.Tls.CaFile, &cpy.Tls.CertFile, &cpy.Tls.KeyFile)
+			if cpy.Tls.InsecureSkipVerify {
+				r.warnln("WARNING: tls certificate verification is disabled, the connection is insecure:", cpy.SourceUrl)
+			}
+			var path string
+			err = r.withRetry(cpy.Retry, func() error {
+				var err error
+				path, digest, err = downloadFile(cpy.SourceUrl, downloadOptions{
+					RawEncoding: cpy.ContentEncoding == syntax.ContentEncodingRaw,
+					HashAlg:     cpy.Hash.Alg,
+					HashSig:     cpy.Hash.Sig,
+					Proxy:       cpy.Proxy.Url,
+					NoProxy:     cpy.Proxy.NoProxy,
+
+					CaFile:             cpy.Tls.CaFile,
+					CertFile:           cpy.Tls.CertFile,
+					KeyFile:            cpy.Tls.KeyFile,
+					InsecureSkipVerify: cpy.Tls.InsecureSkipVerify,
+				})
+				return err
+			})
 			if err != nil {
 				r.fatalln("download file failed:", cpy.SourceUrl, err)
 				return
 			}
 			sourcePath = path
 			needsRemove = true
+			verified = cpy.Hash.Sig != ""
 		default:
 			r.fatalln("unsupported source url schema:", ul.Scheme)
 			return
@@ -402,49 +1036,190 @@ func (r *runner) runActionCopy(cpy syntax.ActionCopy, envs *ExpandEnvs) {
 			os.Remove(sourcePath)
 		}
 	}()
-	if !r.resourceIsValid(cpy, sourcePath) {
+	if !verified && !r.resourceIsValid(cpy, sourcePath) {
 		r.fatalln("resource source invalid:", cpy.SourceUrl)
 		return
 	}
-	err := copyPath(cpy.DestPath, sourcePath)
+	err := copyPath(stringFromSlash(cpy.DestPath), stringFromSlash(sourcePath), cpy.ContinueOnError)
 	if err != nil {
 		r.fatalln("resource copy failed:", cpy.SourceUrl, cpy.DestPath, err)
 		return
 	}
+	if cpy.Hash.Env != "" && digest != "" {
+		envs.addAndExpand(r.log(), cpy.Hash.Env, digest, false)
+	}
 }
 
-func (r *runner) runActionTemplate(action string, envs *ExpandEnvs) {
-	actions, ok := r.searchTemplate(action)
-	if !ok {
-		r.fatalln("template not found:", action)
-		return
+// templateChain returns names of templates being run from outermost to innermost.
+func (r *runner) templateChain() []string {
+	var chain []string
+	for rt := r; rt != nil; rt = rt.parent {
+		if rt.template != "" {
+			chain = append([]string{rt.template}, chain...)
+		}
 	}
-	r.addIndent().runActions(envs, actions)
+	return chain
 }
 
-func (r *runner) runActionSwitch(action syntax.ActionSwitch, envs *ExpandEnvs) {
-	{
-		var n int
-		for compare := range action.Cases {
-			if compare == action.Default {
-				n++
-			}
-		}
-		if n > 1 {
-			r.fatalln("multiple default cases is not allowed")
-			return
+// checkTemplateChain checks chain of template references from outermost to innermost,
+// it fails if the innermost template is already in chain or chain is deeper than maxDepth.
+func checkTemplateChain(chain []string, maxDepth int) error {
+	name := chain[len(chain)-1]
+	for _, t := range chain[:len(chain)-1] {
+		if t == name {
+			return fmt.Errorf("template cycle: %s", strings.Join(chain, " -> "))
 		}
 	}
-	value := action.Value
-	err := envs.expandStringPtrs(&value)
+	if len(chain) > maxDepth {
+		return fmt.Errorf("template depth exceeds limit %d: %s", maxDepth, strings.Join(chain, " -> "))
+	}
+	return nil
+}
+
+func (r *runner) runActionTemplate(name string, tmpl syntax.ActionTemplate, envs *ExpandEnvs) {
+	actions, ok := r.searchTemplate(name)
+	if !ok {
+		r.fatalln("template not found:", name)
+		return
+	}
+	err := checkTemplateChain(append(r.templateChain(), name), r.configs.TemplateMaxDepth)
 	if err != nil {
 		r.fatalln(err)
 		return
 	}
-	var defaultActions syntax.ActionList
-	for compare, actions := range action.Cases {
-		if compare == action.Default {
-			defaultActions = actions
+	if len(tmpl.Overrides) > 0 {
+		var err error
+		actions, err = overrideActions(actions, tmpl.Overrides)
+		if err != nil {
+			r.fatalln("override template actions failed:", name, err)
+			return
+		}
+	}
+	tr := r.addIndent()
+	tr.template = name
+	switch mode := tmpl.Mode; mode {
+	case "", syntax.TemplateModeFailFast:
+		tr.runActions(envs, actions)
+	case syntax.TemplateModeRunAll:
+		failures := tr.runActionsAll(envs, actions)
+		if len(failures) > 0 {
+			r.fatalln(fmt.Sprintf("template actions failed: %d of %d: %s", len(failures), actions.Length(), strings.Join(failures, "; ")))
+		}
+	default:
+		r.fatalln("invalid template mode:", mode)
+	}
+}
+
+func (r *runner) runActionRunAll(action syntax.ActionRunAll, envs *ExpandEnvs) {
+	failures := r.addIndentIfDebug().runActionsAll(envs, action.Actions)
+	if action.FailedEnv != "" {
+		envs.addAndExpand(r.log(), action.FailedEnv, strconv.Itoa(len(failures)), false)
+	}
+	if len(failures) > 0 {
+		msg := fmt.Sprintf("actions failed: %d of %d: %s", len(failures), action.Actions.Length(), strings.Join(failures, "; "))
+		if action.AllowFailure {
+			r.warnln(msg)
+			return
+		}
+		r.fatalln(msg)
+	}
+}
+
+// retryBlockState records commands marked once that have succeeded in retry block.
+type retryBlockState struct {
+	mu   sync.Mutex
+	done map[string]bool
+}
+
+func (s *retryBlockState) isDone(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done[key]
+}
+
+func (s *retryBlockState) markDone(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done[key] = true
+}
+
+// enclosingRetryBlock returns state of nearest retry block, commands in called tasks and templates also belong to it.
+func (r *runner) enclosingRetryBlock() *retryBlockState {
+	for rt := r; rt != nil; rt = rt.parent {
+		if rt.retryBlock != nil {
+			return rt.retryBlock
+		}
+	}
+	return nil
+}
+
+// retryBlockPosition returns position of running action in enclosing retry block, it consists of list names,
+// action indexes and loop iterations of runners from the block, so it's stable across attempts.
+func (r *runner) retryBlockPosition() string {
+	var parts []string
+	for rt := r; rt != nil; rt = rt.parent {
+		if rt.action != nil {
+			part := strconv.Itoa(rt.actionIndex)
+			if rt.list != "" {
+				part = rt.list + ":" + part
+			}
+			parts = append(parts, part)
+		}
+		if rt.iteration > 0 {
+			parts = append(parts, "#"+strconv.Itoa(rt.iteration))
+		}
+		if rt.retryBlock != nil {
+			break
+		}
+	}
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	return strings.Join(parts, "/")
+}
+
+func (r *runner) runActionRetry(action syntax.ActionRetry, envs *ExpandEnvs) {
+	state := &retryBlockState{done: map[string]bool{}}
+	var attempt int
+	err := r.withRetry(action.Retry, func() error {
+		attempt++
+		r.debugln("retry block attempt:", attempt)
+		nr := r.addIndentIfDebug().isolated()
+		nr.retryBlock = state
+		nr.runActions(envs, action.Actions)
+		if nr.failed {
+			return fmt.Errorf("actions failed")
+		}
+		return nil
+	})
+	if err != nil {
+		r.fatalln(fmt.Sprintf("retry block failed after %d attempts: %s", attempt, err))
+	}
+}
+
+func (r *runner) runActionSwitch(action syntax.ActionSwitch, envs *ExpandEnvs) {
+	{
+		var n int
+		for compare := range action.Cases {
+			if compare == action.Default {
+				n++
+			}
+		}
+		if n > 1 {
+			r.fatalln("multiple default cases is not allowed")
+			return
+		}
+	}
+	value := action.Value
+	err := envs.expandStringPtrs(&value)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	var defaultActions syntax.ActionList
+	for compare, actions := range action.Cases {
+		if compare == action.Default {
+			defaultActions = actions
 		} else {
 			err := envs.expandStringPtrs(&compare)
 			if err != nil {
@@ -458,14 +1233,14 @@ func (r *runner) runActionSwitch(action syntax.ActionSwitch, envs *ExpandEnvs) {
 			}
 			if ok {
 				r.debugln("action switch case run:", compare)
-				r.addIndentIfDebug().runActions(envs, actions)
+				r.addIndentIfDebug().runListActions(envs, "case "+compare, actions)
 				return
 			}
 		}
 	}
 	if defaultActions.Length() > 0 {
 		r.debugln("action switch run default case")
-		r.addIndent().runActions(envs, defaultActions)
+		r.addIndent().runListActions(envs, "default", defaultActions)
 	} else {
 		r.debugln("action switch no case matched")
 	}
@@ -485,18 +1260,60 @@ func (r *runner) runActionIf(action syntax.ActionIf, envs *ExpandEnvs) {
 		r.addIndentIfDebug().runActions(envs, action.Actions)
 	} else {
 		r.debugln("action if failed")
-		r.addIndentIfDebug().runActions(envs, action.Else)
+		r.addIndentIfDebug().runListActions(envs, "else", action.Else)
+	}
+}
+
+// stdinLoopValues returns lines of stdin, they are read at first call and cached.
+func (r *runner) stdinLoopValues(paths bool) ([]string, bool) {
+	root := r.root()
+	if root.configs.fromStdin {
+		r.fatalln("couldn't read loop values from stdin, it's already consumed by config file read from stdin")
+		return nil, false
+	}
+	root.stdinOnce.Do(func() {
+		if root.stdin == nil {
+			return
+		}
+		if fd, ok := root.stdin.(*os.File); ok && (isatty.IsTerminal(fd.Fd()) || isatty.IsCygwinTerminal(fd.Fd())) {
+			r.debugln("stdin is a terminal, skip reading")
+			return
+		}
+		content, err := ioutil.ReadAll(root.stdin)
+		root.stdinLines = stringSplitAndTrimFilterSpace(string(content), "\n")
+		root.stdinErr = err
+	})
+	if root.stdinErr != nil {
+		r.fatalln("read stdin failed:", root.stdinErr)
+		return nil, false
+	}
+	if !paths {
+		return root.stdinLines, true
+	}
+	var (
+		resolved []string
+		missing  []string
+	)
+	for _, p := range root.stdinLines {
+		p = r.resolvePath(stringToSlash(p))
+		if _, err := os.Stat(stringFromSlash(p)); err != nil {
+			missing = append(missing, p)
+		}
+		resolved = append(resolved, p)
+	}
+	if len(missing) > 0 {
+		r.fatalln("paths read from stdin don't exist:", strings.Join(missing, ", "))
+		return nil, false
 	}
+	return resolved, true
 }
 
 func (r *runner) runActionLoop(action syntax.ActionLoop, envs *ExpandEnvs) {
-	var looper func(fn func(v string))
+	var values []string
 	switch {
 	case action.Times > 0:
-		looper = func(fn func(v string)) {
-			for i := 0; i < action.Times; i++ {
-				fn(strconv.Itoa(i))
-			}
+		for i := 0; i < action.Times; i++ {
+			values = append(values, strconv.Itoa(i))
 		}
 	case action.Seq.From != action.Seq.To:
 		step := action.Seq.Step
@@ -508,10 +1325,8 @@ func (r *runner) runActionLoop(action syntax.ActionLoop, envs *ExpandEnvs) {
 			r.fatalln("invalid loop seq:", action.Seq.From, action.Seq.To, step)
 			return
 		}
-		looper = func(fn func(v string)) {
-			for i := action.Seq.From; i != action.Seq.To; i += step {
-				fn(strconv.Itoa(i))
-			}
+		for i := action.Seq.From; i != action.Seq.To; i += step {
+			values = append(values, strconv.Itoa(i))
 		}
 	case len(action.Array) > 0:
 		for i := range action.Array {
@@ -521,143 +1336,573 @@ func (r *runner) runActionLoop(action syntax.ActionLoop, envs *ExpandEnvs) {
 				return
 			}
 		}
-		looper = func(fn func(v string)) {
-			for _, v := range action.Array {
-				fn(v)
-			}
+		values = action.Array
+	case action.ArrayEnv != "":
+		err := envs.expandStringPtrs(&action.ArrayEnv)
+		if err != nil {
+			r.fatalln(err)
+			return
+		}
+		if !envs.Exist(action.ArrayEnv) {
+			r.fatalln("loop array env is not defined:", action.ArrayEnv)
+			return
 		}
+		values = envs.getArray(action.ArrayEnv)
 	case action.Split.Value != "":
-		err := envs.expandStringPtrs(&action.Split.Value)
+		err := envs.expandStringPtrs(&action.Split.Value, &action.Split.Separator)
 		if err != nil {
 			r.fatalln(err)
 			return
 		}
 		sep := action.Split.Separator
 		if sep == "" {
-			sep = " "
+			sep = syntax.DefaultArraySeparator
 		}
-		secs := stringSplitAndTrimFilterSpace(action.Split.Value, sep)
-		looper = func(fn func(v string)) {
-			for _, v := range secs {
-				fn(v)
-			}
+		values = stringSplitAndTrimFilterSpace(action.Split.Value, sep)
+	case action.Stdin.Enabled:
+		var ok bool
+		values, ok = r.stdinLoopValues(action.Stdin.Paths)
+		if !ok {
+			return
 		}
 	default:
 		r.fatalln("empty loop block")
 		return
 	}
-	looper(func(v string) {
-		envs := envs
-		r := r.addIndentIfDebug()
+	if len(values) == 0 {
+		r.debugln("loop has no iterations")
+		return
+	}
+	if action.Before.Length() > 0 {
+		r.debugln("loop before")
+		r.addIndentIfDebug().runListActions(envs, "before", action.Before)
+	}
+	if action.Parallel > 1 {
+		if !r.runLoopParallel(action, envs, values) {
+			return
+		}
+	} else {
+		for i, v := range values {
+			r := r.addIndentIfDebug()
+			r.iteration = i + 1
+
+			restoreVar := setLoopEnv(envs, action.Var, v)
+			restoreIndex := setLoopEnv(envs, action.IndexVar, strconv.Itoa(i))
+			if action.Var != "" {
+				r.debugln("loop run with var:", action.Var+"="+v)
+			}
+			r.runActions(envs, action.Actions)
+			restoreVar()
+			restoreIndex()
+		}
+	}
+	if action.After.Length() > 0 {
+		r.debugln("loop after")
+		r.addIndentIfDebug().runListActions(envs, "after", action.After)
+	}
+}
 
-		var (
-			varEnvVal   string
-			varEnvExist bool
-		)
+// setLoopEnv sets loop environment, previous value is restored if existed.
+func setLoopEnv(envs *ExpandEnvs, name, val string) (restore func()) {
+	if name == "" {
+		return func() {}
+	}
+	prev, exist := envs.get(name)
+	envs.set(name, val)
+	return func() {
+		if exist {
+			envs.set(name, prev)
+		}
+	}
+}
+
+// parallelLoop is shared by iterations of parallel loop.
+type parallelLoop struct {
+	// set if any iteration failed in fail-fast mode, remaining actions of running iterations are skipped
+	canceled int32
+}
+
+func (l *parallelLoop) cancel() {
+	atomic.StoreInt32(&l.canceled, 1)
+}
+
+func (l *parallelLoop) isCanceled() bool {
+	return l != nil && atomic.LoadInt32(&l.canceled) != 0
+}
+
+// parallelLoop returns nearest parallel loop of runner, nil if not in parallel loop.
+func (r *runner) parallelLoop() *parallelLoop {
+	for rt := r; rt != nil; rt = rt.parent {
+		if rt.loop != nil {
+			return rt.loop
+		}
+	}
+	return nil
+}
+
+// checkProcessStateChangeable refuses changing process wide states such as current directory
+// and process environments in parallel loop, they are shared by iterations.
+func (r *runner) checkProcessStateChangeable(what string) bool {
+	if r.parallelLoop() != nil {
+		r.fatalln(what, "is not allowed in parallel loop")
+		return false
+	}
+	return true
+}
+
+// runLoopParallel runs iterations concurrently, each one has an isolated runner and environments copy.
+// running iterations are canceled in fail-fast mode after the first failure.
+func (r *runner) runLoopParallel(action syntax.ActionLoop, envs *ExpandEnvs, values []string) bool {
+	var failFast bool
+	switch action.OnFailure {
+	case "", syntax.LoopOnFailureFailFast:
+		failFast = true
+	case syntax.LoopOnFailureCollect:
+	default:
+		r.fatalln("invalid loop failure mode:", action.OnFailure)
+		return false
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		failed  int
+		failure string
+		started int
+		tokens  = make(chan struct{}, action.Parallel)
+		loop    = &parallelLoop{}
+	)
+	for i, v := range values {
+		tokens <- struct{}{}
+		mu.Lock()
+		stop := failFast && failed > 0
+		mu.Unlock()
+		if stop {
+			<-tokens
+			break
+		}
+		started++
+
+		iterEnvs := envs.copy()
+		iterEnvs.noProcessEnvs = true
+		setLoopEnv(iterEnvs, action.Var, v)
+		setLoopEnv(iterEnvs, action.IndexVar, strconv.Itoa(i))
+		nr := r.addIndentIfDebug().isolated()
+		nr.loop = loop
+		nr.iteration = i + 1
 		if action.Var != "" {
-			varEnvVal, varEnvExist = envs.get(action.Var)
-			envs.set(action.Var, v)
+			nr.debugln("loop run with var:", action.Var+"="+v)
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-tokens
+				wg.Done()
+			}()
+			nr.runActions(iterEnvs, action.Actions)
+			if nr.failed {
+				mu.Lock()
+				failed++
+				if failure == "" {
+					failure = nr.failure
+				}
+				mu.Unlock()
+				if failFast {
+					loop.cancel()
+				}
+			}
+		}()
+	}
+	wg.Wait()
 
-			r.debugln("loop run with var:", action.Var+"="+v)
+	if failed > 0 {
+		msg := fmt.Sprintf("loop iterations failed: %d/%d", failed, len(values))
+		if skipped := len(values) - started; skipped > 0 {
+			msg += fmt.Sprintf(", skipped: %d", skipped)
 		}
-		r.runActions(envs, action.Actions)
-		if varEnvExist { // restore
-			envs.set(action.Var, varEnvVal)
+		if failure != "" {
+			msg += ", first failure: " + failure
 		}
-	})
+		r.fatalln(msg)
+		return false
+	}
+	return true
 }
 
-func (r *runner) runActionCmd(action syntax.ActionCmd, envs *ExpandEnvs, execs []string) {
-	envs.addAndExpand(r.log(), syntax.BUILTIN_ENV_LAST_COMMAND_PID, "", false)
+// checkCmdCapture checks capture options of command.
+func (r *runner) checkCmdCapture(capture syntax.CmdCapture, cmdIO syntax.CmdIO) bool {
+	if (capture.StdoutEnv != "" || capture.StderrEnv != "") && cmdIO.Background {
+		r.fatalln("output capturing is not supported for background command")
+		return false
+	}
+	if (capture.StdoutEnv != "" && cmdIO.Stdout != "") || (capture.StderrEnv != "" && cmdIO.Stderr != "") {
+		r.fatalln("output couldn't be redirected to both file and env")
+		return false
+	}
+	switch capture.Output {
+	case "", syntax.OutputTrim, syntax.OutputRaw, syntax.OutputFirstLine, syntax.OutputLastLine, syntax.OutputSplit:
+	default:
+		r.fatalln("invalid output mode:", capture.Output)
+		return false
+	}
+	return true
+}
+
+// captureCmdOutputs replaces stdout and stderr of fds with buffers if they are captured, outputs are also
+// written to terminal if tee. bind binds outputs to envs after command exit, it should be called even if
+// command failed, so outputs could be inspected in silent or runAll blocks. mark records length of captured
+// outputs, the returned rewind drops outputs captured after that, such as outputs of failed attempts.
+func (r *runner) captureCmdOutputs(envs *ExpandEnvs, capture syntax.CmdCapture, tee bool, fds *commandFds) (bind func(), mark func() (rewind func())) {
+	var (
+		stdout, stderr bytes.Buffer
+		terminals      []*maskWriter
+	)
+	captureOutput := func(env string, buf *bytes.Buffer, fd *io.Writer, terminal io.Writer) {
+		if env == "" {
+			return
+		}
+		*fd = buf
+		if tee {
+			t := newMaskWriter(terminal)
+			*fd = io.MultiWriter(buf, t)
+			terminals = append(terminals, t)
+		}
+	}
+	captureOutput(capture.StdoutEnv, &stdout, &fds.Stdout, os.Stdout)
+	captureOutput(capture.StderrEnv, &stderr, &fds.Stderr, os.Stderr)
+	bind = func() {
+		if capture.StdoutEnv != "" {
+			r.bindCmdOutput(envs, capture.StdoutEnv, stdout.String(), capture)
+		}
+		if capture.StderrEnv != "" {
+			r.bindCmdOutput(envs, capture.StderrEnv, stderr.String(), capture)
+		}
+		for _, t := range terminals {
+			t.flush()
+		}
+	}
+	mark = func() func() {
+		stdoutLen, stderrLen := stdout.Len(), stderr.Len()
+		return func() {
+			stdout.Truncate(stdoutLen)
+			stderr.Truncate(stderrLen)
+		}
+	}
+	return bind, mark
+}
+
+// bindCmdOutput binds captured output of command to env in the output mode.
+// lines are trimmed and empty lines are dropped unless untrimmed or keepEmptyLines in split mode.
+func (r *runner) bindCmdOutput(envs *ExpandEnvs, env, output string, capture syntax.CmdCapture) {
+	var lines []string
+	switch capture.Output {
+	case syntax.OutputRaw:
+		envs.addAndExpand(r.log(), env, output, false)
+		return
+	case syntax.OutputFirstLine, syntax.OutputLastLine, syntax.OutputSplit:
+		untrimmed := capture.Untrimmed && capture.Output == syntax.OutputSplit
+		keepEmpty := capture.KeepEmptyLines && capture.Output == syntax.OutputSplit
+		output = strings.Replace(output, "\r\n", "\n", -1)
+		if keepEmpty {
+			// newline at end of output doesn't begin an empty line
+			output = strings.TrimSuffix(output, "\n")
+		}
+		if output != "" || keepEmpty {
+			for _, line := range strings.Split(output, "\n") {
+				if !untrimmed {
+					line = strings.TrimSpace(line)
+				}
+				if line != "" || keepEmpty {
+					lines = append(lines, line)
+				}
+			}
+		}
+	default:
+		envs.addAndExpand(r.log(), env, strings.TrimSpace(output), false)
+		return
+	}
+	switch {
+	case capture.Output == syntax.OutputSplit:
+		envs.addArray(r.log(), env, lines)
+	case len(lines) == 0:
+		envs.addAndExpand(r.log(), env, "", false)
+	case capture.Output == syntax.OutputFirstLine:
+		envs.addAndExpand(r.log(), env, lines[0], false)
+	default:
+		envs.addAndExpand(r.log(), env, lines[len(lines)-1], false)
+	}
+}
+
+// openCommandFds opens redirection files of command, close should be called after command exit.
+func (r *runner) openCommandFds(cmdIO syntax.CmdIO) (fds commandFds, close func(), ok bool) {
+	var (
+		files     []*os.File
+		terminals []*maskWriter
+	)
+	close = func() {
+		for _, t := range terminals {
+			t.flush()
+		}
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	// secrets are masked in terminal display, files keep original outputs
+	terminal := func(w io.Writer) io.Writer {
+		t := newMaskWriter(w)
+		terminals = append(terminals, t)
+		return t
+	}
+	defer func() {
+		if !ok {
+			close()
+		}
+	}()
 
-	var fds commandFds
-	var err error
-	if action.Stdin != "" {
-		fds.Stdin, err = os.OpenFile(action.Stdin, os.O_RDONLY, 0)
+	if cmdIO.Stdin != "" {
+		in, err := os.OpenFile(cmdIO.Stdin, os.O_RDONLY, 0)
 		if err != nil {
 			r.fatalln("open stdin failed:", err)
-			return
+			return fds, close, false
 		}
+		files = append(files, in)
+		fds.Stdin = in
 	}
 
-	if action.Stdout != "" {
-		out, err := openFile(action.Stdout, action.StdoutAppend)
+	if cmdIO.Tee && cmdIO.Background && (cmdIO.Stdout != "" || cmdIO.Stderr != "") {
+		r.fatalln("tee is not supported for background command")
+		return fds, close, false
+	}
+	mode, err := parseFileMode(cmdIO.FileMode)
+	if err != nil {
+		r.fatalln(err)
+		return fds, close, false
+	}
+	if cmdIO.Stdout != "" {
+		out, err := openFile(cmdIO.Stdout, cmdIO.StdoutAppend, mode)
 		if err != nil {
 			r.fatalln("open stdout file failed:", err)
-			return
+			return fds, close, false
 		}
-		defer out.Close()
+		files = append(files, out)
 		fds.Stdout = out
+		if cmdIO.Tee {
+			fds.Stdout = io.MultiWriter(out, terminal(os.Stdout))
+		}
 	}
-	if action.Stderr != "" {
-		if action.Stderr == action.Stdout {
-			if action.StderrAppend != action.StdoutAppend {
+	if cmdIO.Stderr != "" {
+		if cmdIO.Stderr == cmdIO.Stdout {
+			if cmdIO.StderrAppend != cmdIO.StdoutAppend {
 				r.fatalln("couldn't open same stdout/stderr file in different append mode")
-				return
-			} else {
-				action.Stderr = action.Stdout
+				return fds, close, false
 			}
+			fds.Stderr = fds.Stdout
 		} else {
-			out, err := openFile(action.Stderr, action.StderrAppend)
+			out, err := openFile(cmdIO.Stderr, cmdIO.StderrAppend, mode)
 			if err != nil {
 				r.fatalln("open stderr file failed:", err)
-				return
+				return fds, close, false
 			}
-			defer out.Close()
+			files = append(files, out)
 			fds.Stderr = out
+			if cmdIO.Tee {
+				fds.Stderr = io.MultiWriter(out, terminal(os.Stderr))
+			}
 		}
 	}
+	return fds, close, true
+}
+
+func (r *runner) commandEnvs(envs *ExpandEnvs, local syntax.EnvList) *ExpandEnvs {
+	if local.Length() == 0 {
+		return envs
+	}
+	cmdEnvs := envs.copy()
+	r.debugln(">>>>> add command local environments")
+	cmdEnvs.parseEnv(r.log(), local)
+	return cmdEnvs
+}
+
+func (r *runner) runActionCmd(action syntax.ActionCmd, envs *ExpandEnvs, execs []string) {
+	envs.addAndExpand(r.log(), syntax.BUILTIN_ENV_LAST_COMMAND_PID, "", false)
+
+	r.resolvePathPtrs(&action.Stdin, &action.Stdout, &action.Stderr)
+	switch action.Substitution {
+	case "", syntax.SubstitutionKeep, syntax.SubstitutionSplit:
+	default:
+		r.fatalln("invalid substitution mode:", action.Substitution)
+		return
+	}
+	if !r.checkCmdCapture(action.CmdCapture, action.CmdIO) {
+		return
+	}
+	fds, closeFds, ok := r.openCommandFds(action.CmdIO)
+	if !ok {
+		return
+	}
+	defer closeFds()
+	bindOutputs, markOutputs := r.captureCmdOutputs(envs, action.CmdCapture, action.Tee, &fds)
 
-	cmdEnvs := envs
-	if action.Env.Length() > 0 {
-		cmdEnvs = envs.copy()
-		r.debugln(">>>>> add command local environments")
-		cmdEnvs.parseEnv(r.log(), action.Env)
+	cmdEnvs, ok := r.commandSecretEnvs(r.commandEnvs(envs, action.Env), action.Secrets)
+	if !ok {
+		return
+	}
+	if hasMaskedSecrets() && !action.Background {
+		defer maskTerminalFds(&fds)()
+	}
+	var handle *backgroundHandle
+	if action.Handle != "" {
+		if !action.Background {
+			r.fatalln("handle is only supported for background command")
+			return
+		}
+		var err error
+		handle, err = r.root().backgrounds.register(action.Handle)
+		if err != nil {
+			r.fatalln(err)
+			return
+		}
+	}
+	defer bindOutputs()
+	var (
+		block    *retryBlockState
+		position string
+	)
+	if action.Once {
+		block = r.enclosingRetryBlock()
+		position = r.retryBlockPosition()
 	}
-	for _, exec := range execs {
+	for i, exec := range execs {
 		if exec != "" {
+			// position of action and line index identify the command in retry block
+			onceKey := position + "/" + strconv.Itoa(i)
+			if block != nil && block.isDone(onceKey) {
+				r.infoln("exec skipped, succeeded in previous attempt:", exec)
+				continue
+			}
 			r.infoln("exec:", exec)
-			pid, _, err := runCommand(cmdEnvs, exec, action.WorkDir, false, fds, action.Background)
+			var pid int
+			// only outputs of the last attempt are bound
+			rewindOutputs := markOutputs()
+			err := r.withRetry(action.Retry, func() error {
+				rewindOutputs()
+				var err error
+				pid, _, err = runCommand(cmdEnvs, exec, commandOptions{
+					Dir:               action.WorkDir,
+					Fds:               fds,
+					Background:        action.Background,
+					Handle:            handle,
+					LineBuffered:      action.LineBuffered,
+					ResponseFiles:     action.ResponseFiles,
+					SplitSubstitution: action.Substitution == syntax.SubstitutionSplit,
+					Container:         r.taskContainer(),
+					Remote:            r.taskRemote(),
+				})
+				return err
+			})
 			if err != nil {
 				r.fatalln("run command failed:", err)
 				return
 			}
+			if block != nil {
+				block.markDone(onceKey)
+			}
 			envs.addAndExpand(r.log(), syntax.BUILTIN_ENV_LAST_COMMAND_PID, strconv.Itoa(pid), false)
 		}
 	}
 }
 
-func (r *runner) runActionWatch(action syntax.ActionWatch, envs *ExpandEnvs) {
-	err := envs.expandStringPtrs(&action.Dirs, &action.Files)
-	if err != nil {
-		r.fatalln(err)
+func (r *runner) runActionScript(action syntax.ActionScript, envs *ExpandEnvs) {
+	if action.Background {
+		r.fatalln("background is not supported for script")
 		return
 	}
-
-	dirs := splitBlocks(action.Dirs)
-	files := splitBlocks(action.Files)
-	w, err := newWatcher(r.log(), dirs, files)
-	if err != nil {
-		r.fatalln("create watcher failed:", err)
+	// script file is written locally, it couldn't be found by container or remote host
+	if r.taskContainer() != nil {
+		r.fatalln("script is not supported in container task")
 		return
 	}
-	defer w.close()
-
-	r.infoln("start watching.")
-	w.run(func() {
-		nr := newRunner(nil, r.log().addIndent(), r.configs)
-		nr.noExitOnFail = true
-		nr.infoln("received fs changes, run watcher actions >>>>>>")
-		nr.runActions(envs, action.Actions)
-		nr.infoln()
-	})
-}
-
-func (r *runner) findProcess(pidstr, name string, envs *ExpandEnvs) (*os.Process, bool) {
-	err := envs.expandStringPtrs(&name, &pidstr)
+	if r.taskRemote() != nil {
+		r.fatalln("script is not supported in remote task")
+		return
+	}
+	r.resolvePathPtrs(&action.Stdin, &action.Stdout, &action.Stderr)
+	interpreter, err := scriptInterpreter(action.Interpreter, action.Content)
 	if err != nil {
 		r.fatalln(err)
-		return nil, false
+		return
+	}
+	r.infoln("interpreter:", strings.Join(interpreter, " "))
+
+	if !r.checkCmdCapture(action.CmdCapture, action.CmdIO) {
+		return
+	}
+	fds, closeFds, ok := r.openCommandFds(action.CmdIO)
+	if !ok {
+		return
+	}
+	defer closeFds()
+	bindOutputs, _ := r.captureCmdOutputs(envs, action.CmdCapture, action.Tee, &fds)
+	defer bindOutputs()
+
+	cmdEnvs, ok := r.commandSecretEnvs(r.commandEnvs(envs, action.Env), action.Secrets)
+	if !ok {
+		return
+	}
+	if hasMaskedSecrets() {
+		defer maskTerminalFds(&fds)()
+	}
+	path, err := writeScriptFile(action.Content)
+	if err != nil {
+		r.fatalln("create script file failed:", err)
+		return
+	}
+	r.debugln("script file:", stringToSlash(path))
+	args := append(append(interpreter, path), action.Args...)
+	_, _, err = execCommand(cmdEnvs, [][]string{args}, commandOptions{
+		Dir:          action.WorkDir,
+		Fds:          fds,
+		LineBuffered: action.LineBuffered,
+	})
+	// removed before reporting failure, which may exit process
+	os.Remove(path)
+	if err != nil {
+		r.fatalln("run script failed:", err)
+		return
+	}
+}
+
+func (r *runner) runActionWatch(action syntax.ActionWatch, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.Dirs, &action.Files)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+
+	dirs := splitBlocks(action.Dirs)
+	r.resolvePaths(dirs)
+	files := splitBlocks(action.Files)
+	w, err := newWatcher(r.log(), dirs, files)
+	if err != nil {
+		r.fatalln("create watcher failed:", err)
+		return
+	}
+	defer w.close()
+
+	r.infoln("start watching.")
+	w.run(func() {
+		nr := r.addIndent().isolated()
+		nr.infoln("received fs changes, run watcher actions >>>>>>")
+		nr.runActions(envs, action.Actions)
+		nr.infoln()
+	})
+}
+
+func (r *runner) findProcess(pidstr, name string, envs *ExpandEnvs) (*os.Process, bool) {
+	err := envs.expandStringPtrs(&name, &pidstr)
+	if err != nil {
+		r.fatalln(err)
+		return nil, false
 	}
 
 	var pid int
@@ -728,6 +1973,10 @@ func (r *runner) runActionPkill(action syntax.ActionPkill, envs *ExpandEnvs) {
 }
 
 func (r *runner) runActionWait(action syntax.ActionWait, envs *ExpandEnvs) {
+	if action.Handle != "" {
+		r.waitHandle(action, envs)
+		return
+	}
 	process, ok := r.findProcess(action.Pid, action.Process, envs)
 	if !ok {
 		return
@@ -739,6 +1988,80 @@ func (r *runner) runActionWait(action syntax.ActionWait, envs *ExpandEnvs) {
 	}
 }
 
+func (r *runner) waitHandle(action syntax.ActionWait, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.Handle, &action.ExitCodeEnv)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	h, has := r.root().backgrounds.lookup(action.Handle)
+	if !has {
+		r.fatalln("background handle not found:", action.Handle)
+		return
+	}
+	exited, err := h.wait(time.Duration(action.Timeout) * time.Millisecond)
+	if !exited {
+		h.kill()
+		_, err = h.wait(0)
+	}
+	code := exitCode(err)
+	if action.ExitCodeEnv != "" {
+		envs.addAndExpand(r.log(), action.ExitCodeEnv, strconv.Itoa(code), false)
+	}
+	if !exited {
+		r.fatalln("background command timeout, killed:", action.Handle)
+		return
+	}
+	r.infoln("background command exited:", action.Handle, code)
+}
+
+func (r *runner) runActionWaitAll(action syntax.ActionWaitAll, envs *ExpandEnvs) {
+	err := envs.expandStringSlice(action.Handles)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	handles := make([]*backgroundHandle, 0, len(action.Handles))
+	for _, name := range action.Handles {
+		h, has := r.root().backgrounds.lookup(name)
+		if !has {
+			r.fatalln("background handle not found:", name)
+			return
+		}
+		handles = append(handles, h)
+	}
+
+	var deadline time.Time
+	if action.Timeout > 0 {
+		deadline = time.Now().Add(time.Duration(action.Timeout) * time.Millisecond)
+	}
+	var failed int
+	for _, h := range handles {
+		var timeout time.Duration
+		if !deadline.IsZero() {
+			timeout = time.Until(deadline)
+			if timeout <= 0 {
+				timeout = time.Nanosecond
+			}
+		}
+		exited, err := h.wait(timeout)
+		switch {
+		case !exited:
+			failed++
+			r.warnln("background command timeout:", h.name)
+		case err != nil:
+			failed++
+			r.warnln("background command failed:", h.name, err)
+		default:
+			r.infoln("background command succeed:", h.name)
+		}
+	}
+	if failed > 0 {
+		r.fatalln(fmt.Sprintf("background commands failed: %d of %d", failed, len(handles)))
+		return
+	}
+}
+
 func (r *runner) runActionTask(name string, passEnvs, returnEnvs []string, envs *ExpandEnvs) {
 	wd, err := os.Getwd()
 	if err != nil {
@@ -746,16 +2069,17 @@ func (r *runner) runActionTask(name string, passEnvs, returnEnvs []string, envs
 		return
 	}
 
-	r.infoln("workdir:", wd)
+	r.infoln("workdir:", stringToSlash(wd))
 	task, ok := r.searchTask(name)
 	if !ok {
 		r.fatalln("task not found:", name)
 		return
 	}
-	nr := newRunner(nil, r.log().addIndent(), r.configs)
-	nr.noExitOnFail = true
+	nr := r.addIndent().isolated()
+	nr.resetTaskStates(name)
+	defer nr.locks.release()
 
-	taskEnvs := r.createTaskEnvs(name, task, wd)
+	taskEnvs := r.createTaskEnvs(name, task, wd, nil)
 	transferEnvs := func(from, to *ExpandEnvs, envs []string) {
 		for _, env := range envs {
 			v, _ := from.lookupAndFilter(env, nil)
@@ -763,7 +2087,13 @@ func (r *runner) runActionTask(name string, passEnvs, returnEnvs []string, envs
 		}
 	}
 	transferEnvs(envs, taskEnvs, passEnvs)
-	nr.runActions(taskEnvs, task.Actions)
+	if disabled, ok := nr.checkBoolString(taskEnvs, "disabled", task.Disabled); !ok || disabled {
+		if disabled {
+			nr.infoln("task is disabled, skipped:", name)
+		}
+	} else {
+		nr.runTaskBody(task, taskEnvs, wd)
+	}
 	if !nr.failed {
 		transferEnvs(taskEnvs, envs, returnEnvs)
 	}
@@ -773,266 +2103,1631 @@ func (r *runner) runActionTask(name string, passEnvs, returnEnvs []string, envs
 		return
 	}
 	if nr.failed {
-		r.fatalln("child task failed")
+		r.fatalln("child task failed:", nr.failure)
 	}
 }
 
-func (r *runner) expandPathBlockAndGlob(path string, envs *ExpandEnvs, mustBeFile bool) ([]string, bool) {
-	err := envs.expandStringPtrs(&path)
+func (r *runner) runActionCiOutput(action syntax.ActionCiOutput, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.Envs, &action.Platform, &action.File)
 	if err != nil {
 		r.fatalln(err)
-		return nil, false
+		return
+	}
+	platform := action.Platform
+	if platform == "" {
+		switch {
+		case envs.Exist("GITHUB_ACTIONS"):
+			platform = syntax.CiPlatformGithub
+		case envs.Exist("GITLAB_CI"):
+			platform = syntax.CiPlatformGitlab
+		default:
+			r.fatalln("couldn't detect ci platform")
+			return
+		}
 	}
-	matched, err := splitBlocksAndGlobPath(path, mustBeFile)
+	file := action.File
+	switch platform {
+	case syntax.CiPlatformGithub:
+		if file == "" {
+			file, _ = envs.get("GITHUB_OUTPUT")
+		}
+	case syntax.CiPlatformGitlab:
+	default:
+		r.fatalln("unsupported ci platform:", platform)
+		return
+	}
+	if file == "" {
+		r.fatalln("ci output file is not specified")
+		return
+	}
+
+	var buf strings.Builder
+	for _, name := range splitBlocks(action.Envs) {
+		val, ok := envs.get(name)
+		if !ok {
+			r.fatalln("ci output env is not defined:", name)
+			return
+		}
+		if !strings.Contains(val, "\n") {
+			buf.WriteString(name + "=" + val + "\n")
+			continue
+		}
+		if platform != syntax.CiPlatformGithub {
+			r.fatalln("multiple line value is not supported by ci platform:", platform, name)
+			return
+		}
+		delimiter, err := randomDelimiter()
+		if err != nil {
+			r.fatalln("create multiple line value delimiter failed:", err)
+			return
+		}
+		buf.WriteString(name + "<<" + delimiter + "\n" + val + "\n" + delimiter + "\n")
+	}
+	r.debugln("ci output file:", platform, stringToSlash(file))
+	fd, err := openFile(file, true, defaultFileMode)
 	if err != nil {
-		r.fatalln("glob path failed:", err)
-		return nil, false
+		r.fatalln("open ci output file failed:", err)
+		return
+	}
+	_, err = fd.WriteString(buf.String())
+	if err1 := closeFile(fd, action.Durable); err == nil {
+		err = err1
+	}
+	if err != nil {
+		r.fatalln("write ci output file failed:", err)
 	}
-	return matched, true
 }
 
-func (r *runner) runActions(envs *ExpandEnvs, a syntax.ActionList) {
-	for _, a := range a.Actions() {
-		if a.On != "" {
-			val, err := envs.expandString(a.On)
-			if err != nil {
-				r.fatalln(err)
-			}
-			ok, err := checkCondition(envs, val, "", nil)
-			if err != nil {
-				r.fatalln("check condition failed:", err)
-			}
-			if !ok {
-				r.debugln("action condition failed")
-				continue
-			}
+func (r *runner) runActionSource(action syntax.ActionSource, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.Script, &action.Shell)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	if action.Shell == "" {
+		action.Shell = "sh"
+	}
+	// '.' searches PATH for names without slash, so script path must be absolute.
+	script, err := filepath.Abs(stringFromSlash(action.Script))
+	if err != nil {
+		r.fatalln("get script absolute path failed:", err)
+		return
+	}
+	// script output is redirected to stderr to keep env output clean.
+	cmd := exec.Command(action.Shell, "-c", `. "$1" 1>&2 && env -0`, "tash-source", script)
+	cmd.Env = envs.formatEnvs()
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		r.fatalln("source script failed:", err)
+		return
+	}
+	for _, item := range strings.Split(string(output), "\x00") {
+		i := strings.Index(item, "=")
+		if i <= 0 {
+			continue
+		}
+		k, v := item[:i], item[i+1:]
+		switch k {
+		case "_", "SHLVL", "PWD", "OLDPWD":
+			continue
+		}
+		if old, has := envs.get(k); has && old == v {
+			continue
+		}
+		envs.addAndExpand(r.log(), k, v, false)
+	}
+}
+
+func (r *runner) runActionMerge(action syntax.ActionMerge, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.Output, &action.Separator, &action.Header, &action.Mode)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	action.Output = r.resolvePath(action.Output)
+	matched, ok := r.expandPathBlockAndGlob(action.Files, envs, true)
+	if !ok {
+		return
+	}
+	output, err := filepath.Abs(stringFromSlash(action.Output))
+	if err != nil {
+		r.fatalln("get output file path failed:", err)
+		return
+	}
+	var files []string
+	for _, m := range matched {
+		if p, err := filepath.Abs(stringFromSlash(m)); err == nil && p == output {
+			continue
+		}
+		files = append(files, m)
+	}
+	r.infoln("Merge:", files, stringToSlash(action.Output))
+
+	var buf bytes.Buffer
+	for i, file := range files {
+		if i > 0 {
+			buf.WriteString(action.Separator)
+		}
+		if action.Header != "" {
+			buf.WriteString(strings.ReplaceAll(action.Header, "{}", file))
+		}
+		content, err := ioutil.ReadFile(stringFromSlash(file))
+		if err != nil {
+			r.fatalln("read file failed:", err)
+			return
+		}
+		buf.Write(content)
+	}
+	mode, err := parseFileMode(action.Mode)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	fd, err := openFile(stringFromSlash(action.Output), false, mode)
+	if err != nil {
+		r.fatalln("open output file failed:", err)
+		return
+	}
+	_, err = fd.Write(buf.Bytes())
+	if err != nil {
+		fd.Close()
+		r.fatalln("write output file failed:", err)
+		return
+	}
+	err = closeFile(fd, action.Durable)
+	if err != nil {
+		r.fatalln("close output file failed:", err)
+	}
+}
+
+func (r *runner) runActionSplit(action syntax.ActionSplit, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.File, &action.Output, &action.Size)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	if action.Output == "" {
+		action.Output = action.File
+	}
+	r.resolvePathPtrs(&action.File, &action.Output)
+	var size int64
+	if action.Size != "" {
+		size, err = parseSize(action.Size)
+		if err != nil {
+			r.fatalln("parse chunk size failed:", err)
+			return
+		}
+	}
+	switch {
+	case size > 0 && action.Lines > 0:
+		r.fatalln("only one of chunk size and lines could be specified")
+		return
+	case size <= 0 && action.Lines <= 0:
+		r.fatalln("chunk size or lines must be positive")
+		return
+	}
+	r.infoln("Split:", stringToSlash(action.File), stringToSlash(action.Output))
+	chunks, err := splitFile(stringFromSlash(action.File), stringFromSlash(action.Output), size, action.Lines)
+	if err != nil {
+		r.fatalln("split file failed:", err)
+		return
+	}
+	r.debugln("chunks:", chunks)
+}
+
+func (r *runner) runActionLineInFile(action syntax.ActionLineInFile, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.File, &action.Line, &action.State, &action.Regexp, &action.Position, &action.InsertAfter)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	action.File = r.resolvePath(action.File)
+	if action.State == "" {
+		action.State = syntax.LineStatePresent
+	}
+	if action.Position == "" {
+		action.Position = syntax.LinePositionEnd
+	}
+	switch action.State {
+	case syntax.LineStatePresent, syntax.LineStateAbsent:
+	default:
+		r.fatalln("invalid line state:", action.State)
+		return
+	}
+	switch action.Position {
+	case syntax.LinePositionBegin, syntax.LinePositionEnd:
+	default:
+		r.fatalln("invalid line position:", action.Position)
+		return
+	}
+	var match, insertAfter *regexp.Regexp
+	if action.Regexp != "" {
+		match, err = regexp.CompilePOSIX(action.Regexp)
+		if err != nil {
+			r.fatalln("compile regexp failed:", action.Regexp, err)
+			return
+		}
+	}
+	if action.InsertAfter != "" {
+		insertAfter, err = regexp.CompilePOSIX(action.InsertAfter)
+		if err != nil {
+			r.fatalln("compile regexp failed:", action.InsertAfter, err)
+			return
+		}
+	}
+	r.infoln("LineInFile:", stringToSlash(action.File), action.State)
+	changed, err := lineInFile(stringFromSlash(action.File), action.Line, action.State == syntax.LineStatePresent, match, action.Position, insertAfter)
+	if err != nil {
+		r.fatalln("update file failed:", err)
+		return
+	}
+	r.debugln("changed:", changed)
+}
+
+func (r *runner) runActionStat(action syntax.ActionStat, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.Path, &action.TimeFormat)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	action.Path = r.resolvePath(action.Path)
+	r.infoln("Stat:", stringToSlash(action.Path))
 
-			r.debugln("action condition passed")
+	var size, modTime, mode, isDir string
+	info, err := os.Stat(stringFromSlash(action.Path))
+	if err != nil {
+		if !os.IsNotExist(err) || !action.AllowMissing {
+			r.fatalln("stat file failed:", err)
+			return
+		}
+		r.debugln("file doesn't exist")
+	} else {
+		size = strconv.FormatInt(info.Size(), 10)
+		switch action.TimeFormat {
+		case "", syntax.StatTimeFormatRFC3339:
+			modTime = info.ModTime().Format(time.RFC3339)
+		case syntax.StatTimeFormatUnix:
+			modTime = strconv.FormatInt(info.ModTime().Unix(), 10)
+		default:
+			r.fatalln("invalid time format:", action.TimeFormat)
+			return
 		}
-		var done bool
-		next := func(cond bool, fn func()) {
-			if cond && !done && !r.root().failed {
-				fn()
-				done = true
+		mode = fmt.Sprintf("%04o", info.Mode().Perm())
+		isDir = strconv.FormatBool(info.IsDir())
+	}
+	for _, p := range [][2]string{
+		{action.Size, size},
+		{action.ModTime, modTime},
+		{action.Mode, mode},
+		{action.IsDir, isDir},
+		{action.Exist, strconv.FormatBool(info != nil)},
+	} {
+		if p[0] != "" {
+			envs.addAndExpand(r.log(), p[0], p[1], false)
+		}
+	}
+}
+
+func (r *runner) runActionSetEnv(action syntax.ActionSetEnv, envs *ExpandEnvs) {
+	if action.Process && !r.checkProcessStateChangeable("setting process environments") {
+		return
+	}
+	envs.parseEnv(r.log(), action.Set)
+	if action.Process {
+		for _, env := range action.Set.Envs() {
+			for _, item := range splitBlocks(env) {
+				k, _ := stringSplitAndTrimToPair(item, "=")
+				v, has := envs.get(k)
+				if k == "" || !has {
+					continue
+				}
+				err := os.Setenv(k, v)
+				if err != nil {
+					r.fatalln("set process environment failed:", k, err)
+					return
+				}
 			}
 		}
-		next(a.Env.Length() > 0, func() {
-			r.debugln("Env")
-			envs.parseEnv(r.addIndentIfDebug().log(), a.Env)
-		})
-		next(a.Cmd.Exec != "", func() {
-			err := envs.expandStringPtrs(&a.Cmd.Exec, &a.Cmd.WorkDir, &a.Cmd.Stdin, &a.Cmd.Stdout, &a.Cmd.Stderr)
+	}
+	for _, name := range action.Unset {
+		name, err := envs.expandString(name)
+		if err != nil {
+			r.fatalln(err)
+			return
+		}
+		r.debugln("env remove:", name)
+		envs.remove(name)
+		if action.Process {
+			err = os.Unsetenv(name)
 			if err != nil {
-				r.fatalln(err)
+				r.fatalln("unset process environment failed:", name, err)
 				return
 			}
+		}
+	}
+}
 
-			execs := stringSplitAndTrim(a.Cmd.Exec, "\n")
-			r.infoln("Cmd")
-			r.addIndent().runActionCmd(a.Cmd, envs, execs)
-		})
-		next(a.Copy.DestPath != "", func() {
-			err := envs.expandStringPtrs(&a.Copy.SourceUrl, &a.Copy.DestPath)
-			if err != nil {
-				r.fatalln(err)
-			}
-			ptrsToSlash(&a.Copy.SourceUrl, &a.Copy.DestPath)
-			r.infoln("Copy:", a.Copy.SourceUrl, a.Copy.DestPath)
-			r.addIndentIfDebug().runActionCopy(a.Copy, envs)
+func (r *runner) runActionMatch(action syntax.ActionMatch, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.Value, &action.Regexp, &action.Prefix, &action.MatchedEnv)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	reg, err := regexp.Compile(action.Regexp)
+	if err != nil {
+		r.fatalln("compile regexp failed:", action.Regexp, err)
+		return
+	}
+	groups := reg.FindStringSubmatch(action.Value)
+	if action.MatchedEnv != "" {
+		envs.addAndExpand(r.log(), action.MatchedEnv, strconv.FormatBool(groups != nil), false)
+	}
+	if groups == nil {
+		if action.MatchedEnv == "" {
+			r.fatalln(fmt.Sprintf("value %q doesn't match regexp: %s", action.Value, action.Regexp))
+		}
+		return
+	}
+	for i, name := range reg.SubexpNames() {
+		if name != "" {
+			envs.addAndExpand(r.log(), name, groups[i], false)
+		}
+		if action.Prefix != "" {
+			envs.addAndExpand(r.log(), action.Prefix+"_"+strconv.Itoa(i), groups[i], false)
+		}
+	}
+}
+
+func (r *runner) runActionCodec(action syntax.ActionCodec, envs *ExpandEnvs, decode bool) {
+	err := envs.expandStringPtrs(&action.Value, &action.Encoding, &action.Env)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	var val string
+	if decode {
+		val, err = decodeValue(action.Encoding, action.Value)
+	} else {
+		val, err = encodeValue(action.Encoding, action.Value)
+	}
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	envs.addAndExpand(r.log(), action.Env, val, false)
+}
+
+func (r *runner) runActionJsonEncode(action syntax.ActionJsonEncode, envs *ExpandEnvs) {
+	fields := make(map[string]string, len(action.Fields))
+	for name, val := range action.Fields {
+		err := envs.expandStringPtrs(&val)
+		if err != nil {
+			r.fatalln(err)
+			return
+		}
+		fields[name] = val
+	}
+	content, err := buildJsonObject(fields, action.Types)
+	if err != nil {
+		r.fatalln("build json failed:", err)
+		return
+	}
+	envs.addAndExpand(r.log(), action.Env, content, false)
+}
+
+const defaultRandomBytes = 16
+
+func (r *runner) runActionRandom(action syntax.ActionRandom, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.Env, &action.Type)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	var val string
+	switch action.Type {
+	case "", syntax.RandomTypeUuid:
+		val, err = randomUuid()
+	case syntax.RandomTypeHex:
+		if action.Bytes <= 0 {
+			action.Bytes = defaultRandomBytes
+		}
+		val, err = randomHex(action.Bytes)
+	case syntax.RandomTypeInt:
+		var n int64
+		n, err = randomInt(action.Min, action.Max)
+		val = strconv.FormatInt(n, 10)
+	default:
+		r.fatalln("invalid random type:", action.Type)
+		return
+	}
+	if err != nil {
+		r.fatalln("generate random value failed:", err)
+		return
+	}
+	envs.addAndExpand(r.log(), action.Env, val, false)
+}
+
+func (r *runner) runActionRequireVersion(action syntax.ActionRequireVersion, envs *ExpandEnvs) {
+	action.Args = append([]string(nil), action.Args...)
+	err := envs.expandStringPtrs(&action.Cmd, &action.Require, &action.Pattern, &action.Env)
+	if err == nil {
+		err = envs.expandStringSlice(action.Args)
+	}
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	if len(action.Args) == 0 {
+		action.Args = []string{"--version"}
+	}
+	constraints, err := parseVersionConstraints(action.Require)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	pattern := defaultVersionPattern
+	if action.Pattern != "" {
+		pattern, err = regexp.Compile(action.Pattern)
+		if err != nil {
+			r.fatalln("compile version pattern failed:", err)
+			return
+		}
+	}
+	r.infoln("RequireVersion:", action.Cmd, action.Require)
+
+	path, err := exec.LookPath(action.Cmd)
+	if err != nil {
+		r.fatalln(fmt.Sprintf("requires %s %s, but it's not found", action.Cmd, action.Require))
+		return
+	}
+	cmd := exec.Command(path, action.Args...)
+	cmd.Env = envs.formatEnvs()
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		r.fatalln("run command failed:", err)
+		return
+	}
+	version := extractVersion(pattern, string(output))
+	if version == "" {
+		r.fatalln(fmt.Sprintf("couldn't find version of %s in output: %q", action.Cmd, strings.TrimSpace(string(output))))
+		return
+	}
+	r.debugln("found version:", version)
+	for _, c := range constraints {
+		if !c.match(version) {
+			r.fatalln(fmt.Sprintf("requires %s %s, found %s", action.Cmd, action.Require, version))
+			return
+		}
+	}
+	if action.Env != "" {
+		envs.addAndExpand(r.log(), action.Env, version, false)
+	}
+}
+
+// pollDurations returns interval and timeout of polling actions in milliseconds, 1s and 1m by default.
+func pollDurations(interval, timeout uint) (time.Duration, time.Duration) {
+	i, t := time.Duration(interval)*time.Millisecond, time.Duration(timeout)*time.Millisecond
+	if i == 0 {
+		i = time.Second
+	}
+	if t == 0 {
+		t = time.Minute
+	}
+	return i, t
+}
+
+func (r *runner) runActionRetryUntil(action syntax.ActionRetryUntil, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.Cmd, &action.WorkDir, &action.Operator, &action.Compare, &action.Env)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	var compare *string
+	if action.Compare != "" {
+		compare = &action.Compare
+	}
+	interval, timeout := pollDurations(action.Interval, action.Timeout)
+	r.infoln("RetryUntil:", action.Cmd)
+
+	var (
+		output string
+		// error stops polling
+		stopErr error
+	)
+	attempts, err := poll(interval, timeout, func(n int, remain time.Duration) error {
+		_, out, err := runCommand(envs, action.Cmd, commandOptions{
+			Dir:         action.WorkDir,
+			NeedsOutput: true,
+			Container:   r.taskContainer(),
+			Remote:      r.taskRemote(),
+			Timeout:     remain,
 		})
-		next(a.Del != "", func() {
-			matched, ok := r.expandPathBlockAndGlob(a.Del, envs, false)
-			if !ok {
-				return
-			}
-			r.infoln("Del:", matched)
-			for _, m := range matched {
-				err := os.RemoveAll(m)
-				if err != nil {
-					r.fatalln("task action delete failed:", m, err)
-				}
+		if err != nil {
+			if !action.IgnoreError {
+				stopErr = fmt.Errorf("run command failed: %w", err)
+				return permanentError{stopErr}
 			}
+			r.debugln("attempt", n, "failed:", err)
+			return err
+		}
+		output = out
+		ok, err := checkCondition(envs, output, action.Operator, compare)
+		if err != nil {
+			stopErr = fmt.Errorf("check condition failed: %w", err)
+			return permanentError{stopErr}
+		}
+		r.debugln("attempt", n, "output:", output)
+		if !ok {
+			return fmt.Errorf("condition not satisfied")
+		}
+		return nil
+	})
+	if stopErr != nil {
+		r.fatalln(stopErr)
+		return
+	}
+	if err != nil {
+		r.fatalln(fmt.Sprintf("retry timeout after %d attempts, last output: %q", attempts, output))
+		return
+	}
+	r.infoln("condition satisfied after", attempts, "attempts")
+	if action.Env != "" {
+		envs.addAndExpand(r.log(), action.Env, output, false)
+	}
+}
+
+func (r *runner) runActionPoll(action syntax.ActionPoll, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.Cmd, &action.WorkDir, &action.AttemptsEnv)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	interval, timeout := pollDurations(action.Interval, action.Timeout)
+	r.infoln("Poll:", action.Cmd)
+
+	var output bytes.Buffer
+	attempts, err := poll(interval, timeout, func(n int, remain time.Duration) error {
+		output.Reset()
+		_, _, err := runCommand(envs, action.Cmd, commandOptions{
+			Dir:       action.WorkDir,
+			Fds:       commandFds{Stdout: &output, Stderr: &output},
+			Container: r.taskContainer(),
+			Remote:    r.taskRemote(),
+			Timeout:   remain,
 		})
-		next(a.Replace.File != "", func() {
-			if len(a.Replace.Replaces) <= 0 || len(a.Replace.Replaces)%2 != 0 {
-				r.fatalln("invalid replaces pairs")
-			}
-			matched, ok := r.expandPathBlockAndGlob(a.Replace.File, envs, true)
-			if !ok {
-				return
-			}
-			r.infoln("Replace:", matched)
-			r.debugln("Replacements:", a.Replace.Replaces)
-			replacer, err := fileReplacer(a.Replace.Replaces, a.Replace.Regexp)
-			if err != nil {
-				r.fatalln("build replacer failed:", err)
-				return
+		if err != nil {
+			r.debugln("attempt", n, "failed:", err)
+		}
+		return err
+	})
+	io.WriteString(os.Stdout, maskSecrets(output.String()))
+	if err != nil {
+		r.fatalln(fmt.Sprintf("poll timeout after %d attempts, last error: %s", attempts, err))
+		return
+	}
+	r.infoln("command succeeded after", attempts, "attempts")
+	if action.AttemptsEnv != "" {
+		envs.addAndExpand(r.log(), action.AttemptsEnv, strconv.Itoa(attempts), false)
+	}
+}
+
+func (r *runner) runActionWhich(action syntax.ActionWhich, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.Cmd)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	if action.Env == "" {
+		r.fatalln("env name is empty")
+		return
+	}
+	r.infoln("Which:", action.Cmd)
+	path, err := exec.LookPath(action.Cmd)
+	if err == nil {
+		path, err = filepath.Abs(path)
+	}
+	if err != nil {
+		if !errors.Is(err, exec.ErrNotFound) || !action.AllowMissing {
+			r.fatalln("lookup executable failed:", err)
+			return
+		}
+		r.debugln("executable not found:", action.Cmd)
+		path = ""
+	}
+	envs.addAndExpand(r.log(), action.Env, stringToSlash(path), false)
+}
+
+func (r *runner) runActionVerifyManifest(action syntax.ActionVerifyManifest, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.Manifest, &action.Alg, &action.Dir)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	r.resolvePathPtrs(&action.Manifest, &action.Dir)
+	if action.Alg == "" {
+		action.Alg = syntax.ResourceHashAlgSha256
+	}
+	creator := hashCreator(strings.ToUpper(action.Alg))
+	if creator == nil {
+		r.fatalln("invalid hash alg:", action.Alg)
+		return
+	}
+	if action.Dir == "" {
+		action.Dir = stringToSlash(filepath.Dir(stringFromSlash(action.Manifest)))
+	}
+	r.infoln("VerifyManifest:", stringToSlash(action.Manifest))
+
+	content, err := ioutil.ReadFile(stringFromSlash(action.Manifest))
+	if err != nil {
+		r.fatalln("read manifest failed:", err)
+		return
+	}
+	var (
+		failures []string
+		count    int
+	)
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			r.fatalln(fmt.Sprintf("invalid manifest line %d: %s", i+1, line))
+			return
+		}
+		sig := fields[0]
+		// binary mode marker of sha256sum
+		path := strings.TrimPrefix(strings.TrimLeft(fields[1], " "), "*")
+		fullPath := stringFromSlash(path)
+		if !filepath.IsAbs(fullPath) {
+			fullPath = filepath.Join(stringFromSlash(action.Dir), fullPath)
+		}
+		count++
+		digest, err := fileDigest(fullPath, creator)
+		switch {
+		case os.IsNotExist(err):
+			failures = append(failures, path+": missing")
+		case err != nil:
+			failures = append(failures, path+": "+err.Error())
+		case !digestMatches(digest, sig):
+			failures = append(failures, path+": checksum mismatched")
+		default:
+			r.debugln("verified:", path)
+		}
+	}
+	if len(failures) > 0 {
+		r.fatalln(fmt.Sprintf("verify manifest failed, %d of %d files:\n%s", len(failures), count, strings.Join(failures, "\n")))
+	}
+}
+
+func (r *runner) runActionDirChecksum(action syntax.ActionDirChecksum, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.Dir, &action.Alg, &action.Env, &action.Expected, &action.Compare)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	r.resolvePathPtrs(&action.Dir, &action.Compare)
+	if action.Alg == "" {
+		action.Alg = syntax.ResourceHashAlgSha256
+	}
+	creator := hashCreator(strings.ToUpper(action.Alg))
+	if creator == nil {
+		r.fatalln("invalid hash alg:", action.Alg)
+		return
+	}
+	r.infoln("DirChecksum:", action.Dir)
+
+	digest, entries, err := dirDigest(action.Dir, creator, action.IgnoreMode)
+	if err != nil {
+		r.fatalln("compute directory checksum failed:", err)
+		return
+	}
+	sum := hex.EncodeToString(digest)
+	r.debugln("checksum:", sum)
+	if action.Env != "" {
+		envs.addAndExpand(r.log(), action.Env, sum, false)
+	}
+	if action.Expected != "" && !digestMatches(digest, action.Expected) {
+		r.fatalln(fmt.Sprintf("directory checksum mismatched, expected: %s, actual: %s", action.Expected, sum))
+		return
+	}
+	if action.Compare != "" {
+		compareDigest, compareEntries, err := dirDigest(action.Compare, creator, action.IgnoreMode)
+		if err != nil {
+			r.fatalln("compute directory checksum failed:", err)
+			return
+		}
+		if !bytes.Equal(digest, compareDigest) {
+			r.fatalln(fmt.Sprintf("directory mismatched with %s:\n%s", action.Compare, strings.Join(diffDirEntries(entries, compareEntries), "\n")))
+			return
+		}
+	}
+}
+
+func (r *runner) runActionPatch(action syntax.ActionPatch, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.File, &action.Dir)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	r.resolvePathPtrs(&action.File, &action.Dir)
+	if action.Dir == "" {
+		action.Dir = r.resolvePath(".")
+	}
+	content := action.Content
+	if action.File != "" {
+		r.infoln("Patch:", action.File)
+		data, err := ioutil.ReadFile(stringFromSlash(action.File))
+		if err != nil {
+			r.fatalln("read patch file failed:", err)
+			return
+		}
+		content = string(data)
+	} else {
+		r.infoln("Patch")
+	}
+	patches, err := parsePatch(content)
+	if err != nil {
+		r.fatalln("parse patch failed:", err)
+		return
+	}
+	var results []patchResult
+	for _, p := range patches {
+		result, err := applyFilePatch(stringFromSlash(action.Dir), p, action.Strip)
+		if err != nil {
+			r.fatalln("apply patch failed:", err)
+			return
+		}
+		results = append(results, result)
+	}
+	for _, result := range results {
+		path := stringToSlash(result.path)
+		switch {
+		case result.applied:
+			r.debugln("already patched:", path)
+		case result.remove:
+			r.debugln("remove:", path)
+			err = os.Remove(result.path)
+		default:
+			r.debugln("patch:", path)
+			var fd *os.File
+			fd, err = openFile(result.path, false, defaultFileMode)
+			if err == nil {
+				_, err = fd.WriteString(result.content)
+				fd.Close()
 			}
-			for _, m := range matched {
-				err = replacer(m)
-				if err != nil {
-					r.fatalln("replace file failed:", a.Replace.File, err)
+		}
+		if err != nil {
+			r.fatalln("write patched file failed:", path, err)
+			return
+		}
+	}
+}
+
+func (r *runner) runActionSync(action syntax.ActionSync, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.Dir, &action.Files, &action.Dest)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	remote := r.taskRemote()
+	if action.Host.Address != "" {
+		var ok bool
+		remote, ok = r.newRemote(envs, action.Host)
+		if !ok {
+			return
+		}
+		defer remote.close()
+	}
+	if remote == nil {
+		r.fatalln("remote host of sync is not specified")
+		return
+	}
+	r.resolvePathPtrs(&action.Dir)
+	if action.Dir == "" {
+		action.Dir = r.resolvePath(".")
+	}
+	dest := remote.remotePath(action.Dest)
+	r.infoln("Sync:", action.Dir, remote.Address+":"+dest)
+
+	files, err := localSyncFiles(stringFromSlash(action.Dir), splitBlocks(action.Files))
+	if err != nil {
+		r.fatalln("list local files failed:", err)
+		return
+	}
+	client, err := remote.sftp()
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	defer client.Close()
+	stats, err := syncFiles(client, stringFromSlash(action.Dir), files, dest, action.Delete, action.Force)
+	if err != nil {
+		r.fatalln("sync files failed:", err)
+		return
+	}
+	r.debugln(fmt.Sprintf("uploaded: %d, skipped: %d, removed: %d", stats.uploaded, stats.skipped, stats.removed))
+}
+
+func (r *runner) runActionEnsureAbsent(action syntax.ActionEnsureAbsent, envs *ExpandEnvs) {
+	matched, ok := r.expandPathBlockAndGlob(action.Paths, envs, false)
+	if !ok {
+		return
+	}
+	r.infoln("EnsureAbsent:", matched)
+	root := r.basePath()
+	if root == "" {
+		root = "."
+	}
+	for _, m := range matched {
+		path := stringFromSlash(m)
+		err := checkRemovable(path, stringFromSlash(root), action.AllowOutside)
+		if err != nil {
+			r.fatalln(err)
+			return
+		}
+		if action.Recursive {
+			err = os.RemoveAll(path)
+		} else {
+			err = os.Remove(path)
+			if err != nil && !os.IsNotExist(err) {
+				if stat, serr := os.Lstat(path); serr == nil && stat.IsDir() {
+					err = fmt.Errorf("directory is not empty, set recursive to remove it: %s", m)
 				}
 			}
-		})
-		next(a.Chmod.Path != "", func() {
-			matched, ok := r.expandPathBlockAndGlob(a.Chmod.Path, envs, false)
-			if !ok {
+		}
+		if err != nil && !os.IsNotExist(err) {
+			r.fatalln("remove path failed:", err)
+			return
+		}
+	}
+}
+
+func (r *runner) runActionLinkTree(action syntax.ActionLinkTree, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.Source, &action.Dest)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	if action.Dest == "" {
+		r.fatalln("link tree dest is empty")
+		return
+	}
+	r.resolvePathPtrs(&action.Source, &action.Dest)
+	r.infoln("LinkTree:", action.Source, action.Dest)
+	linked, err := linkTree(stringFromSlash(action.Dest), stringFromSlash(action.Source), action.Overwrite, action.Relative)
+	if err != nil {
+		r.fatalln("link tree failed:", err)
+		return
+	}
+	r.debugln("files linked:", linked)
+}
+
+func (r *runner) runActionGenerate(action syntax.ActionGenerate, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.Source, &action.Dest)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	if action.Dest == "" {
+		r.fatalln("generate dest is empty")
+		return
+	}
+	r.resolvePathPtrs(&action.Source, &action.Dest)
+	r.infoln("Generate:", action.Source, action.Dest)
+	generated, err := generateTree(stringFromSlash(action.Dest), stringFromSlash(action.Source), envs.envs, action.Overwrite, action.Durable)
+	if err != nil {
+		r.fatalln("generate files failed:", err)
+		return
+	}
+	r.debugln("files generated:", generated)
+}
+
+func (r *runner) runActionValidate(action syntax.ActionValidate, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.Format)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	matched, ok := r.expandPathBlockAndGlob(action.Files, envs, true)
+	if !ok {
+		return
+	}
+	if len(matched) == 0 {
+		r.fatalln("no files matched:", action.Files)
+		return
+	}
+	r.infoln("Validate:", matched)
+	for _, m := range matched {
+		format := action.Format
+		if format == "" {
+			switch strings.ToLower(filepath.Ext(m)) {
+			case ".json":
+				format = syntax.ValidateFormatJson
+			case ".yaml", ".yml":
+				format = syntax.ValidateFormatYaml
+			default:
+				r.fatalln("couldn't detect file format:", m)
 				return
 			}
-			r.infoln("Chmod:", matched)
-			for _, m := range matched {
-				err := os.Chmod(m, os.FileMode(a.Chmod.Mode))
-				if err != nil {
-					r.fatalln("chmod failed:", m, err)
-				}
-			}
-		})
-		next(a.Chdir.Actions.Length() > 0, func() {
-			err := envs.expandStringPtrs(&a.Chdir.Dir)
+		}
+		err = validateFile(stringFromSlash(m), format, action.RequiredKeys)
+		if err != nil {
+			r.fatalln("validate file failed:", m, err)
+			return
+		}
+	}
+}
+
+func (r *runner) runActionVerify(action syntax.ActionVerify, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.File, &action.Size, &action.Checksum)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	r.resolvePathPtrs(&action.File)
+	r.infoln("Verify:", stringToSlash(action.File))
+	var (
+		size     int64 = -1
+		creator  func() hash.Hash
+		checksum string
+	)
+	if action.Size != "" {
+		size, err = parseSize(action.Size)
+		if err != nil {
+			r.fatalln(err)
+			return
+		}
+	}
+	if action.Checksum != "" {
+		creator, checksum, err = parseChecksum(action.Checksum)
+		if err != nil {
+			r.fatalln(err)
+			return
+		}
+	}
+	failures, err := verifyFile(stringFromSlash(action.File), size, creator, checksum, action.AllowEmpty)
+	if err != nil {
+		r.fatalln("verify file failed:", err)
+		return
+	}
+	if len(failures) > 0 {
+		r.fatalln("verify file failed:", stringToSlash(action.File)+":", strings.Join(failures, "; "))
+		return
+	}
+	r.debugln("file verified")
+}
+
+func (r *runner) runActionDiff(action syntax.ActionDiff, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.File, &action.Expected, &action.Content)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	var update bool
+	if action.Update != "" {
+		val, err := envs.expandString(action.Update)
+		if err != nil {
+			r.fatalln(err)
+			return
+		}
+		update, err = checkCondition(envs, val, "", nil)
+		if err != nil {
+			r.fatalln("couldn't eval value of 'update' field:", action.Update, err)
+			return
+		}
+	}
+	r.resolvePathPtrs(&action.File, &action.Expected)
+	if action.Context <= 0 {
+		action.Context = 3
+	}
+	r.infoln("Diff:", stringToSlash(action.File), stringToSlash(action.Expected))
+
+	actual, err := ioutil.ReadFile(stringFromSlash(action.File))
+	if err != nil {
+		r.fatalln("read file failed:", err)
+		return
+	}
+	expected := []byte(action.Content)
+	expectedName := "expected"
+	if action.Expected != "" {
+		expectedName = action.Expected
+		expected, err = ioutil.ReadFile(stringFromSlash(action.Expected))
+		if err != nil && !(update && os.IsNotExist(err)) {
+			r.fatalln("read expected file failed:", err)
+			return
+		}
+	}
+	if bytes.Equal(actual, expected) {
+		r.debugln("files are identical")
+		return
+	}
+	if update {
+		if action.Expected == "" {
+			r.fatalln("couldn't update inline expected content")
+			return
+		}
+		r.infoln("update expected file:", stringToSlash(action.Expected))
+		err = copyFile(stringFromSlash(action.Expected), stringFromSlash(action.File))
+		if err != nil {
+			r.fatalln("update expected file failed:", err)
+		}
+		return
+	}
+	diff := unifiedDiff(expectedName, action.File, string(expected), string(actual), action.Context)
+	r.fatalln("files are different:\n" + strings.TrimSuffix(diff, "\n"))
+}
+
+func (r *runner) runActionDrift(action syntax.ActionDrift, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.CountEnv)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	fail, ok := r.checkBoolString(envs, "fail", action.Fail)
+	if !ok {
+		return
+	}
+	if action.Context <= 0 {
+		action.Context = 3
+	}
+	r.infoln("Drift.")
+
+	var items []driftItem
+	for _, f := range action.Files {
+		err := envs.expandStringPtrs(&f.Path, &f.Content, &f.Source, &f.Mode)
+		if err != nil {
+			r.fatalln(err)
+			return
+		}
+		if f.Path == "" {
+			r.fatalln("drift file path is empty")
+			return
+		}
+		r.resolvePathPtrs(&f.Path, &f.Source)
+		want := desiredFile{
+			path:    stringFromSlash(f.Path),
+			content: []byte(f.Content),
+			absent:  f.Absent,
+		}
+		if f.Mode != "" {
+			want.mode, err = parseFileMode(f.Mode)
 			if err != nil {
 				r.fatalln(err)
 				return
 			}
-			r.infoln("Chdir:", a.Chdir.Dir)
-			err = runInDir(a.Chdir.Dir, func() error {
-				r.addIndent().runActions(envs, a.Chdir.Actions)
-				return nil
-			})
-			if err != nil {
-				r.fatalln("chdir failed:", err)
-				return
-			}
-		})
-		next(a.Mkdir != "", func() {
-			err := envs.expandStringPtrs(&a.Mkdir)
+		}
+		if f.Source != "" && !f.Absent {
+			want.content, err = ioutil.ReadFile(stringFromSlash(f.Source))
 			if err != nil {
-				r.fatalln(err)
+				r.fatalln("read desired file failed:", err)
 				return
 			}
-			blocks := splitBlocks(a.Mkdir)
+		}
+		item, err := fileDrift(want, action.Context)
+		if err != nil {
+			r.fatalln("compare file failed:", f.Path, err)
+			return
+		}
+		if item != nil {
+			items = append(items, *item)
+		}
+	}
+	var names []string
+	for name := range action.Envs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		want, err := envs.expandString(action.Envs[name])
+		if err != nil {
+			r.fatalln(err)
+			return
+		}
+		if item := envDrift(envs, name, want); item != nil {
+			items = append(items, *item)
+		}
+	}
 
-			r.infoln("Mkdir:", blocks)
-			for _, dir := range blocks {
-				err = os.MkdirAll(dir, 0755)
-				if err != nil {
-					r.fatalln("mkdir failed:", err)
-					return
-				}
+	if action.CountEnv != "" {
+		envs.addAndExpand(r.log(), action.CountEnv, strconv.Itoa(len(items)), false)
+	}
+	if len(items) == 0 {
+		r.infoln("no drift detected")
+		return
+	}
+	lines := []string{fmt.Sprintf("drift detected: %d items", len(items))}
+	for _, item := range items {
+		lines = append(lines, item.String())
+	}
+	report := strings.Join(lines, "\n")
+	if fail {
+		r.fatalln(report)
+		return
+	}
+	r.warnln(report)
+}
+
+func (r *runner) expandPathBlockAndGlob(path string, envs *ExpandEnvs, mustBeFile bool) ([]string, bool) {
+	err := envs.expandStringPtrs(&path)
+	if err != nil {
+		r.fatalln(err)
+		return nil, false
+	}
+	blocks := splitBlocks(path)
+	r.resolvePaths(blocks)
+	matched, err := globPaths(blocks, mustBeFile)
+	if err != nil {
+		r.fatalln("glob path failed:", err)
+		return nil, false
+	}
+	return matched, true
+}
+
+func (r *runner) runActions(envs *ExpandEnvs, a syntax.ActionList) {
+	for i, a := range a.Actions() {
+		if r.parallelLoop().isCanceled() {
+			return
+		}
+		r.runAction(envs, i, a)
+	}
+}
+
+// runListActions runs actions of named list such as 'before' and 'else', the name distinguishes
+// positions of actions in lists of same action.
+func (r *runner) runListActions(envs *ExpandEnvs, list string, a syntax.ActionList) {
+	prev := r.list
+	r.list = list
+	defer func() {
+		r.list = prev
+	}()
+	r.runActions(envs, a)
+}
+
+// runActionsAll runs all actions even if some of them failed, returns failures of failed actions.
+func (r *runner) runActionsAll(envs *ExpandEnvs, a syntax.ActionList) []string {
+	var failures []string
+	for i, a := range a.Actions() {
+		if r.parallelLoop().isCanceled() {
+			break
+		}
+		nr := r.isolated()
+		nr.runAction(envs, i, a)
+		if nr.failed {
+			failure := nr.failure
+			if failure == "" {
+				failure = actionKind(a) + " failed"
 			}
-		})
-		next(a.Template != "", func() {
-			templates := splitBlocks(a.Template)
-			r.infoln("Template:", templates)
-			for _, template := range templates {
-				if len(templates) > 1 {
-					r.infoln(">>>>> template:", template)
-				}
-				r.runActionTemplate(template, envs)
+			failures = append(failures, failure)
+		}
+	}
+	return failures
+}
+
+// taskName returns name of nearest task.
+func (r *runner) taskName() string {
+	for rt := r; rt != nil; rt = rt.parent {
+		if rt.task != "" {
+			return rt.task
+		}
+	}
+	return ""
+}
+
+// runAction runs action at index of its action list.
+func (r *runner) runAction(envs *ExpandEnvs, index int, a syntax.Action) {
+	prevAction, prevIndex := r.action, r.actionIndex
+	r.action, r.actionIndex = &a, index
+	defer func() {
+		r.action, r.actionIndex = prevAction, prevIndex
+	}()
+	if disabled, ok := r.checkBoolString(envs, "disabled", a.Disabled); !ok || disabled {
+		if disabled {
+			r.infoln("action is disabled, skipped:", actionKind(a))
+		}
+		return
+	}
+	if a.On != "" {
+		val, err := envs.expandString(a.On)
+		if err != nil {
+			r.fatalln(err)
+		}
+		ok, err := checkCondition(envs, val, "", nil)
+		if err != nil {
+			r.fatalln("check condition failed:", err)
+		}
+		if !ok {
+			r.debugln("action condition failed")
+			return
+		}
+
+		r.debugln("action condition passed")
+	}
+	if t := r.root().timings; t != nil {
+		defer t.record(timingKindAction, r.actionName(a), time.Now())
+	}
+	defer envs.setScoped(syntax.BUILTIN_ENV_TASH_TASK, r.taskName())()
+	defer envs.setScoped(syntax.BUILTIN_ENV_TASH_ACTION_INDEX, strconv.Itoa(index+1))()
+	defer envs.setScoped(syntax.BUILTIN_ENV_TASH_ACTION_TYPE, actionKind(a))()
+	if a.LocalEnv.Length() > 0 {
+		r.debugln(">>>>> add action local environments")
+		restore := envs.overlay(r.addIndentIfDebug().log(), a.LocalEnv)
+		defer restore()
+	}
+	var done bool
+	next := func(cond bool, fn func()) {
+		if cond && !done && !r.scope().failed {
+			fn()
+			done = true
+		}
+	}
+	next(a.Env.Length() > 0, func() {
+		r.debugln("Env")
+		envs.parseEnv(r.addIndentIfDebug().log(), a.Env)
+	})
+	next(a.Cmd.Exec != "", func() {
+		err := envs.expandStringPtrs(&a.Cmd.Exec, &a.Cmd.WorkDir, &a.Cmd.Stdin, &a.Cmd.Stdout, &a.Cmd.Stderr, &a.Cmd.FileMode)
+		if err != nil {
+			r.fatalln(err)
+			return
+		}
+
+		execs := stringSplitAndTrim(a.Cmd.Exec, "\n")
+		r.infoln("Cmd")
+		r.addIndent().runActionCmd(a.Cmd, envs, execs)
+	})
+	next(a.Script.Content != "", func() {
+		err := envs.expandStringPtrs(&a.Script.Interpreter, &a.Script.WorkDir, &a.Script.Stdin, &a.Script.Stdout, &a.Script.Stderr, &a.Script.FileMode)
+		if err == nil {
+			a.Script.Args = append([]string(nil), a.Script.Args...)
+			err = envs.expandStringSlice(a.Script.Args)
+		}
+		if err != nil {
+			r.fatalln(err)
+			return
+		}
+		r.infoln("Script")
+		r.addIndent().runActionScript(a.Script, envs)
+	})
+	next(a.Copy.DestPath != "", func() {
+		err := envs.expandStringPtrs(&a.Copy.SourceUrl, &a.Copy.DestPath)
+		if err != nil {
+			r.fatalln(err)
+		}
+		ptrsToSlash(&a.Copy.SourceUrl, &a.Copy.DestPath)
+		if !strings.Contains(a.Copy.SourceUrl, "://") {
+			a.Copy.SourceUrl = r.resolvePath(a.Copy.SourceUrl)
+		}
+		a.Copy.DestPath = r.resolvePath(a.Copy.DestPath)
+		r.infoln("Copy:", a.Copy.SourceUrl, a.Copy.DestPath)
+		r.addIndentIfDebug().runActionCopy(a.Copy, envs)
+	})
+	next(a.Del != "", func() {
+		matched, ok := r.expandPathBlockAndGlob(a.Del, envs, false)
+		if !ok {
+			return
+		}
+		r.infoln("Del:", matched)
+		for _, m := range matched {
+			err := os.RemoveAll(m)
+			if err != nil {
+				r.fatalln("task action delete failed:", m, err)
 			}
-		})
-		next(len(a.Switch.Cases) > 0, func() {
-			r.debugln("Switch")
-			r.runActionSwitch(a.Switch, envs)
-		})
-		next(a.If.Actions.Length() > 0 || a.If.Else.Length() > 0, func() {
-			r.debugln("If")
-			r.addIndentIfDebug().runActionIf(a.If, envs)
-		})
-		next(a.Loop.Actions.Length() > 0, func() {
-			r.debugln("Loop")
-			r.runActionLoop(a.Loop, envs)
-		})
-		next(a.Silent.Actions.Length() > 0, func() {
-			r.debugln("Silent")
-			var (
-				showLog    bool
-				allowError bool
-			)
-			for _, flag := range a.Silent.Flags {
-				switch flag {
-				case syntax.SilentFlagShowLog:
-					showLog = true
-				case syntax.SilentFlagAllowError:
-					allowError = true
-				default:
-					r.warnln("invalid silent flag:", flag)
-				}
+		}
+	})
+	next(a.EnsureAbsent.Paths != "", func() {
+		r.runActionEnsureAbsent(a.EnsureAbsent, envs)
+	})
+	next(a.Replace.File != "", func() {
+		if len(a.Replace.Replaces) <= 0 || len(a.Replace.Replaces)%2 != 0 {
+			r.fatalln("invalid replaces pairs")
+		}
+		matched, ok := r.expandPathBlockAndGlob(a.Replace.File, envs, true)
+		if !ok {
+			return
+		}
+		r.infoln("Replace:", matched)
+		r.debugln("Replacements:", a.Replace.Replaces)
+		replacer, err := fileReplacer(a.Replace.Replaces, a.Replace.Regexp)
+		if err != nil {
+			r.fatalln("build replacer failed:", err)
+			return
+		}
+		for _, m := range matched {
+			err = replacer(m)
+			if err != nil {
+				r.fatalln("replace file failed:", a.Replace.File, err)
 			}
-			r.addIndentIfDebug().silent(!showLog, allowError).runActions(envs, a.Silent.Actions)
-		})
-		next(a.Echo != (syntax.ActionEcho{}), func() {
-			err := envs.expandStringPtrs(&a.Echo.File, &a.Echo.Content)
+		}
+	})
+	next(a.Chmod.Path != "", func() {
+		matched, ok := r.expandPathBlockAndGlob(a.Chmod.Path, envs, false)
+		if !ok {
+			return
+		}
+		r.infoln("Chmod:", matched)
+		for _, m := range matched {
+			err := os.Chmod(m, os.FileMode(a.Chmod.Mode))
 			if err != nil {
-				r.fatalln(err)
-				return
+				r.fatalln("chmod failed:", m, err)
 			}
-			r.infoln("Echo:", a.Echo.File)
-			func() {
-				fd, err := openFile(a.Echo.File, a.Echo.Append)
-				if err != nil {
-					r.fatalln("open file failed:", err)
-					return
-				}
-				defer fd.Close()
-				_, err = fd.WriteString(a.Echo.Content)
-				if err != nil {
-					r.warnln("write file failed:", err)
-				}
-			}()
+		}
+	})
+	next(a.Chdir.Actions.Length() > 0, func() {
+		err := envs.expandStringPtrs(&a.Chdir.Dir)
+		if err != nil {
+			r.fatalln(err)
+			return
+		}
+		a.Chdir.Dir = r.resolvePath(a.Chdir.Dir)
+		r.infoln("Chdir:", stringToSlash(a.Chdir.Dir))
+		if !r.checkProcessStateChangeable("chdir") {
+			return
+		}
+		dir, err := filepath.Abs(stringFromSlash(a.Chdir.Dir))
+		if err != nil {
+			r.fatalln("get directory absolute path failed:", err)
+			return
+		}
+		err = runInDir(dir, func() error {
+			cr := r.addIndent()
+			cr.pathBase = dir
+			cr.runActions(envs, a.Chdir.Actions)
+			return nil
 		})
-		next(a.Task.Name != "", func() {
-			err := envs.expandStringPtrs(&a.Task.Name)
+		if err != nil {
+			r.fatalln("chdir failed:", err)
+			return
+		}
+	})
+	next(a.Lock.File != "", func() {
+		r.runActionLock(a.Lock, envs)
+	})
+	next(a.Mkdir != "", func() {
+		err := envs.expandStringPtrs(&a.Mkdir)
+		if err != nil {
+			r.fatalln(err)
+			return
+		}
+		blocks := splitBlocks(a.Mkdir)
+		r.resolvePaths(blocks)
+
+		r.infoln("Mkdir:", sliceToSlash(blocks))
+		for _, dir := range blocks {
+			err = os.MkdirAll(dir, 0755)
 			if err != nil {
-				r.fatalln(err)
+				r.fatalln("mkdir failed:", err)
 				return
 			}
-			tasks := splitBlocks(a.Task.Name)
-			r.infoln("Task:", tasks)
-			for _, name := range tasks {
-				if len(tasks) > 1 {
-					r.infoln(">>>>>task:", name)
-				}
-				r.runActionTask(name, a.Task.PassEnvs, a.Task.ReturnEnvs, envs)
+		}
+	})
+	next(a.Template.Name != "", func() {
+		templates := splitBlocks(a.Template.Name)
+		r.infoln("Template:", templates)
+		for _, template := range templates {
+			if len(templates) > 1 {
+				r.infoln(">>>>> template:", template)
 			}
-		})
-		next(a.Watch.Actions.Length() > 0, func() {
-			r.infoln("Watch.")
-			r.runActionWatch(a.Watch, envs)
-		})
-		next(a.Pkill != (syntax.ActionPkill{}), func() {
-			r.infoln("Pkill.")
-
-			r.runActionPkill(a.Pkill, envs)
-		})
-		next(a.Sleep > 0, func() {
-			dur := time.Duration(a.Sleep) * time.Millisecond
-			r.infoln("Sleep:", dur.String())
-
-			time.Sleep(dur)
-		})
-		next(a.Wait != (syntax.ActionWait{}), func() {
-			r.infoln("Wait.")
-
-			r.runActionWait(a.Wait, envs)
-		})
-		next(a.Warn != "", func() {
-			r.debugln("Warn.")
-			err := envs.expandStringPtrs(&a.Warn)
+			r.runActionTemplate(template, a.Template, envs)
+		}
+	})
+	next(len(a.Switch.Cases) > 0, func() {
+		r.debugln("Switch")
+		r.runActionSwitch(a.Switch, envs)
+	})
+	next(a.If.Actions.Length() > 0 || a.If.Else.Length() > 0, func() {
+		r.debugln("If")
+		r.addIndentIfDebug().runActionIf(a.If, envs)
+	})
+	next(a.Loop.Actions.Length() > 0, func() {
+		r.debugln("Loop")
+		r.runActionLoop(a.Loop, envs)
+	})
+	next(a.Retry.Actions.Length() > 0, func() {
+		r.infoln("Retry.")
+		r.runActionRetry(a.Retry, envs)
+	})
+	next(a.RunAll.Actions.Length() > 0, func() {
+		r.debugln("RunAll")
+		r.runActionRunAll(a.RunAll, envs)
+	})
+	next(a.Silent.Actions.Length() > 0, func() {
+		r.debugln("Silent")
+		var (
+			showLog    bool
+			allowError bool
+		)
+		for _, flag := range a.Silent.Flags {
+			switch flag {
+			case syntax.SilentFlagShowLog:
+				showLog = true
+			case syntax.SilentFlagAllowError:
+				allowError = true
+			default:
+				r.warnln("invalid silent flag:", flag)
+			}
+		}
+		r.addIndentIfDebug().silent(!showLog, allowError).runActions(envs, a.Silent.Actions)
+	})
+	next(a.Echo != (syntax.ActionEcho{}), func() {
+		err := envs.expandStringPtrs(&a.Echo.File, &a.Echo.Content, &a.Echo.Mode)
+		if err != nil {
+			r.fatalln(err)
+			return
+		}
+		mode, err := parseFileMode(a.Echo.Mode)
+		if err != nil {
+			r.fatalln(err)
+			return
+		}
+		a.Echo.File = r.resolvePath(a.Echo.File)
+		r.infoln("Echo:", stringToSlash(a.Echo.File))
+		func() {
+			fd, err := openFile(a.Echo.File, a.Echo.Append, mode)
 			if err != nil {
-				r.fatalln(err)
+				r.fatalln("open file failed:", err)
 				return
 			}
-			r.warnln(a.Warn)
-		})
-		next(a.Fatal != "", func() {
-			r.debugln("Fatal.")
-			err := envs.expandStringPtrs(&a.Fatal)
+			_, err = fd.WriteString(a.Echo.Content)
 			if err != nil {
-				r.fatalln(err)
-				return
+				r.warnln("write file failed:", err)
 			}
-			r.fatalln(a.Fatal)
-		})
-	}
+			err = closeFile(fd, a.Echo.Durable)
+			if err != nil {
+				r.fatalln("close file failed:", err)
+			}
+		}()
+	})
+	next(a.CiOutput.Envs != "", func() {
+		r.infoln("CiOutput:", a.CiOutput.Envs)
+		r.runActionCiOutput(a.CiOutput, envs)
+	})
+	next(a.SetEnv.Set.Length() > 0 || len(a.SetEnv.Unset) > 0, func() {
+		r.debugln("SetEnv")
+		r.addIndentIfDebug().runActionSetEnv(a.SetEnv, envs)
+	})
+	next(a.Match.Regexp != "", func() {
+		r.debugln("Match")
+		r.addIndentIfDebug().runActionMatch(a.Match, envs)
+	})
+	next(a.Random.Env != "", func() {
+		r.debugln("Random")
+		r.addIndentIfDebug().runActionRandom(a.Random, envs)
+	})
+	next(a.Encode.Env != "", func() {
+		r.debugln("Encode")
+		r.addIndentIfDebug().runActionCodec(a.Encode, envs, false)
+	})
+	next(a.Decode.Env != "", func() {
+		r.debugln("Decode")
+		r.addIndentIfDebug().runActionCodec(a.Decode, envs, true)
+	})
+	next(a.JsonEncode.Env != "", func() {
+		r.debugln("JsonEncode")
+		r.addIndentIfDebug().runActionJsonEncode(a.JsonEncode, envs)
+	})
+	next(a.Source.Script != "", func() {
+		r.infoln("Source:", a.Source.Script)
+		r.addIndentIfDebug().runActionSource(a.Source, envs)
+	})
+	next(a.Merge.Output != "", func() {
+		r.runActionMerge(a.Merge, envs)
+	})
+	next(a.LineInFile.File != "", func() {
+		r.runActionLineInFile(a.LineInFile, envs)
+	})
+	next(a.Which.Cmd != "", func() {
+		r.runActionWhich(a.Which, envs)
+	})
+	next(a.RequireVersion.Cmd != "", func() {
+		r.runActionRequireVersion(a.RequireVersion, envs)
+	})
+	next(a.RetryUntil.Cmd != "", func() {
+		r.runActionRetryUntil(a.RetryUntil, envs)
+	})
+	next(a.Poll.Cmd != "", func() {
+		r.runActionPoll(a.Poll, envs)
+	})
+	next(a.Filter.File != "" || a.Filter.Env != "", func() {
+		r.runActionFilter(a.Filter, envs)
+	})
+	next(a.Sort.File != "" || a.Sort.Env != "", func() {
+		r.runActionSort(a.Sort, envs)
+	})
+	next(a.VerifyManifest.Manifest != "", func() {
+		r.runActionVerifyManifest(a.VerifyManifest, envs)
+	})
+	next(a.Verify.File != "", func() {
+		r.runActionVerify(a.Verify, envs)
+	})
+	next(a.DirChecksum.Dir != "", func() {
+		r.runActionDirChecksum(a.DirChecksum, envs)
+	})
+	next(a.Patch.File != "" || a.Patch.Content != "", func() {
+		r.runActionPatch(a.Patch, envs)
+	})
+	next(a.Sync.Dest != "", func() {
+		r.runActionSync(a.Sync, envs)
+	})
+	next(a.LinkTree.Source != "", func() {
+		r.runActionLinkTree(a.LinkTree, envs)
+	})
+	next(a.Generate.Source != "", func() {
+		r.runActionGenerate(a.Generate, envs)
+	})
+	next(a.Validate.Files != "", func() {
+		r.runActionValidate(a.Validate, envs)
+	})
+	next(a.Diff.File != "", func() {
+		r.runActionDiff(a.Diff, envs)
+	})
+	next(len(a.Drift.Files) > 0 || len(a.Drift.Envs) > 0, func() {
+		r.runActionDrift(a.Drift, envs)
+	})
+	next(a.Stat.Path != "", func() {
+		r.runActionStat(a.Stat, envs)
+	})
+	next(a.Split.File != "", func() {
+		r.runActionSplit(a.Split, envs)
+	})
+	next(a.Task.Name != "", func() {
+		err := envs.expandStringPtrs(&a.Task.Name)
+		if err != nil {
+			r.fatalln(err)
+			return
+		}
+		tasks := splitBlocks(a.Task.Name)
+		r.infoln("Task:", tasks)
+		for _, name := range tasks {
+			if len(tasks) > 1 {
+				r.infoln(">>>>>task:", name)
+			}
+			r.runActionTask(name, a.Task.PassEnvs, a.Task.ReturnEnvs, envs)
+		}
+	})
+	next(a.Watch.Actions.Length() > 0, func() {
+		r.infoln("Watch.")
+		r.runActionWatch(a.Watch, envs)
+	})
+	next(a.Pkill != (syntax.ActionPkill{}), func() {
+		r.infoln("Pkill.")
+
+		r.runActionPkill(a.Pkill, envs)
+	})
+	next(a.Sleep > 0, func() {
+		dur := time.Duration(a.Sleep) * time.Millisecond
+		r.infoln("Sleep:", dur.String())
+
+		time.Sleep(dur)
+	})
+	next(a.Wait != (syntax.ActionWait{}), func() {
+		r.infoln("Wait.")
+
+		r.runActionWait(a.Wait, envs)
+	})
+	next(len(a.WaitAll.Handles) > 0, func() {
+		r.infoln("WaitAll.")
+
+		r.runActionWaitAll(a.WaitAll, envs)
+	})
+	next(a.Warn != "", func() {
+		r.debugln("Warn.")
+		err := envs.expandStringPtrs(&a.Warn)
+		if err != nil {
+			r.fatalln(err)
+			return
+		}
+		r.warnln(a.Warn)
+	})
+	next(a.Fatal != "", func() {
+		r.debugln("Fatal.")
+		err := envs.expandStringPtrs(&a.Fatal)
+		if err != nil {
+			r.fatalln(err)
+			return
+		}
+		r.fatalln(a.Fatal)
+	})
 }
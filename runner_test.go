@@ -0,0 +1,2399 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uiez/tash/syntax"
+)
+
+// runTestTask runs task of tash.yaml in dir by root runner recording failures instead of exiting,
+// it returns message of the first failure, empty if task succeeded.
+func runTestTask(t *testing.T, dir, name string, args ...string) string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	r := newRunner(nil, newLogger(false), testConfiguration(t, dir))
+	r.noExitOnFail = true
+	r.backgrounds = newBackgroundRegistry()
+	r.runTaskByName(name, args, dir)
+	if r.failed && r.failure == "" {
+		return "failed"
+	}
+	return r.failure
+}
+
+// readTestFile returns content of file in dir, it's empty if file doesn't exist.
+func readTestFile(t *testing.T, dir, name string) string {
+	t.Helper()
+	content, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestTaskActionRunsTaskBody(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - task: {name: child}
+  child:
+    before:
+      - echo: {content: before, file: before.txt}
+    actions:
+      - fatal: boom
+      - echo: {content: actions, file: actions.txt}
+    after:
+      - echo: {content: after, file: after.txt}
+  require:
+    actions:
+      - task: {name: requireChild}
+  requireChild:
+    requireEnvs: [TASH_TEST_MISSING_ENV]
+    actions:
+      - echo: {content: actions, file: require.txt}
+`})
+	failure := runTestTask(t, dir, "main")
+	if !strings.Contains(failure, "boom") {
+		t.Errorf("original failure isn't reported: %q", failure)
+	}
+	if readTestFile(t, dir, "before.txt") != "before" || readTestFile(t, dir, "after.txt") != "after" {
+		t.Error("before and after actions of called task should run")
+	}
+	if readTestFile(t, dir, "actions.txt") != "" {
+		t.Error("actions after failure shouldn't run")
+	}
+
+	if failure := runTestTask(t, dir, "require"); !strings.Contains(failure, "TASH_TEST_MISSING_ENV") {
+		t.Errorf("missing required env isn't reported: %q", failure)
+	}
+	if readTestFile(t, dir, "require.txt") != "" {
+		t.Error("actions shouldn't run if required envs are missing")
+	}
+}
+
+func TestTaskActionDoesNotInheritTaskStates(t *testing.T) {
+	r := newRunner(nil, newLogger(false), newConfiguration(false))
+	r.resetTaskStates("caller")
+	r.container.Image = "alpine"
+	r.remote.Address = "example.com:22"
+	r.secrets.values = map[string]string{"TOKEN": "secret"}
+
+	nr := r.addIndent().isolated()
+	nr.resetTaskStates("callee")
+	if nr.taskContainer() != nil {
+		t.Error("container of caller is inherited")
+	}
+	if nr.taskRemote() != nil {
+		t.Error("remote host of caller is inherited")
+	}
+	if len(nr.taskSecrets().values) != 0 {
+		t.Error("secrets of caller are inherited")
+	}
+	if nr.taskLocks() == r.taskLocks() {
+		t.Error("locks of caller are shared")
+	}
+}
+
+func TestTaskActionReleasesLocks(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - task: {name: child}
+      - lock: {file: task.lock}
+  child:
+    actions:
+      - lock: {file: task.lock}
+`})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatalf("lock of called task isn't released after it ends: %s", failure)
+	}
+}
+
+func TestEnsureAbsent(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"build/a.o":  "a",
+		"build/b.o":  "b",
+		"keep/c.txt": "c",
+		"tash.yaml": `
+tasks:
+  present:
+    actions:
+      - ensureAbsent: {paths: "build/*.o"}
+  absent:
+    actions:
+      - ensureAbsent: {paths: "missing.txt"}
+  dir:
+    actions:
+      - ensureAbsent: {paths: keep}
+  recursive:
+    actions:
+      - ensureAbsent: {paths: keep, recursive: true}
+  unsafe:
+    actions:
+      - ensureAbsent: {paths: ".."}
+`,
+	})
+	if failure := runTestTask(t, dir, "present"); failure != "" {
+		t.Fatal(failure)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "build", "a.o")); !os.IsNotExist(err) {
+		t.Error("matched file isn't removed")
+	}
+	if failure := runTestTask(t, dir, "absent"); failure != "" {
+		t.Errorf("absent path should be no-op: %s", failure)
+	}
+	if failure := runTestTask(t, dir, "dir"); failure == "" {
+		t.Error("non-empty directory shouldn't be removed without recursive")
+	}
+	if failure := runTestTask(t, dir, "recursive"); failure != "" {
+		t.Fatal(failure)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "keep")); !os.IsNotExist(err) {
+		t.Error("directory isn't removed recursively")
+	}
+	if failure := runTestTask(t, dir, "unsafe"); !strings.Contains(failure, "refuse") {
+		t.Errorf("removing parent directory should be refused: %q", failure)
+	}
+}
+
+func TestParallelLoop(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  complete:
+    actions:
+      - loop:
+          array: [a, b, c, d]
+          var: ITEM
+          parallel: 2
+          actions:
+            - echo: {content: "${ITEM}", file: "${ITEM}.txt"}
+  failFast:
+    actions:
+      - loop:
+          array: [bad, slow]
+          var: ITEM
+          parallel: 2
+          actions:
+            - switch:
+                value: "${ITEM}"
+                cases:
+                  bad: [{fatal: boom}]
+                  slow: [{sleep: 300}, {echo: {content: slow, file: slow.txt}}]
+  collect:
+    actions:
+      - loop:
+          array: [bad, slow, fine]
+          var: ITEM
+          parallel: 2
+          onFailure: collect
+          actions:
+            - switch:
+                value: "${ITEM}"
+                cases:
+                  bad: [{fatal: boom}]
+                  slow: [{sleep: 300}, {echo: {content: slow, file: collected.txt}}]
+                  fine: [{echo: {content: fine, file: fine.txt}}]
+  chdir:
+    actions:
+      - loop:
+          array: [a, b]
+          parallel: 2
+          actions:
+            - chdir: {dir: ., actions: [{echo: {content: x, file: x.txt}}]}
+  path:
+    actions:
+      - loop:
+          array: [a, b]
+          parallel: 2
+          actions:
+            - env: ["PATH=/tash-test-bin"]
+`})
+	if failure := runTestTask(t, dir, "complete"); failure != "" {
+		t.Fatal(failure)
+	}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if readTestFile(t, dir, name+".txt") != name {
+			t.Errorf("iteration %s isn't completed", name)
+		}
+	}
+
+	if failure := runTestTask(t, dir, "failFast"); !strings.Contains(failure, "loop iterations failed: 1/2") {
+		t.Errorf("fail-fast loop failure: %q", failure)
+	}
+	if readTestFile(t, dir, "slow.txt") != "" {
+		t.Error("running iteration isn't canceled in fail-fast mode")
+	}
+
+	if failure := runTestTask(t, dir, "collect"); !strings.Contains(failure, "loop iterations failed: 1/3") {
+		t.Errorf("collect loop failure: %q", failure)
+	}
+	if readTestFile(t, dir, "collected.txt") != "slow" || readTestFile(t, dir, "fine.txt") != "fine" {
+		t.Error("all iterations should run in collect mode")
+	}
+
+	if failure := runTestTask(t, dir, "chdir"); !strings.Contains(failure, "not allowed in parallel loop") {
+		t.Errorf("chdir in parallel loop should be refused: %q", failure)
+	}
+	path := os.Getenv("PATH")
+	if failure := runTestTask(t, dir, "path"); !strings.Contains(failure, "PATH couldn't be changed") {
+		t.Errorf("changing PATH in parallel loop should be refused: %q", failure)
+	}
+	if os.Getenv("PATH") != path {
+		t.Error("PATH of process is changed by parallel loop")
+	}
+}
+
+// TestParallelLoopFailures should be run with -race, failing iterations share notifier and timings of root runner.
+func TestParallelLoopFailures(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+notify: {file: events.jsonl}
+tasks:
+  failures:
+    actions:
+      - loop:
+          array: [a, b, c, d]
+          var: ITEM
+          parallel: 4
+          onFailure: collect
+          actions:
+            - fatal: "${ITEM} failed"
+`})
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	timings := &taskTimings{Summary: true}
+	r := newRunner(nil, newLogger(false), testConfiguration(t, dir))
+	r.noExitOnFail = true
+	r.backgrounds = newBackgroundRegistry()
+	r.timings = timings
+	r.runTaskByName("failures", nil, dir)
+	if !strings.Contains(r.failure, "loop iterations failed: 4/4") {
+		t.Errorf("parallel loop failure: %q", r.failure)
+	}
+
+	var event taskEvent
+	err = json.Unmarshal([]byte(readTestFile(t, dir, "events.jsonl")), &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Status != taskStatusFailed || !strings.HasSuffix(event.FailedAction, "fatal") {
+		t.Errorf("failed event: %+v", event)
+	}
+	var fatals int
+	for _, rec := range timings.records {
+		if rec.Kind == timingKindAction && strings.HasSuffix(rec.Name, "fatal") {
+			fatals++
+		}
+	}
+	if fatals != 4 {
+		t.Errorf("timing records of failed iterations: %d", fatals)
+	}
+}
+
+func TestRetryBlockOnce(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - retry:
+          times: 2
+          delay: 1
+          actions:
+            - cmd: {exec: "sh -c 'echo x >> once.txt'", once: true}
+            - cmd: {exec: "sh -c 'echo x >> always.txt'"}
+            - cmd: {exec: "sh -c 'echo x >> twice.txt'", once: true}
+            - cmd: {exec: "sh -c 'echo x >> twice.txt'", once: true}
+            - loop:
+                array: [a, b]
+                var: ITEM
+                actions:
+                  - cmd: {exec: "sh -c 'echo ${ITEM} >> loop.txt'", once: true}
+            - if:
+                check: "false"
+                else: [{cmd: {exec: "sh -c 'echo x >> else.txt'", once: true}}]
+            - cmd: {exec: "sh -c 'test -f marker || { touch marker; exit 1; }'"}
+`})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	for name, want := range map[string]string{
+		"once.txt":   "x\n",
+		"always.txt": "x\nx\n",
+		"twice.txt":  "x\nx\n",
+		"loop.txt":   "a\nb\n",
+		"else.txt":   "x\n",
+	} {
+		if content := readTestFile(t, dir, name); content != want {
+			t.Errorf("%s: %q, want %q", name, content, want)
+		}
+	}
+}
+
+func TestPollAction(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  succeed:
+    actions:
+      - poll:
+          cmd: "sh -c 'echo x >> attempts.txt; test -f ready || { test -f marker && touch ready; touch marker; exit 1; }'"
+          interval: 1
+          attemptsEnv: "N"
+      - echo: {content: "${N}", file: n.txt}
+  timeout:
+    actions:
+      - poll: {cmd: "sleep 5", interval: 1, timeout: 200}
+  until:
+    actions:
+      - retryUntil:
+          cmd: "sh -c 'echo x >> until.txt; cat until.txt | wc -l'"
+          operator: number.greaterThanOrEqual
+          compare: "3"
+          interval: 1
+          env: COUNT
+      - echo: {content: "${COUNT}", file: count.txt}
+`})
+	if failure := runTestTask(t, dir, "succeed"); failure != "" {
+		t.Fatal(failure)
+	}
+	if n := readTestFile(t, dir, "n.txt"); n != "3" {
+		t.Errorf("attempts: %q", n)
+	}
+
+	start := time.Now()
+	if failure := runTestTask(t, dir, "timeout"); !strings.Contains(failure, "timeout") {
+		t.Errorf("poll timeout: %q", failure)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("attempt isn't bounded by timeout: %s", elapsed)
+	}
+
+	if failure := runTestTask(t, dir, "until"); failure != "" {
+		t.Fatal(failure)
+	}
+	if count := strings.TrimSpace(readTestFile(t, dir, "count.txt")); count != "3" {
+		t.Errorf("output of last attempt: %q", count)
+	}
+}
+
+func TestCaptureOutputAsArray(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("cat is not available on windows")
+	}
+	dir := testDir(t, map[string]string{
+		"ls.txt":    "a b.txt\n\n c.txt \n",
+		"lines.txt": "a\n\nb\n",
+		"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - cmd:
+          exec: cat ls.txt
+          stdoutEnv: FILES
+          output: split
+          untrimmed: true
+      - loop:
+          arrayEnv: FILES
+          var: F
+          actions:
+            - echo: {content: "[${F}]\n", file: files.txt, append: true}
+      - cmd:
+          exec: cat lines.txt
+          stdoutEnv: LINES
+          output: split
+          keepEmptyLines: true
+      - echo: {content: "${#LINES[@]}", file: count.txt}
+      - env: ["UPPER|upper=x"]
+      - cmd: {exec: cat lines.txt, stdoutEnv: UPPER, output: split}
+      - echo: {content: "${UPPER[@]}", file: upper.txt}
+`,
+	})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if files := readTestFile(t, dir, "files.txt"); files != "[a b.txt]\n[ c.txt ]\n" {
+		t.Errorf("iterated lines: %q", files)
+	}
+	if count := readTestFile(t, dir, "count.txt"); count != "3" {
+		t.Errorf("count of lines with empty ones: %q", count)
+	}
+	if upper := readTestFile(t, dir, "upper.txt"); upper != "A B" {
+		t.Errorf("transformed elements: %q", upper)
+	}
+}
+
+func TestScriptCaptureOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - script:
+          content: |
+            echo a
+            echo b
+            echo error >&2
+          stdoutEnv: OUT
+          stderrEnv: ERR
+          output: split
+      - echo: {content: "${#OUT[@]} ${OUT[1]} ${ERR}", file: out.txt}
+  conflict:
+    actions:
+      - script: {content: "echo a", stdoutEnv: OUT, stdout: out.txt}
+`})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if out := readTestFile(t, dir, "out.txt"); out != "2 b error" {
+		t.Errorf("captured outputs: %q", out)
+	}
+	if failure := runTestTask(t, dir, "conflict"); !strings.Contains(failure, "both file and env") {
+		t.Errorf("capturing redirected output should be refused: %q", failure)
+	}
+}
+
+func TestScriptRefusedInContainerAndRemote(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		setup func(r *runner)
+	}{
+		{"container", func(r *runner) { r.container.Image = "alpine" }},
+		{"remote", func(r *runner) { r.remote.Address = "example.com:22" }},
+	} {
+		r := newRunner(nil, newLogger(false), newConfiguration(false))
+		r.noExitOnFail = true
+		r.resetTaskStates("main")
+		c.setup(r)
+		r.runActionScript(syntax.ActionScript{Content: "echo a"}, testEnvs(t))
+		if !strings.Contains(r.failure, "script is not supported in "+c.name+" task") {
+			t.Errorf("script in %s task should be refused: %q", c.name, r.failure)
+		}
+	}
+}
+
+func TestCiOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("cat is not available on windows")
+	}
+	dir := testDir(t, map[string]string{
+		"lines.txt": "a\nb\n",
+		"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - env: ["NAME=tash", "LINES=` + "`cat lines.txt`" + `"]
+      - ciOutput: {envs: NAME, platform: github, file: out.txt, durable: true}
+      - ciOutput: {envs: LINES, platform: gitlab, file: out.txt}
+  missing:
+    actions:
+      - env: ["NAME=tash"]
+      - ciOutput: {envs: "NAME;MISSING", platform: github, file: missing.txt}
+`,
+	})
+	failure := runTestTask(t, dir, "main")
+	if !strings.Contains(failure, "multiple line value is not supported") {
+		t.Errorf("multiple line value on gitlab should be refused: %q", failure)
+	}
+	if content := readTestFile(t, dir, "out.txt"); content != "NAME=tash\n" {
+		t.Errorf("ci output: %q", content)
+	}
+
+	failure = runTestTask(t, dir, "missing")
+	if !strings.Contains(failure, "ci output env is not defined: MISSING") {
+		t.Errorf("undefined env should be refused: %q", failure)
+	}
+	if content := readTestFile(t, dir, "missing.txt"); content != "" {
+		t.Errorf("ci output of undefined env: %q", content)
+	}
+}
+
+func TestLoopStdin(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"a.txt": "a",
+		"tash.yaml": `
+tasks:
+  lines:
+    actions:
+      - loop:
+          stdin: {enabled: true}
+          var: LINE
+          actions:
+            - echo: {content: "[${LINE}]", file: lines.txt, append: true}
+  paths:
+    actions:
+      - loop:
+          stdin: {enabled: true, paths: true}
+          var: LINE
+          actions:
+            - echo: {content: "${LINE}", file: paths.txt}
+`,
+	})
+	run := func(configs *Configuration, name, stdin string) string {
+		wd, err := os.Getwd()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chdir(wd)
+		r := newRunner(nil, newLogger(false), configs)
+		r.noExitOnFail = true
+		r.backgrounds = newBackgroundRegistry()
+		r.stdin = strings.NewReader(stdin)
+		r.runTaskByName(name, nil, dir)
+		return r.failure
+	}
+
+	configs := testConfiguration(t, dir)
+	if failure := run(configs, "lines", "x\n\n  y  \n"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "lines.txt"); content != "[x][y]" {
+		t.Errorf("loop values read from stdin: %q", content)
+	}
+	if failure := run(configs, "paths", "a.txt\nmissing.txt\n"); !strings.Contains(failure, "missing.txt") {
+		t.Errorf("missing paths should be reported: %q", failure)
+	}
+
+	configs.fromStdin = true
+	if failure := run(configs, "lines", "x\n"); !strings.Contains(failure, "consumed by config") {
+		t.Errorf("stdin consumed by config should be refused: %q", failure)
+	}
+}
+
+func TestMatchAction(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  version:
+    actions:
+      - match: {value: v1.2.3, regexp: '^v(?P<major>\\d+)\\.(?P<minor>\\d+)', prefix: V}
+      - echo: {content: "${major} ${minor} ${V_0} ${V_2}", file: version.txt}
+  flag:
+    actions:
+      - match: {value: dev, regexp: '^v\\d', matchedEnv: MATCHED}
+      - echo: {content: "${MATCHED}", file: flag.txt}
+  mismatch:
+    actions:
+      - match: {value: dev, regexp: '^v\\d'}
+`})
+	if failure := runTestTask(t, dir, "version"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "version.txt"); content != "1 2 v1.2 2" {
+		t.Errorf("captured groups: %q", content)
+	}
+	if failure := runTestTask(t, dir, "flag"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "flag.txt"); content != "false" {
+		t.Errorf("matched flag: %q", content)
+	}
+	if failure := runTestTask(t, dir, "mismatch"); !strings.Contains(failure, "doesn't match") {
+		t.Errorf("mismatch should fail: %q", failure)
+	}
+}
+
+func TestCiOutputGithub(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("cat is not available on windows")
+	}
+	dir := testDir(t, map[string]string{
+		"lines.txt": "a\nb\n",
+		"out.txt":   "EXISTING=1\n",
+		"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - env: ["NAME=tash", "LINES=` + "`cat lines.txt`" + `"]
+      - ciOutput: {envs: "NAME;LINES"}
+`,
+	})
+	defer os.Unsetenv("GITHUB_ACTIONS")
+	defer os.Unsetenv("GITHUB_OUTPUT")
+	os.Setenv("GITHUB_ACTIONS", "true")
+	os.Setenv("GITHUB_OUTPUT", filepath.Join(dir, "out.txt"))
+
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	lines := strings.Split(readTestFile(t, dir, "out.txt"), "\n")
+	if len(lines) != 7 || lines[0] != "EXISTING=1" || lines[1] != "NAME=tash" {
+		t.Fatalf("github output isn't appended: %q", lines)
+	}
+	delimiter := strings.TrimPrefix(lines[2], "LINES<<")
+	if delimiter == lines[2] || lines[3] != "a" || lines[4] != "b" || lines[5] != delimiter {
+		t.Errorf("multiple line value: %q", lines)
+	}
+}
+
+func TestPathEnvsSlashSeparated(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"sub/a.txt": "a",
+		"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - echo: {content: "${WORKDIR}", file: workdir.txt}
+      - env: ["FILES=sub/*.txt"]
+      - echo: {content: "${FILES|file.glob}", file: glob.txt}
+`,
+	})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "workdir.txt"); content != filepath.ToSlash(dir) {
+		t.Errorf("WORKDIR: got %q, want %q", content, filepath.ToSlash(dir))
+	}
+	if content := readTestFile(t, dir, "glob.txt"); content != "sub/a.txt" {
+		t.Errorf("globbed path isn't slash separated: %q", content)
+	}
+}
+
+func TestTaskWorkDirRelativeToConfigFile(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"build/.keep":    "",
+		"other/.keep":    "",
+		"conf/out/.keep": "",
+		"tash.yaml": `
+imports: conf/more.yaml
+workDir: build
+tasks:
+  default:
+    actions:
+      - echo: {content: default, file: default.txt}
+  own:
+    workDir: other
+    actions:
+      - echo: {content: own, file: own.txt}
+`,
+		"conf/more.yaml": `
+workDir: out
+tasks:
+  imported:
+    actions:
+      - echo: {content: imported, file: imported.txt}
+`,
+	})
+	for _, name := range []string{"default", "own", "imported"} {
+		if failure := runTestTask(t, dir, name); failure != "" {
+			t.Fatalf("%s: %s", name, failure)
+		}
+	}
+	for file, content := range map[string]string{
+		"build/default.txt":     "default",
+		"other/own.txt":         "own",
+		"conf/out/imported.txt": "imported",
+	} {
+		if got := readTestFile(t, dir, file); got != content {
+			t.Errorf("%s: got %q, want %q", file, got, content)
+		}
+	}
+}
+
+func TestSourceAction(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	dir := testDir(t, map[string]string{
+		"env.sh": "export TASH_TEST_SOURCED='hello world'\nTASH_TEST_LOCAL=local\n",
+		"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - source: {script: env.sh}
+      - echo: {content: "${TASH_TEST_SOURCED}|${TASH_TEST_LOCAL}", file: out.txt}
+`,
+	})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "out.txt"); content != "hello world|" {
+		t.Errorf("sourced environments: %q", content)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+env: [A=base, B=base]
+profiles:
+  prod: [A=prod]
+  dev: [A=dev]
+tasks:
+  main:
+    actions:
+      - echo: {content: "${A} ${B}", file: out.txt}
+`})
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	configs := testConfiguration(t, dir)
+	for profile, want := range map[string]string{
+		"":     "base base",
+		"prod": "prod base",
+		"dev":  "dev base",
+	} {
+		runTasks(configs, testLogger(t), []string{"main"}, nil, profile, taskOutputs{}, nil)
+		if content := readTestFile(t, dir, "out.txt"); content != want {
+			t.Errorf("profile %q: got %q, want %q", profile, content, want)
+		}
+	}
+
+	var failure string
+	log := newLogger(false)
+	log.exit = func(msg string) {
+		failure = msg
+	}
+	runTasks(configs, log, []string{"main"}, nil, "test", taskOutputs{}, nil)
+	if !strings.Contains(failure, "profile not found: test, available: [dev, prod]") {
+		t.Errorf("unknown profile error: %q", failure)
+	}
+}
+
+func TestTemplateRunAll(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+templates:
+  steps:
+    - fatal: first failure
+    - echo: {content: ran, file: ran.txt}
+    - fatal: second failure
+tasks:
+  runAll:
+    actions:
+      - template: {name: steps, mode: runAll}
+      - echo: {content: after, file: after.txt}
+  failFast:
+    actions:
+      - template: steps
+`})
+	failure := runTestTask(t, dir, "runAll")
+	if !strings.Contains(failure, "first failure") || !strings.Contains(failure, "second failure") {
+		t.Errorf("all failures should be reported: %q", failure)
+	}
+	if readTestFile(t, dir, "ran.txt") != "ran" {
+		t.Error("actions after failure should run in runAll mode")
+	}
+	if readTestFile(t, dir, "after.txt") != "" {
+		t.Error("actions after failed template shouldn't run")
+	}
+
+	if err := os.Remove(filepath.Join(dir, "ran.txt")); err != nil {
+		t.Fatal(err)
+	}
+	failure = runTestTask(t, dir, "failFast")
+	if !strings.Contains(failure, "first failure") || strings.Contains(failure, "second failure") {
+		t.Errorf("only first failure should be reported: %q", failure)
+	}
+	if readTestFile(t, dir, "ran.txt") != "" {
+		t.Error("actions after failure shouldn't run in failFast mode")
+	}
+}
+
+func TestMergeAction(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"sql/2.sql":  "two\n",
+		"sql/10.sql": "ten\n",
+		"sql/1.sql":  "one\n",
+		"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - merge: {files: "sql/*.sql", output: sql/all.sql, separator: "--\n", header: "# {}\n"}
+`,
+	})
+	for i := 0; i < 2; i++ {
+		// output file matched by glob at second run is excluded
+		if failure := runTestTask(t, dir, "main"); failure != "" {
+			t.Fatal(failure)
+		}
+		want := "# sql/1.sql\none\n--\n# sql/10.sql\nten\n--\n# sql/2.sql\ntwo\n"
+		if content := readTestFile(t, dir, "sql/all.sql"); content != want {
+			t.Errorf("merged content: got %q, want %q", content, want)
+		}
+	}
+}
+
+func TestEnvCommandSubstitution(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("echo is not an executable on windows")
+	}
+	dir := testDir(t, map[string]string{"tash.yaml": `
+env: ["GREETING=` + "`echo hello`" + `", "LITERAL=\"` + "`echo hello`" + `\""]
+tasks:
+  main:
+    actions:
+      - if:
+          check: "${GREETING|? == hello}"
+          actions:
+            - echo: {content: "${LITERAL}", file: out.txt}
+          else:
+            - fatal: "command output isn't assigned: ${GREETING}"
+`})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "out.txt"); content != "`echo hello`" {
+		t.Errorf("quoted backquotes should be kept literal: %q", content)
+	}
+}
+
+func TestRelativeFsPathsBase(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"src.txt":     "config dir",
+		"sub/src.txt": "workdir",
+		"tash.yaml": `
+tasks:
+  configDir:
+    actions:
+      - copy: {sourceUrl: src.txt, destPath: dest.txt}
+      - copy: {sourceUrl: src.txt, destPath: "cwd:cwd.txt"}
+  workDir:
+    workDir: sub
+    actions:
+      - copy: {sourceUrl: src.txt, destPath: dest.txt}
+`,
+	})
+	cwd := testDir(t, nil)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err = os.Chdir(cwd); err != nil {
+		t.Fatal(err)
+	}
+	configs := testConfiguration(t, dir)
+	for _, name := range []string{"configDir", "workDir"} {
+		r := newRunner(nil, newLogger(false), configs)
+		r.noExitOnFail = true
+		r.runTaskByName(name, nil, cwd)
+		if r.failure != "" {
+			t.Fatalf("%s: %s", name, r.failure)
+		}
+	}
+	for file, want := range map[string]string{
+		filepath.Join(dir, "dest.txt"):        "config dir",
+		filepath.Join(cwd, "cwd.txt"):         "config dir",
+		filepath.Join(dir, "sub", "dest.txt"): "workdir",
+	} {
+		if got := readTestFile(t, filepath.Dir(file), filepath.Base(file)); got != want {
+			t.Errorf("%s: got %q, want %q", file, got, want)
+		}
+	}
+}
+
+func TestStatAction(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"data.txt": "hello world",
+		"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - stat: {path: data.txt, size: SIZE, modTime: MTIME, timeFormat: unix, isDir: IS_DIR, exist: EXIST}
+      - if:
+          check: "${SIZE|? -gt 10}"
+          actions:
+            - echo: {content: "${SIZE} ${IS_DIR} ${EXIST} ${MTIME}", file: out.txt}
+      - stat: {path: missing.txt, size: MISSING_SIZE, exist: MISSING_EXIST, allowMissing: true}
+      - echo: {content: "[${MISSING_SIZE}] ${MISSING_EXIST}", file: missing.txt}
+  missing:
+    actions:
+      - stat: {path: none.txt, size: SIZE}
+`,
+	})
+	mtime := time.Unix(1600000000, 0)
+	if err := os.Chtimes(filepath.Join(dir, "data.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "out.txt"); content != "11 false true 1600000000" {
+		t.Errorf("stat envs: %q", content)
+	}
+	if content := readTestFile(t, dir, "missing.txt"); content != "[] false" {
+		t.Errorf("stat envs of missing file: %q", content)
+	}
+	if failure := runTestTask(t, dir, "missing"); !strings.Contains(failure, "stat file failed") {
+		t.Errorf("missing file should fail: %q", failure)
+	}
+}
+
+func TestTemplateOverrides(t *testing.T) {
+	dir := testDir(t, map[string]string{"third.txt": "old", "tash.yaml": `
+templates:
+  build:
+    - echo: {content: default, file: out.txt}
+    - echo: {content: "+kept", file: out.txt, append: true}
+    - echo: {content: "+third", file: third.txt, append: true}
+tasks:
+  main:
+    actions:
+      - template:
+          name: build
+          overrides:
+            0: {echo: {content: overridden}}
+            2: {Echo: {append: null}}
+  outOfRange:
+    actions:
+      - template: {name: build, overrides: {3: {echo: {content: x}}}}
+`})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "out.txt"); content != "overridden+kept" {
+		t.Errorf("overridden field: %q", content)
+	}
+	if content := readTestFile(t, dir, "third.txt"); content != "+third" {
+		t.Errorf("field reset by null: %q", content)
+	}
+	if failure := runTestTask(t, dir, "outOfRange"); !strings.Contains(failure, "out of range") {
+		t.Errorf("override index out of range should be refused: %q", failure)
+	}
+}
+
+func TestWhichAction(t *testing.T) {
+	bin := "sh"
+	if runtime.GOOS == "windows" {
+		bin = "cmd"
+	}
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - which: {cmd: ` + bin + `, env: BIN}
+      - echo: {content: "${BIN}", file: bin.txt}
+      - which: {cmd: tash-test-missing-binary, env: MISSING, allowMissing: true}
+      - echo: {content: "[${MISSING}]", file: missing.txt}
+  missing:
+    actions:
+      - which: {cmd: tash-test-missing-binary, env: MISSING}
+`})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	path := readTestFile(t, dir, "bin.txt")
+	if !filepath.IsAbs(filepath.FromSlash(path)) {
+		t.Errorf("executable path isn't absolute: %q", path)
+	}
+	info, err := os.Stat(filepath.FromSlash(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode()&0111 == 0 {
+		t.Errorf("path isn't executable: %s", path)
+	}
+	if content := readTestFile(t, dir, "missing.txt"); content != "[]" {
+		t.Errorf("missing executable should set empty env: %q", content)
+	}
+	if failure := runTestTask(t, dir, "missing"); !strings.Contains(failure, "lookup executable failed") {
+		t.Errorf("missing executable should fail: %q", failure)
+	}
+}
+
+func TestCmdOutputRedirection(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	dir := testDir(t, map[string]string{
+		"truncate.txt": "old\n",
+		"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - cmd: {exec: "sh -c 'echo out; echo err 1>&2'", stdout: truncate.txt}
+      - cmd: {exec: "sh -c 'echo out; echo err 1>&2'", stdout: truncate.txt}
+      - cmd: {exec: "sh -c 'echo out'", stdout: append.txt, stdoutAppend: true}
+      - cmd: {exec: "sh -c 'echo out'", stdout: append.txt, stdoutAppend: true}
+      - cmd: {exec: "sh -c 'echo out; echo err 1>&2'", stdout: both.txt, stderr: both.txt}
+      - cmd: {exec: "sh -c 'echo out; echo err 1>&2'", stdout: tee.txt, stderr: tee.err.txt, tee: true}
+  mismatchedAppend:
+    actions:
+      - cmd: {exec: "sh -c 'echo out'", stdout: both.txt, stderr: both.txt, stderrAppend: true}
+`,
+	})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	for file, want := range map[string]string{
+		"truncate.txt": "out\n",
+		"append.txt":   "out\nout\n",
+		"both.txt":     "out\nerr\n",
+		"tee.txt":      "out\n",
+		"tee.err.txt":  "err\n",
+	} {
+		if got := readTestFile(t, dir, file); got != want {
+			t.Errorf("%s: got %q, want %q", file, got, want)
+		}
+	}
+	if failure := runTestTask(t, dir, "mismatchedAppend"); !strings.Contains(failure, "different append mode") {
+		t.Errorf("same file in different append mode should be refused: %q", failure)
+	}
+}
+
+func TestRequireEnvs(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+env: [TASH_TEST_PRESENT=1]
+tasks:
+  present:
+    requireEnvs: [TASH_TEST_PRESENT, TASH_TEST_PROCESS]
+    actions:
+      - echo: {content: ran, file: present.txt}
+  missing:
+    requireEnvs: [TASH_TEST_MISSING_A, TASH_TEST_PRESENT, TASH_TEST_MISSING_B]
+    actions:
+      - echo: {content: ran, file: missing.txt}
+`})
+	defer os.Unsetenv("TASH_TEST_PROCESS")
+	os.Setenv("TASH_TEST_PROCESS", "1")
+	if failure := runTestTask(t, dir, "present"); failure != "" {
+		t.Fatal(failure)
+	}
+	if readTestFile(t, dir, "present.txt") != "ran" {
+		t.Error("actions should run if required envs are present")
+	}
+	failure := runTestTask(t, dir, "missing")
+	if !strings.Contains(failure, "required environments missing: TASH_TEST_MISSING_A, TASH_TEST_MISSING_B") {
+		t.Errorf("missing envs should be reported together: %q", failure)
+	}
+	if readTestFile(t, dir, "missing.txt") != "" {
+		t.Error("actions shouldn't run if required envs are missing")
+	}
+}
+
+func TestTaskArgumentValidation(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  deploy:
+    args:
+      - env: VERSION
+        regexp: '^v[0-9]+\.[0-9]+$'
+      - env: STAGE
+        default: dev
+        allowed: [dev, prod]
+    actions:
+      - echo: {content: "${VERSION} ${STAGE}", file: out.txt}
+`})
+	if failure := runTestTask(t, dir, "deploy", "v1.2", "prod"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "out.txt"); content != "v1.2 prod" {
+		t.Errorf("validated arguments: %q", content)
+	}
+	if failure := runTestTask(t, dir, "deploy", "v1.2"); failure != "" {
+		t.Errorf("default value should be validated too: %s", failure)
+	}
+	for _, c := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"1.2"}, `VERSION="1.2", doesn't match pattern`},
+		{[]string{"v1.2.3"}, `VERSION="v1.2.3", doesn't match pattern`},
+		{[]string{"v1.2", "test"}, `STAGE="test", allowed: [dev, prod]`},
+	} {
+		if failure := runTestTask(t, dir, "deploy", c.args...); !strings.Contains(failure, c.err) {
+			t.Errorf("%v: got %q, want %q", c.args, failure, c.err)
+		}
+	}
+}
+
+func TestCmdResponseFiles(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("echo is not an executable on windows")
+	}
+	dir := testDir(t, map[string]string{
+		"args.rsp": "hello\nworld\n",
+		"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - env: [RSP=args.rsp]
+      - cmd: {exec: "echo @${RSP} !", responseFiles: true, stdout: out.txt}
+      - cmd: {exec: "echo @${RSP}", stdout: literal.txt}
+`,
+	})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "out.txt"); content != "hello world !\n" {
+		t.Errorf("response file args: %q", content)
+	}
+	if content := readTestFile(t, dir, "literal.txt"); content != "@args.rsp\n" {
+		t.Errorf("response files should be opt-in: %q", content)
+	}
+}
+
+func TestLoopBeforeAfter(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - loop:
+          array: [a, b, c]
+          var: ITEM
+          before:
+            - echo: {content: "before ", file: out.txt, append: true}
+          actions:
+            - echo: {content: "${ITEM} ", file: out.txt, append: true}
+          after:
+            - echo: {content: "after", file: out.txt, append: true}
+  empty:
+    actions:
+      - env: ["EMPTY[]=()"]
+      - loop:
+          arrayEnv: EMPTY
+          var: ITEM
+          before:
+            - echo: {content: before, file: empty.txt}
+          actions:
+            - echo: {content: "${ITEM}", file: empty.txt}
+          after:
+            - echo: {content: after, file: empty.txt}
+`})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "out.txt"); content != "before a b c after" {
+		t.Errorf("loop before and after: %q", content)
+	}
+	if failure := runTestTask(t, dir, "empty"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "empty.txt"); content != "" {
+		t.Errorf("before and after should be skipped without iterations: %q", content)
+	}
+}
+
+func TestDiffAction(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"actual.txt": "one\ntwo\n",
+		"same.txt":   "one\ntwo\n",
+		"golden.txt": "one\n2\n",
+		"tash.yaml": `
+tasks:
+  same:
+    actions:
+      - diff: {file: actual.txt, expected: same.txt}
+      - diff: {file: actual.txt, content: "one\ntwo\n"}
+  different:
+    actions:
+      - diff: {file: actual.txt, expected: golden.txt}
+  update:
+    actions:
+      - diff: {file: actual.txt, expected: golden.txt, update: "true"}
+      - diff: {file: actual.txt, expected: new.txt, update: "true"}
+`,
+	})
+	if failure := runTestTask(t, dir, "same"); failure != "" {
+		t.Fatal(failure)
+	}
+	failure := runTestTask(t, dir, "different")
+	if !strings.Contains(failure, "files are different") || !strings.Contains(failure, "-2\n+two") {
+		t.Errorf("diff of different files: %q", failure)
+	}
+	if failure = runTestTask(t, dir, "update"); failure != "" {
+		t.Fatal(failure)
+	}
+	for _, name := range []string{"golden.txt", "new.txt"} {
+		if content := readTestFile(t, dir, name); content != "one\ntwo\n" {
+			t.Errorf("%s isn't updated: %q", name, content)
+		}
+	}
+}
+
+func TestTaskOutputs(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  build:
+    outputs: [VERSION, ARTIFACT]
+    actions:
+      - env: [VERSION=1.0, ARTIFACT=tash.tar.gz, INTERNAL=secret]
+`})
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	configs := testConfiguration(t, dir)
+	for format, want := range map[string]string{
+		outputsFormatJson: "{\n  \"ARTIFACT\": \"tash.tar.gz\",\n  \"VERSION\": \"1.0\"\n}",
+		outputsFormatEnv:  "ARTIFACT=tash.tar.gz\nVERSION=1.0\n",
+	} {
+		file := filepath.Join(dir, "outputs."+format)
+		runTasks(configs, testLogger(t), []string{"build"}, nil, "", taskOutputs{File: file, Format: format}, nil)
+		if content := strings.TrimSpace(readTestFile(t, dir, "outputs."+format)); content != strings.TrimSpace(want) {
+			t.Errorf("%s outputs: got %q, want %q", format, content, want)
+		}
+	}
+}
+
+func TestTemplateCycleAtRuntime(t *testing.T) {
+	// testConfiguration doesn't check templates, cycles are detected when running
+	dir := testDir(t, map[string]string{"tash.yaml": `
+templates:
+  self: [{template: self}]
+  a: [{echo: {content: a, file: a.txt}}, {template: b}]
+  b: [{template: a}]
+tasks:
+  self:
+    actions:
+      - template: self
+  twoTemplates:
+    actions:
+      - template: a
+`})
+	for name, want := range map[string]string{
+		"self":         "template cycle: self -> self",
+		"twoTemplates": "template cycle: a -> b -> a",
+	} {
+		if failure := runTestTask(t, dir, name); !strings.Contains(failure, want) {
+			t.Errorf("%s: got %q, want %q", name, failure, want)
+		}
+	}
+	if content := readTestFile(t, dir, "a.txt"); content != "a" {
+		t.Errorf("template should run once before cycle is detected: %q", content)
+	}
+}
+
+func TestTaskArgumentDefaults(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  pack:
+    args:
+      - env: NAME
+        default: tash
+      - env: OUTPUT
+        default: "${NAME}.tar.gz"
+    actions:
+      - echo: {content: "${OUTPUT}", file: out.txt}
+  later:
+    args:
+      - env: OUTPUT
+        default: "${NAME}.tar.gz"
+      - env: NAME
+        default: tash
+    actions:
+      - echo: {content: "${OUTPUT}", file: later.txt}
+`})
+	if failure := runTestTask(t, dir, "pack"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "out.txt"); content != "tash.tar.gz" {
+		t.Errorf("default referencing earlier argument: %q", content)
+	}
+	if failure := runTestTask(t, dir, "pack", "app"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "out.txt"); content != "app.tar.gz" {
+		t.Errorf("default referencing passed argument: %q", content)
+	}
+	if failure := runTestTask(t, dir, "later"); !strings.Contains(failure, "NAME") {
+		t.Errorf("default referencing later argument should fail: %q", failure)
+	}
+	if readTestFile(t, dir, "later.txt") != "" {
+		t.Error("actions shouldn't run if argument default is invalid")
+	}
+}
+
+func TestVerifyManifest(t *testing.T) {
+	files := map[string]string{}
+	var manifest strings.Builder
+	for _, name := range []string{"a.bin", "sub/b.bin", "c.bin"} {
+		sum := sha256.Sum256([]byte(name))
+		manifest.WriteString(hex.EncodeToString(sum[:]) + "  " + name + "\n")
+		files["dist/"+name] = name
+	}
+	files["dist/SHA256SUMS"] = manifest.String()
+	files["tash.yaml"] = `
+tasks:
+  main:
+    actions:
+      - verifyManifest: {manifest: dist/SHA256SUMS}
+`
+	dir := testDir(t, files)
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "dist", "sub", "b.bin"), []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "dist", "c.bin")); err != nil {
+		t.Fatal(err)
+	}
+	failure := runTestTask(t, dir, "main")
+	if !strings.HasSuffix(failure, "2 of 3 files:\nsub/b.bin: checksum mismatched\nc.bin: missing") {
+		t.Errorf("tampered and missing files should be reported: %q", failure)
+	}
+}
+
+func TestValidateAction(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"conf/a.json": `{"name": "a"}`,
+		"conf/b.yaml": "name: b\n",
+		"bad/c.yml":   "name: [c\n",
+		"tash.yaml": `
+tasks:
+  valid:
+    actions:
+      - validate: {files: "conf/*", requiredKeys: [name]}
+  invalid:
+    actions:
+      - validate: {files: "bad/*"}
+`,
+	})
+	if failure := runTestTask(t, dir, "valid"); failure != "" {
+		t.Fatal(failure)
+	}
+	if failure := runTestTask(t, dir, "invalid"); !strings.Contains(failure, "c.yml") {
+		t.Errorf("malformed yaml should be reported: %q", failure)
+	}
+}
+
+func TestActionLocalEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - env: [GREETING=hello]
+      - localEnv: [GREETING=hi, TASH_TEST_SCOPED=scoped]
+        cmd: {exec: "sh -c 'echo $GREETING $TASH_TEST_SCOPED'", stdout: scoped.txt}
+      - cmd: {exec: "sh -c 'echo $GREETING [$TASH_TEST_SCOPED]'", stdout: after.txt}
+`})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "scoped.txt"); content != "hi scoped\n" {
+		t.Errorf("action scoped envs: %q", content)
+	}
+	if content := readTestFile(t, dir, "after.txt"); content != "hello []\n" {
+		t.Errorf("action scoped envs should be restored: %q", content)
+	}
+}
+
+func TestCmdSubstitutionMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	dir := testDir(t, map[string]string{
+		"lines.txt": "a b\nc\n",
+		"args.sh":   "echo $#\nfor a; do echo \"[$a]\"; done\n",
+		"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - cmd: {exec: "sh args.sh ` + "`cat lines.txt`" + `", stdout: keep.txt}
+      - cmd: {exec: "sh args.sh ` + "`cat lines.txt`" + `", substitution: split, stdout: split.txt}
+`,
+	})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "keep.txt"); content != "1\n[a b\nc]\n" {
+		t.Errorf("output kept in one argument: %q", content)
+	}
+	if content := readTestFile(t, dir, "split.txt"); content != "3\n[a]\n[b]\n[c]\n" {
+		t.Errorf("output split into words: %q", content)
+	}
+}
+
+func TestScriptAction(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - env: ["NAME=tash"]
+      - script:
+          content: |
+            for a; do
+              echo "arg $a"
+            done
+            echo "hello $NAME"
+          args: [x, "y z"]
+          stdout: sh.txt
+      - script:
+          content: |
+            #!/bin/sh -e
+            echo shebang
+          stdout: shebang.txt
+  python:
+    actions:
+      - script:
+          interpreter: python3
+          content: |
+            import os
+            for i in range(2):
+                print(i, os.environ["NAME"])
+          env: ["NAME=py"]
+          stdout: py.txt
+`})
+	tmp := testDir(t, nil)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmp)
+
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if out := readTestFile(t, dir, "sh.txt"); out != "arg x\narg y z\nhello tash\n" {
+		t.Errorf("sh script output: %q", out)
+	}
+	if out := readTestFile(t, dir, "shebang.txt"); out != "shebang\n" {
+		t.Errorf("shebang script output: %q", out)
+	}
+	if empty, err := dirEmpty(tmp); err != nil || !empty {
+		t.Errorf("script files are not cleaned up: %v", err)
+	}
+
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is not available")
+	}
+	if failure := runTestTask(t, dir, "python"); failure != "" {
+		t.Fatal(failure)
+	}
+	if out := readTestFile(t, dir, "py.txt"); out != "0 py\n1 py\n" {
+		t.Errorf("python script output: %q", out)
+	}
+}
+
+func TestParallelLoopLimitAndScope(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - env: ["SHARED=before"]
+      - loop:
+          array: [a, b, c, d]
+          var: ITEM
+          indexVar: IDX
+          parallel: 2
+          actions:
+            - sleep: 200
+            - env: ["SHARED=${ITEM}"]
+            - echo: {content: "${IDX} ${SHARED}", file: "${ITEM}.txt"}
+      - echo: {content: "${SHARED}", file: shared.txt}
+`})
+	begin := time.Now()
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if elapsed := time.Since(begin); elapsed < 400*time.Millisecond {
+		t.Errorf("more than 2 iterations run concurrently, elapsed %s", elapsed)
+	}
+	for i, name := range []string{"a", "b", "c", "d"} {
+		if content, want := readTestFile(t, dir, name+".txt"), fmt.Sprintf("%d %s", i, name); content != want {
+			t.Errorf("iteration envs: %q, want %q", content, want)
+		}
+	}
+	if content := readTestFile(t, dir, "shared.txt"); content != "before" {
+		t.Errorf("envs changed by parallel iterations are visible after loop: %q", content)
+	}
+}
+
+func TestDirChecksumAction(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"src/a.txt":  "a",
+		"same/a.txt": "a",
+		"diff/a.txt": "b",
+		"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - dirChecksum: {dir: src, env: SUM, compare: same}
+      - dirChecksum: {dir: same, expected: "${SUM}"}
+  compare:
+    actions:
+      - dirChecksum: {dir: src, compare: diff}
+  expected:
+    actions:
+      - dirChecksum: {dir: src, expected: "0000"}
+`,
+	})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if failure := runTestTask(t, dir, "compare"); !strings.Contains(failure, "~ a.txt:") {
+		t.Errorf("compare failure: %q", failure)
+	}
+	if failure := runTestTask(t, dir, "expected"); !strings.Contains(failure, "checksum mismatched") {
+		t.Errorf("expected failure: %q", failure)
+	}
+}
+
+func TestRetryUntilAction(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	dir := testDir(t, map[string]string{
+		"status.sh": "echo x >> attempts.txt\nif [ $(wc -l < attempts.txt) -gt 2 ]; then echo Running; else echo Pending; fi\n",
+		"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - retryUntil: {cmd: sh status.sh, compare: Running, interval: 1, env: STATUS}
+      - echo: {content: "${STATUS}", file: status.txt}
+  timeout:
+    actions:
+      - retryUntil: {cmd: echo Pending, compare: Running, interval: 1, timeout: 100, env: STATUS}
+  failed:
+    actions:
+      - retryUntil: {cmd: sh -c "exit 1", compare: Running, interval: 1}
+`,
+	})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if status := readTestFile(t, dir, "status.txt"); status != "Running" {
+		t.Errorf("output of last attempt: %q", status)
+	}
+	if attempts := readTestFile(t, dir, "attempts.txt"); attempts != "x\nx\nx\n" {
+		t.Errorf("attempts: %q", attempts)
+	}
+	if failure := runTestTask(t, dir, "timeout"); failure == "" {
+		t.Error("unmatched output should fail after timeout")
+	}
+	if failure := runTestTask(t, dir, "failed"); failure == "" {
+		t.Error("failed command should fail")
+	}
+}
+
+func TestRequireVersionAction(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	dir := testDir(t, map[string]string{
+		"faketool": "#!/bin/sh\necho \"faketool version 2.3.1 (build 20)\"\n",
+		"tash.yaml": `
+tasks:
+  satisfied:
+    actions:
+      - requireVersion: {cmd: ./faketool, require: ">=2.3, <3", env: VERSION}
+      - echo: {content: "${VERSION}", file: version.txt}
+  unsatisfied:
+    actions:
+      - requireVersion: {cmd: ./faketool, require: ">=2.10"}
+  pattern:
+    actions:
+      - requireVersion: {cmd: ./faketool, require: ">=20", pattern: 'build (\\d+)'}
+  missing:
+    actions:
+      - requireVersion: {cmd: tash-missing-tool, require: ">=1"}
+`,
+	})
+	if err := os.Chmod(filepath.Join(dir, "faketool"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if failure := runTestTask(t, dir, "satisfied"); failure != "" {
+		t.Fatal(failure)
+	}
+	if version := readTestFile(t, dir, "version.txt"); version != "2.3.1" {
+		t.Errorf("found version: %q", version)
+	}
+	if failure := runTestTask(t, dir, "unsatisfied"); !strings.Contains(failure, "requires ./faketool >=2.10, found 2.3.1") {
+		t.Errorf("unsatisfied version failure: %q", failure)
+	}
+	if failure := runTestTask(t, dir, "pattern"); failure != "" {
+		t.Errorf("version extracted by pattern: %q", failure)
+	}
+	if failure := runTestTask(t, dir, "missing"); !strings.Contains(failure, "not found") {
+		t.Errorf("missing tool failure: %q", failure)
+	}
+}
+
+func TestSetEnvAction(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	defer os.Unsetenv("TASH_TEST_INHERITED")
+	defer os.Unsetenv("TASH_TEST_PROCESS")
+	os.Setenv("TASH_TEST_INHERITED", "inherited")
+	os.Setenv("TASH_TEST_PROCESS", "process")
+
+	dir := testDir(t, map[string]string{
+		"envs.sh": "echo \"${TASH_TEST_SET-none} ${TASH_TEST_INHERITED-none} ${TASH_TEST_PROCESS-none}\"\n",
+		"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - setEnv: {set: ["TASH_TEST_SET=set"], unset: [TASH_TEST_INHERITED]}
+      - cmd: {exec: sh envs.sh, stdout: local.txt}
+  process:
+    actions:
+      - setEnv: {set: ["TASH_TEST_SET=set"], unset: [TASH_TEST_PROCESS], process: true}
+      - cmd: {exec: sh envs.sh, stdout: process.txt}
+`,
+	})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "local.txt"); content != "set none process\n" {
+		t.Errorf("environments of child command: %q", content)
+	}
+	if _, has := os.LookupEnv("TASH_TEST_SET"); has {
+		t.Error("process environment is changed without process option")
+	}
+	if os.Getenv("TASH_TEST_INHERITED") != "inherited" {
+		t.Error("process environment is unset without process option")
+	}
+
+	defer os.Unsetenv("TASH_TEST_SET")
+	if failure := runTestTask(t, dir, "process"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "process.txt"); content != "set inherited none\n" {
+		t.Errorf("environments of child command: %q", content)
+	}
+	if os.Getenv("TASH_TEST_SET") != "set" {
+		t.Error("process environment isn't set")
+	}
+	if _, has := os.LookupEnv("TASH_TEST_PROCESS"); has {
+		t.Error("process environment isn't unset")
+	}
+}
+
+func TestRunAllAction(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - runAll:
+          actions:
+            - fatal: first failed
+            - echo: {content: ran, file: ran.txt}
+            - fatal: third failed
+      - echo: {content: after, file: after.txt}
+  allowed:
+    actions:
+      - runAll:
+          actions: [{fatal: first failed}, {fatal: second failed}, {env: ["X=1"]}]
+          failedEnv: FAILED
+          allowFailure: true
+      - echo: {content: "${FAILED}", file: failed.txt}
+`})
+	failure := runTestTask(t, dir, "main")
+	if !strings.Contains(failure, "actions failed: 2 of 3") || !strings.Contains(failure, "first failed") || !strings.Contains(failure, "third failed") {
+		t.Errorf("aggregate failure: %q", failure)
+	}
+	if readTestFile(t, dir, "ran.txt") != "ran" {
+		t.Error("actions after failure should run")
+	}
+	if readTestFile(t, dir, "after.txt") != "" {
+		t.Error("task should fail after runAll block")
+	}
+
+	if failure = runTestTask(t, dir, "allowed"); failure != "" {
+		t.Fatal(failure)
+	}
+	if failed := readTestFile(t, dir, "failed.txt"); failed != "2" {
+		t.Errorf("failed count: %q", failed)
+	}
+}
+
+func TestFileModeOption(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits aren't supported on windows")
+	}
+	dir := testDir(t, map[string]string{
+		"lines.txt": "b\na\n",
+		"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - echo: {content: secret, file: echo.txt, mode: "0600"}
+      - echo: {content: "#!/bin/sh", file: run.sh, mode: "0755"}
+      - cmd: {exec: echo out, stdout: out/cmd.txt, fileMode: "0600"}
+      - sort: {file: lines.txt, toFile: sorted.txt, toFileMode: "0600"}
+  invalid:
+    actions:
+      - echo: {content: x, file: invalid.txt, mode: "0999"}
+`,
+	})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	for name, want := range map[string]os.FileMode{
+		"echo.txt":    0600,
+		"run.sh":      0755,
+		"out/cmd.txt": 0600,
+		"sorted.txt":  0600,
+	} {
+		info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != want {
+			t.Errorf("%s: mode %s, want %s", name, info.Mode(), want)
+		}
+	}
+	if failure := runTestTask(t, dir, "invalid"); !strings.Contains(failure, "invalid file mode") {
+		t.Errorf("invalid mode should be refused: %q", failure)
+	}
+}
+
+func TestCmdCaptureStdoutAndStderr(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	dir := testDir(t, map[string]string{
+		"streams.sh": "echo '  result  '\necho '  warning: deprecated  ' >&2\n",
+		"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - cmd: {exec: sh streams.sh, stdoutEnv: OUT, stderrEnv: ERR}
+      - echo: {content: "[${OUT}][${ERR}]", file: out.txt}
+  stderrOnly:
+    actions:
+      - cmd: {exec: sh streams.sh, stderrEnv: ERR}
+      - echo: {content: "[${ERR}]", file: err.txt}
+`,
+	})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "out.txt"); content != "[result][warning: deprecated]" {
+		t.Errorf("captured outputs: %q", content)
+	}
+	if failure := runTestTask(t, dir, "stderrOnly"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "err.txt"); content != "[warning: deprecated]" {
+		t.Errorf("captured stderr: %q", content)
+	}
+}
+
+func TestWaitAllAction(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	dir := testDir(t, map[string]string{
+		"good.sh": "sleep 0.1\necho done > good.txt\n",
+		"bad.sh":  "sleep 0.1\nexit 2\n",
+		"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - cmd: {exec: sh good.sh, background: true, handle: good}
+      - cmd: {exec: sh bad.sh, background: true, handle: bad}
+      - waitAll: {handles: [good, bad]}
+  succeed:
+    actions:
+      - cmd: {exec: sh good.sh, background: true, handle: good}
+      - waitAll: {handles: [good]}
+  timeout:
+    actions:
+      - cmd: {exec: sleep 1, background: true, handle: slow}
+      - waitAll: {handles: [slow], timeout: 100}
+  unknown:
+    actions:
+      - waitAll: {handles: [missing]}
+`,
+	})
+	var failure string
+	output := captureStdout(t, func() {
+		failure = runTestTask(t, dir, "main")
+	})
+	if !strings.Contains(failure, "background commands failed: 1 of 2") {
+		t.Errorf("failure of waitAll: %q", failure)
+	}
+	if !strings.Contains(output, "background command succeed: good") || !strings.Contains(output, "background command failed: bad") {
+		t.Errorf("status of each handle isn't reported:\n%s", output)
+	}
+	if readTestFile(t, dir, "good.txt") != "done\n" {
+		t.Error("succeeded command isn't waited")
+	}
+
+	if failure = runTestTask(t, dir, "succeed"); failure != "" {
+		t.Fatal(failure)
+	}
+	begin := time.Now()
+	if failure = runTestTask(t, dir, "timeout"); !strings.Contains(failure, "1 of 1") {
+		t.Errorf("timeout failure: %q", failure)
+	}
+	if elapsed := time.Since(begin); elapsed > 800*time.Millisecond {
+		t.Errorf("waitAll doesn't stop at timeout: %s", elapsed)
+	}
+	if failure = runTestTask(t, dir, "unknown"); !strings.Contains(failure, "handle not found") {
+		t.Errorf("unknown handle failure: %q", failure)
+	}
+}
+
+func TestParseTaskCalls(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  deploy:
+    args: [{env: ENV}, {env: VERSION}]
+    actions: []
+  test:
+    actions: []
+`})
+	configs := testConfiguration(t, dir)
+	calls, err := parseTaskCalls(configs, []string{"test", "deploy", "prod", "v1.2.3", "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range calls {
+		got = append(got, c.name+"("+strings.Join(c.args, ",")+")")
+	}
+	if strings.Join(got, " ") != "test() deploy(prod,v1.2.3) test()" {
+		t.Errorf("task calls: %q", got)
+	}
+	for _, words := range [][]string{{"prod", "deploy"}, {"test", "x"}, {"deploy", "a", "b", "c"}} {
+		if _, err := parseTaskCalls(configs, words); err == nil {
+			t.Errorf("%q should be refused", words)
+		}
+	}
+}
+
+func TestPositionalTaskArguments(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  deploy:
+    args:
+      - {env: TASH_TEST_ENV}
+      - {env: TASH_TEST_VERSION, default: latest}
+    actions:
+      - echo: {content: "${TASH_TEST_ENV} ${TASH_TEST_VERSION}", file: out.txt}
+`})
+	run := func(named []string, positionals ...string) string {
+		t.Helper()
+		r := newRunner(nil, newLogger(false), testConfiguration(t, dir))
+		r.noExitOnFail = true
+		r.backgrounds = newBackgroundRegistry()
+		r.globalArgs = named
+		wd, _ := os.Getwd()
+		defer os.Chdir(wd)
+		r.runTaskByName("deploy", positionals, dir)
+		if r.failed {
+			return "failure: " + r.failure
+		}
+		return readTestFile(t, dir, "out.txt")
+	}
+	defer os.Unsetenv("TASH_TEST_VERSION")
+	os.Setenv("TASH_TEST_VERSION", "from-env")
+
+	for _, c := range []struct {
+		named       []string
+		positionals []string
+		want        string
+	}{
+		// positionals are bound in order
+		{nil, []string{"prod", "v1.2.3"}, "prod v1.2.3"},
+		// positional takes priority over environment
+		{nil, []string{"prod"}, "prod from-env"},
+		// named args are skipped by positionals
+		{[]string{"TASH_TEST_ENV=staging"}, []string{"v2"}, "staging v2"},
+		{[]string{"TASH_TEST_VERSION=v3"}, []string{"dev"}, "dev v3"},
+		{[]string{"TASH_TEST_ENV=staging"}, []string{"v2", "extra"}, "failure: too many positional arguments"},
+	} {
+		if got := run(c.named, c.positionals...); !strings.HasPrefix(got, c.want) {
+			t.Errorf("named %q, positionals %q: got %q, want %q", c.named, c.positionals, got, c.want)
+		}
+	}
+}
+
+func TestRandomAction(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - random: {env: ID1}
+      - random: {env: ID2, type: uuid}
+      - random: {env: HEX, type: hex, bytes: 4}
+      - random: {env: DICE, type: int, min: 1, max: 6}
+      - echo: {content: "${ID1} ${ID2} ${HEX} ${DICE}", file: out.txt}
+  invalid:
+    actions:
+      - random: {env: NUM, type: int, min: 6, max: 1}
+`})
+	uuidPattern := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	fields := strings.Fields(readTestFile(t, dir, "out.txt"))
+	if len(fields) != 4 {
+		t.Fatalf("generated values: %q", fields)
+	}
+	for _, id := range fields[:2] {
+		if !uuidPattern.MatchString(id) {
+			t.Errorf("invalid uuid: %s", id)
+		}
+	}
+	if fields[0] == fields[1] {
+		t.Errorf("successive uuids are same: %s", fields[0])
+	}
+	if len(fields[2]) != 8 {
+		t.Errorf("hex of 4 bytes: %s", fields[2])
+	}
+	if n, err := strconv.Atoi(fields[3]); err != nil || n < 1 || n > 6 {
+		t.Errorf("integer out of range: %s", fields[3])
+	}
+	if failure := runTestTask(t, dir, "invalid"); !strings.Contains(failure, "invalid range") {
+		t.Errorf("invalid range should be refused: %q", failure)
+	}
+
+	seen := map[int64]bool{}
+	for i := 0; i < 200; i++ {
+		n, err := randomInt(-1, 1)
+		if err != nil || n < -1 || n > 1 {
+			t.Fatalf("random int: %d, %v", n, err)
+		}
+		seen[n] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("boundaries aren't generated: %v", seen)
+	}
+}
+
+func TestEncodeDecodeAction(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - encode: {value: "user:pass", env: ENCODED}
+      - decode: {value: "${ENCODED}", env: DECODED}
+      - echo: {content: "${ENCODED} ${DECODED}", file: out.txt}
+  invalid:
+    actions:
+      - decode: {value: "%%%", env: DECODED}
+`})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "out.txt"); content != "dXNlcjpwYXNz user:pass" {
+		t.Errorf("round trip: %q", content)
+	}
+	if failure := runTestTask(t, dir, "invalid"); failure == "" {
+		t.Error("decoding invalid value should fail")
+	}
+}
+
+func TestWaitBackgroundHandle(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - cmd: {exec: sh -c "sleep 0.1; echo done > done.txt; exit 3", background: true, handle: short}
+      - cmd: {exec: sh -c "exit 0", background: true, handle: ok}
+      - wait: {handle: short, exitCodeEnv: SHORT}
+      - wait: {handle: ok, exitCodeEnv: OK}
+      - echo: {content: "${SHORT} ${OK}", file: codes.txt}
+  timeout:
+    actions:
+      - cmd: {exec: sleep 5, background: true, handle: slow}
+      - runAll:
+          actions: [{wait: {handle: slow, exitCodeEnv: SLOW, timeout: 100}}]
+          allowFailure: true
+          failedEnv: FAILED
+      - echo: {content: "${SLOW} ${FAILED}", file: timeout.txt}
+`})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if readTestFile(t, dir, "done.txt") != "done\n" {
+		t.Error("wait returned before background command exited")
+	}
+	if codes := readTestFile(t, dir, "codes.txt"); codes != "3 0" {
+		t.Errorf("exit codes: %q", codes)
+	}
+
+	begin := time.Now()
+	if failure := runTestTask(t, dir, "timeout"); failure != "" {
+		t.Fatal(failure)
+	}
+	if elapsed := time.Since(begin); elapsed > 2*time.Second {
+		t.Errorf("background command isn't killed after timeout: %s", elapsed)
+	}
+	if content := readTestFile(t, dir, "timeout.txt"); content != "-1 1" {
+		t.Errorf("exit code of killed command and failure: %q", content)
+	}
+}
+
+func TestUrlQueryEncodeAction(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - encode: {value: "name=tash cli&v=1", encoding: urlQuery, env: Q}
+      - echo: {content: "https://example.com/search?q=${Q}", file: url.txt}
+`})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "url.txt"); content != "https://example.com/search?q=name%3Dtash+cli%26v%3D1" {
+		t.Errorf("escaped url: %q", content)
+	}
+}
+
+func TestJsonEncodeAction(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - env: ["NAME=tash & co", "COUNT=3"]
+      - jsonEncode:
+          env: BODY
+          fields: {name: "${NAME}", count: "${COUNT}"}
+          types: {count: number}
+      - echo: {content: "${BODY}", file: body.json}
+`})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(readTestFile(t, dir, "body.json")), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body) != 2 || body["name"] != "tash & co" || body["count"] != float64(3) {
+		t.Errorf("parsed json: %v", body)
+	}
+}
+
+func TestCopyBindsDownloadDigest(t *testing.T) {
+	content := "downloaded content"
+	sum := sha256.Sum256([]byte(content))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	dir := testDir(t, map[string]string{"tash.yaml": fmt.Sprintf(`
+tasks:
+  main:
+    actions:
+      - copy:
+          sourceUrl: %s
+          destPath: out.txt
+          hash: {alg: SHA256, env: DIGEST}
+      - echo: {content: "${DIGEST}", file: digest.txt}
+  noAlg:
+    actions:
+      - copy:
+          sourceUrl: %s
+          destPath: noalg.txt
+          hash: {env: DIGEST}
+`, server.URL, server.URL)})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if got := readTestFile(t, dir, "out.txt"); got != content {
+		t.Errorf("downloaded content: %q", got)
+	}
+	if got := readTestFile(t, dir, "digest.txt"); got != hex.EncodeToString(sum[:]) {
+		t.Errorf("bound digest: %q", got)
+	}
+
+	if failure := runTestTask(t, dir, "noAlg"); !strings.Contains(failure, "hash algorithm is required to bind digest env: DIGEST") {
+		t.Errorf("digest env without algorithm should be refused: %q", failure)
+	}
+	if got := readTestFile(t, dir, "noalg.txt"); got != "" {
+		t.Errorf("resource is downloaded without algorithm of digest env: %q", got)
+	}
+}
+
+func TestTaskBeforeAfter(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  success:
+    before:
+      - echo: {content: "before ", file: success.txt, append: true}
+    actions:
+      - echo: {content: "actions ", file: success.txt, append: true}
+    after:
+      - echo: {content: after, file: success.txt, append: true}
+  failure:
+    before:
+      - echo: {content: "before ", file: failure.txt, append: true}
+    actions:
+      - fatal: setup broken
+      - echo: {content: "actions ", file: failure.txt, append: true}
+    after:
+      - echo: {content: after, file: failure.txt, append: true}
+`})
+	if failure := runTestTask(t, dir, "success"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "success.txt"); content != "before actions after" {
+		t.Errorf("task before and after: %q", content)
+	}
+
+	if failure := runTestTask(t, dir, "failure"); !strings.Contains(failure, "setup broken") {
+		t.Errorf("original failure isn't propagated: %q", failure)
+	}
+	if content := readTestFile(t, dir, "failure.txt"); content != "before after" {
+		t.Errorf("after actions should run on failure: %q", content)
+	}
+}
+
+func TestLoopSplitSeparator(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - env: ["HOSTS=a.local, b.local,,c.local,", "SEP=,"]
+      - loop:
+          split: {value: "${HOSTS}", separator: "${SEP}"}
+          var: HOST
+          actions:
+            - echo: {content: "[${HOST}]", file: out.txt, append: true}
+`})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "out.txt"); content != "[a.local][b.local][c.local]" {
+		t.Errorf("iterations of comma separated list: %q", content)
+	}
+}
+
+func TestCaptureOutputModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("cat is not available on windows")
+	}
+	dir := testDir(t, map[string]string{
+		"out.txt": "  building\n\n  step 2 \n  done: v1.2 \n\n",
+		"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - cmd: {exec: cat out.txt, stdoutEnv: TRIMMED}
+      - cmd: {exec: cat out.txt, stdoutEnv: RAW, output: raw}
+      - cmd: {exec: cat out.txt, stdoutEnv: FIRST, output: firstLine}
+      - cmd: {exec: cat out.txt, stdoutEnv: LAST, output: lastLine}
+      - echo: {content: "${TRIMMED}", file: trimmed.txt}
+      - echo: {content: "${RAW}", file: raw.txt}
+      - echo: {content: "${FIRST}", file: first.txt}
+      - echo: {content: "${LAST}", file: last.txt}
+  invalid:
+    actions:
+      - cmd: {exec: cat out.txt, stdoutEnv: OUT, output: middleLine}
+`,
+	})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	for file, want := range map[string]string{
+		"trimmed.txt": "building\n\n  step 2 \n  done: v1.2",
+		"raw.txt":     "  building\n\n  step 2 \n  done: v1.2 \n\n",
+		"first.txt":   "building",
+		"last.txt":    "done: v1.2",
+	} {
+		if got := readTestFile(t, dir, file); got != want {
+			t.Errorf("%s: got %q, want %q", file, got, want)
+		}
+	}
+	if failure := runTestTask(t, dir, "invalid"); !strings.Contains(failure, "invalid output mode") {
+		t.Errorf("invalid output mode should be refused: %q", failure)
+	}
+}
+
+func TestDisabledTaskAndAction(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - echo: {content: "first ", file: out.txt, append: true}
+        disabled: true
+      - echo: {content: "second ", file: out.txt, append: true}
+      - echo: {content: "third ", file: out.txt, append: true}
+        disabled: "${SKIP_THIRD}"
+      - echo: {content: "fourth", file: out.txt, append: true}
+        disabled: "${SKIP_FOURTH}"
+  skipped:
+    disabled: "${SKIP_TASK}"
+    actions:
+      - echo: {content: task, file: task.txt}
+`})
+	defer os.Unsetenv("SKIP_THIRD")
+	defer os.Unsetenv("SKIP_FOURTH")
+	os.Setenv("SKIP_THIRD", "true")
+	os.Setenv("SKIP_FOURTH", "false")
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "out.txt"); content != "second fourth" {
+		t.Errorf("disabled actions should be skipped: %q", content)
+	}
+
+	defer os.Unsetenv("SKIP_TASK")
+	os.Setenv("SKIP_TASK", "true")
+	var failure string
+	output := captureStdout(t, func() {
+		failure = runTestTask(t, dir, "skipped")
+	})
+	if failure != "" {
+		t.Fatal(failure)
+	}
+	if readTestFile(t, dir, "task.txt") != "" {
+		t.Error("disabled task shouldn't run")
+	}
+	if !strings.Contains(output, "task is disabled") {
+		t.Errorf("disabled task isn't reported: %q", output)
+	}
+
+	os.Setenv("SKIP_TASK", "false")
+	if failure := runTestTask(t, dir, "skipped"); failure != "" {
+		t.Fatal(failure)
+	}
+	if readTestFile(t, dir, "task.txt") != "task" {
+		t.Error("enabled task should run")
+	}
+}
+
+func TestVerifyAction(t *testing.T) {
+	content := "artifact content"
+	sum := sha256.Sum256([]byte(content))
+	checksum := "sha256:" + hex.EncodeToString(sum[:])
+	dir := testDir(t, map[string]string{
+		"app.bin":   content,
+		"empty.bin": "",
+		"tash.yaml": fmt.Sprintf(`
+tasks:
+  valid:
+    actions:
+      - verify: {file: app.bin, size: "%d", checksum: "SHA256:%s"}
+      - verify: {file: empty.bin, size: "0", allowEmpty: true}
+  missing:
+    actions:
+      - verify: {file: missing.bin}
+  directory:
+    actions:
+      - verify: {file: "."}
+  empty:
+    actions:
+      - verify: {file: empty.bin}
+  size:
+    actions:
+      - verify: {file: app.bin, size: 1KB}
+  checksum:
+    actions:
+      - verify: {file: app.bin, checksum: "sha256:%s"}
+  all:
+    actions:
+      - verify: {file: empty.bin, size: "10", checksum: "%s"}
+`, len(content), strings.ToUpper(checksum[len("sha256:"):]), strings.Repeat("0", 64), checksum),
+	})
+	if failure := runTestTask(t, dir, "valid"); failure != "" {
+		t.Fatal(failure)
+	}
+	for task, wants := range map[string][]string{
+		"missing":   {"file doesn't exist"},
+		"directory": {"not a regular file"},
+		"empty":     {"file is empty"},
+		"size":      {"size mismatched, expect 1024, got 16"},
+		"checksum":  {"checksum mismatched, expect " + strings.Repeat("0", 64)},
+		"all":       {"file is empty", "size mismatched", "checksum mismatched"},
+	} {
+		failure := runTestTask(t, dir, task)
+		for _, want := range wants {
+			if !strings.Contains(failure, want) {
+				t.Errorf("%s: failure doesn't name %q: %q", task, want, failure)
+			}
+		}
+	}
+}
+
+func TestActionScopedEnvs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - cmd: {exec: "sh -c 'echo $TASH_TASK $TASH_ACTION_INDEX $TASH_ACTION_TYPE'", stdout: cmd.txt}
+      - task: {name: child}
+      - echo: {content: "${TASH_TASK} ${TASH_ACTION_INDEX} ${TASH_ACTION_TYPE}", file: after.txt}
+  child:
+    actions:
+      - echo: {content: "${TASH_TASK} ${TASH_ACTION_INDEX} ${TASH_ACTION_TYPE}", file: child.txt}
+`})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	for file, want := range map[string]string{
+		"cmd.txt":   "main 1 cmd\n",
+		"child.txt": "child 1 echo",
+		"after.txt": "main 3 echo",
+	} {
+		if got := readTestFile(t, dir, file); got != want {
+			t.Errorf("%s: got %q, want %q", file, got, want)
+		}
+	}
+}
+
+func TestPollActionOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	dir := testDir(t, map[string]string{
+		"check.sh": "echo x >> attempts.txt\nn=$(wc -l < attempts.txt | tr -d ' ')\necho \"attempt-$n\"\ntest $n -ge 4\n",
+		"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - poll: {cmd: sh check.sh, interval: 1, timeout: 5000}
+`,
+	})
+	var failure string
+	output := captureStdout(t, func() {
+		failure = runTestTask(t, dir, "main")
+	})
+	if failure != "" {
+		t.Fatal(failure)
+	}
+	if attempts := strings.Count(readTestFile(t, dir, "attempts.txt"), "x"); attempts != 4 {
+		t.Errorf("attempts: %d", attempts)
+	}
+	if !strings.Contains(output, "attempt-4") {
+		t.Errorf("output of final attempt isn't shown: %q", output)
+	}
+	for _, n := range []string{"attempt-1", "attempt-2", "attempt-3"} {
+		if strings.Contains(output, n) {
+			t.Errorf("output of %s should be suppressed: %q", n, output)
+		}
+	}
+}
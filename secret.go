@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/uiez/tash/syntax"
+)
+
+// secretStore loads secrets lazily, it's shared by parallel runners.
+type secretStore struct {
+	mu      sync.Mutex
+	sources map[string]syntax.TaskSecret
+	values  map[string]string
+}
+
+func newSecretStore(sources map[string]syntax.TaskSecret) *secretStore {
+	return &secretStore{
+		sources: sources,
+		values:  map[string]string{},
+	}
+}
+
+func (s *secretStore) get(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, has := s.values[name]; has {
+		return v, nil
+	}
+	src, has := s.sources[name]
+	if !has {
+		return "", fmt.Errorf("secret not defined")
+	}
+	v, err := loadSecret(src)
+	if err != nil {
+		return "", err
+	}
+	addMaskedSecret(v)
+	s.values[name] = v
+	return v, nil
+}
+
+func loadSecret(src syntax.TaskSecret) (string, error) {
+	if src.File != "" {
+		content, err := ioutil.ReadFile(stringFromSlash(src.File))
+		if err != nil {
+			return "", fmt.Errorf("read secret file failed: %w", err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		args := []string{"find-generic-password", "-w", "-s", src.Keyring.Service}
+		if src.Keyring.Account != "" {
+			args = append(args, "-a", src.Keyring.Account)
+		}
+		cmd = exec.Command("security", args...)
+	case "linux", "freebsd", "openbsd", "netbsd":
+		args := []string{"lookup", "service", src.Keyring.Service}
+		if src.Keyring.Account != "" {
+			args = append(args, "account", src.Keyring.Account)
+		}
+		cmd = exec.Command("secret-tool", args...)
+	default:
+		return "", fmt.Errorf("keyring is not supported on %s", runtime.GOOS)
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("read keyring failed: %w", err)
+	}
+	return strings.TrimRight(string(output), "\r\n"), nil
+}
+
+// maskedSecrets are values of loaded secrets and redactions, replaced in logs.
+var maskedSecrets struct {
+	sync.RWMutex
+	values   []string
+	patterns []*regexp.Regexp
+}
+
+// minSecretEnvLength limits values of secret-like envs being masked, short values such as '1' are common words.
+const minSecretEnvLength = 4
+
+func addMaskedSecret(v string) {
+	if v == "" {
+		return
+	}
+	maskedSecrets.Lock()
+	defer maskedSecrets.Unlock()
+	for _, mv := range maskedSecrets.values {
+		if mv == v {
+			return
+		}
+	}
+	maskedSecrets.values = append(maskedSecrets.values, v)
+	// longer values are replaced first, so secrets containing others are masked entirely
+	sort.SliceStable(maskedSecrets.values, func(i, j int) bool {
+		return len(maskedSecrets.values[i]) > len(maskedSecrets.values[j])
+	})
+}
+
+func addMaskedPattern(p *regexp.Regexp) {
+	maskedSecrets.Lock()
+	defer maskedSecrets.Unlock()
+	for _, mp := range maskedSecrets.patterns {
+		if mp.String() == p.String() {
+			return
+		}
+	}
+	maskedSecrets.patterns = append(maskedSecrets.patterns, p)
+}
+
+// hasMaskedSecrets reports whether any secret or redaction is registered, loaded secrets of actions are included.
+func hasMaskedSecrets() bool {
+	maskedSecrets.RLock()
+	defer maskedSecrets.RUnlock()
+	return len(maskedSecrets.values) > 0 || len(maskedSecrets.patterns) > 0
+}
+
+func maskSecrets(s string) string {
+	maskedSecrets.RLock()
+	defer maskedSecrets.RUnlock()
+	for _, v := range maskedSecrets.values {
+		s = strings.Replace(s, v, "***", -1)
+	}
+	for _, p := range maskedSecrets.patterns {
+		s = p.ReplaceAllString(s, "***")
+	}
+	return s
+}
+
+// maskWriter masks secrets of output by lines, secrets spanning lines aren't masked.
+type maskWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func newMaskWriter(w io.Writer) *maskWriter {
+	return &maskWriter{w: w}
+}
+
+func (m *maskWriter) Write(p []byte) (int, error) {
+	m.buf = append(m.buf, p...)
+	if i := bytes.LastIndexByte(m.buf, '\n'); i >= 0 {
+		_, err := io.WriteString(m.w, maskSecrets(string(m.buf[:i+1])))
+		m.buf = append(m.buf[:0], m.buf[i+1:]...)
+		if err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// flush writes incomplete last line.
+func (m *maskWriter) flush() {
+	if len(m.buf) > 0 {
+		io.WriteString(m.w, maskSecrets(string(m.buf)))
+		m.buf = m.buf[:0]
+	}
+}
+
+// maskTerminalFds pipes outputs written to terminal directly through mask writers, returned function flushes them
+// after command exit. commands see pipes instead of terminal.
+func maskTerminalFds(fds *commandFds) (flush func()) {
+	var terminals []*maskWriter
+	if fds.Stdout == nil {
+		t := newMaskWriter(os.Stdout)
+		fds.Stdout = t
+		terminals = append(terminals, t)
+	}
+	if fds.Stderr == nil {
+		t := newMaskWriter(os.Stderr)
+		fds.Stderr = t
+		terminals = append(terminals, t)
+	}
+	return func() {
+		for _, t := range terminals {
+			t.flush()
+		}
+	}
+}
+
+// setupRedaction registers redactions of configuration, values are expanded by task envs.
+func (r *runner) setupRedaction(envs *ExpandEnvs) bool {
+	redact := r.configs.Redact
+	envs.redactSecretEnvs = redact.SecretEnvs
+	if redact.SecretEnvs {
+		for k, v := range envs.envs {
+			if secretEnvPattern.MatchString(k) && len(v) >= minSecretEnvLength {
+				addMaskedSecret(v)
+			}
+		}
+	}
+	for _, v := range redact.Values {
+		v, err := envs.expandString(v)
+		if err != nil {
+			r.fatalln("expand redaction value failed:", err)
+			return false
+		}
+		addMaskedSecret(v)
+	}
+	for _, p := range redact.Patterns {
+		reg, err := regexp.CompilePOSIX(p)
+		if err != nil {
+			r.fatalln("compile redaction pattern failed:", p, err)
+			return false
+		}
+		addMaskedPattern(reg)
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestTaskSecretFromFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	dir := testDir(t, map[string]string{
+		"token.txt": "s3cr3t-value\n",
+		"token.sh":  "echo \"token=$TOKEN\"\n",
+		"tash.yaml": `
+tasks:
+  main:
+    secrets:
+      - {env: TOKEN, file: token.txt}
+    actions:
+      - cmd: {exec: sh token.sh, secrets: [TOKEN], stdout: file.txt}
+      - cmd: {exec: sh token.sh, secrets: [TOKEN]}
+      - cmd: {exec: sh token.sh, stdout: unlisted.txt}
+`,
+	})
+	var failure string
+	output := captureStdout(t, func() {
+		failure = runTestTask(t, dir, "main")
+	})
+	if failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "file.txt"); content != "token=s3cr3t-value\n" {
+		t.Errorf("secret isn't passed to command: %q", content)
+	}
+	if content := readTestFile(t, dir, "unlisted.txt"); content != "token=\n" {
+		t.Errorf("secret is passed to command not listing it: %q", content)
+	}
+	if strings.Contains(output, "s3cr3t-value") || !strings.Contains(output, "token=***") {
+		t.Errorf("secret isn't masked in logged output: %q", output)
+	}
+}
+
+func TestMaskWriter(t *testing.T) {
+	addMaskedSecret("mask-writer-secret")
+	addMaskedPattern(regexp.MustCompile(`mwp_[a-z0-9]+`))
+
+	var buf bytes.Buffer
+	w := newMaskWriter(&buf)
+	for _, chunk := range []string{"key=mask-wri", "ter-secret\nid=mwp_", "x1y2 done\ntail mask-writer-secret"} {
+		w.Write([]byte(chunk))
+	}
+	if got := buf.String(); got != "key=***\nid=*** done\n" {
+		t.Errorf("masked complete lines: %q", got)
+	}
+	w.flush()
+	if got := buf.String(); got != "key=***\nid=*** done\ntail ***" {
+		t.Errorf("masked output after flush: %q", got)
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	dir := testDir(t, map[string]string{
+		"print.sh": "echo \"deploy=$DEPLOY_ID token=$API_TOKEN gh=ghp_R3dact3d plain=$PLAIN\"\n",
+		"tash.yaml": `
+redact:
+  values: ["${DEPLOY_ID}"]
+  patterns: ["ghp_[A-Za-z0-9]+"]
+  secretEnvs: true
+env: [DEPLOY_ID=deploy-7f3a9]
+tasks:
+  main:
+    actions:
+      - env: [API_TOKEN=tok-redact-4821, PLAIN=visible-value]
+      - cmd: {exec: sh print.sh, stdoutEnv: OUTPUT, tee: true}
+      - echo: {content: "${OUTPUT}", file: output.txt}
+      - cmd: {exec: sh print.sh}
+`,
+	})
+	var failure string
+	output := captureStdout(t, func() {
+		failure = runTestTask(t, dir, "main")
+		newLogger(false).infoln("logged tok-redact-4821")
+	})
+	if failure != "" {
+		t.Fatal(failure)
+	}
+	if !strings.Contains(output, "logged ***") {
+		t.Errorf("logs aren't redacted: %q", output)
+	}
+	for _, secret := range []string{"deploy-7f3a9", "tok-redact-4821", "ghp_R3dact3d"} {
+		if strings.Contains(output, secret) {
+			t.Errorf("%s isn't redacted: %q", secret, output)
+		}
+	}
+	if n := strings.Count(output, "deploy=*** token=*** gh=*** plain=visible-value"); n != 2 {
+		t.Errorf("captured and terminal outputs aren't redacted in display: %q", output)
+	}
+	// captured value keeps original output
+	if content := readTestFile(t, dir, "output.txt"); !strings.Contains(content, "token=tok-redact-4821") {
+		t.Errorf("captured output: %q", content)
+	}
+}
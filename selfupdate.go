@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/uiez/tash/syntax"
+)
+
+// executablePath returns path of running executable, it's replaced in tests.
+var executablePath = os.Executable
+
+func selfUpdate(log indentLogger, binUrl, hashAlg, hashSig, hashUrl string) {
+	if binUrl == "" {
+		log.fatalln("update url is not specified")
+		return
+	}
+	envs := newExpandEnvs()
+	envs.addAndExpand(log, syntax.BUILTIN_ENV_HOST_OS, runtime.GOOS, false)
+	envs.addAndExpand(log, syntax.BUILTIN_ENV_HOST_ARCH, runtime.GOARCH, false)
+	err := envs.expandStringPtrs(&binUrl, &hashUrl)
+	if err != nil {
+		log.fatalln(err)
+		return
+	}
+	if hashAlg == "" {
+		hashAlg = syntax.ResourceHashAlgSha256
+	}
+	hashAlg = strings.ToUpper(hashAlg)
+	if hashSig == "" && hashUrl != "" {
+		log.infoln("fetch checksum:", hashUrl)
+		hashSig, err = downloadChecksum(hashUrl)
+		if err != nil {
+			log.fatalln("fetch checksum failed:", err)
+			return
+		}
+	}
+	if hashSig == "" {
+		log.fatalln("checksum is required to verify the new binary")
+		return
+	}
+
+	exe, err := executablePath()
+	if err != nil {
+		log.fatalln("get executable path failed:", err)
+		return
+	}
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		log.fatalln("resolve executable path failed:", err)
+		return
+	}
+
+	log.infoln("download:", binUrl)
+	path, _, err := downloadFile(binUrl, downloadOptions{
+		HashAlg: hashAlg,
+		HashSig: hashSig,
+	})
+	if err != nil {
+		log.fatalln("download binary failed:", err)
+		return
+	}
+	defer os.Remove(path)
+
+	log.infoln("replace:", stringToSlash(exe))
+	err = replaceExecutable(log, exe, path)
+	if err != nil {
+		log.fatalln("update binary failed:", err)
+		return
+	}
+	log.infoln("updated.")
+}
+
+func downloadChecksum(url string) (string, error) {
+	path, _, err := downloadFile(url, downloadOptions{})
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(path)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	// support both plain digest and 'sha256sum' output format
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty checksum file")
+	}
+	return fields[0], nil
+}
+
+// replaceExecutable swaps the verified binary with the executable:
+// it's copied to a temp file in the same directory to make the final rename atomic,
+// the old executable is moved aside first and restored if the swap failed.
+func replaceExecutable(log logger, exe, downloaded string) error {
+	dir := filepath.Dir(exe)
+	tmp, err := ioutil.TempFile(dir, ".tash-update*")
+	if err != nil {
+		return fmt.Errorf("create temp file failed: %w", err)
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath)
+
+	err = copyFile(tmpPath, downloaded)
+	if err != nil {
+		return fmt.Errorf("copy binary failed: %w", err)
+	}
+	err = os.Chmod(tmpPath, 0755)
+	if err != nil {
+		return fmt.Errorf("chmod binary failed: %w", err)
+	}
+
+	if runtime.GOOS != "windows" {
+		// rename is atomic, executable is never missing even if interrupted.
+		err = os.Rename(tmpPath, exe)
+		if err != nil {
+			return fmt.Errorf("replace executable failed: %w", err)
+		}
+		return nil
+	}
+	// running executable couldn't be overwritten on windows, but it could be renamed.
+	backup := exe + ".old"
+	_ = os.Remove(backup)
+	err = os.Rename(exe, backup)
+	if err != nil {
+		return fmt.Errorf("backup executable failed: %w", err)
+	}
+	err = os.Rename(tmpPath, exe)
+	if err != nil {
+		if err2 := os.Rename(backup, exe); err2 != nil {
+			return fmt.Errorf("replace executable failed: %w, rollback failed: %s", err, err2)
+		}
+		return fmt.Errorf("replace executable failed: %w", err)
+	}
+	if err = os.Remove(backup); err != nil {
+		log.debugln("remove old executable failed:", err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestReplaceExecutable(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"tash":     "old",
+		"download": "new",
+	})
+	exe := filepath.Join(dir, "tash")
+	err := replaceExecutable(testLogger(t), exe, filepath.Join(dir, "download"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content := readTestFile(t, dir, "tash"); content != "new" {
+		t.Errorf("executable content: %q", content)
+	}
+	stat, err := os.Stat(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && stat.Mode().Perm() != 0755 {
+		t.Errorf("executable mode: %v", stat.Mode().Perm())
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(matches) != 2 {
+		t.Errorf("temporary or backup files are left: %v", matches)
+	}
+}
+
+func TestSelfUpdate(t *testing.T) {
+	newBinary := []byte("new tash binary")
+	sum := sha256.Sum256(newBinary)
+	checksum := hex.EncodeToString(sum[:])
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tash-" + runtime.GOOS + "-" + runtime.GOARCH:
+			w.Write(newBinary)
+		case "/SHA256SUMS":
+			fmt.Fprintf(w, "%s  tash\n", checksum)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	dir := testDir(t, map[string]string{"tash": "old tash binary"})
+	// downloaded files are created in temp dir
+	tmp := testDir(t, nil)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmp)
+	exe := filepath.Join(dir, "tash")
+	defer func(fn func() (string, error)) {
+		executablePath = fn
+	}(executablePath)
+	executablePath = func() (string, error) {
+		return exe, nil
+	}
+	update := func(hashSig, hashUrl string) string {
+		var failure string
+		log := newLogger(false)
+		log.exit = func(msg string) {
+			if failure == "" {
+				failure = msg
+			}
+		}
+		selfUpdate(log, server.URL+"/tash-${HOST_OS}-${HOST_ARCH}", "", hashSig, hashUrl)
+		return failure
+	}
+	noTempFiles := func() {
+		t.Helper()
+		if matches, _ := filepath.Glob(filepath.Join(tmp, "*")); len(matches) != 0 {
+			t.Errorf("downloaded files are left: %v", matches)
+		}
+		if matches, _ := filepath.Glob(filepath.Join(dir, "*")); len(matches) != 1 {
+			t.Errorf("temporary files are left beside executable: %v", matches)
+		}
+	}
+
+	for _, sig := range []string{strings.Repeat("0", 64), ""} {
+		hashUrl := ""
+		if sig == "" {
+			hashUrl = server.URL + "/missing"
+		}
+		if failure := update(sig, hashUrl); failure == "" {
+			t.Errorf("update with checksum %q %q should fail", sig, hashUrl)
+		}
+		if content := readTestFile(t, dir, "tash"); content != "old tash binary" {
+			t.Errorf("executable is changed by failed update: %q", content)
+		}
+		noTempFiles()
+	}
+	if failure := update(strings.Repeat("0", 64), ""); !strings.Contains(failure, "checksum mismatched") {
+		t.Errorf("mismatched checksum isn't reported: %q", failure)
+	}
+
+	if failure := update("", server.URL+"/SHA256SUMS"); failure != "" {
+		t.Fatal(failure)
+	}
+	if content := readTestFile(t, dir, "tash"); content != string(newBinary) {
+		t.Errorf("updated executable: %q", content)
+	}
+	noTempFiles()
+}
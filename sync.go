@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// syncMarker is the file marks remote directory created by sync, extraneous files are only removed in marked
+// directories unless forced.
+const syncMarker = ".tash-sync"
+
+type syncStats struct {
+	uploaded int
+	skipped  int
+	removed  int
+}
+
+// localSyncFiles returns slash separated paths of files relative to dir, matched directories are walked.
+func localSyncFiles(dir string, patterns []string) ([]string, error) {
+	if len(patterns) == 0 {
+		patterns = []string{"."}
+	}
+	var roots []string
+	for _, p := range patterns {
+		roots = append(roots, filepath.Join(dir, p))
+	}
+	matched, err := globPaths(roots, false)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var files []string
+	for _, m := range matched {
+		err = filepath.Walk(stringFromSlash(m), func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			if !seen[rel] {
+				seen[rel] = true
+				files = append(files, rel)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// checkPruneDest refuses to remove extraneous files in empty, root, home directory or its ancestors,
+// relative dest is based on home.
+func checkPruneDest(dest, home string) error {
+	cleaned := path.Clean(dest)
+	switch {
+	case strings.TrimSpace(dest) == "":
+		return fmt.Errorf("dest is empty")
+	case cleaned == "/" || cleaned == "." || cleaned == "~" || cleaned == ".." || strings.HasPrefix(cleaned, "../"):
+		return fmt.Errorf("dest is root or home directory: %s", dest)
+	case home != "" && path.IsAbs(cleaned) && (cleaned == path.Clean(home) || strings.HasPrefix(path.Clean(home), cleaned+"/")):
+		return fmt.Errorf("dest is home directory or its ancestor: %s", dest)
+	}
+	return nil
+}
+
+// checkPruneAllowed checks whether extraneous files in dest could be removed, dest should be created by sync
+// unless force.
+func checkPruneAllowed(client *sftp.Client, dest string, force bool) error {
+	home, err := client.Getwd()
+	if err != nil {
+		return fmt.Errorf("get remote home directory failed: %w", err)
+	}
+	err = checkPruneDest(dest, home)
+	if err != nil || force {
+		return err
+	}
+	if _, err = client.Stat(path.Join(dest, syncMarker)); err == nil {
+		return nil
+	}
+	entries, err := client.ReadDir(dest)
+	if err != nil || len(entries) == 0 {
+		// dest doesn't exist or it's empty, it's created by sync
+		return nil
+	}
+	return fmt.Errorf("dest isn't created by sync, set force to remove extraneous files: %s", dest)
+}
+
+// syncFiles uploads files to remote dest directory, files with same size and modification time are skipped.
+// remote files not in files are removed if del, see checkPruneAllowed.
+func syncFiles(client *sftp.Client, dir string, files []string, dest string, del, force bool) (syncStats, error) {
+	var stats syncStats
+	if del {
+		err := checkPruneAllowed(client, dest, force)
+		if err != nil {
+			return stats, err
+		}
+	}
+	err := client.MkdirAll(dest)
+	if err != nil {
+		return stats, fmt.Errorf("create remote directory failed: %s, %w", dest, err)
+	}
+	synced := map[string]bool{}
+	if del {
+		marker := path.Join(dest, syncMarker)
+		fd, err := client.Create(marker)
+		if err != nil {
+			return stats, fmt.Errorf("create sync marker failed: %w", err)
+		}
+		fd.Close()
+		synced[marker] = true
+	}
+	for _, rel := range files {
+		localPath := filepath.Join(dir, filepath.FromSlash(rel))
+		remotePath := path.Join(dest, rel)
+		synced[remotePath] = true
+
+		stat, err := os.Stat(localPath)
+		if err != nil {
+			return stats, err
+		}
+		if rstat, err := client.Stat(remotePath); err == nil && rstat.Size() == stat.Size() && rstat.ModTime().Unix() == stat.ModTime().Unix() {
+			if rstat.Mode().Perm() != stat.Mode().Perm() {
+				err = client.Chmod(remotePath, stat.Mode().Perm())
+				if err != nil {
+					return stats, fmt.Errorf("change remote file mode failed: %s, %w", remotePath, err)
+				}
+			}
+			stats.skipped++
+			continue
+		}
+		err = uploadFile(client, localPath, remotePath, stat)
+		if err != nil {
+			return stats, fmt.Errorf("upload file failed: %s, %w", rel, err)
+		}
+		stats.uploaded++
+	}
+	if !del {
+		return stats, nil
+	}
+	var extraneous []string
+	walker := client.Walk(dest)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return stats, fmt.Errorf("walk remote directory failed: %w", err)
+		}
+		if !walker.Stat().IsDir() && !synced[walker.Path()] {
+			extraneous = append(extraneous, walker.Path())
+		}
+	}
+	for _, p := range extraneous {
+		err = client.Remove(p)
+		if err != nil {
+			return stats, fmt.Errorf("remove remote file failed: %s, %w", p, err)
+		}
+		stats.removed++
+	}
+	return stats, nil
+}
+
+// uploadFile copies file to remote path, permission bits and modification time are preserved like copyFile.
+func uploadFile(client *sftp.Client, localPath, remotePath string, stat os.FileInfo) error {
+	err := client.MkdirAll(path.Dir(remotePath))
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := client.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err1 := dst.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = client.Chmod(remotePath, stat.Mode().Perm())
+	}
+	if err == nil {
+		err = client.Chtimes(remotePath, stat.ModTime(), stat.ModTime())
+	}
+	if err != nil {
+		client.Remove(remotePath)
+		return err
+	}
+	return nil
+}
+
+// sftp opens sftp client on the shared ssh connection.
+func (h *remoteHost) sftp() (*sftp.Client, error) {
+	client, err := h.connect()
+	if err != nil {
+		return nil, err
+	}
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		return nil, fmt.Errorf("create sftp client failed: %w", err)
+	}
+	return sc, nil
+}
+
+// remotePath resolves relative path against remote directory of host.
+func (h *remoteHost) remotePath(p string) string {
+	p = stringToSlash(p)
+	if h.Dir != "" && !path.IsAbs(p) {
+		return path.Join(h.Dir, p)
+	}
+	return p
+}
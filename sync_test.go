@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// testSftpClient connects to in-process sftp server serving local filesystem.
+func testSftpClient(t *testing.T) *sftp.Client {
+	t.Helper()
+	crd, swr := io.Pipe()
+	srd, cwr := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{srd, swr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	client, err := sftp.NewClientPipe(crd, cwr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// server closes its writer first, otherwise client waits for server's response forever
+		server.Close()
+		client.Close()
+	})
+	return client
+}
+
+func TestCheckPruneDest(t *testing.T) {
+	for _, c := range []struct {
+		dest string
+		ok   bool
+	}{
+		{"", false},
+		{" ", false},
+		{".", false},
+		{"./", false},
+		{"~", false},
+		{"/", false},
+		{"..", false},
+		{"../app", false},
+		{"/home/user", false},
+		{"/home/user/", false},
+		{"/home", false},
+		{"/home/user/app", true},
+		{"app", true},
+		{"/srv/app", true},
+	} {
+		err := checkPruneDest(c.dest, "/home/user")
+		if (err == nil) != c.ok {
+			t.Errorf("dest %q: error %v, want ok %v", c.dest, err, c.ok)
+		}
+	}
+}
+
+func TestSyncFiles(t *testing.T) {
+	src := testDir(t, map[string]string{
+		"a.txt":     "a",
+		"sub/b.txt": "b",
+	})
+	err := os.Chmod(filepath.Join(src, "a.txt"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := testSftpClient(t)
+	files, err := localSyncFiles(src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.ToSlash(filepath.Join(testDir(t, nil), "dest"))
+	stats, err := syncFiles(client, src, files, dest, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.uploaded != 2 {
+		t.Fatalf("uploaded %d files, want 2", stats.uploaded)
+	}
+	if content := readTestFile(t, dest, "sub/b.txt"); content != "b" {
+		t.Errorf("synced content: %q", content)
+	}
+	stat, err := os.Stat(filepath.Join(dest, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != 0600 {
+		t.Errorf("synced mode: %v", stat.Mode().Perm())
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dest, "extra.txt"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err = syncFiles(client, src, files, dest, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.skipped != 2 || stats.removed != 1 {
+		t.Errorf("second sync: %+v", stats)
+	}
+	if _, err = os.Stat(filepath.Join(dest, syncMarker)); err != nil {
+		t.Errorf("sync marker removed: %v", err)
+	}
+}
+
+func TestSyncFilesRefuseUnmarkedDest(t *testing.T) {
+	src := testDir(t, map[string]string{"a.txt": "a"})
+	dest := testDir(t, map[string]string{"keep.txt": "keep"})
+	client := testSftpClient(t)
+
+	_, err := syncFiles(client, src, []string{"a.txt"}, dest, true, false)
+	if err == nil {
+		t.Fatal("pruning unmarked directory should be refused")
+	}
+	if _, err = os.Stat(filepath.Join(dest, "keep.txt")); err != nil {
+		t.Fatalf("file removed by refused sync: %v", err)
+	}
+
+	// syncing to unmarked dest is still allowed without delete
+	_, err = syncFiles(client, src, []string{"a.txt"}, dest, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := syncFiles(client, src, []string{"a.txt"}, dest, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.removed != 1 {
+		t.Errorf("forced sync: %+v", stats)
+	}
+}
@@ -6,8 +6,26 @@ type contextActions struct {
 	Env ActionEnv
 	// change current working directory
 	Chdir ActionChdir
+	// hold exclusive file lock for actions or rest of task
+	Lock ActionLock
 	// silent logs or errors, same as '-' and '@' in makefile.
 	Silent ActionSilent
+	// write environments to ci platform outputs
+	CiOutput ActionCiOutput
+	// source shell script and import environments changed by it
+	Source ActionSource
+	// set or unset environments, optionally applied to tash process
+	SetEnv ActionSetEnv
+	// match value with regexp and bind capture groups to environments
+	Match ActionMatch
+	// generate random value to environment
+	Random ActionRandom
+	// encode value and bind result to environment
+	Encode ActionCodec
+	// decode value and bind result to environment
+	Decode ActionCodec
+	// build json object from values and bind it to environment
+	JsonEncode ActionJsonEncode
 }
 
 // environment definition
@@ -25,9 +43,144 @@ type ActionChdir struct {
 	Actions ActionList
 }
 
+// hold exclusive file lock like task lock, such as guarding destructive operations from concurrent runs.
+// relative paths are based on task directory. the lock is released after Actions completed,
+// or when task ends if Actions is empty.
+type ActionLock struct {
+	// lock file path
+	File string
+	// wait for lock held by another process instead of failing
+	Wait bool
+	// max waiting time in milliseconds, 0 means forever
+	Timeout uint
+	// actions run while holding the lock
+	Actions ActionList
+}
+
 // silent execution, default hide log, but still fatal on errors
 // uses flags to changes the default behavior
 type ActionSilent struct {
 	Flags   []string
 	Actions ActionList
 }
+
+const (
+	CiPlatformGithub = "github"
+	CiPlatformGitlab = "gitlab"
+)
+
+// write environments to ci platform outputs, so later ci steps could consume them.
+//
+// github: append name=value to $GITHUB_OUTPUT.
+// gitlab: append name=value to a dotenv file, it should be declared as 'artifacts:reports:dotenv' in ci config.
+type ActionCiOutput struct {
+	// env names, text block
+	Envs string
+	// github or gitlab, detected by environment GITHUB_ACTIONS/GITLAB_CI if empty.
+	Platform string
+	// output file path, $GITHUB_OUTPUT by default on github, required on gitlab.
+	File string
+	// flush output file and it's directory entry to disk before completed, for crash consistency.
+	Durable bool
+}
+
+// source shell script and import environments changed by it,
+// the shell should support 'env -0'.
+type ActionSource struct {
+	// script path
+	Script string
+	// shell used to source script, 'sh' by default
+	Shell string
+}
+
+// set and unset environments, commands always see them through environments passed to them.
+type ActionSetEnv struct {
+	// environments to set, same format as Env
+	Set EnvList
+	// names of environments to remove entirely
+	Unset []string
+	// also set/unset environments of tash process by os.Setenv/os.Unsetenv, so they are visible to
+	// code reading process environments, such as executable lookup, proxy settings and tasks started later.
+	// process changes are not restored by localEnv, and they are shared by parallel loop iterations.
+	Process bool
+}
+
+// match value with regexp, named groups are bound to environments of the same name, numbered groups
+// are bound to 'PREFIX_N' if Prefix is specified, unmatched optional groups are bound to empty.
+// action fails if mismatched unless MatchedEnv is specified, environments are unchanged in that case.
+type ActionMatch struct {
+	Value string
+	// RE2(perl) regexp to support named groups, unlike posix regexp of other actions,
+	// such as 'v(?P<major>\\d+)\\.(?P<minor>\\d+)'
+	Regexp string
+	// prefix of env names bound to numbered groups, such as 'V' binds V_0(whole match), V_1, V_2...
+	Prefix string
+	// env name bound to 'true' or 'false'
+	MatchedEnv string
+}
+
+const (
+	RandomTypeUuid = "uuid"
+	RandomTypeHex  = "hex"
+	RandomTypeInt  = "int"
+)
+
+// generate random value by crypto/rand and bind it to environment.
+type ActionRandom struct {
+	// env name
+	Env string
+	// uuid(default): version 4 uuid such as '0b7e3f5c-9d2a-4c1e-8f6b-2a4d6e8f0c1a'.
+	// hex: hex string of Bytes random bytes.
+	// int: integer between Min and Max, both are included.
+	Type string
+	// bytes count of hex string, 16 by default
+	Bytes int
+	Min   int64
+	Max   int64
+}
+
+const (
+	EncodingBase64     = "base64"
+	EncodingBase64Url  = "base64url"
+	EncodingHex        = "hex"
+	EncodingGzipBase64 = "gzip+base64"
+	EncodingUrlQuery   = "urlQuery"
+	EncodingUrlPath    = "urlPath"
+)
+
+// encode or decode value, decoding fails if value is invalid.
+type ActionCodec struct {
+	Value string
+	// base64(default): standard base64 with padding.
+	// base64url: url safe base64 with padding, unpadded value is also accepted in decoding.
+	// hex: lower case hex string.
+	// gzip+base64: gzip compressed and standard base64 encoded.
+	// urlQuery: escaped for url query parameter, space is encoded as '+', such as 'a b&c' to 'a+b%26c'.
+	// urlPath: escaped for url path segment, space is encoded as '%20'.
+	Encoding string
+	// env name
+	Env string
+}
+
+const (
+	JsonTypeString = "string"
+	JsonTypeNumber = "number"
+	JsonTypeBool   = "bool"
+	JsonTypeRaw    = "json"
+)
+
+// build json object and bind it to environment, such as:
+// {env: BODY, fields: {name: $NAME, meta.size: $SIZE}, types: {meta.size: number}} binds
+// '{"meta":{"size":10},"name":"tash"}' to BODY, keys of object are sorted.
+type ActionJsonEncode struct {
+	// env name
+	Env string
+	// values keyed by field name, dot separated name creates nested objects
+	Fields map[string]string
+	// value types keyed by field name:
+	// string(default): value is kept as string.
+	// number: value is converted to integer or float number.
+	// bool: value is converted to boolean, true/yes/1 or false/no/0.
+	// json: value is json text, such as array or object.
+	Types map[string]string
+}
@@ -8,6 +8,10 @@ type flowActions struct {
 	If ActionIf
 	// loop running, same as 'for' keyword in programming, 'while' doesn't supported yet.
 	Loop ActionLoop
+	// run all actions even if some of them failed, fails after all actions completed if any failed.
+	RunAll ActionRunAll
+	// run actions again from the first one if any of them failed.
+	Retry ActionRetry
 }
 
 // sugar for condition checking
@@ -38,12 +42,66 @@ type ActionLoop struct {
 	}
 	// loop over string array
 	Array []string
-	// loop over string array split from given value and separator
+	// loop over elements of array env, such as output captured in split mode
+	ArrayEnv string
+	// loop over string array split from given value and separator, items are trimmed and empty items are skipped.
 	Split struct {
-		Value     string
+		Value string
+		// separator such as ',' or '\n', DefaultArraySeparator by default
 		Separator string
 	}
+	// loop over lines read from stdin, such as paths piped by 'git diff --name-only | tash lint'.
+	// lines are trimmed and empty lines are skipped, stdin is read once and shared by loops.
+	// there is no iteration if stdin is a terminal or empty.
+	Stdin struct {
+		Enabled bool
+		// lines must be existing paths, missing paths are reported together before iterations.
+		// relative paths are resolved like paths of file actions.
+		Paths bool
+	}
+
+	// env name to access index of iteration, begin at 0
+	IndexVar string
+
+	// run at most Parallel iterations concurrently, 0 or 1 means sequentially.
+	// each parallel iteration runs with a copy of environments, changes are not visible to
+	// other iterations and actions after loop. changing process wide states such as 'chdir', process
+	// environments and PATH is refused.
+	Parallel int
+	// failure handling of parallel iterations, loop fails if any iteration failed:
+	// failFast(default): no more iterations are started after a failure, remaining actions of running ones
+	// are skipped, running commands are waited.
+	// collect: run all iterations and report failed count.
+	OnFailure string
+
+	// actions to be run
+	Actions ActionList
+	// actions run once before first iteration, skipped if there are no iterations
+	Before ActionList
+	// actions run once after last iteration, skipped if there are no iterations
+	After ActionList
+}
+
+// retry block of actions, each attempt runs actions from the first one with the same environments,
+// environments changed by failed attempt are kept. commands marked 'once' aren't run again after they succeeded.
+type ActionRetry struct {
+	// times, delay and backoff between attempts
+	Retry
+	// actions to be run
+	Actions ActionList
+}
 
+// best effort running, such as cleanup steps.
+type ActionRunAll struct {
 	// actions to be run
 	Actions ActionList
+	// env name to bind count of failed actions
+	FailedEnv string
+	// don't fail after running if some actions failed, useful with FailedEnv
+	AllowFailure bool
 }
+
+const (
+	LoopOnFailureFailFast = "failFast"
+	LoopOnFailureCollect  = "collect"
+)
@@ -1,6 +1,9 @@
 package syntax
 
 // filesystem actions
+//
+// relative paths are resolved against the chdir directory or task workdir, falling back to the directory
+// of config file that task defined in, prefix path with 'cwd:' to resolve it against current working directory.
 type fsActions struct {
 	// copy resources
 	Copy ActionCopy
@@ -16,12 +19,45 @@ type fsActions struct {
 	Watch ActionWatch
 	// write content to file
 	Echo ActionEcho
+	// concatenate files into one
+	Merge ActionMerge
+	// split file into numbered chunks
+	Split ActionSplit
+	// ensure a line is present or absent in file
+	LineInFile ActionLineInFile
+	// bind file metadata to environments
+	Stat ActionStat
+	// compare file with expected file or content, fails with unified diff if mismatched
+	Diff ActionDiff
+	// report drift of files and envs from desired state without changing anything
+	Drift ActionDrift
+	// verify files listed in checksum manifest such as SHA256SUMS
+	VerifyManifest ActionVerifyManifest
+	// verify existence, size and checksum of file in one check
+	Verify ActionVerify
+	// validate json/yaml files
+	Validate ActionValidate
+	// compute checksum of directory tree, compare it with expected value or another directory
+	DirChecksum ActionDirChecksum
+	// mirror directory tree with symlinks to source files
+	LinkTree ActionLinkTree
+	// render directory tree of text templates
+	Generate ActionGenerate
+	// apply unified diff to files
+	Patch ActionPatch
+	// upload files to remote host over sftp
+	Sync ActionSync
+	// remove paths if exist, refuse to remove unsafe paths
+	EnsureAbsent ActionEnsureAbsent
 }
 
 const (
 	ResourceHashAlgSha1   = "SHA1"
 	ResourceHashAlgMD5    = "MD5"
 	ResourceHashAlgSha256 = "SHA256"
+
+	ContentEncodingDecode = "decode"
+	ContentEncodingRaw    = "raw"
 )
 
 // resource copy/download
@@ -34,18 +70,195 @@ type ActionCopy struct {
 	DestPath string
 	// Force
 	Force string
+	// keep copying remaining files of directory if some files failed, failures are reported after copying.
+	// copying aborts at first failure by default.
+	ContinueOnError bool
+	// retry failed download of http/https resource
+	Retry Retry
+	// how to handle http Content-Encoding of response, hash is checked against the saved content.
+	// decode(default): decode gzip and deflate content, other encodings such as brotli(br) are refused.
+	// raw: save content as is.
+	ContentEncoding string
 	// hash checking for file
 	Hash struct {
 		// hash algorithm, support SHA1, MD5 and SHA256, sha1 by default.
 		Alg string
 		// hexadecimal string, case insensitive
 		Sig string
+		// env name bound to hex digest of downloaded http/https resource computed by Alg, so it could be
+		// recorded such as in lock file. it's computed while downloading and only bound if file is downloaded.
+		// Alg must be specified explicitly if it's set.
+		Env string
+	}
+	// proxy of http/https resource, HTTP_PROXY/HTTPS_PROXY/NO_PROXY environments are used if Url is empty.
+	Proxy struct {
+		// proxy url, supports http, https and socks5 schema, 'direct' to disable proxy.
+		Url string
+		// comma separated hosts connected directly: '*' for all hosts, 'example.com' matches it and it's subdomains,
+		// ip or CIDR such as '10.0.0.0/8', port could be specified like 'example.com:8080'.
+		NoProxy string
 	}
+	// tls options of https resource
+	Tls struct {
+		// PEM encoded CA certificates trusted in addition to system ones
+		CaFile string
+		// PEM encoded client certificate and key for mutual TLS
+		CertFile string
+		KeyFile  string
+		// skip verification of server certificate, it's insecure and only for development.
+		InsecureSkipVerify bool
+	}
+}
+
+const ProxyDirect = "direct"
+
+const (
+	LineStatePresent = "present"
+	LineStateAbsent  = "absent"
+
+	LinePositionBegin = "begin"
+	LinePositionEnd   = "end"
+)
+
+// ensure a line is present or absent in file, file is only written if it's changed.
+type ActionLineInFile struct {
+	// file path, it will be created if not exist in present state
+	File string
+	// the line content
+	Line string
+	// present or absent, present by default
+	State string
+	// regexp to locate lines, in present state the last matched line will be replaced,
+	// in absent state all matched lines will be removed.
+	// if empty, lines equal to Line are located.
+	Regexp string
+	// where to insert the line if not found, begin or end, end by default
+	Position string
+	// regexp to locate the line to insert after, it takes priority over Position if matched
+	InsertAfter string
+}
+
+const (
+	StatTimeFormatRFC3339 = "rfc3339"
+	StatTimeFormatUnix    = "unix"
+)
+
+// bind file metadata to environments, fields except Path, TimeFormat and AllowMissing are env names,
+// empty env names are skipped.
+type ActionStat struct {
+	// file or directory path, symlinks are followed
+	Path string
+	// file size in bytes
+	Size string
+	// modification time
+	ModTime string
+	// format of modification time, rfc3339 or unix(seconds), rfc3339 by default
+	TimeFormat string
+	// octal permission string, such as 0644
+	Mode string
+	// 'true' or 'false'
+	IsDir string
+	// 'true' or 'false', useful with AllowMissing
+	Exist string
+	// don't fail if path doesn't exist, other envs are set to empty
+	AllowMissing bool
+}
+
+// compare file with expected file or content
+type ActionDiff struct {
+	// actual file path
+	File string
+	// expected file path
+	Expected string
+	// expected content, used if Expected is empty
+	Content string
+	// condition, overwrite expected file with actual file instead of failing, for golden-file workflows.
+	Update string
+	// context lines of diff, 3 by default
+	Context int
+}
+
+// report differences between current state and desired state of files and envs like a plan, nothing is changed.
+// each drifted item is reported as '+'(create), '~'(update) or '-'(remove) with unified diff of content.
+type ActionDrift struct {
+	// desired state of files
+	Files []DriftFile
+	// desired env values, the key is env name
+	Envs map[string]string
+	// fail if any drift is detected, drift is only reported by default.
+	Fail BoolString
+	// env name bound to count of drifted items
+	CountEnv string
+	// context lines of diff, 3 by default
+	Context int
+}
+
+type DriftFile struct {
+	// file path
+	Path string
+	// desired content, used if Source is empty
+	Content string
+	// file path of desired content
+	Source string
+	// octal permission such as '0644', not compared if empty
+	Mode string
+	// file should not exist, other fields are ignored
+	Absent bool
+}
+
+// verify artifact file exists, is a regular file, isn't empty and matches expected size and checksum.
+// failed sub checks are reported together in one message.
+type ActionVerify struct {
+	// file path
+	File string
+	// expected size, support unit suffixes like 512KB, 100MB, not checked if empty
+	Size string
+	// expected checksum in format 'alg:hex' such as 'sha256:HEX', supports sha1, md5 and sha256, not checked if empty
+	Checksum string
+	// empty file is allowed
+	AllowEmpty bool
+}
+
+// verify files listed in checksum manifest, lines are in 'sha256sum' output format: '<hex>  <path>',
+// all mismatched and missing files are reported together.
+type ActionVerifyManifest struct {
+	// manifest file path
+	Manifest string
+	// hash algorithm, support SHA1, MD5 and SHA256, SHA256 by default.
+	Alg string
+	// base directory of relative paths in manifest, manifest directory by default
+	Dir string
+}
+
+const (
+	ValidateFormatJson = "json"
+	ValidateFormatYaml = "yaml"
+)
+
+// validate json/yaml files syntax
+type ActionValidate struct {
+	// file paths, support glob
+	Files string
+	// json or yaml, detected by file extension if empty
+	Format string
+	// top-level keys must be present, document should be an object if not empty
+	RequiredKeys []string
 }
 
 // path delete, support glob
 type ActionDel = string
 
+// remove matched paths, it's no-op if nothing matched. filesystem root, home directory, current directory
+// and their ancestors are refused, so are paths outside of task directory(or chdir directory) unless AllowOutside.
+type ActionEnsureAbsent struct {
+	// paths, support glob
+	Paths string
+	// remove directories recursively, non-empty directories fail without it
+	Recursive bool
+	// allow removing paths outside of task directory
+	AllowOutside bool
+}
+
 // replace file content
 type ActionReplace struct {
 	// file path, not directory, support glob
@@ -71,6 +284,10 @@ type ActionEcho struct {
 	Content string
 	File    string
 	Append  bool
+	// octal permission of file such as '0755', 0644 by default
+	Mode string
+	// flush file and it's directory entry to disk before completed, for crash consistency.
+	Durable bool
 }
 
 // watch fs changes
@@ -82,3 +299,109 @@ type ActionWatch struct {
 
 	Actions ActionList
 }
+
+// concatenate files into one
+type ActionMerge struct {
+	// input files, support glob, merged in lexical order
+	Files string
+	// output file path, it's excluded from input files
+	Output string
+	// written between files
+	Separator string
+	// written before each file, '{}' is replaced by file path
+	Header string
+	// octal permission of output file such as '0755', 0644 by default
+	Mode string
+	// flush output file and it's directory entry to disk before completed, for crash consistency.
+	Durable bool
+}
+
+// split file into chunks named 'prefix.000', 'prefix.001'...
+type ActionSplit struct {
+	// file to split, not directory
+	File string
+	// chunk file prefix, use file path by default
+	Output string
+	// max bytes of each chunk, support unit suffixes like 512KB, 100MB
+	Size string
+	// max lines of each chunk, only one of size and lines could be specified
+	Lines int
+}
+
+// checksum of directory tree is computed over sorted entries, each entry contributes it's
+// slash-separated relative path, type, permission bits(unless IgnoreMode), and content digest
+// for files or target for symlinks.
+type ActionDirChecksum struct {
+	// directory path
+	Dir string
+	// hash algorithm, support SHA1, MD5 and SHA256, SHA256 by default.
+	Alg string
+	// ignore permission bits, useful for comparing across platforms
+	IgnoreMode bool
+	// env name to bind checksum in hex
+	Env string
+	// expected checksum in hex, fails if mismatched
+	Expected string
+	// another directory to compare with, fails with differed entries if mismatched
+	Compare string
+}
+
+// apply unified diff to files like 'patch', files are written only if all of them are patched.
+// file already patched is skipped, so it's safe to run again.
+type ActionPatch struct {
+	// patch file path
+	File string
+	// inline patch content, used if File is empty, it's not expanded
+	Content string
+	// directory of files to be patched
+	Dir string
+	// leading path components removed from file names like 'patch -p', set it to 1 for 'a/' and 'b/' prefixes
+	// of git diff. files outside of Dir are refused.
+	Strip int
+}
+
+// upload files to remote host over sftp, files with same size and modification time are skipped,
+// permission bits and modification time are preserved.
+type ActionSync struct {
+	// local directory
+	Dir string
+	// file patterns relative to Dir, support glob, matched directories are uploaded recursively,
+	// all files in Dir by default.
+	Files string
+	// remote directory, relative path is based on Dir of host
+	Dest string
+	// delete remote files in Dest which are not uploaded. it's refused if Dest is empty, root, home directory
+	// or its ancestors, and only allowed in directories created by sync(marked by '.tash-sync' file) unless Force.
+	Delete bool
+	// delete remote files in existing directory which isn't created by sync
+	Force bool
+	// remote host, host of task is used if address is empty
+	Host TaskHost
+}
+
+// mirror source directory tree into dest, directories are created and files are symlinked to sources,
+// so changes of sources are reflected without copying again. existing links to the same source are kept.
+type ActionLinkTree struct {
+	// source directory
+	Source string
+	// dest directory, created if not exist
+	Dest string
+	// replace existing files and links in dest, fails by default
+	Overwrite bool
+	// create links relative to link directory instead of absolute source paths
+	Relative bool
+}
+
+// render text files of source directory as go text/template to dest directory, such as project scaffolding.
+// envs are template data like '{{.NAME}}', missing envs are errors. file and directory names could also be
+// templates such as '{{.NAME}}.go'. binary files(containing NUL bytes) are copied verbatim, modes are preserved.
+type ActionGenerate struct {
+	// source directory of templates
+	Source string
+	// dest directory, created if not exist
+	Dest string
+	// replace existing files in dest, fails by default
+	Overwrite bool
+	// flush generated files and their directory entries to disk, for crash consistency.
+	Durable bool
+}
@@ -8,12 +8,24 @@ type processActions struct {
 	Sleep ActionSleep
 	// execute command
 	Cmd ActionCmd
+	// execute script
+	Script ActionScript
 	// wait process exit
 	Wait ActionWait
+	// wait background commands of handles exit
+	WaitAll ActionWaitAll
 	// print warning
 	Warn ActionWarn
 	// print error and exit(can be ignored by silent rules)
 	Fatal ActionFatal
+	// lookup executable path of command
+	Which ActionWhich
+	// run command repeatedly until it's output satisfies condition
+	RetryUntil ActionRetryUntil
+	// run command repeatedly until it succeeds
+	Poll ActionPoll
+	// check version of installed tool
+	RequireVersion ActionRequireVersion
 }
 
 // command execution
@@ -24,9 +36,72 @@ type ActionCmd struct {
 	Env EnvList
 	// command line string, supports unix pipe
 	Exec string
+	// how output of command substitution(`cmd`) is tokenized, output is trimmed first.
+	// keep(default): output is kept as is in the argument, even it contains spaces or newlines.
+	// split: output is split into words by whitespaces like shell, words adjoining
+	// the substitution are joined with the first and last word.
+	Substitution string
+	// names of task secrets passed to command environments, terminal outputs of command are piped to mask them.
+	Secrets []string
+	// expand '@file' arguments to whitespace or newline separated arguments in file, like gcc/javac response files.
+	// relative file path is based on WorkDir
+	ResponseFiles bool
+	// retry failed command, each line of Exec is retried separately
+	Retry Retry
+	// run each line of Exec only once in enclosing retry block, succeeded lines are skipped in later attempts,
+	// for non-idempotent commands such as creating resources. lines are identified by position of action in
+	// the block and line index, not command text.
+	Once bool
+	CmdCapture
+	// name of background command referenced by waitAll action, only for background command
+	Handle string
 
-	// io redirection from/to file
+	CmdIO
+}
+
+const (
+	RetryJitterNone  = "none"
+	RetryJitterFull  = "full"
+	RetryJitterEqual = "equal"
+)
+
+// retry options of failed command or download, delay before n-th retry is Delay*Multiplier^(n-1), limited by MaxDelay.
+type Retry struct {
+	// retry times after first failure, 0 to disable retrying
+	Times int
+	// initial delay in milliseconds, 1000 by default
+	Delay uint
+	// max delay in milliseconds, unlimited if 0
+	MaxDelay uint
+	// delay multiplier, 2 by default, 1 for fixed delay
+	Multiplier float64
+	// randomize delay to spread out retries of parallel jobs:
+	// none(default): computed delay is used.
+	// full: random delay between 0 and computed delay.
+	// equal: half of computed delay plus random delay between 0 and the other half.
+	Jitter string
+}
 
+// capture outputs of command into envs
+type CmdCapture struct {
+	// env names bound to trimmed stdout and stderr of command, outputs of all lines of Exec are concatenated.
+	// the captured stream isn't printed unless Tee is set, and couldn't be redirected to file.
+	StdoutEnv string
+	StderrEnv string
+	// how captured outputs are bound to envs:
+	// trim(default): leading and trailing whitespaces are removed.
+	// raw: output is kept as is, including trailing newline.
+	// firstLine, lastLine: the first or last non-empty line of output, trimmed.
+	// split: non-empty lines of output are bound as array env, lines are trimmed unless Untrimmed.
+	Output string
+	// keep spaces of lines such as in file names, only for split output mode
+	Untrimmed bool
+	// keep empty lines as array elements, only for split output mode
+	KeepEmptyLines bool
+}
+
+// io redirection from/to file
+type CmdIO struct {
 	// os.Stdin if empty
 	Stdin string
 
@@ -35,14 +110,60 @@ type ActionCmd struct {
 	// append to or truncate file
 	StdoutAppend bool
 
-	// os.Stderr if empty
+	// os.Stderr if empty, could be same as Stdout
 	Stderr       string
 	StderrAppend bool
 
+	// octal permission of created stdout/stderr files such as '0600', 0644 by default
+	FileMode string
+
+	// also write redirected output to terminal like 'tee', not supported for background command
+	Tee bool
+
+	// ask command to flush output by lines, so output of long-running command is shown in real time
+	// even if it's redirected or captured. tash doesn't buffer output, but programs using C stdio or
+	// python buffer output when it's not a terminal. PYTHONUNBUFFERED is set, and command is run by
+	// 'stdbuf -oL -eL' on local host if stdbuf is available.
+	LineBuffered bool
+
 	// run in background
 	Background bool
 }
 
+// run multi-line script by writing it to a temp file, the file is removed after script exit.
+// envs are passed to script as environments, but script content is not expanded.
+// script always run on host, background is not supported.
+type ActionScript struct {
+	// working directory
+	WorkDir string
+	// script local env
+	Env EnvList
+	// interpreter command line such as 'python3 -u', use '#!' line of Content if empty, or 'sh' by default.
+	Interpreter string
+	// script content
+	Content string
+	// script arguments
+	Args []string
+	// names of task secrets passed to script environments, terminal outputs of script are piped to mask them.
+	Secrets []string
+
+	CmdCapture
+	CmdIO
+}
+
+const (
+	SubstitutionKeep  = "keep"
+	SubstitutionSplit = "split"
+)
+
+const (
+	OutputTrim      = "trim"
+	OutputRaw       = "raw"
+	OutputFirstLine = "firstLine"
+	OutputLastLine  = "lastLine"
+	OutputSplit     = "split"
+)
+
 // pkill process
 type ActionPkill struct {
 	Process string
@@ -57,6 +178,85 @@ type ActionSleep uint
 type ActionWait struct {
 	Process string
 	Pid     string
+
+	// handle name of background command, Process and Pid are ignored if not empty.
+	Handle string
+	// env name bound to exit code of background command of handle, -1 if it's killed by signal.
+	ExitCodeEnv string
+	// timeout in milliseconds of waiting background command of handle, 0 to wait forever.
+	// commands are killed if timeout reached and the action fails.
+	Timeout uint
+}
+
+// wait background commands started with handle names and report exit status of each handle,
+// action fails if any command exited with error.
+type ActionWaitAll struct {
+	Handles []string
+	// timeout in milliseconds, 0 to wait forever, commands still running are reported as failed but not killed.
+	Timeout uint
+}
+
+// lookup executable path of command in PATH and bind it to environment
+type ActionWhich struct {
+	// command name or path
+	Cmd string
+	// env name of absolute executable path
+	Env string
+	// set env to empty instead of failing if not found
+	AllowMissing bool
+}
+
+// poll command output until condition is true or timeout, command runs in container or on remote host of task
+// like cmd action, and it's killed if it doesn't exit before timeout.
+type ActionRetryUntil struct {
+	// command line string, output is trimmed
+	Cmd string
+	// working directory
+	WorkDir string
+	// condition operator, see operators of Switch, 'string.equal' if Compare is not empty,
+	// otherwise 'bool.true'.
+	Operator string
+	// compare value of condition, not used if empty
+	Compare string
+	// ms between attempts, 1000 by default
+	Interval uint
+	// ms to give up, 60000 by default
+	Timeout uint
+	// treat command failures as unmatched attempts instead of failing
+	IgnoreError bool
+	// env name to bind output of last attempt
+	Env string
+}
+
+// poll command until it exits with zero, such as readiness check 'pg_isready -h db'.
+// outputs of attempts are suppressed, only output of the final attempt is printed. command runs in container or
+// on remote host of task like cmd action, and it's killed if it doesn't exit before timeout.
+type ActionPoll struct {
+	// command line string
+	Cmd string
+	// working directory
+	WorkDir string
+	// ms between attempts, 1000 by default
+	Interval uint
+	// ms to give up, 60000 by default
+	Timeout uint
+	// env name to bind count of attempts
+	AttemptsEnv string
+}
+
+// run tool to print version, fails with 'requires X >=Y, found Z' if the version doesn't satisfy constraints.
+// versions are compared by dot separated numbers, missing parts are treated as 0.
+type ActionRequireVersion struct {
+	// command name or path
+	Cmd string
+	// arguments to print version, '--version' by default. both stdout and stderr are searched.
+	Args []string
+	// comma separated constraints, each is an operator(>=, >, <=, <, =, !=) followed by version, such as '>=1.14, <2'
+	Require string
+	// regexp to extract version from output, first submatch is used if exists, first dotted number by default
+	Pattern string
+	// env name to bind found version
+	Env string
 }
 
 type ActionWarn = string
@@ -1,5 +1,7 @@
 package syntax
 
+import "encoding/json"
+
 // reference actions
 type refActions struct {
 	// execute actions defined in template
@@ -15,5 +17,31 @@ type ActionTask struct {
 	ReturnEnvs []string
 }
 
-// run actions defined in template
-type ActionTemplate = string
+const (
+	TemplateModeFailFast = "failFast"
+	TemplateModeRunAll   = "runAll"
+)
+
+// run actions defined in template, could be template names or a struct.
+type ActionTemplate struct {
+	// template names, text block
+	Name string
+	// failFast(default): stop at first failed action.
+	// runAll: run all actions even if some of them failed, and fails after all completed.
+	Mode string
+	// override fields of template actions, the key is action index in template starts from 0,
+	// the value is merged into the action as json merge patch(RFC 7386):
+	// objects are merged recursively with case-insensitive keys, null resets the field,
+	// other values such as strings and lists replace the field.
+	Overrides map[int]json.RawMessage
+}
+
+func (t *ActionTemplate) UnmarshalJSON(bytes []byte) error {
+	var name string
+	if json.Unmarshal(bytes, &name) == nil {
+		t.Name = name
+		return nil
+	}
+	type template ActionTemplate
+	return json.Unmarshal(bytes, (*template)(t))
+}
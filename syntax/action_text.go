@@ -0,0 +1,58 @@
+package syntax
+
+// text processing actions
+type textActions struct {
+	// filter lines by pattern
+	Filter ActionFilter
+	// sort lines
+	Sort ActionSort
+}
+
+// input and output of text actions, input is read line by line.
+type TextIO struct {
+	// input file path, support glob, matched files are read in lexical order
+	File string
+	// input env name, used if File is empty
+	Env string
+	// output file path
+	ToFile string
+	// octal permission of output file such as '0600', 0644 by default
+	ToFileMode string
+	// flush output file and it's directory entry to disk before completed, for crash consistency.
+	ToFileDurable bool
+	// output env name, lines are joined by '\n'
+	ToEnv string
+	// separator of items in input and output env instead of '\n', such as ',' or ' '(syntax.DefaultArraySeparator).
+	// items are trimmed and empty items are skipped when splitting input env.
+	EnvSeparator string
+}
+
+// filter lines, lines are kept if they match all specified patterns.
+type ActionFilter struct {
+	TextIO
+	// posix regexp
+	Regexp string
+	// substring
+	Contains string
+	// keep lines don't match instead
+	Invert bool
+	// max lines kept, unlimited if zero
+	Limit int
+}
+
+const (
+	SortByLexical = "lexical"
+	SortByNumeric = "numeric"
+)
+
+// sort lines, like 'sort -u'
+type ActionSort struct {
+	TextIO
+	// lexical or numeric, lexical by default.
+	// numeric supports integer with 0x/0o/0b prefix and float, lines failed to be parsed are treated as 0.
+	By string
+	// descending order
+	Reverse bool
+	// remove duplicated lines
+	Unique bool
+}
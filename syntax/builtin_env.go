@@ -9,4 +9,10 @@ const (
 
 	// override by every AcionCommand, empty means command failed to start
 	BUILTIN_ENV_LAST_COMMAND_PID = "LAST_COMMAND_PID"
+
+	// set while each action is running and restored after it completed, for correlating outputs with definitions.
+	// task name, action index(1-based) in its action list and action type such as 'cmd'.
+	BUILTIN_ENV_TASH_TASK         = "TASH_TASK"
+	BUILTIN_ENV_TASH_ACTION_INDEX = "TASH_ACTION_INDEX"
+	BUILTIN_ENV_TASH_ACTION_TYPE  = "TASH_ACTION_TYPE"
 )
@@ -2,21 +2,134 @@ package syntax
 
 import (
 	"encoding/json"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
 )
 
 // Env:
 //   could be text block(lines of semicolon separated key-value pair: key=value or key="value")
+//   value surrounded by '`' such as key=`date +%s` is replaced by the command output when assigning,
+//   quote it to keep it literal: key="`date +%s`"
+//   list item could also be PlatformEnv, such as {name: BINEXT, platforms: {windows: .exe}}
+//   or EnvBlock using another pair separator, such as {block: "name: tash\nversion: 1.0", separator: ":"}
+//   key could declare transforms applied in order whenever the env is assigned, including assignments
+//   by actions later, such as 'VERSION|trimSpace|lower=`git describe`', transforms are functions of
+//   expand filter string.transform, their args couldn't contain '=' or '|'. '|' in key always declares
+//   transforms, it's an error if name before it isn't valid env name or any transform is empty.
+//   array values aren't transformed.
 type EnvList struct {
 	envs []string
 }
 
+// PlatformEnv has value variants keyed by 'GOOS/GOARCH', 'GOOS' or 'GOARCH' such as 'linux/arm64',
+// 'windows' and 'amd64', the most specific one matching host platform is used, falling back to Value.
+// it's resolved when loading configuration.
+type PlatformEnv struct {
+	Name      string
+	Value     string
+	Platforms map[string]string
+	// transforms applied when env is assigned, such as [trimSpace, lower]
+	Transforms []string
+}
+
+// Resolve returns env item 'name=value' for platform.
+func (p PlatformEnv) Resolve(goos, goarch string) string {
+	val := p.Value
+	for _, key := range []string{goos + "/" + goarch, goos, goarch} {
+		if v, has := p.Platforms[key]; has {
+			val = v
+			break
+		}
+	}
+	if val == "" {
+		// empty value is skipped by env parsing, quote it to define empty env
+		val = `""`
+	}
+	name := p.Name
+	for _, t := range p.Transforms {
+		name += "|" + t
+	}
+	return name + "=" + val
+}
+
+// EnvBlock is text block of key-value pairs separated by Separator instead of '=', such as 'key: value' lines.
+// lines are separated by newline or semicolon like Env, pairs are split at the first separator, so values
+// could contain the separator, quote values to keep leading or trailing spaces.
+type EnvBlock struct {
+	Block     string
+	Separator string
+}
+
+// Resolve converts block to 'key=value' lines.
+func (b EnvBlock) Resolve() (string, error) {
+	sep := b.Separator
+	if sep == "" {
+		sep = "="
+	}
+	var pairs []string
+	for _, line := range strings.Split(b.Block, "\n") {
+		for _, item := range strings.Split(line, ";") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			i := strings.Index(item, sep)
+			if i <= 0 {
+				return "", fmt.Errorf("invalid pair of env block, separator '%s' not found: %s", sep, item)
+			}
+			pairs = append(pairs, strings.TrimSpace(item[:i])+"="+strings.TrimSpace(item[i+len(sep):]))
+		}
+	}
+	return strings.Join(pairs, "\n"), nil
+}
+
+// BoolString is boolean value expanded by environments, it could be unmarshaled from string or boolean.
+type BoolString string
+
+func (b *BoolString) UnmarshalJSON(bytes []byte) error {
+	var v bool
+	if json.Unmarshal(bytes, &v) == nil {
+		*b = BoolString(strconv.FormatBool(v))
+		return nil
+	}
+	var s string
+	err := json.Unmarshal(bytes, &s)
+	if err != nil {
+		return err
+	}
+	*b = BoolString(s)
+	return nil
+}
+
 func (e *EnvList) UnmarshalJSON(bytes []byte) error {
 	var arrayTester []json.RawMessage
 	if json.Unmarshal(bytes, &arrayTester) == nil {
 		var envs []string
-		err := json.Unmarshal(bytes, &envs)
-		if err != nil {
-			return err
+		for _, item := range arrayTester {
+			var env string
+			if json.Unmarshal(item, &env) != nil {
+				var b EnvBlock
+				if json.Unmarshal(item, &b) == nil && b.Block != "" {
+					env, err := b.Resolve()
+					if err != nil {
+						return err
+					}
+					envs = append(envs, env)
+					continue
+				}
+				var p PlatformEnv
+				err := json.Unmarshal(item, &p)
+				if err != nil {
+					return err
+				}
+				if p.Name == "" {
+					return fmt.Errorf("platform env name is empty")
+				}
+				env = p.Resolve(runtime.GOOS, runtime.GOARCH)
+			}
+			envs = append(envs, env)
 		}
 		e.envs = envs
 	} else {
@@ -29,6 +142,9 @@ func (e *EnvList) UnmarshalJSON(bytes []byte) error {
 	}
 	return nil
 }
+func (e EnvList) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.envs)
+}
 func (e *EnvList) Length() int {
 	return len(e.envs)
 }
@@ -65,6 +181,9 @@ func (a *ActionList) UnmarshalJSON(bytes []byte) error {
 	}
 	return nil
 }
+func (a ActionList) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.actions)
+}
 func (a *ActionList) Length() int {
 	return len(a.actions)
 }
@@ -77,11 +196,39 @@ type Configuration struct {
 	// relative path is based on current file directory.
 	// supports import tash config file(.yaml,.yml) and environment config file(.env)
 	//
+	// entry could carry a checksum suffix such as 'common.yaml#sha256:HEX', file content is verified
+	// before parsing, supports sha1, md5 and sha256. '#' not followed by 'alg:hex' is part of path.
+	//
+	// environments such as 'conf/${HOST_OS}/*.yaml' are expanded before globbing, only system environments and
+	// builtin HOST_OS, HOST_ARCH, PATHLISTSEP are available. expanded paths outside of directory of the config file
+	// are refused.
+	//
 	// directories will be ignored
+	//
+	// files ending with '.tash.yaml' in '.tash' directory beside root config file are also imported in sorted order
+	// after imports, unless '--no-discover' is specified.
 	Imports string
 
+	// max nesting depth of template references, 32 by default, value in importing file takes priority over imported files.
+	// reference cycles and excessive nesting are reported with the chain when loading config.
+	TemplateMaxDepth int
+
+	// notify task completion events, value in importing file takes priority over imported files.
+	Notify Notification
+	// values replaced by '***' in logs and terminal display of captured command outputs, in addition to
+	// task secrets. redactions of all files are merged.
+	Redact Redaction
+
+	// default working directory of tasks defined in current file,
+	// relative path is based on current file directory.
+	WorkDir string
+
 	// defines global environment variables.
 	Env EnvList
+	// defines environment profiles, profile is selected by '--profile' option,
+	// it's environments are added after global environments.
+	// the key is profile name
+	Profiles map[string]EnvList
 	// defines templates(action list) can be referenced from tasks.
 	// the key is template name
 	Templates map[string]ActionList
@@ -91,34 +238,165 @@ type Configuration struct {
 	Tasks map[string]Task
 }
 
+// task completion event is sent when task run from command line finished or failed,
+// the event is a json object such as:
+// {"task":"build","status":"failed","start":"2020-05-01T10:00:00Z","durationMs":1520.3,"failedAction":"build > cmd: go build"}
+//
+// failing to notify only prints warning.
+type Notification struct {
+	// webhook url receives event by POST request, expanded by task environments
+	Url string
+	// request timeout in milliseconds, 10000 by default
+	Timeout uint
+	// retry failed request
+	Retry Retry
+	// json lines file appended with events, expanded by task environments, relative path is based on task directory
+	File string
+}
+
+// redaction is a safety net against leaking secrets printed by commands in logs.
+type Redaction struct {
+	// literal values, expanded by task environments when task starts, such as '$API_TOKEN'
+	Values []string
+	// posix regexps, such as 'ghp_[A-Za-z0-9]+'
+	Patterns []string
+	// redact values of envs whose names look like secrets such as API_TOKEN, DB_PASSWORD when they're assigned,
+	// values shorter than 4 characters are ignored.
+	SecretEnvs bool
+}
+
 // defines task arguments
 type TaskArgument struct {
 	// task argument name as environment variable
 	Env         string
 	Description string
-	// argument default value
+	// argument default value, it's expanded in declaration order, so could reference arguments defined before.
 	Default string
+	// posix regexp the value must match, use '^' and '$' to match whole value
+	Regexp string
+	// allowed values, ignored if empty
+	Allowed []string
 }
 
 type Task struct {
 	Description string
-	// current directory if empty
+	// skip the task with a warning, such as 'true' or '$SKIP_DEPLOY', it's expanded by task environments.
+	Disabled BoolString
+	// working directory, relative path is based on directory of the file defining this task.
+	// Configuration.WorkDir is used if empty, or current directory if both are empty.
 	WorkDir string
 
 	// task arguments(can be passed as environment or command line options)
 	Args []TaskArgument
+	// environments must be defined before running actions, all missing ones are reported together.
+	RequireEnvs []string
+	// environments written to outputs file after task completed, see --outputs option.
+	Outputs []string
+	// run command actions in container, disabled if image is empty.
+	Container TaskContainer
+	// secrets available to cmd/script actions listing them in 'secrets'.
+	Secrets []TaskSecret
+	// prevent running concurrently or running again after completed.
+	Lock TaskLock
+	// run command actions on remote host over ssh, disabled if address is empty.
+	Host TaskHost
 
+	// actions run before Actions, such as starting services.
+	Before ActionList
 	// a sequence of task actions.
 	Actions ActionList
+	// actions run after Before and Actions even if they failed, such as stopping services.
+	// task fails after After completed if Before or Actions failed.
+	After ActionList
+}
+
+// TaskContainer runs each command of cmd actions by 'RUNTIME run --rm -i IMAGE cmd args...',
+// the task WorkDir is mounted at the same path and command directory is used as container workdir,
+// environments differ from host environments(except PATH) are passed to container.
+// other actions and command substitutions still run on the host, tasks called by 'task' action
+// don't inherit this option.
+type TaskContainer struct {
+	// container image
+	Image string
+	// container runtime executable, docker or podman, default docker
+	Runtime string
+	// extra options of 'run' command, such as '--network=host'
+	Options []string
+}
+
+// TaskSecret is loaded from file or OS keyring when it's first used by commands.
+// it couldn't be expanded in strings and is not visible to other actions, it's only passed
+// to environments of commands listing it, such as 'sh -c "curl -H \$TOKEN ..."'(escaped
+// to let shell read it). values are masked in logs after loaded.
+type TaskSecret struct {
+	// env name
+	Env string
+	// file path, trailing newlines are trimmed
+	File string
+	// OS keyring item, read by 'security' on macOS, 'secret-tool' on linux
+	Keyring struct {
+		Service string
+		Account string
+	}
 }
 
+// TaskHost runs each command of cmd actions on remote host over ssh by remote user's shell,
+// arguments are expanded locally and quoted, environments differ from local environments are exported to
+// the command except PATH, local builtin environments such as WORKDIR and secrets, passing secrets to remote
+// command is refused. other actions and command substitutions still run locally, tasks called
+// by 'task' action don't inherit this option.
+type TaskHost struct {
+	// [user@]host[:port], port 22 by default
+	Address string
+	// remote user, current user by default
+	User string
+	// private key file, ~/.ssh/id_ed25519, id_ecdsa and id_rsa are tried if empty,
+	// keys of ssh-agent are also used if SSH_AUTH_SOCK is set.
+	IdentityFile string
+	// name of task secret used as password
+	PasswordSecret string
+	// known hosts file used to verify host key, ~/.ssh/known_hosts by default
+	KnownHostsFile string
+	// skip host key verification, it's insecure
+	InsecureIgnoreHostKey bool
+	// remote directory commands run in, relative WorkDir of cmd actions is based on it, home directory if empty
+	Dir string
+	// connect timeout in milliseconds, 10000 by default
+	Timeout uint
+}
+
+// TaskLock holds an exclusive file lock(flock on unix, LockFileEx on windows) while task is running,
+// the lock is released by OS if tash exited. relative paths are based on task directory.
+type TaskLock struct {
+	// lock file path, lock is not used if empty
+	File string
+	// wait for lock held by another process instead of failing
+	Wait bool
+	// max waiting time in milliseconds, 0 means forever
+	Timeout uint
+	// marker file created after task completed successfully, task is skipped if it exists.
+	// remove it to run task again.
+	Done string
+}
+
+const (
+	ContainerRuntimeDocker = "docker"
+	ContainerRuntimePodman = "podman"
+)
+
 type Action struct {
 	On string
+	// skip the action, such as 'true' or '$SKIP_LINT', it's checked before On.
+	Disabled BoolString
+	// environments only available to this action, previous values are restored after action completed,
+	// same as 'VAR=x cmd' in shell.
+	LocalEnv EnvList
 	contextActions
 	flowActions
 	fsActions
 	processActions
 	refActions
+	textActions
 }
 
 const DefaultArraySeparator = " "
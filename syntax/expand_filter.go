@@ -9,6 +9,7 @@ const (
 	Ef_string_default = "string.default"
 	// args: function [function args]
 	//	trimSpace:
+	//	collapseSpace: replace consecutive whitespaces with one space and trim
 	//	trimPrefix:
 	//	trimSuffix:
 	//	quote:
@@ -91,6 +92,11 @@ const (
 	// args: no args
 	Ef_file_content = "file.content"
 
+	// return files changed since given git ref(value), deleted files are excluded,
+	// paths are relative to current directory.
+	// args: 0: no args, 1: glob pattern to filter files, 2: glob pattern, join separator
+	Ef_git_changed = "git.changed"
+
 	// args: 0: output as timestamp, 1: output as format, input will be ignored
 	Ef_date_now = "date.now"
 	// args: format, input should be timestamp
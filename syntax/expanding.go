@@ -13,6 +13,14 @@ package syntax
 //	* ${"string literal" [| filter[ arg]...]...}
 // uses '\' to avoid escaping, such as '\$', '\$', '\\'
 //
+// array env is declared by '[]' suffix of name and assigned in shell style: 'ARR[]=(a "b c" $X)', elements are
+// quoted or separated by spaces, and expanded separately. values without the suffix such as 'P=(foo|bar)' are
+// plain strings. the plain value '$ARR' is elements joined by space, and:
+//	* ${ARR[0]}: element at index, index can be negative, out of range is an error
+//	* ${ARR[@]}: all elements joined by space, or ${ARR[@SEP]} joined by literal SEP, such as ${ARR[@,]}
+//	* ${#ARR[@]}: elements count
+// non-array env is treated as array of one element, or empty array if it's not defined.
+//
 // predefined task-specific env:
 //    WORKDIR: task initial working directory
 //    HOST_OS: host os(GOOS)
@@ -38,6 +38,28 @@ const (
 	Op_file_socket               = "file.socket"
 	Op_file_setuid               = "file.setuid"
 	Op_file_binary               = "file.binary"
+	// value file has same content as compare file
+	Op_file_sameContent = "file.sameContent"
+	// value path is compare path or inside it, symlinks are resolved
+	Op_path_within = "path.within"
+	// value fd(0/1/2 or stdin/stdout/stderr) is a terminal
+	Op_fd_terminal = "fd.terminal"
+	// value fd(0/1/2 or stdin/stdout/stderr) is a pipe, such as 'tash | less'
+	Op_fd_pipe = "fd.pipe"
+	// value number is within compare range 'min,max', boundaries are included
+	Op_number_between = "number.between"
+	// value number is within compare range 'min,max', boundaries are excluded
+	Op_number_betweenExclusive = "number.betweenExclusive"
+	// count of paths matched by value patterns(semicolon or newline separated) satisfies compare,
+	// compare is number operator and number such as '-gt 0', '> 0' or 'number.between 1,3', or a number to check equality.
+	// comparison symbols such as '>' and '==' are compared as numbers.
+	Op_glob_count = "glob.count"
+	// process of value pid is running, such as '$LAST_COMMAND_PID' of background command
+	Op_process_running = "process.running"
+	// value directory has no entries, it's an error if value is missing or isn't a directory
+	Op_dir_empty = "dir.empty"
+	// value directory has entries, it's an error if value is missing or isn't a directory
+	Op_dir_notEmpty = "dir.notEmpty"
 )
 
 var OperatorAlias = map[string]string{
@@ -79,6 +101,7 @@ var OperatorAlias = map[string]string{
 	"-S":   Op_file_socket,
 	"-u":   Op_file_setuid,
 	"-B":   Op_file_binary,
+	"-t":   Op_fd_terminal,
 }
 
 func IsValidOP(op string) bool {
@@ -102,6 +125,9 @@ func IsValidOP(op string) bool {
 		Op_number_notEqual,
 		Op_number_lessThanOrEqual,
 		Op_number_lessThan,
+		Op_number_between,
+		Op_number_betweenExclusive,
+		Op_glob_count,
 		Op_env_defined,
 		Op_file_newerThan,
 		Op_file_olderThan,
@@ -117,7 +143,14 @@ func IsValidOP(op string) bool {
 		Op_file_notEmpty,
 		Op_file_socket,
 		Op_file_setuid,
-		Op_file_binary:
+		Op_file_binary,
+		Op_file_sameContent,
+		Op_path_within,
+		Op_fd_terminal,
+		Op_fd_pipe,
+		Op_process_running,
+		Op_dir_empty,
+		Op_dir_notEmpty:
 		return true
 	default:
 		_, has := OperatorAlias[op]
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/uiez/tash/syntax"
+)
+
+const maxTextLineSize = 16 << 20
+
+// readTextLines streams input lines to fn until it returns false.
+func (r *runner) readTextLines(tio syntax.TextIO, envs *ExpandEnvs, fn func(line string) bool) bool {
+	var input io.Reader
+	if tio.File != "" {
+		matched, ok := r.expandPathBlockAndGlob(tio.File, envs, true)
+		if !ok {
+			return false
+		}
+		var readers []io.Reader
+		for _, m := range matched {
+			fd, err := os.Open(stringFromSlash(m))
+			if err != nil {
+				r.fatalln("open input file failed:", err)
+				return false
+			}
+			defer fd.Close()
+			readers = append(readers, fd)
+		}
+		input = io.MultiReader(readers...)
+	} else {
+		val, has := envs.get(tio.Env)
+		if !has {
+			r.fatalln("input env not defined:", tio.Env)
+			return false
+		}
+		if tio.EnvSeparator != "" {
+			for _, item := range stringSplitAndTrimFilterSpace(val, tio.EnvSeparator) {
+				if !fn(item) {
+					break
+				}
+			}
+			return true
+		}
+		input = strings.NewReader(val)
+	}
+
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(nil, maxTextLineSize)
+	for scanner.Scan() {
+		if !fn(strings.TrimSuffix(scanner.Text(), "\r")) {
+			return true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		r.fatalln("read input failed:", err)
+		return false
+	}
+	return true
+}
+
+func (r *runner) writeTextLines(tio syntax.TextIO, envs *ExpandEnvs, lines []string) {
+	if tio.ToEnv != "" {
+		sep := "\n"
+		if tio.EnvSeparator != "" {
+			sep = tio.EnvSeparator
+		}
+		envs.addAndExpand(r.log(), tio.ToEnv, strings.Join(lines, sep), false)
+	}
+	if tio.ToFile != "" {
+		mode, _ := parseFileMode(tio.ToFileMode)
+		fd, err := openFile(stringFromSlash(tio.ToFile), false, mode)
+		if err != nil {
+			r.fatalln("open output file failed:", err)
+			return
+		}
+		w := bufio.NewWriter(fd)
+		for _, l := range lines {
+			w.WriteString(l)
+			w.WriteByte('\n')
+		}
+		err = w.Flush()
+		if err != nil {
+			fd.Close()
+			r.fatalln("write output file failed:", err)
+			return
+		}
+		err = closeFile(fd, tio.ToFileDurable)
+		if err != nil {
+			r.fatalln("close output file failed:", err)
+		}
+	}
+}
+
+func textInputName(tio syntax.TextIO) string {
+	if tio.File != "" {
+		return stringToSlash(tio.File)
+	}
+	return "$" + tio.Env
+}
+
+func (r *runner) prepareTextIO(tio *syntax.TextIO, envs *ExpandEnvs) bool {
+	err := envs.expandStringPtrs(&tio.ToFile, &tio.ToFileMode, &tio.EnvSeparator)
+	if err != nil {
+		r.fatalln(err)
+		return false
+	}
+	_, err = parseFileMode(tio.ToFileMode)
+	if err != nil {
+		r.fatalln(err)
+		return false
+	}
+	if tio.ToFile == "" && tio.ToEnv == "" {
+		r.fatalln("output file or env should be specified")
+		return false
+	}
+	tio.ToFile = r.resolvePath(tio.ToFile)
+	return true
+}
+
+func (r *runner) runActionSort(action syntax.ActionSort, envs *ExpandEnvs) {
+	if !r.prepareTextIO(&action.TextIO, envs) {
+		return
+	}
+	var less func(a, b string) bool
+	switch action.By {
+	case "", syntax.SortByLexical:
+		less = func(a, b string) bool {
+			return a < b
+		}
+	case syntax.SortByNumeric:
+		less = func(a, b string) bool {
+			return parseNumber(a) < parseNumber(b)
+		}
+	default:
+		r.fatalln("invalid sort method:", action.By)
+		return
+	}
+	r.infoln("Sort:", textInputName(action.TextIO))
+
+	var lines []string
+	ok := r.readTextLines(action.TextIO, envs, func(line string) bool {
+		lines = append(lines, line)
+		return true
+	})
+	if !ok {
+		return
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		if action.Reverse {
+			return less(lines[j], lines[i])
+		}
+		return less(lines[i], lines[j])
+	})
+	if action.Unique {
+		// equal lines may not be adjacent in numeric order
+		seen := make(map[string]bool)
+		var end int
+		for _, l := range lines {
+			if seen[l] {
+				continue
+			}
+			seen[l] = true
+			lines[end] = l
+			end++
+		}
+		lines = lines[:end]
+	}
+	r.writeTextLines(action.TextIO, envs, lines)
+}
+
+// parseNumber parses integer with base prefixes or float, 0 is returned if failed.
+func parseNumber(s string) float64 {
+	s = strings.TrimSpace(s)
+	if i, err := parseInt(s); err == nil {
+		return float64(i)
+	}
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
+
+func (r *runner) runActionFilter(action syntax.ActionFilter, envs *ExpandEnvs) {
+	err := envs.expandStringPtrs(&action.Regexp, &action.Contains)
+	if err != nil {
+		r.fatalln(err)
+		return
+	}
+	if !r.prepareTextIO(&action.TextIO, envs) {
+		return
+	}
+	var reg *regexp.Regexp
+	if action.Regexp != "" {
+		reg, err = regexp.CompilePOSIX(action.Regexp)
+		if err != nil {
+			r.fatalln("compile regexp failed:", action.Regexp, err)
+			return
+		}
+	}
+	r.infoln("Filter:", textInputName(action.TextIO))
+
+	var lines []string
+	ok := r.readTextLines(action.TextIO, envs, func(line string) bool {
+		match := (reg == nil || reg.MatchString(line)) &&
+			(action.Contains == "" || strings.Contains(line, action.Contains))
+		if match != action.Invert {
+			lines = append(lines, line)
+		}
+		return action.Limit <= 0 || len(lines) < action.Limit
+	})
+	if !ok {
+		return
+	}
+	r.writeTextLines(action.TextIO, envs, lines)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFilterAction(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"logs/a.log": "INFO start\nERROR disk full\nINFO retry\n",
+		"logs/b.log": "ERROR timeout\nWARN slow\nERROR refused\n",
+		"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - filter: {file: "logs/*.log", regexp: "^ERROR", toFile: errors.txt}
+      - filter: {file: "logs/*.log", regexp: "^ERROR", invert: true, toFile: others.txt}
+      - filter: {file: "logs/*.log", contains: ERROR, limit: 2, toEnv: FIRST}
+      - echo: {content: "${FIRST}", file: limit.txt}
+      - filter: {env: FIRST, contains: disk, toFile: first.txt}
+      - env: ["ITEMS=a1,b2, a3 ,"]
+      - filter: {env: ITEMS, envSeparator: ",", regexp: "^a", toEnv: A_ITEMS}
+      - echo: {content: "${A_ITEMS}", file: items.txt}
+`,
+	})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	for file, want := range map[string]string{
+		"errors.txt": "ERROR disk full\nERROR timeout\nERROR refused\n",
+		"others.txt": "INFO start\nINFO retry\nWARN slow\n",
+		"limit.txt":  "ERROR disk full\nERROR timeout",
+		"first.txt":  "ERROR disk full\n",
+		"items.txt":  "a1,a3",
+	} {
+		if got := readTestFile(t, dir, file); got != want {
+			t.Errorf("%s: got %q, want %q", file, got, want)
+		}
+	}
+}
+
+func TestSortAction(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"words.txt":   "pear\napple\nfig\napple\n",
+		"numbers.txt": "10\n9\n0x10\n1.5\n-2\n",
+		"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - sort: {file: words.txt, toFile: lexical.txt}
+      - sort: {file: words.txt, reverse: true, toFile: reverse.txt}
+      - sort: {file: words.txt, unique: true, toFile: unique.txt}
+      - sort: {file: numbers.txt, by: numeric, toFile: numeric.txt}
+      - sort: {file: numbers.txt, by: numeric, reverse: true, toFile: numericReverse.txt}
+      - env: ["DEPS=b a c a"]
+      - sort: {env: DEPS, envSeparator: " ", unique: true, toEnv: SORTED}
+      - echo: {content: "${SORTED}", file: env.txt}
+`,
+	})
+	if failure := runTestTask(t, dir, "main"); failure != "" {
+		t.Fatal(failure)
+	}
+	for file, want := range map[string]string{
+		"lexical.txt":        "apple\napple\nfig\npear\n",
+		"reverse.txt":        "pear\nfig\napple\napple\n",
+		"unique.txt":         "apple\nfig\npear\n",
+		"numeric.txt":        "-2\n1.5\n9\n10\n0x10\n",
+		"numericReverse.txt": "0x10\n10\n9\n1.5\n-2\n",
+		"env.txt":            "a b c",
+	} {
+		if got := readTestFile(t, dir, file); got != want {
+			t.Errorf("%s: got %q, want %q", file, got, want)
+		}
+	}
+}
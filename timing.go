@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uiez/tash/syntax"
+)
+
+const (
+	timingKindTask   = "task"
+	timingKindAction = "action"
+
+	// maxTimingSummary limits records printed in summary
+	maxTimingSummary = 20
+)
+
+type timingRecord struct {
+	Kind       string    `json:"kind"`
+	Name       string    `json:"name"`
+	Start      time.Time `json:"start"`
+	DurationMs float64   `json:"durationMs"`
+
+	duration time.Duration
+}
+
+// taskTimings records durations of tasks and actions, it's shared by parallel runners.
+type taskTimings struct {
+	// print slowest records after tasks completed
+	Summary bool
+	// write all records as json
+	File string
+
+	mu       sync.Mutex
+	records  []timingRecord
+	reported bool
+}
+
+func (t *taskTimings) enabled() bool {
+	return t != nil && (t.Summary || t.File != "")
+}
+
+func (t *taskTimings) record(kind, name string, start time.Time) {
+	d := time.Since(start)
+	t.mu.Lock()
+	t.records = append(t.records, timingRecord{
+		Kind:       kind,
+		Name:       name,
+		Start:      start,
+		DurationMs: float64(d) / float64(time.Millisecond),
+		duration:   d,
+	})
+	t.mu.Unlock()
+}
+
+// report prints summary and writes records file, only the first call takes effect,
+// so it could be called before exiting on failure.
+func (t *taskTimings) report(log indentLogger) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.reported {
+		return
+	}
+	t.reported = true
+
+	records := append([]timingRecord(nil), t.records...)
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].duration > records[j].duration
+	})
+	if t.Summary {
+		log.infoln()
+		log.infoln("Timing:")
+		llog := log.addIndent()
+		for i, r := range records {
+			if i == maxTimingSummary {
+				llog.infoln(fmt.Sprintf("... and %d more", len(records)-i))
+				break
+			}
+			llog.infoln(fmt.Sprintf("%10s  %-6s  %s", r.duration.Round(time.Millisecond), r.Kind, r.Name))
+		}
+	}
+	if t.File != "" {
+		content, err := json.MarshalIndent(records, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(t.File, content, 0644)
+		}
+		if err != nil {
+			log.warnln("write timing file failed:", err)
+		}
+	}
+}
+
+// actionName describes action by task, templates and action kind, such as 'build > tmpl > cmd: go build'.
+func (r *runner) actionName(a syntax.Action) string {
+	var names []string
+	for rt := r; rt != nil; rt = rt.parent {
+		switch {
+		case rt.template != "":
+			names = append([]string{rt.template}, names...)
+		case rt.task != "":
+			names = append([]string{rt.task}, names...)
+		}
+	}
+	kind := actionKind(a)
+	if a.Cmd.Exec != "" {
+		exec := strings.TrimSpace(a.Cmd.Exec)
+		if i := strings.IndexByte(exec, '\n'); i >= 0 {
+			exec = exec[:i] + " ..."
+		}
+		kind += ": " + exec
+	}
+	return strings.Join(append(names, kind), " > ")
+}
+
+// actionKind returns field name of the action defined.
+func actionKind(a syntax.Action) string {
+	val := reflect.ValueOf(a)
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		group := typ.Field(i)
+		if !group.Anonymous {
+			continue
+		}
+		groupVal := val.Field(i)
+		for j := 0; j < group.Type.NumField(); j++ {
+			if !groupVal.Field(j).IsZero() {
+				return lowerFirst(group.Type.Field(j).Name)
+			}
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTaskTimings(t *testing.T) {
+	dir := testDir(t, map[string]string{"tash.yaml": `
+tasks:
+  main:
+    actions:
+      - sleep: 10
+      - sleep: 150
+      - env: ["DONE=1"]
+`})
+	file := filepath.Join(dir, "timing.json")
+	timings := &taskTimings{Summary: true, File: file}
+	r := newRunner(nil, newLogger(false), testConfiguration(t, dir))
+	r.noExitOnFail = true
+	r.backgrounds = newBackgroundRegistry()
+	r.timings = timings
+	output := captureStdout(t, func() {
+		r.runTaskByName("main", nil, dir)
+		timings.report(r.log())
+	})
+	if r.failed {
+		t.Fatal(r.failure)
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []timingRecord
+	if err = json.Unmarshal(content, &records); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, r := range records {
+		names = append(names, r.Kind+" "+r.Name)
+	}
+	if want := "task main,action main > sleep,action main > sleep,action main > env"; strings.Join(names, ",") != want {
+		t.Errorf("records: %q", names)
+	}
+	if records[0].DurationMs < 160 || records[1].DurationMs < 150 || records[2].DurationMs < 10 {
+		t.Errorf("durations: %.1f %.1f %.1f", records[0].DurationMs, records[1].DurationMs, records[2].DurationMs)
+	}
+
+	summary := output[strings.Index(output, "Timing:"):]
+	lines := strings.Split(strings.TrimSpace(summary), "\n")
+	if len(lines) != 5 || !strings.Contains(lines[1], "task    main") || !strings.Contains(lines[2], "main > sleep") {
+		t.Errorf("slowest records should be listed first:\n%s", summary)
+	}
+}
@@ -1,26 +1,43 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"crypto/md5"
+	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cosiner/argv"
+	"github.com/ghodss/yaml"
+	"github.com/mattn/go-isatty"
 	"github.com/mattn/go-zglob"
 	"github.com/uiez/tash/syntax"
 )
@@ -71,6 +88,33 @@ func stringSplitAndTrimToPair(s, sep string) (s1, s2 string) {
 	return stringAtAndTrim(secs, 0), stringAtAndTrim(secs, 1)
 }
 
+// dirEmpty reports whether directory has no entries, it reads one entry at most.
+func dirEmpty(path string) (bool, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, fmt.Errorf("directory not found: %s", path)
+		}
+		return false, fmt.Errorf("open directory failed: %w", err)
+	}
+	defer fd.Close()
+	stat, err := fd.Stat()
+	if err != nil {
+		return false, fmt.Errorf("read directory status failed: %w", err)
+	}
+	if !stat.IsDir() {
+		return false, fmt.Errorf("path is not a directory: %s", path)
+	}
+	_, err = fd.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("read directory failed: %w", err)
+	}
+	return false, nil
+}
+
 func copyFile(dst, src string) error {
 	srcFd, err := os.OpenFile(src, os.O_RDONLY, 0)
 	if err != nil {
@@ -97,7 +141,47 @@ func copyFile(dst, src string) error {
 	return nil
 }
 
-func copyPath(dst, src string) error {
+// maxCopyFailures limits failures reported by copyPathError
+const maxCopyFailures = 10
+
+type copyFailure struct {
+	path string
+	err  error
+}
+
+// copyPathError reports partially copied directory tree.
+type copyPathError struct {
+	copied   int
+	failed   int
+	failures []copyFailure
+	aborted  bool
+}
+
+func (e *copyPathError) add(path string, err error) {
+	e.failed++
+	if len(e.failures) < maxCopyFailures {
+		e.failures = append(e.failures, copyFailure{path: stringToSlash(path), err: err})
+	}
+}
+
+func (e *copyPathError) Error() string {
+	if e.aborted {
+		f := e.failures[0]
+		return fmt.Sprintf("copy aborted after %d files copied, failed at %s: %s", e.copied, f.path, f.err)
+	}
+	lines := []string{fmt.Sprintf("%d files failed, %d files copied:", e.failed, e.copied)}
+	for _, f := range e.failures {
+		lines = append(lines, fmt.Sprintf("%s: %s", f.path, f.err))
+	}
+	if more := e.failed - len(e.failures); more > 0 {
+		lines = append(lines, fmt.Sprintf("... and %d more", more))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// copyPath copies file or directory tree, failures of directory entries abort copying unless continueOnError,
+// they are reported by *copyPathError.
+func copyPath(dst, src string, continueOnError bool) error {
 	stat, err := os.Stat(src)
 	if err != nil {
 		return fmt.Errorf("read source path status failed: %w", err)
@@ -117,10 +201,25 @@ func copyPath(dst, src string) error {
 		}
 		return copyFile(dst, src)
 	}
-	dirChmods := map[string]os.FileMode{}
+	var (
+		dirChmods = map[string]os.FileMode{}
+		result    copyPathError
+	)
+	// fail records failure, returns error to abort walking or SkipDir to skip failed directory.
+	fail := func(path string, info os.FileInfo, err error) error {
+		result.add(path, err)
+		if !continueOnError {
+			result.aborted = true
+			return &result
+		}
+		if info != nil && info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
 	err = filepath.Walk(src, func(srcPath string, info os.FileInfo, err error) error {
 		if err != nil {
-			return err
+			return fail(srcPath, info, err)
 		}
 		relPath, err := filepath.Rel(src, srcPath)
 		if err != nil {
@@ -130,16 +229,24 @@ func copyPath(dst, src string) error {
 		if info.IsDir() {
 			err = os.Mkdir(dstPath, 0755)
 			if err != nil {
-				return err
+				return fail(srcPath, info, err)
 			}
 			if info.Mode() != 0755 {
 				dirChmods[dstPath] = info.Mode()
 			}
 			return nil
 		}
-		return copyFile(dstPath, srcPath)
+		err = copyFile(dstPath, srcPath)
+		if err != nil {
+			return fail(srcPath, info, err)
+		}
+		result.copied++
+		return nil
 	})
 	if err != nil {
+		if errors.Is(err, &result) {
+			return err
+		}
 		return fmt.Errorf("copy path tree failed: %w", err)
 	}
 	for dir, mode := range dirChmods {
@@ -148,53 +255,455 @@ func copyPath(dst, src string) error {
 			return fmt.Errorf("fix dir mod failed: %w", err)
 		}
 	}
+	if result.failed > 0 {
+		return &result
+	}
 	return nil
 }
 
-func checkHash(log logger, path string, alg, sig string, r io.Reader) bool {
-	var hashCreator func() hash.Hash
+// linkTree creates directories of src tree in dst and symlinks files to src, links already pointing to
+// the same source are kept, other existing files are replaced only if overwrite. it returns count of links created.
+func linkTree(dst, src string, overwrite, relative bool) (int, error) {
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return 0, err
+	}
+	dst, err = filepath.Abs(dst)
+	if err != nil {
+		return 0, err
+	}
+	stat, err := os.Stat(src)
+	if err != nil {
+		return 0, fmt.Errorf("read source path status failed: %w", err)
+	}
+	if !stat.IsDir() {
+		return 0, fmt.Errorf("source is not a directory: %s", src)
+	}
+	var linked int
+	err = filepath.Walk(src, func(srcPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, srcPath)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dst, relPath)
+		if info.IsDir() {
+			if srcPath == dst {
+				return filepath.SkipDir
+			}
+			err = os.MkdirAll(dstPath, 0755)
+			if err != nil {
+				return fmt.Errorf("create directory failed: %s, %w", dstPath, err)
+			}
+			return nil
+		}
+		target := srcPath
+		if relative {
+			target, err = filepath.Rel(filepath.Dir(dstPath), srcPath)
+			if err != nil {
+				return err
+			}
+		}
+		existed, err := os.Lstat(dstPath)
+		if err == nil {
+			if existed.Mode()&os.ModeSymlink != 0 {
+				if old, err := os.Readlink(dstPath); err == nil && old == target {
+					return nil
+				}
+			}
+			if !overwrite || existed.IsDir() {
+				return fmt.Errorf("dest path already exists: %s", dstPath)
+			}
+			err = os.Remove(dstPath)
+			if err != nil {
+				return fmt.Errorf("remove existing path failed: %w", err)
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		err = os.Symlink(target, dstPath)
+		if err != nil {
+			return fmt.Errorf("create symlink failed: %w", err)
+		}
+		linked++
+		return nil
+	})
+	return linked, err
+}
+
+// checkRemovable refuses removing filesystem root, home directory, current directory, their ancestors
+// and paths outside of root directory unless allowOutside, symlinks in parent directories are resolved before checking.
+func checkRemovable(path, root string, allowOutside bool) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	if filepath.Dir(abs) == abs {
+		return fmt.Errorf("refuse to remove filesystem root: %s", path)
+	}
+	// symlinks in parent directories are resolved, the last element is kept as only the link itself is removed.
+	if parent, err := filepath.EvalSymlinks(filepath.Dir(abs)); err == nil {
+		abs = filepath.Join(parent, filepath.Base(abs))
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	root = evalSymlinksIfExist(root)
+	protected := map[string]string{root: "task directory"}
+	if wd, err := os.Getwd(); err == nil {
+		protected[evalSymlinksIfExist(wd)] = "current directory"
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		protected[evalSymlinksIfExist(filepath.Clean(home))] = "home directory"
+	}
+	for p, name := range protected {
+		if isSubPath(abs, p) {
+			return fmt.Errorf("refuse to remove %s or its ancestors: %s", name, path)
+		}
+	}
+	if !allowOutside && !isSubPath(root, abs) {
+		return fmt.Errorf("refuse to remove path outside of task directory: %s", path)
+	}
+	return nil
+}
+
+// evalSymlinksIfExist resolves symlinks in path, path is returned unchanged if failed.
+func evalSymlinksIfExist(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return path
+}
+
+// isSubPath reports whether path is dir or inside it, both should be absolute.
+func isSubPath(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+func hashCreator(alg string) func() hash.Hash {
 	switch alg {
 	case syntax.ResourceHashAlgSha1:
-		hashCreator = sha1.New
+		return sha1.New
 	case syntax.ResourceHashAlgMD5:
-		hashCreator = md5.New
+		return md5.New
 	case syntax.ResourceHashAlgSha256:
-		hashCreator = sha256.New
+		return sha256.New
 	}
-	if hashCreator == nil || sig == "" {
+	return nil
+}
+
+func checkHash(log logger, path string, alg, sig string, r io.Reader) bool {
+	creator := hashCreator(alg)
+	if creator == nil || sig == "" {
 		log.fatalln("invalid hash alg or sig:", path)
 		return false
 	}
-	h := hashCreator()
+	h := creator()
 	_, err := io.Copy(h, r)
 	if err != nil {
 		log.fatalln("check hash failed:", path, err)
 		return false
 	}
-	return hex.EncodeToString(h.Sum(nil)) == strings.ToLower(sig)
+	return digestMatches(h.Sum(nil), sig)
+}
+
+// parseChecksum parses checksum in format 'alg:hex', alg is case-insensitive.
+func parseChecksum(checksum string) (creator func() hash.Hash, sig string, err error) {
+	i := strings.Index(checksum, ":")
+	if i < 0 {
+		return nil, "", fmt.Errorf("invalid checksum format, should be 'alg:hex': %s", checksum)
+	}
+	alg, sig := strings.ToUpper(checksum[:i]), checksum[i+1:]
+	creator = hashCreator(alg)
+	if creator == nil {
+		return nil, "", fmt.Errorf("invalid hash alg: %s", alg)
+	}
+	return creator, sig, nil
+}
+
+// verifyChecksum checks content against checksum in format 'alg:hex', alg is case-insensitive.
+func verifyChecksum(content []byte, checksum string) error {
+	creator, sig, err := parseChecksum(checksum)
+	if err != nil {
+		return err
+	}
+	h := creator()
+	h.Write(content)
+	if !digestMatches(h.Sum(nil), sig) {
+		return fmt.Errorf("checksum mismatched, expect %s, got %s", strings.ToLower(sig), hex.EncodeToString(h.Sum(nil)))
+	}
+	return nil
+}
+
+// verifyFile checks file is an existing regular file, not empty unless allowEmpty, and matches size and checksum
+// if size isn't negative and creator isn't nil. failed checks are returned, error is returned if file couldn't be read.
+func verifyFile(path string, size int64, creator func() hash.Hash, checksum string, allowEmpty bool) ([]string, error) {
+	stat, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return []string{"file doesn't exist"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !stat.Mode().IsRegular() {
+		return []string{"not a regular file"}, nil
+	}
+	var failures []string
+	if stat.Size() == 0 && !allowEmpty {
+		failures = append(failures, "file is empty")
+	}
+	if size >= 0 && stat.Size() != size {
+		failures = append(failures, fmt.Sprintf("size mismatched, expect %d, got %d", size, stat.Size()))
+	}
+	if creator != nil {
+		fd, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer fd.Close()
+		h := creator()
+		_, err = io.Copy(h, fd)
+		if err != nil {
+			return nil, err
+		}
+		if !digestMatches(h.Sum(nil), checksum) {
+			failures = append(failures, fmt.Sprintf("checksum mismatched, expect %s, got %s", strings.ToLower(checksum), hex.EncodeToString(h.Sum(nil))))
+		}
+	}
+	return failures, nil
+}
+
+func digestMatches(digest []byte, sig string) bool {
+	return hex.EncodeToString(digest) == strings.ToLower(sig)
+}
+
+type downloadOptions struct {
+	// keep content encoded by Content-Encoding instead of decoding it
+	RawEncoding bool
+	// hash is computed while downloading if alg or sig is not empty and the digest is returned,
+	// the downloaded file is removed if sig is not empty and mismatched.
+	HashAlg string
+	HashSig string
+	// proxy url, environments are used if empty, see ActionCopy.Proxy
+	Proxy   string
+	NoProxy string
+	// tls options, see ActionCopy.Tls
+	CaFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+func (o downloadOptions) hasTlsOptions() bool {
+	return o.CaFile != "" || o.CertFile != "" || o.KeyFile != "" || o.InsecureSkipVerify
+}
+
+func tlsConfig(opts downloadOptions) (*tls.Config, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+	if opts.CaFile != "" {
+		content, err := ioutil.ReadFile(stringFromSlash(opts.CaFile))
+		if err != nil {
+			return nil, fmt.Errorf("read ca file failed: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificates found in ca file: %s", opts.CaFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		if opts.CertFile == "" || opts.KeyFile == "" {
+			return nil, fmt.Errorf("client certificate and key file should be specified together")
+		}
+		cert, err := tls.LoadX509KeyPair(stringFromSlash(opts.CertFile), stringFromSlash(opts.KeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate failed: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func httpClient(opts downloadOptions) (*http.Client, error) {
+	if opts.Proxy == "" && !opts.hasTlsOptions() {
+		return http.DefaultClient, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.hasTlsOptions() {
+		cfg, err := tlsConfig(opts)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = cfg
+	}
+	switch opts.Proxy {
+	case "":
+	case syntax.ProxyDirect:
+		transport.Proxy = nil
+	default:
+		proxyUrl, err := url.Parse(opts.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %w", err)
+		}
+		switch proxyUrl.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy schema: %s", proxyUrl.Scheme)
+		}
+		noProxy := stringSplitAndTrimFilterSpace(opts.NoProxy, ",")
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if bypassProxy(req.URL, noProxy) {
+				return nil, nil
+			}
+			return proxyUrl, nil
+		}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// bypassProxy checks whether host of u matches any entry of noProxy list.
+func bypassProxy(u *url.URL, noProxy []string) bool {
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	ip := net.ParseIP(host)
+	for _, entry := range noProxy {
+		entry = strings.ToLower(entry)
+		if entry == "*" {
+			return true
+		}
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && ipNet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		entryHost, entryPort := entry, ""
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			entryHost, entryPort = h, p
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		entryHost = strings.TrimPrefix(entryHost, "*")
+		entryHost = strings.TrimPrefix(entryHost, ".")
+		if host == entryHost || strings.HasSuffix(host, "."+entryHost) {
+			return true
+		}
+	}
+	return false
 }
 
-func downloadFile(url string) (string, error) {
-	resp, err := http.Get(url)
+// downloadFile downloads url to temp file, hex digest of content is returned if hash alg is specified.
+func downloadFile(url string, opts downloadOptions) (path, digest string, err error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", "", fmt.Errorf("create download request failed: %w", err)
+	}
+	if opts.RawEncoding {
+		// disable transparent gzip decoding of transport
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+	client, err := httpClient(opts)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("create download request failed: %w", err)
+		return "", "", fmt.Errorf("send download request failed: %w", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 300 {
-		return "", fmt.Errorf("failed to fetch resource: %s", resp.Status)
+		return "", "", fmt.Errorf("failed to fetch resource: %s", resp.Status)
+	}
+	body := io.Reader(resp.Body)
+	if !opts.RawEncoding {
+		// transport only decodes gzip content it requested, content encoded by
+		// servers or proxies without being asked still needs to be decoded.
+		decoder, err := decodeContent(resp.Body, resp.Header.Get("Content-Encoding"))
+		if err != nil {
+			return "", "", err
+		}
+		defer decoder.Close()
+		body = decoder
+	}
+
+	var h hash.Hash
+	if opts.HashAlg != "" || opts.HashSig != "" {
+		creator := hashCreator(opts.HashAlg)
+		if creator == nil {
+			return "", "", fmt.Errorf("invalid hash alg: %s", opts.HashAlg)
+		}
+		h = creator()
+		body = io.TeeReader(body, h)
 	}
 
 	fd, err := ioutil.TempFile("", "tash*")
 	if err != nil {
-		return "", fmt.Errorf("create tmp file failed: %w", err)
+		return "", "", fmt.Errorf("create tmp file failed: %w", err)
 	}
-	defer fd.Close()
-	_, err = io.Copy(fd, resp.Body)
+	_, err = io.Copy(fd, body)
+	fd.Close()
 	if err != nil {
 		os.Remove(fd.Name())
-		return "", fmt.Errorf("download file failed: %w", err)
+		return "", "", fmt.Errorf("download file failed: %w", err)
+	}
+	if h != nil {
+		sum := h.Sum(nil)
+		if opts.HashSig != "" && !digestMatches(sum, opts.HashSig) {
+			os.Remove(fd.Name())
+			return "", "", fmt.Errorf("checksum mismatched")
+		}
+		digest = hex.EncodeToString(sum)
+	}
+	return fd.Name(), digest, nil
+}
+
+// decodeContent decodes content by http Content-Encoding, the returned reader should be closed after read,
+// it doesn't close r.
+func decodeContent(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return ioutil.NopCloser(r), nil
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("create gzip reader failed: %w", err)
+		}
+		return gr, nil
+	case "deflate":
+		// deflate of http is zlib format(RFC 1950), some servers send raw deflate stream without zlib header.
+		br := bufio.NewReader(r)
+		if header, err := br.Peek(2); err == nil && isZlibHeader(header) {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return nil, fmt.Errorf("create zlib reader failed: %w", err)
+			}
+			return zr, nil
+		}
+		return flate.NewReader(br), nil
+	case "br":
+		return nil, fmt.Errorf("brotli content encoding isn't supported, keep it raw instead")
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s, keep it raw instead", encoding)
 	}
-	return fd.Name(), nil
+}
+
+// isZlibHeader checks compression method and check bits of zlib header.
+func isZlibHeader(header []byte) bool {
+	return header[0]&0x0f == 8 && header[0]>>4 <= 7 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0
 }
 
 type commandFds struct {
@@ -203,11 +712,76 @@ type commandFds struct {
 	Stderr io.Writer
 }
 
-func execCommand(envs *ExpandEnvs, sections [][]string, cmdDir string, needsOutput bool, fds commandFds, background bool) (pid int, output string, err error) {
+type commandOptions struct {
+	// working directory, current directory if empty
+	Dir string
+	// capture trimmed stdout as output, stdio in Fds are ignored
+	NeedsOutput bool
+	Fds         commandFds
+	// start command without waiting it exit
+	Background bool
+	// ask command to flush output by lines
+	LineBuffered bool
+	// watch background commands if not nil
+	Handle *backgroundHandle
+	// expand '@file' arguments to whitespace separated arguments in file
+	ResponseFiles bool
+	// split output of command substitution into words instead of keeping it in one argument
+	SplitSubstitution bool
+	// run commands in container if not nil
+	Container *containerOptions
+	// run commands on remote host if not nil
+	Remote *remoteHost
+	// kill command if it doesn't exit in time, 0 for no limit. it's not supported for background command.
+	Timeout time.Duration
+}
+
+func execCommand(envs *ExpandEnvs, sections [][]string, opts commandOptions) (pid int, output string, err error) {
+	var (
+		cmdDir      = opts.Dir
+		needsOutput = opts.NeedsOutput
+		fds         = opts.Fds
+	)
 	if len(sections) == 0 {
 		return 0, "", fmt.Errorf("empty command line string")
 	}
-	cmds, err := argv.Cmds(sections...)
+	if opts.Background && opts.Timeout > 0 {
+		return 0, "", fmt.Errorf("timeout is not supported for background command")
+	}
+	if opts.LineBuffered {
+		envs = envs.copy()
+		envs.set("PYTHONUNBUFFERED", "1")
+		if opts.Remote == nil && opts.Container == nil {
+			sections = lineBufferedSections(sections)
+		}
+	}
+	if opts.Remote != nil {
+		if opts.Background {
+			return 0, "", fmt.Errorf("background command is not supported on remote host")
+		}
+		if err = checkRemoteEnvs(envs); err != nil {
+			return 0, "", err
+		}
+		if needsOutput {
+			output, err = opts.Remote.output(envs, sections, cmdDir, opts.Timeout)
+		} else {
+			err = opts.Remote.run(envs, sections, cmdDir, fds, opts.Timeout)
+		}
+		return 0, output, err
+	}
+	if opts.Container != nil {
+		sections, err = opts.Container.wrap(envs, sections, cmdDir)
+		if err != nil {
+			return 0, "", err
+		}
+	}
+	ctx := context.Background()
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	cmds, err := commandsContext(ctx, sections)
 	if err != nil {
 		return 0, "", fmt.Errorf("build command failed: %s", err)
 	}
@@ -223,14 +797,20 @@ func execCommand(envs *ExpandEnvs, sections [][]string, cmdDir string, needsOutp
 		fds.Stdout = bytes.NewBuffer(nil)
 		fds.Stderr = nil
 	}
-	if background {
+	if opts.Background {
 		err = argv.Start(fds.Stdin, fds.Stdout, fds.Stderr, cmds...)
 	} else {
 		err = argv.Pipe(fds.Stdin, fds.Stdout, fds.Stderr, cmds...)
 	}
 	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return 0, "", fmt.Errorf("command timeout after %s", opts.Timeout)
+		}
 		return 0, "", fmt.Errorf("run command failed: %s", err)
 	}
+	if opts.Background && opts.Handle != nil {
+		opts.Handle.watch(cmds)
+	}
 	if p := cmds[len(cmds)-1].Process; p != nil {
 		pid = p.Pid
 	}
@@ -240,53 +820,234 @@ func execCommand(envs *ExpandEnvs, sections [][]string, cmdDir string, needsOutp
 	return pid, "", nil
 }
 
-func runCommand(envs *ExpandEnvs, cmd, cmdDir string, needsOutput bool, fds commandFds, background bool) (pid int, output string, err error) {
+// commandsContext creates commands of sections like argv.Cmds, commands are killed if ctx is done.
+func commandsContext(ctx context.Context, sections [][]string) ([]*exec.Cmd, error) {
+	var cmds []*exec.Cmd
+	for _, args := range sections {
+		if len(args) == 0 {
+			return nil, errors.New("invalid cmd")
+		}
+		cmds = append(cmds, exec.CommandContext(ctx, args[0], args[1:]...))
+	}
+	return cmds, nil
+}
+
+// lineBufferedSections runs each section by stdbuf to make stdio of C programs line buffered.
+func lineBufferedSections(sections [][]string) [][]string {
+	stdbuf, err := exec.LookPath("stdbuf")
+	if err != nil {
+		return sections
+	}
+	wrapped := make([][]string, len(sections))
+	for i, args := range sections {
+		wrapped[i] = append([]string{stdbuf, "-oL", "-eL"}, args...)
+	}
+	return wrapped
+}
+
+func runCommand(envs *ExpandEnvs, cmd string, opts commandOptions) (pid int, output string, err error) {
+	var substitutions []string
 	sections, err := argv.Argv(
 		cmd,
 		func(cmd string) (string, error) {
-			return getCmdStringOutput(envs, cmdDir, cmd)
+			output, err := getCmdStringOutput(envs, cmd, opts.Dir)
+			if err != nil || !opts.SplitSubstitution {
+				return output, err
+			}
+			// argv appends output to current argument, it's replaced by a marker and split later.
+			substitutions = append(substitutions, output)
+			return substitutionMarker(len(substitutions) - 1), nil
 		},
 		envs.expandString,
 	)
 	if err != nil {
 		return 0, "", fmt.Errorf("parse command string failed: %s", err)
 	}
+	if len(substitutions) > 0 {
+		for i := range sections {
+			sections[i] = splitSubstitutions(sections[i], substitutions)
+		}
+	}
 	if len(sections) == 0 {
 		return 0, "", fmt.Errorf("empty command line string")
 	}
-	return execCommand(envs, sections, cmdDir, needsOutput, fds, background)
+	if opts.ResponseFiles {
+		for i := range sections {
+			sections[i], err = expandResponseFiles(sections[i], opts.Dir)
+			if err != nil {
+				return 0, "", err
+			}
+		}
+	}
+	return execCommand(envs, sections, opts)
 }
 
-func getCmdStringOutput(envs *ExpandEnvs, cmd, cmdDir string) (string, error) {
-	_, output, err := runCommand(envs, cmd, cmdDir, true, commandFds{}, false)
-	return output, err
-}
-func parseInt(s string) (int64, error) {
-	for prefix, base := range map[string]int{
-		"0x": 16,
-		"0o": 8,
-		"0b": 2,
-	} {
-		if strings.HasPrefix(s, prefix) {
-			return strconv.ParseInt(s, base, 64)
+// scriptInterpreter returns interpreter command of script: the specified one,
+// or the '#!' line of script, 'sh' by default.
+func scriptInterpreter(interpreter, content string) ([]string, error) {
+	if interpreter == "" && strings.HasPrefix(content, "#!") {
+		line := content[2:]
+		if i := strings.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+		}
+		interpreter = strings.TrimSpace(line)
+		if interpreter == "" {
+			return nil, fmt.Errorf("empty script interpreter line")
 		}
 	}
-	return strconv.ParseInt(s, 10, 64)
-}
-func parseBool(s string) (bool, error) {
-	switch strings.ToLower(s) {
-	case "true", "yes", "1":
-		return true, nil
-	case "", "false", "no", "0":
-		return false, nil
-	default:
-		return false, fmt.Errorf("invalid boolean value: %s", s)
+	if interpreter == "" {
+		interpreter = "sh"
 	}
+	return strings.Fields(interpreter), nil
 }
-func checkCondition(envs *ExpandEnvs, value, operator string, compareField *string) (bool, error) {
-	fixAlias := func(o *string) {
-		if a, has := syntax.OperatorAlias[*o]; has {
-			*o = a
+
+func writeScriptFile(content string) (string, error) {
+	fd, err := ioutil.TempFile("", "tash-script*")
+	if err != nil {
+		return "", err
+	}
+	_, err = fd.WriteString(content)
+	if err1 := fd.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Chmod(fd.Name(), 0700)
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+		return "", err
+	}
+	return fd.Name(), nil
+}
+
+const substitutionMarkerRune = '\x00'
+
+func substitutionMarker(idx int) string {
+	return string(substitutionMarkerRune) + strconv.Itoa(idx) + string(substitutionMarkerRune)
+}
+
+// splitSubstitutions replaces substitution markers in arguments with words of outputs,
+// an argument consists of only empty substitutions is removed like shell.
+func splitSubstitutions(args []string, outputs []string) []string {
+	var result []string
+	for _, arg := range args {
+		if !strings.ContainsRune(arg, substitutionMarkerRune) {
+			result = append(result, arg)
+			continue
+		}
+		var (
+			word  strings.Builder
+			valid bool
+		)
+		// segments alternate between literal and marker index
+		segments := strings.Split(arg, string(substitutionMarkerRune))
+		for i, seg := range segments {
+			if i%2 == 0 {
+				if seg != "" {
+					word.WriteString(seg)
+					valid = true
+				}
+				continue
+			}
+			idx, err := strconv.Atoi(seg)
+			if err != nil || idx < 0 || idx >= len(outputs) {
+				word.WriteString(seg)
+				continue
+			}
+			for j, w := range strings.Fields(outputs[idx]) {
+				if j > 0 {
+					result = append(result, word.String())
+					word.Reset()
+				}
+				word.WriteString(w)
+				valid = true
+			}
+		}
+		if valid {
+			result = append(result, word.String())
+		}
+	}
+	return result
+}
+
+// expandResponseFiles replaces '@file' arguments with whitespace separated arguments in the file,
+// the command name is kept as is, quoting isn't supported in file.
+func expandResponseFiles(args []string, cmdDir string) ([]string, error) {
+	var expanded []string
+	for i, arg := range args {
+		if i == 0 || len(arg) <= 1 || arg[0] != '@' {
+			expanded = append(expanded, arg)
+			continue
+		}
+		path := stringFromSlash(arg[1:])
+		if cmdDir != "" && !filepath.IsAbs(path) {
+			path = filepath.Join(cmdDir, path)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read response file failed: %w", err)
+		}
+		expanded = append(expanded, strings.Fields(string(content))...)
+	}
+	return expanded, nil
+}
+
+func getCmdStringOutput(envs *ExpandEnvs, cmd, cmdDir string) (string, error) {
+	_, output, err := runCommand(envs, cmd, commandOptions{Dir: cmdDir, NeedsOutput: true})
+	return output, err
+}
+func parseInt(s string) (int64, error) {
+	for prefix, base := range map[string]int{
+		"0x": 16,
+		"0o": 8,
+		"0b": 2,
+	} {
+		if strings.HasPrefix(s, prefix) {
+			return strconv.ParseInt(s[len(prefix):], base, 64)
+		}
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// parseFloat parses integer with base prefixes or float.
+func parseFloat(s string) (float64, error) {
+	if v, err := parseInt(s); err == nil {
+		return float64(v), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// parseNumberRange parses range in format 'min,max'.
+func parseNumberRange(s string) (min, max float64, err error) {
+	bounds := strings.Split(s, ",")
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("invalid number range, expect 'min,max': %s", s)
+	}
+	min, err1 := parseFloat(strings.TrimSpace(bounds[0]))
+	max, err2 := parseFloat(strings.TrimSpace(bounds[1]))
+	if err1 != nil || err2 != nil {
+		return 0, 0, fmt.Errorf("invalid number range, expect 'min,max': %s", s)
+	}
+	if min > max {
+		return 0, 0, fmt.Errorf("invalid number range, min is greater than max: %s", s)
+	}
+	return min, max, nil
+}
+
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "true", "yes", "1":
+		return true, nil
+	case "", "false", "no", "0":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid boolean value: %s", s)
+	}
+}
+func checkCondition(envs *ExpandEnvs, value, operator string, compareField *string) (bool, error) {
+	fixAlias := func(o *string) {
+		if a, has := syntax.OperatorAlias[*o]; has {
+			*o = a
 		}
 	}
 	if operator == "" {
@@ -358,6 +1119,37 @@ func checkCondition(envs *ExpandEnvs, value, operator string, compareField *stri
 		case syntax.Op_number_lessThan:
 			ok = v1 < v2
 		}
+	case syntax.Op_number_between, syntax.Op_number_betweenExclusive:
+		min, max, err := parseNumberRange(compare)
+		if err != nil {
+			return false, err
+		}
+		v, err := parseFloat(value)
+		if err != nil {
+			return false, fmt.Errorf("convert value to number failed: %s", value)
+		}
+		if operator == syntax.Op_number_between {
+			ok = v >= min && v <= max
+		} else {
+			ok = v > min && v < max
+		}
+	case syntax.Op_glob_count:
+		countOp, countCompare := syntax.Op_number_equal, strings.TrimSpace(compare)
+		if fields := strings.Fields(countCompare); len(fields) >= 2 {
+			countOp, countCompare = fields[0], strings.Join(fields[1:], " ")
+			if op, has := globCountOperators[countOp]; has {
+				countOp = op
+			}
+			fixAlias(&countOp)
+		}
+		if !strings.HasPrefix(countOp, "number.") {
+			return false, fmt.Errorf("invalid glob count compare, expect number operator and number: %s", compare)
+		}
+		matched, err := splitBlocksAndGlobPath(value, false)
+		if err != nil {
+			return false, fmt.Errorf("glob path failed: %w", err)
+		}
+		return checkCondition(envs, strconv.Itoa(len(matched)), countOp, &countCompare)
 	case syntax.Op_file_newerThan, syntax.Op_file_olderThan:
 		s1, e1 := os.Stat(value)
 		s2, e2 := os.Stat(compare)
@@ -370,6 +1162,18 @@ func checkCondition(envs *ExpandEnvs, value, operator string, compareField *stri
 		case syntax.Op_file_olderThan:
 			ok = s1.ModTime().Before(s2.ModTime())
 		}
+	case syntax.Op_file_sameContent:
+		var err error
+		ok, err = sameFileContent(value, compare)
+		if err != nil {
+			return false, fmt.Errorf("compare file content failed: %w", err)
+		}
+	case syntax.Op_path_within:
+		var err error
+		ok, err = pathWithin(value, compare)
+		if err != nil {
+			return false, err
+		}
 	case syntax.Op_bool_and,
 		syntax.Op_bool_or:
 		o1, e1 := parseBool(value)
@@ -468,7 +1272,35 @@ func checkCondition(envs *ExpandEnvs, value, operator string, compareField *stri
 			ok = checkFileStatMode(func(mode os.FileMode) bool {
 				return mode&os.ModeSocket != 0
 			})
-		//case "-t":
+		case syntax.Op_fd_terminal, syntax.Op_fd_pipe:
+			fd, err := stdFile(value)
+			if err != nil {
+				return false, err
+			}
+			stat, err := fd.Stat()
+			if err != nil {
+				return false, fmt.Errorf("stat fd failed: %w", err)
+			}
+			if operator == syntax.Op_fd_terminal {
+				ok = isatty.IsTerminal(fd.Fd()) || isatty.IsCygwinTerminal(fd.Fd())
+			} else {
+				ok = stat.Mode()&os.ModeNamedPipe != 0
+			}
+		case syntax.Op_process_running:
+			pid, err := strconv.Atoi(value)
+			if err != nil || pid <= 0 {
+				return false, fmt.Errorf("invalid pid: %s", value)
+			}
+			ok, err = processRunning(pid)
+			if err != nil {
+				return false, fmt.Errorf("check process failed: %w", err)
+			}
+		case syntax.Op_dir_empty, syntax.Op_dir_notEmpty:
+			empty, err := dirEmpty(value)
+			if err != nil {
+				return false, err
+			}
+			ok = empty == (operator == syntax.Op_dir_empty)
 		case syntax.Op_file_setuid:
 			ok = checkFileStatMode(func(mode os.FileMode) bool {
 				return mode&os.ModeSetuid != 0
@@ -491,6 +1323,30 @@ func checkCondition(envs *ExpandEnvs, value, operator string, compareField *stri
 	return ok, nil
 }
 
+// globCountOperators are comparison symbols compared as numbers in glob.count, such as '> 0'.
+var globCountOperators = map[string]string{
+	">":  syntax.Op_number_greaterThan,
+	">=": syntax.Op_number_greaterThanOrEqual,
+	"==": syntax.Op_number_equal,
+	"!=": syntax.Op_number_notEqual,
+	"<=": syntax.Op_number_lessThanOrEqual,
+	"<":  syntax.Op_number_lessThan,
+}
+
+// stdFile returns standard file by fd number or name.
+func stdFile(fd string) (*os.File, error) {
+	switch fd {
+	case "0", "stdin":
+		return os.Stdin, nil
+	case "1", "stdout":
+		return os.Stdout, nil
+	case "2", "stderr":
+		return os.Stderr, nil
+	default:
+		return nil, fmt.Errorf("invalid fd: %s", fd)
+	}
+}
+
 func fileReplacer(args []string, isRegexp bool) (func(path string) error, error) {
 	if len(args) == 0 {
 		return func(path string) error {
@@ -553,10 +1409,213 @@ func fileReplacer(args []string, isRegexp bool) (func(path string) error, error)
 	}), nil
 }
 
+func randomDelimiter() (string, error) {
+	var b [8]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", err
+	}
+	return "TASH_EOF_" + hex.EncodeToString(b[:]), nil
+}
+
+func encodeValue(encoding, value string) (string, error) {
+	switch encoding {
+	case "", syntax.EncodingBase64:
+		return base64.StdEncoding.EncodeToString([]byte(value)), nil
+	case syntax.EncodingBase64Url:
+		return base64.URLEncoding.EncodeToString([]byte(value)), nil
+	case syntax.EncodingHex:
+		return hex.EncodeToString([]byte(value)), nil
+	case syntax.EncodingGzipBase64:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write([]byte(value))
+		if err1 := w.Close(); err == nil {
+			err = err1
+		}
+		if err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+	case syntax.EncodingUrlQuery:
+		return url.QueryEscape(value), nil
+	case syntax.EncodingUrlPath:
+		return url.PathEscape(value), nil
+	default:
+		return "", fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+}
+
+func decodeValue(encoding, value string) (string, error) {
+	var (
+		data []byte
+		err  error
+	)
+	switch encoding {
+	case "", syntax.EncodingBase64, syntax.EncodingGzipBase64:
+		data, err = base64.StdEncoding.DecodeString(value)
+	case syntax.EncodingBase64Url:
+		if strings.HasSuffix(value, "=") || len(value)%4 == 0 {
+			data, err = base64.URLEncoding.DecodeString(value)
+		} else {
+			data, err = base64.RawURLEncoding.DecodeString(value)
+		}
+	case syntax.EncodingHex:
+		data, err = hex.DecodeString(value)
+	case syntax.EncodingUrlQuery, syntax.EncodingUrlPath:
+		var s string
+		if encoding == syntax.EncodingUrlQuery {
+			s, err = url.QueryUnescape(value)
+		} else {
+			s, err = url.PathUnescape(value)
+		}
+		data = []byte(s)
+	default:
+		return "", fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid %s value: %w", encoding, err)
+	}
+	if encoding == syntax.EncodingGzipBase64 {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return "", fmt.Errorf("invalid gzip data: %w", err)
+		}
+		data, err = ioutil.ReadAll(r)
+		if err != nil {
+			return "", fmt.Errorf("invalid gzip data: %w", err)
+		}
+	}
+	return string(data), nil
+}
+
+// jsonValue converts string value to json value of type.
+func jsonValue(typ, value string) (interface{}, error) {
+	switch typ {
+	case "", syntax.JsonTypeString:
+		return value, nil
+	case syntax.JsonTypeNumber:
+		if v, err := parseInt(value); err == nil {
+			return v, nil
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number: %s", value)
+		}
+		return v, nil
+	case syntax.JsonTypeBool:
+		v, err := parseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid boolean: %s", value)
+		}
+		return v, nil
+	case syntax.JsonTypeRaw:
+		if !json.Valid([]byte(value)) {
+			return nil, fmt.Errorf("invalid json: %s", value)
+		}
+		return json.RawMessage(value), nil
+	default:
+		return nil, fmt.Errorf("unsupported type: %s", typ)
+	}
+}
+
+// buildJsonObject builds json object from fields, dot separated field name creates nested objects.
+func buildJsonObject(fields, types map[string]string) (string, error) {
+	for name := range types {
+		if _, has := fields[name]; !has {
+			return "", fmt.Errorf("type of undefined field: %s", name)
+		}
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	root := map[string]interface{}{}
+	for _, name := range names {
+		val, err := jsonValue(types[name], fields[name])
+		if err != nil {
+			return "", fmt.Errorf("field %s: %w", name, err)
+		}
+		keys := strings.Split(name, ".")
+		obj := root
+		for i, key := range keys[:len(keys)-1] {
+			child, has := obj[key]
+			if !has {
+				child = map[string]interface{}{}
+				obj[key] = child
+			}
+			m, ok := child.(map[string]interface{})
+			if !ok {
+				return "", fmt.Errorf("field %s conflicts with %s", name, strings.Join(keys[:i+1], "."))
+			}
+			obj = m
+		}
+		key := keys[len(keys)-1]
+		if _, has := obj[key]; has {
+			return "", fmt.Errorf("field %s conflicts with nested fields", name)
+		}
+		obj[key] = val
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(root)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// randomUuid generates version 4 uuid.
+func randomUuid() (string, error) {
+	var b [16]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	s := hex.EncodeToString(b[:])
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:], nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// randomInt generates integer in [min, max].
+func randomInt(min, max int64) (int64, error) {
+	if min > max {
+		return 0, fmt.Errorf("invalid range, min is greater than max: %d,%d", min, max)
+	}
+	n := new(big.Int).Sub(big.NewInt(max), big.NewInt(min))
+	n.Add(n, big.NewInt(1))
+	v, err := rand.Int(rand.Reader, n)
+	if err != nil {
+		return 0, err
+	}
+	return v.Add(v, big.NewInt(min)).Int64(), nil
+}
+
+// paths stored in environments and printed in logs are always slash-separated to avoid
+// conflicting with the '\' escaping in expanding, they are converted by stringToSlash,
+// ptrsToSlash and sliceToSlash at the boundary where they're produced.
+// filesystem calls use native separators converted by stringFromSlash.
 func stringToSlash(s string) string {
 	return filepath.ToSlash(s)
 }
 
+func stringFromSlash(s string) string {
+	return filepath.FromSlash(s)
+}
+
 func ptrsToSlash(ptr ...*string) {
 	for _, ptr := range ptr {
 		*ptr = filepath.ToSlash(*ptr)
@@ -570,7 +1629,488 @@ func sliceToSlash(paths []string) []string {
 	return paths
 }
 
-func openFile(name string, append bool) (*os.File, error) {
+func fileDigest(path string, creator func() hash.Hash) ([]byte, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	h := creator()
+	_, err = io.Copy(h, fd)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// dirDigest computes digest of directory tree, records of each entry keyed by relative path
+// are returned to report differences.
+func dirDigest(dir string, creator func() hash.Hash, ignoreMode bool) ([]byte, map[string]string, error) {
+	root := stringFromSlash(dir)
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !stat.IsDir() {
+		return nil, nil, fmt.Errorf("not a directory: %s", dir)
+	}
+	var paths []string
+	entries := map[string]string{}
+	// walk in lexical order and doesn't follow symlinks
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		relPath = stringToSlash(relPath)
+
+		mode := info.Mode()
+		var kind, content string
+		switch {
+		case mode.IsDir():
+			kind = "dir"
+		case mode&os.ModeSymlink != 0:
+			kind = "symlink"
+			content, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			content = stringToSlash(content)
+		case mode.IsRegular():
+			kind = "file"
+			digest, err := fileDigest(path, creator)
+			if err != nil {
+				return err
+			}
+			content = hex.EncodeToString(digest)
+		default:
+			return fmt.Errorf("unsupported file type: %s, %s", relPath, mode.Type())
+		}
+		perm := "-"
+		if !ignoreMode && kind != "symlink" {
+			perm = fmt.Sprintf("%04o", mode.Perm())
+		}
+		paths = append(paths, relPath)
+		entries[relPath] = kind + " " + perm + " " + content
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(paths)
+	h := creator()
+	for _, p := range paths {
+		// fields are separated by NUL which couldn't appear in paths
+		_, _ = fmt.Fprintf(h, "%s\x00%s\x00", p, entries[p])
+	}
+	return h.Sum(nil), entries, nil
+}
+
+// diffDirEntries lists entries differed between two directories in path order.
+func diffDirEntries(a, b map[string]string) []string {
+	var paths []string
+	for p := range a {
+		paths = append(paths, p)
+	}
+	for p := range b {
+		if _, has := a[p]; !has {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	var diffs []string
+	for _, p := range paths {
+		va, hasA := a[p]
+		vb, hasB := b[p]
+		switch {
+		case !hasB:
+			diffs = append(diffs, "- "+p)
+		case !hasA:
+			diffs = append(diffs, "+ "+p)
+		case va != vb:
+			diffs = append(diffs, fmt.Sprintf("~ %s: %s => %s", p, va, vb))
+		}
+	}
+	return diffs
+}
+
+// sameFileContent compares file sizes first, then sha256 digests.
+func sameFileContent(path1, path2 string) (bool, error) {
+	path1, path2 = stringFromSlash(path1), stringFromSlash(path2)
+	stat1, err := os.Stat(path1)
+	if err != nil {
+		return false, err
+	}
+	stat2, err := os.Stat(path2)
+	if err != nil {
+		return false, err
+	}
+	if stat1.IsDir() || stat2.IsDir() {
+		return false, fmt.Errorf("couldn't compare content of directory")
+	}
+	if stat1.Size() != stat2.Size() {
+		return false, nil
+	}
+	creator := hashCreator(syntax.ResourceHashAlgSha256)
+	digest1, err := fileDigest(path1, creator)
+	if err != nil {
+		return false, err
+	}
+	digest2, err := fileDigest(path2, creator)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(digest1, digest2), nil
+}
+
+// validateFile checks json/yaml syntax and required top-level keys.
+func validateFile(path, format string, requiredKeys []string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	switch format {
+	case syntax.ValidateFormatJson:
+		err = json.Unmarshal(content, &doc)
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line, col := offsetPosition(content, syntaxErr.Offset)
+			return fmt.Errorf("line %d, column %d: %w", line, col, err)
+		}
+	case syntax.ValidateFormatYaml:
+		// yaml errors contain line number
+		err = yaml.Unmarshal(content, &doc)
+	default:
+		return fmt.Errorf("invalid format: %s", format)
+	}
+	if err != nil {
+		return err
+	}
+	if len(requiredKeys) == 0 {
+		return nil
+	}
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("document is not an object")
+	}
+	var missing []string
+	for _, k := range requiredKeys {
+		if _, has := obj[k]; !has {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("required keys missing: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func offsetPosition(content []byte, offset int64) (line, col int) {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	line = 1 + bytes.Count(content[:offset], []byte("\n"))
+	col = int(offset) - bytes.LastIndexByte(content[:offset], '\n')
+	return line, col - 1
+}
+
+func realPath(path string) (string, error) {
+	path, err := filepath.Abs(stringFromSlash(path))
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return path, nil
+		}
+		return "", err
+	}
+	return resolved, nil
+}
+
+func pathWithin(path, dir string) (bool, error) {
+	path, err := realPath(path)
+	if err != nil {
+		return false, fmt.Errorf("resolve path failed: %w", err)
+	}
+	dir, err = realPath(dir)
+	if err != nil {
+		return false, fmt.Errorf("resolve directory failed: %w", err)
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		// different volumes on windows
+		return false, nil
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
+
+// lineInFile ensures the line is present or absent in file, the file is only written if changed.
+func lineInFile(path, line string, present bool, match *regexp.Regexp, position string, insertAfter *regexp.Regexp) (bool, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+		if !present {
+			// line is absent in missing file
+			return false, nil
+		}
+	}
+	var (
+		lines   []string
+		newline = "\n"
+	)
+	if len(content) > 0 {
+		str := string(content)
+		if strings.Contains(str, "\r\n") {
+			newline = "\r\n"
+		}
+		lines = strings.Split(strings.TrimSuffix(str, newline), newline)
+	}
+	isTarget := func(l string) bool {
+		if match != nil {
+			return match.MatchString(l)
+		}
+		return l == line
+	}
+
+	var (
+		result  []string
+		changed bool
+	)
+	if !present {
+		for _, l := range lines {
+			if isTarget(l) {
+				changed = true
+				continue
+			}
+			result = append(result, l)
+		}
+	} else {
+		result = lines
+		found := -1
+		for i, l := range lines {
+			if isTarget(l) {
+				found = i
+			}
+		}
+		if found >= 0 {
+			if lines[found] != line {
+				lines[found] = line
+				changed = true
+			}
+		} else {
+			insert := len(lines)
+			if position == syntax.LinePositionBegin {
+				insert = 0
+			}
+			if insertAfter != nil {
+				for i, l := range lines {
+					if insertAfter.MatchString(l) {
+						insert = i + 1
+					}
+				}
+			}
+			result = make([]string, 0, len(lines)+1)
+			result = append(result, lines[:insert]...)
+			result = append(result, line)
+			result = append(result, lines[insert:]...)
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	var buf strings.Builder
+	for _, l := range result {
+		buf.WriteString(l)
+		buf.WriteString(newline)
+	}
+	fd, err := openFile(path, false, defaultFileMode)
+	if err != nil {
+		return false, err
+	}
+	defer fd.Close()
+	_, err = fd.WriteString(buf.String())
+	return true, err
+}
+
+// overrideActions applies json merge patches to actions with same index in list.
+func overrideActions(list syntax.ActionList, overrides map[int]json.RawMessage) (syntax.ActionList, error) {
+	content, err := json.Marshal(list)
+	if err != nil {
+		return list, err
+	}
+	var actions []interface{}
+	err = json.Unmarshal(content, &actions)
+	if err != nil {
+		return list, err
+	}
+	for idx, patch := range overrides {
+		if idx < 0 || idx >= len(actions) {
+			return list, fmt.Errorf("action index out of range: %d, template has %d actions", idx, len(actions))
+		}
+		var p interface{}
+		err = json.Unmarshal(patch, &p)
+		if err != nil {
+			return list, fmt.Errorf("decode override of action %d failed: %w", idx, err)
+		}
+		actions[idx] = mergePatch(actions[idx], p)
+	}
+	content, err = json.Marshal(actions)
+	if err != nil {
+		return list, err
+	}
+	var result syntax.ActionList
+	err = json.Unmarshal(content, &result)
+	if err != nil {
+		return list, fmt.Errorf("decode overridden actions failed: %w", err)
+	}
+	return result, nil
+}
+
+// mergePatch implements json merge patch(RFC 7386), object keys are matched case-insensitively
+// to be consistent with config unmarshaling.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		key := k
+		for tk := range t {
+			if strings.EqualFold(tk, k) {
+				key = tk
+				break
+			}
+		}
+		if v == nil {
+			delete(t, key)
+			continue
+		}
+		t[key] = mergePatch(t[key], v)
+	}
+	return t
+}
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"KB", 1 << 10},
+	{"MB", 1 << 20},
+	{"GB", 1 << 30},
+	{"TB", 1 << 40},
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"T", 1 << 40},
+	{"B", 1},
+}
+
+// parseSize parses byte size with optional unit suffixes, units are 1024 based and case insensitive.
+func parseSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(str, u.suffix) {
+			str = strings.TrimSpace(strings.TrimSuffix(str, u.suffix))
+			unit = u.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(str, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// splitFile writes file content into chunks named 'prefix.000', 'prefix.001'..., each chunk
+// contains at most size bytes or lines, the last chunk contains the remainder.
+func splitFile(file, prefix string, size int64, lines int) ([]string, error) {
+	src, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	var (
+		chunks []string
+		reader = bufio.NewReader(src)
+	)
+	for {
+		if _, err := reader.Peek(1); err == io.EOF {
+			break
+		}
+		name := fmt.Sprintf("%s.%03d", prefix, len(chunks))
+		dst, err := openFile(name, false, defaultFileMode)
+		if err != nil {
+			return chunks, err
+		}
+		if lines > 0 {
+			for i := 0; i < lines; i++ {
+				line, err := reader.ReadBytes('\n')
+				if len(line) > 0 {
+					if _, werr := dst.Write(line); werr != nil {
+						err = werr
+					}
+				}
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					dst.Close()
+					return chunks, err
+				}
+			}
+		} else {
+			_, err = io.CopyN(dst, reader, size)
+			if err != nil && err != io.EOF {
+				dst.Close()
+				return chunks, err
+			}
+		}
+		err = dst.Close()
+		if err != nil {
+			return chunks, err
+		}
+		chunks = append(chunks, stringToSlash(name))
+	}
+	return chunks, nil
+}
+
+// defaultFileMode is used by openFile if mode isn't specified
+const defaultFileMode = 0644
+
+// parseFileMode parses octal permission string such as '0755', defaultFileMode is returned if empty.
+func parseFileMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return defaultFileMode, nil
+	}
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("invalid file mode: %s", s)
+	}
+	return os.FileMode(m), nil
+}
+
+// openFile opens file for writing, parent directories are created with 0755. if mode is not defaultFileMode,
+// it's also applied to existing file and isn't affected by umask.
+func openFile(name string, append bool, mode os.FileMode) (*os.File, error) {
 	flags := os.O_WRONLY | os.O_CREATE
 	if append {
 		flags |= os.O_APPEND
@@ -581,7 +2121,59 @@ func openFile(name string, append bool) (*os.File, error) {
 	if err != nil {
 		return nil, fmt.Errorf("create parent directories failed: %w", err)
 	}
-	return os.OpenFile(name, flags, 00644)
+	fd, err := os.OpenFile(name, flags, mode)
+	if err != nil {
+		return nil, err
+	}
+	if mode != defaultFileMode {
+		err = fd.Chmod(mode)
+		if err != nil {
+			fd.Close()
+			return nil, fmt.Errorf("change file mode failed: %w", err)
+		}
+	}
+	return fd, nil
+}
+
+// syncFile is file flushed by closeFile, it's implemented by *os.File.
+type syncFile interface {
+	Name() string
+	Sync() error
+	Close() error
+}
+
+// closeFile closes written file, data and directory entry of file are flushed to disk first if durable,
+// so created or truncated file survives crash.
+func closeFile(fd syncFile, durable bool) error {
+	if durable {
+		err := fd.Sync()
+		if err != nil {
+			fd.Close()
+			return fmt.Errorf("sync file failed: %w", err)
+		}
+	}
+	err := fd.Close()
+	if err != nil || !durable {
+		return err
+	}
+	return syncDir(filepath.Dir(fd.Name()))
+}
+
+// syncDir flushes directory entries to disk, it's not supported on windows and skipped.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	err = d.Sync()
+	if err != nil {
+		return fmt.Errorf("sync directory failed: %w", err)
+	}
+	return nil
 }
 
 func stringUnquote(s string) string {
@@ -617,8 +2209,11 @@ func splitBlocks(s string) []string {
 }
 
 func splitBlocksAndGlobPath(path string, mustBeFile bool) ([]string, error) {
+	return globPaths(splitBlocks(path), mustBeFile)
+}
+
+func globPaths(blocks []string, mustBeFile bool) ([]string, error) {
 	var matched []string
-	blocks := splitBlocks(path)
 	for _, block := range blocks {
 		m, err := zglob.Glob(block)
 		if err != nil && !errors.Is(err, os.ErrNotExist) {
@@ -626,6 +2221,7 @@ func splitBlocksAndGlobPath(path string, mustBeFile bool) ([]string, error) {
 		}
 		matched = append(matched, m...)
 	}
+	matched = sliceToSlash(matched)
 	sort.Strings(matched)
 
 	if !mustBeFile {
@@ -651,6 +2247,51 @@ func splitBlocksAndGlobPath(path string, mustBeFile bool) ([]string, error) {
 	return matched, nil
 }
 
+func gitChangedFiles(ref, pattern string) ([]string, error) {
+	if ref == "" {
+		return nil, fmt.Errorf("empty git ref")
+	}
+	var match func(string) bool
+	if pattern != "" {
+		g, err := zglob.New(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("compile pattern failed: %s, %w", pattern, err)
+		}
+		match = g.Match
+	}
+	root, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return nil, fmt.Errorf("not in a git repository: %w", err)
+	}
+	topDir := strings.TrimSpace(string(root))
+	out, err := exec.Command("git", "-C", topDir, "diff", "--name-only", "--diff-filter=d", ref, "--").Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return nil, fmt.Errorf("git diff failed: %s", strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("git diff failed: %w", err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("get current directory failed: %w", err)
+	}
+	var files []string
+	for _, name := range stringSplitAndTrimFilterSpace(string(out), "\n") {
+		path := filepath.Join(topDir, filepath.FromSlash(name))
+		if rel, err := filepath.Rel(wd, path); err == nil {
+			path = rel
+		}
+		path = stringToSlash(path)
+		if match != nil && !match(path) {
+			continue
+		}
+		files = append(files, path)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
 func runInDir(dir string, fn func() error) error {
 	wd, err := os.Getwd()
 	if err != nil {
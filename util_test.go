@@ -0,0 +1,1238 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uiez/tash/syntax"
+)
+
+func TestParseIntPrefix(t *testing.T) {
+	for s, want := range map[string]int64{
+		"10":    10,
+		"0x1f":  31,
+		"0o17":  15,
+		"0b101": 5,
+		"-12":   -12,
+		"0x0":   0,
+	} {
+		got, err := parseInt(s)
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+		if got != want {
+			t.Errorf("%s: got %d, want %d", s, got, want)
+		}
+	}
+}
+
+func TestGetCmdStringOutputSubstitution(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("echo is not an executable on windows")
+	}
+	envs := newExpandEnvs()
+	envs.parsePairs(newLogger(false), os.Environ(), false)
+	out, err := getCmdStringOutput(envs, "echo `echo hello`", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "hello" {
+		t.Errorf("got %q, want %q", out, "hello")
+	}
+}
+
+func TestCheckRemovableSymlinkParent(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symlinks requires privilege on windows")
+	}
+	outside := testDir(t, map[string]string{"victim/file": "x"})
+	root := testDir(t, map[string]string{"inside/file": "x"})
+	err := os.Symlink(outside, filepath.Join(root, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = checkRemovable(filepath.Join(root, "link", "victim"), root, false); err == nil {
+		t.Error("path resolved outside of root through symlink should be refused")
+	}
+	if err = checkRemovable(filepath.Join(root, "link"), root, false); err != nil {
+		t.Errorf("symlink itself should be removable: %s", err)
+	}
+	if err = checkRemovable(filepath.Join(root, "inside", "file"), root, false); err != nil {
+		t.Errorf("path inside root should be removable: %s", err)
+	}
+}
+
+func TestLineInFile(t *testing.T) {
+	dir := testDir(t, map[string]string{"conf": "a=1\nb=2\n"})
+	path := filepath.Join(dir, "conf")
+	for _, c := range []struct {
+		line    string
+		present bool
+		changed bool
+		content string
+	}{
+		{"c=3", true, true, "a=1\nb=2\nc=3\n"},
+		{"c=3", true, false, "a=1\nb=2\nc=3\n"},
+		{"a=1", false, true, "b=2\nc=3\n"},
+		{"a=1", false, false, "b=2\nc=3\n"},
+	} {
+		changed, err := lineInFile(path, c.line, c.present, nil, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content := readTestFile(t, dir, "conf"); changed != c.changed || content != c.content {
+			t.Errorf("line %q present %v: changed %v, content %q", c.line, c.present, changed, content)
+		}
+	}
+
+	missing := filepath.Join(dir, "missing")
+	changed, err := lineInFile(missing, "a=1", false, nil, "", nil)
+	if err != nil || changed {
+		t.Errorf("absent line in missing file: changed %v, err %v", changed, err)
+	}
+	if _, err = os.Stat(missing); !os.IsNotExist(err) {
+		t.Error("missing file is created in absent state")
+	}
+}
+
+// recordSyncFile records Sync calls of file.
+type recordSyncFile struct {
+	*os.File
+	synced int
+}
+
+func (f *recordSyncFile) Sync() error {
+	f.synced++
+	return f.File.Sync()
+}
+
+func TestCloseFileDurable(t *testing.T) {
+	dir := testDir(t, nil)
+	for _, durable := range []bool{false, true} {
+		fd, err := os.Create(filepath.Join(dir, "file"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := &recordSyncFile{File: fd}
+		if err = closeFile(f, durable); err != nil {
+			t.Fatal(err)
+		}
+		if want := map[bool]int{false: 0, true: 1}[durable]; f.synced != want {
+			t.Errorf("durable %v: synced %d times", durable, f.synced)
+		}
+	}
+}
+
+func TestTaskOutputsWrite(t *testing.T) {
+	dir := testDir(t, nil)
+	o := taskOutputs{File: filepath.Join(dir, "outputs.env"), Format: outputsFormatEnv, values: map[string]string{"B": "2", "A": "1"}}
+	if err := o.write(); err != nil {
+		t.Fatal(err)
+	}
+	if content := readTestFile(t, dir, "outputs.env"); content != "A=1\nB=2\n" {
+		t.Errorf("outputs: %q", content)
+	}
+}
+
+func TestGitChangedFiles(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+	dir := testDir(t, map[string]string{
+		"a.txt":     "a",
+		"sub/b.go":  "package b",
+		"sub/c.txt": "c",
+	})
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=tash", "-c", "user.email=tash@example.com"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s, %s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	git("add", "-A")
+	git("commit", "-q", "-m", "init")
+	for name, content := range map[string]string{"a.txt": "A", "sub/b.go": "package bb"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(filepath.Join(dir, "sub", "c.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	var changed, filtered, inSub []string
+	err := runInDir(dir, func() error {
+		var err error
+		if changed, err = gitChangedFiles("HEAD", ""); err != nil {
+			return err
+		}
+		if filtered, err = gitChangedFiles("HEAD", "**/*.go"); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runInDir(filepath.Join(dir, "sub"), func() error {
+		var err error
+		inSub, err = gitChangedFiles("HEAD", "")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(changed, " ") != "a.txt sub/b.go" {
+		t.Errorf("changed files: %q", changed)
+	}
+	if strings.Join(filtered, " ") != "sub/b.go" {
+		t.Errorf("filtered files: %q", filtered)
+	}
+	if strings.Join(inSub, " ") != "../a.txt b.go" {
+		t.Errorf("paths should be relative to current directory: %q", inSub)
+	}
+
+	outside := testDir(t, nil)
+	err = runInDir(outside, func() error {
+		_, err := gitChangedFiles("HEAD", "")
+		return err
+	})
+	if err == nil || !strings.Contains(err.Error(), "not in a git repository") {
+		t.Errorf("error outside of git repository: %v", err)
+	}
+}
+
+func TestPathWithin(t *testing.T) {
+	root := testDir(t, map[string]string{"base/sub/file": "x", "sibling/file": "x", "base2/file": "x"})
+	for _, c := range []struct {
+		path, dir string
+		within    bool
+	}{
+		{"base", "base", true},
+		{"base/sub/file", "base", true},
+		{"base/missing/file", "base", true},
+		{"sibling/file", "base", false},
+		{"base2/file", "base", false},
+		{"base/../sibling", "base", false},
+		{"base/sub/../../escape", "base", false},
+		{"..", "base", false},
+	} {
+		var within bool
+		err := runInDir(root, func() error {
+			var err error
+			within, err = pathWithin(c.path, c.dir)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("%s within %s: %s", c.path, c.dir, err)
+		}
+		if within != c.within {
+			t.Errorf("%s within %s: got %v, want %v", c.path, c.dir, within, c.within)
+		}
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	if err := os.Symlink(filepath.Join(root, "sibling"), filepath.Join(root, "base", "link")); err != nil {
+		t.Fatal(err)
+	}
+	within, err := pathWithin(filepath.Join(root, "base", "link", "file"), filepath.Join(root, "base"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if within {
+		t.Error("path escaping by symlink shouldn't be within directory")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for s, want := range map[string]int64{
+		"100":   100,
+		"100B":  100,
+		"2k":    2 << 10,
+		"512KB": 512 << 10,
+		"1.5MB": 3 << 19,
+		"1 GB":  1 << 30,
+	} {
+		got, err := parseSize(s)
+		if err != nil {
+			t.Errorf("%s: %s", s, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got %d, want %d", s, got, want)
+		}
+	}
+	for _, s := range []string{"", "MB", "-1KB", "1XB"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("%s: invalid size should be refused", s)
+		}
+	}
+}
+
+func TestSplitFile(t *testing.T) {
+	const content = "line1\nline2\nline3\nline4\nline5"
+	dir := testDir(t, map[string]string{"data.txt": content})
+	file := filepath.Join(dir, "data.txt")
+	for _, c := range []struct {
+		name   string
+		size   int64
+		lines  int
+		chunks []string
+	}{
+		{"size", 8, 0, []string{"line1\nli", "ne2\nline", "3\nline4\n", "line5"}},
+		{"exact", int64(len(content)), 0, []string{content}},
+		{"lines", 0, 2, []string{"line1\nline2\n", "line3\nline4\n", "line5"}},
+	} {
+		prefix := filepath.Join(dir, c.name)
+		chunks, err := splitFile(file, prefix, c.size, c.lines)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if len(chunks) != len(c.chunks) {
+			t.Fatalf("%s: got %d chunks %v, want %d", c.name, len(chunks), chunks, len(c.chunks))
+		}
+		var merged strings.Builder
+		for i, chunk := range chunks {
+			if want := filepath.ToSlash(prefix) + fmt.Sprintf(".%03d", i); chunk != want {
+				t.Errorf("%s: chunk name %q, want %q", c.name, chunk, want)
+			}
+			got := readTestFile(t, dir, filepath.Base(chunk))
+			if got != c.chunks[i] {
+				t.Errorf("%s: chunk %d got %q, want %q", c.name, i, got, c.chunks[i])
+			}
+			merged.WriteString(got)
+		}
+		if merged.String() != content {
+			t.Errorf("%s: reassembled content %q", c.name, merged.String())
+		}
+	}
+}
+
+func TestSameContentCondition(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"a.txt":    "hello",
+		"same.txt": "hello",
+		"diff.txt": "world",
+		"long.txt": "hello world",
+		"sub/x":    "",
+	})
+	for _, c := range []struct {
+		compare string
+		same    bool
+	}{
+		{"same.txt", true},
+		{"diff.txt", false},
+		{"long.txt", false},
+	} {
+		compare := filepath.Join(dir, c.compare)
+		same, err := checkCondition(newExpandEnvs(), filepath.Join(dir, "a.txt"), syntax.Op_file_sameContent, &compare)
+		if err != nil {
+			t.Fatalf("%s: %s", c.compare, err)
+		}
+		if same != c.same {
+			t.Errorf("%s: got %v, want %v", c.compare, same, c.same)
+		}
+	}
+	for _, name := range []string{"missing.txt", "sub"} {
+		compare := filepath.Join(dir, name)
+		if _, err := checkCondition(newExpandEnvs(), filepath.Join(dir, "a.txt"), syntax.Op_file_sameContent, &compare); err == nil {
+			t.Errorf("%s: comparing should fail", name)
+		}
+	}
+}
+
+func TestExpandResponseFiles(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"lines.rsp":  "-a\n-b\n\n-c\n",
+		"spaces.rsp": "-x  -y\t-z",
+	})
+	args, err := expandResponseFiles([]string{"@cmd", "@lines.rsp", "-m", "@" + filepath.ToSlash(filepath.Join(dir, "spaces.rsp")), "@"}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(args, " "); got != "@cmd -a -b -c -m -x -y -z @" {
+		t.Errorf("expanded args: %q", got)
+	}
+	if _, err = expandResponseFiles([]string{"cmd", "@missing.rsp"}, dir); err == nil {
+		t.Error("missing response file should fail")
+	}
+}
+
+func TestDownloadContentEncoding(t *testing.T) {
+	const content = "hello tash, hello tash, hello tash"
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte(content))
+	gw.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// encoded regardless of Accept-Encoding, like misconfigured servers or proxies
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gz.Bytes())
+	}))
+	defer server.Close()
+
+	sha256Hex := func(b []byte) string {
+		sum := sha256.Sum256(b)
+		return hex.EncodeToString(sum[:])
+	}
+	for _, c := range []struct {
+		raw     bool
+		content []byte
+	}{
+		{false, []byte(content)},
+		{true, gz.Bytes()},
+	} {
+		path, digest, err := downloadFile(server.URL, downloadOptions{RawEncoding: c.raw, HashAlg: "SHA256", HashSig: sha256Hex(c.content)})
+		if err != nil {
+			t.Fatalf("raw %v: %s", c.raw, err)
+		}
+		got, err := ioutil.ReadFile(path)
+		os.Remove(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, c.content) {
+			t.Errorf("raw %v: saved content %q", c.raw, got)
+		}
+		if digest != sha256Hex(c.content) {
+			t.Errorf("raw %v: digest %s", c.raw, digest)
+		}
+	}
+}
+
+func TestDownloadHashWhileStreaming(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	sum := sha256.Sum256(content)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	// downloaded files are created in temp dir
+	tmp := testDir(t, nil)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmp)
+
+	path, digest, err := downloadFile(server.URL, downloadOptions{HashAlg: "SHA256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// digest is computed from the stream, it doesn't depend on the saved file
+	if err = os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if digest != hex.EncodeToString(sum[:]) {
+		t.Errorf("digest of download: %s", digest)
+	}
+
+	_, _, err = downloadFile(server.URL, downloadOptions{HashAlg: "SHA256", HashSig: strings.Repeat("0", 64)})
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatched") {
+		t.Fatalf("mismatched checksum should fail: %v", err)
+	}
+	if empty, err := dirEmpty(tmp); err != nil || !empty {
+		t.Errorf("mismatched download should be removed: %v", err)
+	}
+}
+
+func TestValidateFile(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"valid.json":   `{"name": "tash", "version": 1}`,
+		"invalid.json": "{\n  \"name\": \"tash\",\n  \"version\": }",
+		"array.json":   `[1, 2]`,
+		"valid.yaml":   "name: tash\nversion: 1\n",
+		"invalid.yaml": "name: tash\n  version: [1\n",
+	})
+	for _, c := range []struct {
+		file     string
+		format   string
+		required []string
+		err      string
+	}{
+		{"valid.json", syntax.ValidateFormatJson, []string{"name", "version"}, ""},
+		{"invalid.json", syntax.ValidateFormatJson, nil, "line 3, column 14"},
+		{"valid.json", syntax.ValidateFormatJson, []string{"name", "license", "authors"}, "required keys missing: license, authors"},
+		{"array.json", syntax.ValidateFormatJson, nil, ""},
+		{"array.json", syntax.ValidateFormatJson, []string{"name"}, "document is not an object"},
+		{"valid.yaml", syntax.ValidateFormatYaml, []string{"name"}, ""},
+		{"invalid.yaml", syntax.ValidateFormatYaml, nil, "line 2"},
+		{"valid.yaml", "toml", nil, "invalid format"},
+	} {
+		err := validateFile(filepath.Join(dir, c.file), c.format, c.required)
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: %s", c.file, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%s: got error %v, want %s", c.file, err, c.err)
+		}
+	}
+}
+
+func TestSplitSubstitutions(t *testing.T) {
+	outputs := []string{"a b\nc", "", "x"}
+	m := substitutionMarker
+	for _, c := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"cmd", m(0)}, []string{"cmd", "a", "b", "c"}},
+		{[]string{"cmd", "pre-" + m(0) + "-post"}, []string{"cmd", "pre-a", "b", "c-post"}},
+		{[]string{"cmd", m(1), "last"}, []string{"cmd", "last"}},
+		{[]string{"cmd", "pre" + m(1)}, []string{"cmd", "pre"}},
+		{[]string{"cmd", m(2) + m(0)}, []string{"cmd", "xa", "b", "c"}},
+	} {
+		got := splitSubstitutions(c.args, outputs)
+		if strings.Join(got, "|") != strings.Join(c.want, "|") {
+			t.Errorf("%q: got %q, want %q", c.args, got, c.want)
+		}
+	}
+}
+
+func TestFdConditions(t *testing.T) {
+	check := func(value, operator string) bool {
+		t.Helper()
+		ok, err := checkCondition(newExpandEnvs(), value, operator, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	stdout := os.Stdout
+	defer func() { os.Stdout = stdout }()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	os.Stdout = w
+	if !check("stdout", syntax.Op_fd_pipe) || !check("1", syntax.Op_fd_pipe) {
+		t.Error("piped stdout should be a pipe")
+	}
+	if check("stdout", syntax.Op_fd_terminal) {
+		t.Error("piped stdout shouldn't be a terminal")
+	}
+
+	f, err := ioutil.TempFile(testDir(t, nil), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	os.Stdout = f
+	if check("stdout", syntax.Op_fd_pipe) || check("stdout", syntax.Op_fd_terminal) {
+		t.Error("regular file stdout should be neither a pipe nor a terminal")
+	}
+
+	if _, err := checkCondition(newExpandEnvs(), "3", syntax.Op_fd_pipe, nil); err == nil {
+		t.Error("invalid fd should be refused")
+	}
+}
+
+func TestDirDigest(t *testing.T) {
+	files := map[string]string{"a.txt": "a", "sub/b.txt": "b"}
+	a, b := testDir(t, files), testDir(t, files)
+	digest := func(dir string, ignoreMode bool) ([]byte, map[string]string) {
+		t.Helper()
+		sum, entries, err := dirDigest(dir, hashCreator("SHA256"), ignoreMode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sum, entries
+	}
+	sumA, entriesA := digest(a, false)
+	if sumB, _ := digest(b, false); !bytes.Equal(sumA, sumB) {
+		t.Fatal("identical trees should match")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(b, "sub", "b.txt"), []byte("c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sumB, entriesB := digest(b, false)
+	if bytes.Equal(sumA, sumB) {
+		t.Error("changed byte should cause mismatch")
+	}
+	if diffs := diffDirEntries(entriesA, entriesB); len(diffs) != 1 || !strings.HasPrefix(diffs[0], "~ sub/b.txt:") {
+		t.Errorf("differed entries: %q", diffs)
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	c := testDir(t, files)
+	if err := os.Chmod(filepath.Join(c, "a.txt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if sumC, _ := digest(c, false); bytes.Equal(sumA, sumC) {
+		t.Error("changed mode should cause mismatch")
+	}
+	sumA, _ = digest(a, true)
+	if sumC, _ := digest(c, true); !bytes.Equal(sumA, sumC) {
+		t.Error("mode should be ignored")
+	}
+}
+
+func TestDownloadProxy(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("direct"))
+	}))
+	defer target.Close()
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// proxy requests have absolute uri
+		proxied = append(proxied, r.URL.String())
+		w.Write([]byte("proxied"))
+	}))
+	defer proxy.Close()
+
+	download := func(url string, opts downloadOptions) string {
+		t.Helper()
+		path, _, err := downloadFile(url, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(path)
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+	if content := download("http://tash.invalid/file", downloadOptions{Proxy: proxy.URL}); content != "proxied" {
+		t.Errorf("request isn't routed through proxy: %q", content)
+	}
+	if len(proxied) != 1 || proxied[0] != "http://tash.invalid/file" {
+		t.Errorf("proxied requests: %q", proxied)
+	}
+	if content := download(target.URL, downloadOptions{Proxy: proxy.URL, NoProxy: "example.com, 127.0.0.0/8"}); content != "direct" {
+		t.Errorf("bypass host isn't connected directly: %q", content)
+	}
+	if content := download(target.URL, downloadOptions{Proxy: syntax.ProxyDirect}); content != "direct" {
+		t.Errorf("direct mode isn't connected directly: %q", content)
+	}
+	if len(proxied) != 1 {
+		t.Errorf("bypassed requests are routed through proxy: %q", proxied)
+	}
+	if _, _, err := downloadFile(target.URL, downloadOptions{Proxy: "ftp://proxy"}); err == nil {
+		t.Error("unsupported proxy schema should be refused")
+	}
+}
+
+func TestBypassProxy(t *testing.T) {
+	noProxy := []string{"example.com", ".internal.org", "10.0.0.0/8", "api.test:8080"}
+	for rawUrl, want := range map[string]bool{
+		"http://example.com/a":       true,
+		"https://www.example.com/a":  true,
+		"http://notexample.com/a":    false,
+		"http://svc.internal.org/a":  true,
+		"http://10.1.2.3/a":          true,
+		"http://11.1.2.3/a":          false,
+		"http://api.test:8080/a":     true,
+		"http://api.test/a":          false,
+		"https://EXAMPLE.com:8443/a": true,
+	} {
+		u, err := url.Parse(rawUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bypassProxy(u, noProxy); got != want {
+			t.Errorf("%s: bypass %t, want %t", rawUrl, got, want)
+		}
+	}
+	u, _ := url.Parse("http://any.host/")
+	if !bypassProxy(u, []string{"*"}) {
+		t.Error("'*' should bypass all hosts")
+	}
+}
+
+// testCert issues certificate signed by parent, it's self-signed if parent is nil.
+func testCert(t *testing.T, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return cert, key, certPem, keyPem
+}
+
+func TestDownloadTls(t *testing.T) {
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey, caPem, _ := testCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "tash test ca"},
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	_, _, serverPem, serverKeyPem := testCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotAfter:     notAfter,
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	_, _, clientPem, clientKeyPem := testCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "tash client"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	serverCert, err := tls.X509KeyPair(serverPem, serverKeyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	dir := testDir(t, map[string]string{
+		"ca.pem":         string(caPem),
+		"client.pem":     string(clientPem),
+		"client-key.pem": string(clientKeyPem),
+	})
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	for _, c := range []struct {
+		name string
+		opts downloadOptions
+		ok   bool
+	}{
+		{"default", downloadOptions{}, false},
+		{"ca without client certificate", downloadOptions{CaFile: caFile}, false},
+		{"ca and client certificate", downloadOptions{CaFile: caFile, CertFile: certFile, KeyFile: keyFile}, true},
+		{"skip verify", downloadOptions{CertFile: certFile, KeyFile: keyFile, InsecureSkipVerify: true}, true},
+		{"certificate without key", downloadOptions{CaFile: caFile, CertFile: certFile}, false},
+	} {
+		path, _, err := downloadFile(server.URL, c.opts)
+		if err != nil {
+			if c.ok {
+				t.Errorf("%s: %s", c.name, err)
+			}
+			continue
+		}
+		content, _ := ioutil.ReadFile(path)
+		os.Remove(path)
+		if !c.ok {
+			t.Errorf("%s: download should fail", c.name)
+		} else if string(content) != "secure" {
+			t.Errorf("%s: content %q", c.name, content)
+		}
+	}
+}
+
+func TestCopyPathFailures(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privilege on windows")
+	}
+	src := testDir(t, map[string]string{"a.txt": "a", "c.txt": "c"})
+	// dangling symlink fails copying
+	if err := os.Symlink(filepath.Join(src, "missing"), filepath.Join(src, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := copyPath(filepath.Join(testDir(t, nil), "dst"), src, false)
+	if err == nil {
+		t.Fatal("copy should fail")
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "aborted after 1 files copied") || !strings.Contains(msg, "b.txt") {
+		t.Errorf("aborted copy error: %s", msg)
+	}
+
+	dst := filepath.Join(testDir(t, nil), "dst")
+	err = copyPath(dst, src, true)
+	if err == nil {
+		t.Fatal("copy should fail")
+	}
+	msg = err.Error()
+	if !strings.HasPrefix(msg, "1 files failed, 2 files copied:") || !strings.Contains(msg, "b.txt") {
+		t.Errorf("continued copy error: %s", msg)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(dst, "c.txt")); string(content) != "c" {
+		t.Error("files after failure should be copied")
+	}
+}
+
+func TestLinkTree(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privilege on windows")
+	}
+	root := testDir(t, map[string]string{"src/a.txt": "a", "src/sub/b.txt": "b"})
+	src, dst := filepath.Join(root, "src"), filepath.Join(root, "dst")
+	linked, err := linkTree(dst, src, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linked != 2 {
+		t.Errorf("linked count: %d", linked)
+	}
+	for _, name := range []string{"a.txt", "sub/b.txt"} {
+		path := filepath.Join(dst, filepath.FromSlash(name))
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("%s isn't a symlink", name)
+			continue
+		}
+		if target, _ := os.Readlink(path); target != filepath.Join(src, filepath.FromSlash(name)) {
+			t.Errorf("%s links to %s", name, target)
+		}
+	}
+	if info, err := os.Lstat(filepath.Join(dst, "sub")); err != nil || !info.IsDir() {
+		t.Error("directories should be created")
+	}
+
+	// changes of sources are reflected, existing links to the same source are kept
+	if err = ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if linked, err = linkTree(dst, src, false, false); err != nil || linked != 0 {
+		t.Errorf("linking again: %d, %v", linked, err)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(dst, "a.txt")); string(content) != "changed" {
+		t.Errorf("content through link: %q", content)
+	}
+
+	// existing links to other targets are refused unless overwrite
+	if _, err = linkTree(dst, src, false, true); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("existing link should be refused: %v", err)
+	}
+	if _, err = linkTree(dst, src, true, true); err != nil {
+		t.Fatal(err)
+	}
+	if target, _ := os.Readlink(filepath.Join(dst, "sub", "b.txt")); target != filepath.Join("..", "..", "src", "sub", "b.txt") {
+		t.Errorf("relative link target: %s", target)
+	}
+}
+
+func TestParseFileMode(t *testing.T) {
+	for s, want := range map[string]os.FileMode{"": 0644, "0600": 0600, "755": 0755} {
+		mode, err := parseFileMode(s)
+		if err != nil || mode != want {
+			t.Errorf("%q: %o, %v", s, mode, err)
+		}
+	}
+	for _, s := range []string{"0800", "rw", "01777"} {
+		if _, err := parseFileMode(s); err == nil {
+			t.Errorf("invalid mode should be refused: %q", s)
+		}
+	}
+}
+
+func TestNumberBetween(t *testing.T) {
+	for _, c := range []struct {
+		value, compare       string
+		inclusive, exclusive bool
+	}{
+		{"5", "1,10", true, true},
+		{"0", "1,10", false, false},
+		{"11", "1,10", false, false},
+		{"1", "1,10", true, false},
+		{"10", "1, 10", true, false},
+		{"0x0a", "1,10", true, false},
+		{"2.5", "-1.5,2.5", true, false},
+		{"-1", "-1.5,2.5", true, true},
+	} {
+		for operator, want := range map[string]bool{
+			syntax.Op_number_between:          c.inclusive,
+			syntax.Op_number_betweenExclusive: c.exclusive,
+		} {
+			compare := c.compare
+			ok, err := checkCondition(newExpandEnvs(), c.value, operator, &compare)
+			if err != nil {
+				t.Errorf("%s %s %s: %s", c.value, operator, c.compare, err)
+				continue
+			}
+			if ok != want {
+				t.Errorf("%s %s %s: %t, want %t", c.value, operator, c.compare, ok, want)
+			}
+		}
+	}
+	for _, c := range [][2]string{{"5", "1"}, {"5", "1,2,3"}, {"5", "a,10"}, {"5", "10,1"}, {"x", "1,10"}} {
+		compare := c[1]
+		if _, err := checkCondition(newExpandEnvs(), c[0], syntax.Op_number_between, &compare); err == nil {
+			t.Errorf("%s between %s should be refused", c[0], c[1])
+		}
+	}
+}
+
+func TestGlobCount(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"one/a.failed":  "",
+		"many/a.failed": "",
+		"many/b.failed": "",
+		"many/c.failed": "",
+		"many/d.txt":    "",
+	})
+	pattern := func(sub string) string {
+		return filepath.ToSlash(filepath.Join(dir, sub, "*.failed"))
+	}
+	for _, c := range []struct {
+		value, compare string
+		want           bool
+	}{
+		{pattern("none"), "0", true},
+		{pattern("none"), "-gt 0", false},
+		{pattern("one"), "1", true},
+		{pattern("one"), "-gt 0", true},
+		{pattern("many"), "3", true},
+		{pattern("many"), "number.between 1,3", true},
+		{pattern("many"), "-lt 3", false},
+		{pattern("one") + ";" + pattern("many"), "4", true},
+		{pattern("none"), "> 0", false},
+		{pattern("one"), "> 0", true},
+		{pattern("many"), "== 3", true},
+		{pattern("many"), "!= 3", false},
+		{pattern("many"), ">= 4", false},
+		{pattern("many"), "<= 3", true},
+		{pattern("one"), "< 1", false},
+	} {
+		compare := c.compare
+		ok, err := checkCondition(newExpandEnvs(), c.value, syntax.Op_glob_count, &compare)
+		if err != nil {
+			t.Errorf("%s %s: %s", c.value, c.compare, err)
+			continue
+		}
+		if ok != c.want {
+			t.Errorf("%s %s: %t, want %t", c.value, c.compare, ok, c.want)
+		}
+	}
+	compare := "string.equal 1"
+	if _, err := checkCondition(newExpandEnvs(), pattern("one"), syntax.Op_glob_count, &compare); err == nil {
+		t.Error("non-number compare operator should be refused")
+	}
+}
+
+// timedWriter records time of each write.
+type timedWriter struct {
+	mu    sync.Mutex
+	times []time.Time
+	buf   bytes.Buffer
+}
+
+func (w *timedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.times = append(w.times, time.Now())
+	return w.buf.Write(p)
+}
+
+func TestLineBufferedOutput(t *testing.T) {
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 is not available")
+	}
+	script := filepath.Join(testDir(t, map[string]string{"progress.py": "import time\nprint('a')\ntime.sleep(0.3)\nprint('b')\n"}), "progress.py")
+	envs := newExpandEnvs()
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, "PYTHONUNBUFFERED=") {
+			envs.parsePairs(testLogger(t), []string{env}, false)
+		}
+	}
+	var w timedWriter
+	_, _, err = execCommand(envs, [][]string{{python, script}}, commandOptions{
+		Fds:          commandFds{Stdout: &w},
+		LineBuffered: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.buf.String() != "a\nb\n" {
+		t.Fatalf("output: %q", w.buf.String())
+	}
+	// python buffers output written to pipe, lines arrive together at exit without line buffering
+	if len(w.times) < 2 {
+		t.Fatalf("output should arrive incrementally, writes: %d", len(w.times))
+	}
+	if gap := w.times[len(w.times)-1].Sub(w.times[0]); gap < 200*time.Millisecond {
+		t.Errorf("lines should arrive over time, gap: %s", gap)
+	}
+}
+
+func TestEncodeDecodeValue(t *testing.T) {
+	const value = "user:p@ss?/~ é"
+	for _, encoding := range []string{"", syntax.EncodingBase64, syntax.EncodingBase64Url, syntax.EncodingHex, syntax.EncodingGzipBase64} {
+		encoded, err := encodeValue(encoding, value)
+		if err != nil {
+			t.Fatalf("%s: %s", encoding, err)
+		}
+		decoded, err := decodeValue(encoding, encoded)
+		if err != nil || decoded != value {
+			t.Errorf("%s: round trip %q => %q => %q, %v", encoding, value, encoded, decoded, err)
+		}
+	}
+	if encoded, _ := encodeValue(syntax.EncodingBase64, "user:pass"); encoded != "dXNlcjpwYXNz" {
+		t.Errorf("base64: %s", encoded)
+	}
+	if decoded, err := decodeValue(syntax.EncodingBase64Url, "Pz8_"); err != nil || decoded != "???" {
+		t.Errorf("base64url: %q, %v", decoded, err)
+	}
+	if decoded, err := decodeValue(syntax.EncodingBase64Url, "YQ"); err != nil || decoded != "a" {
+		t.Errorf("unpadded base64url: %q, %v", decoded, err)
+	}
+	for encoding, invalid := range map[string]string{
+		syntax.EncodingBase64:     "not base64!",
+		syntax.EncodingHex:        "xyz",
+		syntax.EncodingGzipBase64: "dXNlcjpwYXNz",
+		"rot13":                   "abc",
+	} {
+		if _, err := decodeValue(encoding, invalid); err == nil {
+			t.Errorf("%s: invalid value should be refused: %q", encoding, invalid)
+		}
+	}
+}
+
+func TestUrlEncoding(t *testing.T) {
+	const value = "a b&c=d/é?"
+	for encoding, want := range map[string]string{
+		syntax.EncodingUrlQuery: "a+b%26c%3Dd%2F%C3%A9%3F",
+		syntax.EncodingUrlPath:  "a%20b&c=d%2F%C3%A9%3F",
+	} {
+		encoded, err := encodeValue(encoding, value)
+		if err != nil || encoded != want {
+			t.Errorf("%s: %q, want %q, %v", encoding, encoded, want, err)
+		}
+		if decoded, err := decodeValue(encoding, encoded); err != nil || decoded != value {
+			t.Errorf("%s: decoded %q, %v", encoding, decoded, err)
+		}
+		if _, err := decodeValue(encoding, "%zz"); err == nil {
+			t.Errorf("%s: invalid escape should be refused", encoding)
+		}
+	}
+}
+
+func TestBuildJsonObject(t *testing.T) {
+	content, err := buildJsonObject(map[string]string{
+		"name":       `tash "cli" <dev>`,
+		"meta.size":  "0x10",
+		"meta.ratio": "1.5",
+		"meta.ok":    "yes",
+		"tags":       `["a","b"]`,
+	}, map[string]string{
+		"meta.size":  syntax.JsonTypeNumber,
+		"meta.ratio": syntax.JsonTypeNumber,
+		"meta.ok":    syntax.JsonTypeBool,
+		"tags":       syntax.JsonTypeRaw,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"meta":{"ok":true,"ratio":1.5,"size":16},"name":"tash \"cli\" <dev>","tags":["a","b"]}`; content != want {
+		t.Errorf("json: %s, want %s", content, want)
+	}
+
+	for _, c := range []struct {
+		fields, types map[string]string
+	}{
+		{map[string]string{"size": "x"}, map[string]string{"size": syntax.JsonTypeNumber}},
+		{map[string]string{"ok": "maybe"}, map[string]string{"ok": syntax.JsonTypeBool}},
+		{map[string]string{"raw": "{"}, map[string]string{"raw": syntax.JsonTypeRaw}},
+		{map[string]string{"a": "1"}, map[string]string{"b": syntax.JsonTypeNumber}},
+		{map[string]string{"a": "1", "a.b": "2"}, nil},
+	} {
+		if _, err := buildJsonObject(c.fields, c.types); err == nil {
+			t.Errorf("%v %v should be refused", c.fields, c.types)
+		}
+	}
+}
+
+func TestProcessRunning(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sleep is not available on windows")
+	}
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	pid := strconv.Itoa(cmd.Process.Pid)
+	running := func() bool {
+		ok, err := checkCondition(newExpandEnvs(), pid, syntax.Op_process_running, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	if !running() {
+		t.Error("started process should be running")
+	}
+	if err := cmd.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS == "linux" {
+		// killed but unwaited process is a zombie
+		deadline := time.Now().Add(5 * time.Second)
+		for running() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if running() {
+			t.Error("zombie process shouldn't be running")
+		}
+	}
+	cmd.Wait()
+	if running() {
+		t.Error("killed process shouldn't be running")
+	}
+
+	for _, value := range []string{"", "abc", "0", "-1"} {
+		if _, err := checkCondition(newExpandEnvs(), value, syntax.Op_process_running, nil); err == nil {
+			t.Errorf("invalid pid %q should be refused", value)
+		}
+	}
+}
+
+func TestDirEmptyOperators(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"full/a.txt":  "",
+		"full/b.txt":  "",
+		"nested/x/.k": "",
+		"file.txt":    "",
+	})
+	if err := os.Mkdir(filepath.Join(dir, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		sub   string
+		empty bool
+	}{
+		{"empty", true},
+		{"full", false},
+		{"nested", false},
+	} {
+		for operator, want := range map[string]bool{
+			syntax.Op_dir_empty:    c.empty,
+			syntax.Op_dir_notEmpty: !c.empty,
+		} {
+			ok, err := checkCondition(newExpandEnvs(), filepath.Join(dir, c.sub), operator, nil)
+			if err != nil {
+				t.Errorf("%s %s: %s", c.sub, operator, err)
+				continue
+			}
+			if ok != want {
+				t.Errorf("%s %s: %t, want %t", c.sub, operator, ok, want)
+			}
+		}
+	}
+	for sub, want := range map[string]string{"missing": "directory not found", "file.txt": "not a directory"} {
+		for _, operator := range []string{syntax.Op_dir_empty, syntax.Op_dir_notEmpty} {
+			_, err := checkCondition(newExpandEnvs(), filepath.Join(dir, sub), operator, nil)
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("%s %s: %v, want error %q", sub, operator, err, want)
+			}
+		}
+	}
+}
+
+func TestDecodeContent(t *testing.T) {
+	const content = "hello tash, hello tash, hello tash"
+	var gz, zl, fl bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte(content))
+	gw.Close()
+	zw := zlib.NewWriter(&zl)
+	zw.Write([]byte(content))
+	zw.Close()
+	fw, _ := flate.NewWriter(&fl, flate.DefaultCompression)
+	fw.Write([]byte(content))
+	fw.Close()
+
+	for _, c := range []struct {
+		encoding string
+		encoded  []byte
+	}{
+		{"", []byte(content)},
+		{"identity", []byte(content)},
+		{"gzip", gz.Bytes()},
+		{"X-Gzip", gz.Bytes()},
+		{"deflate", zl.Bytes()},
+		// raw deflate stream sent by some servers
+		{"deflate", fl.Bytes()},
+	} {
+		r, err := decodeContent(bytes.NewReader(c.encoded), c.encoding)
+		if err != nil {
+			t.Errorf("%s: %s", c.encoding, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(got) != content {
+			t.Errorf("%s: decoded %q, %v", c.encoding, got, err)
+		}
+	}
+	for encoding, want := range map[string]string{"br": "brotli", "compress": "unsupported content encoding"} {
+		_, err := decodeContent(bytes.NewReader(nil), encoding)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: %v, want error %q", encoding, err, want)
+		}
+	}
+}
+
+func TestDownloadSendFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := server.URL
+	server.Close()
+	_, _, err := downloadFile(url, downloadOptions{})
+	if err == nil || !strings.Contains(err.Error(), "send download request failed") {
+		t.Errorf("failure of sending request: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	defaultVersionPattern = regexp.MustCompile(`\d+(?:\.\d+)*`)
+	versionPattern        = regexp.MustCompile(`^v?\d`)
+)
+
+// extractVersion returns first submatch of pattern if exists, otherwise whole match.
+func extractVersion(pattern *regexp.Regexp, output string) string {
+	m := pattern.FindStringSubmatch(output)
+	switch len(m) {
+	case 0:
+		return ""
+	case 1:
+		return m[0]
+	default:
+		return m[1]
+	}
+}
+
+// compareVersions compares dot separated numbers, non-digit suffixes of parts such as '1rc1' are ignored.
+func compareVersions(v1, v2 string) int {
+	p1, p2 := strings.Split(v1, "."), strings.Split(v2, ".")
+	for i := 0; i < len(p1) || i < len(p2); i++ {
+		var n1, n2 int
+		if i < len(p1) {
+			n1 = leadingNumber(p1[i])
+		}
+		if i < len(p2) {
+			n2 = leadingNumber(p2[i])
+		}
+		switch {
+		case n1 < n2:
+			return -1
+		case n1 > n2:
+			return 1
+		}
+	}
+	return 0
+}
+
+func leadingNumber(s string) int {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	n, _ := strconv.Atoi(s[:i])
+	return n
+}
+
+type versionConstraint struct {
+	op      string
+	version string
+}
+
+func (c versionConstraint) match(version string) bool {
+	n := compareVersions(version, c.version)
+	switch c.op {
+	case ">=":
+		return n >= 0
+	case ">":
+		return n > 0
+	case "<=":
+		return n <= 0
+	case "<":
+		return n < 0
+	case "!=":
+		return n != 0
+	default:
+		return n == 0
+	}
+}
+
+func parseVersionConstraints(s string) ([]versionConstraint, error) {
+	var constraints []versionConstraint
+	for _, item := range stringSplitAndTrimFilterSpace(s, ",") {
+		var c versionConstraint
+		for _, op := range []string{">=", "<=", "!=", "==", ">", "<", "="} {
+			if strings.HasPrefix(item, op) {
+				c.op = op
+				item = item[len(op):]
+				break
+			}
+		}
+		if c.op == "" || c.op == "==" {
+			c.op = "="
+		}
+		c.version = strings.TrimSpace(item)
+		if !versionPattern.MatchString(c.version) {
+			return nil, fmt.Errorf("invalid version constraint: %s", s)
+		}
+		constraints = append(constraints, c)
+	}
+	if len(constraints) == 0 {
+		return nil, fmt.Errorf("version constraint is required")
+	}
+	return constraints, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestVersionConstraints(t *testing.T) {
+	for _, c := range []struct {
+		require, version string
+		ok               bool
+	}{
+		{">=1.14", "1.14", true},
+		{">=1.14", "1.9.2", false},
+		{">=1.14, <2", "1.20.1", true},
+		{">=1.14, <2", "2.0", false},
+		{"=1.2", "1.2.0", true},
+		{"!=1.2", "1.2.0", false},
+		{">1.2", "v1.2.1rc1", true},
+	} {
+		constraints, err := parseVersionConstraints(c.require)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok := true
+		for _, constraint := range constraints {
+			ok = ok && constraint.match(c.version)
+		}
+		if ok != c.ok {
+			t.Errorf("%s %s: %t, want %t", c.version, c.require, ok, c.ok)
+		}
+	}
+	for _, s := range []string{"", ">=", ">=x.y"} {
+		if _, err := parseVersionConstraints(s); err == nil {
+			t.Errorf("invalid constraint should be refused: %q", s)
+		}
+	}
+}
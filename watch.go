@@ -161,7 +161,7 @@ func (w *watcher) shouldWatchPath(path string, isDir *bool) bool {
 func (w *watcher) watchPath(path string) {
 	stat, err := os.Stat(path)
 	if err != nil {
-		w.log.warnln("retrieve file stat failed:", path, err)
+		w.log.warnln("retrieve file stat failed:", stringToSlash(path), err)
 		return
 	}
 	isDir := stat.IsDir()
@@ -176,27 +176,27 @@ func (w *watcher) watchPath(path string) {
 }
 
 func (w *watcher) watchFile(path string) {
-	w.log.debugln("add watch file:", path)
+	w.log.debugln("add watch file:", stringToSlash(path))
 	err := w.w.Add(path)
 	if err != nil {
-		w.log.warnln("watch file failed:", path, err)
+		w.log.warnln("watch file failed:", stringToSlash(path), err)
 	} else {
 		w.watching[path] = false
 	}
 }
 
 func (w *watcher) watchDir(dir string, direntsExcludeDir bool) {
-	w.log.debugln("add watch dir:", dir)
+	w.log.debugln("add watch dir:", stringToSlash(dir))
 	err := w.w.Add(dir)
 	if err != nil {
-		w.log.warnln("add watch dir failed:", dir, err)
+		w.log.warnln("add watch dir failed:", stringToSlash(dir), err)
 	} else {
 		w.watching[dir] = true
 	}
 
 	dirents, err := ioutil.ReadDir(dir)
 	if err != nil {
-		w.log.warnln("list watch dir items failed:", dir, err)
+		w.log.warnln("list watch dir items failed:", stringToSlash(dir), err)
 	}
 	for _, ent := range dirents {
 		path := filepath.Join(dir, ent.Name())